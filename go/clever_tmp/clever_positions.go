@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/fleet"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
 	"io/ioutil"
 	"os"
 	"regexp"
@@ -61,6 +64,8 @@ type BusPosition struct {
 	Deviation      float64
 	Direction      string
 	RetrievedAt    time.Time
+	// a position_quality flag, blank if it passed every check
+	Quality string
 }
 
 type TripCache map[string]TripInstance
@@ -120,7 +125,7 @@ func findExistingTrip(db *gorm.DB, cache TripCache, bpr CleverPositionReport, re
 	return newTrip, false
 }
 
-func logPosition(db *gorm.DB, cache TripCache, bpr CleverPositionReport, reportTime time.Time) {
+func logPosition(db *gorm.DB, cache TripCache, tracker *position_quality.Tracker, registry *fleet.Batch, bpr CleverPositionReport, reportTime time.Time, days bus_positions.ServiceDays) {
 	var err error
 	trip, tripFound := findExistingTrip(db, cache, bpr, reportTime)
 	if !tripFound {
@@ -139,10 +144,32 @@ func logPosition(db *gorm.DB, cache TripCache, bpr CleverPositionReport, reportT
 		Lon:            bpr.Lon,
 		Direction:      bpr.DirectionDN,
 		TripInstanceID: trip.ID,
+		// Clever doesn't say when the bus reported, so this goes by when we
+		// retrieved it.
+		Quality: tracker.Check(bpr.Vehicle, position_quality.Fix{At: reportTime, Lat: bpr.Lat, Lon: bpr.Lon}),
 	}
 
 	err = db.Model(&trip).Association("BusPositions").Append(bp).Error
 	check(err)
+	if bp.Quality != position_quality.Good {
+		return
+	}
+	registry.Add(fleet.Observation{
+		Agency:      "clever",
+		VehicleID:   bpr.Vehicle,
+		RouteID:     trip.Route,
+		BlockID:     bpr.BlockID,
+		ServiceDate: days.DateOf(reportTime),
+		At:          reportTime,
+		Lat:         bpr.Lat,
+		Lon:         bpr.Lon,
+	})
+}
+
+// notInService says whether the bus is pulling out, deadheading or pulling
+// in rather than on a trip.
+func notInService(bpr CleverPositionReport) bool {
+	return bpr.HeadSign == "Not in Service" || bpr.HeadSign == "N/A"
 }
 
 func tripFromReport(bpr CleverPositionReport, reportTime time.Time) TripInstance {
@@ -208,8 +235,12 @@ func writeCache(filename string, cache TripCache) {
 func main() {
 	inputFile := flag.String("input_file", "", "XML file with bus data")
 	cacheFile := flag.String("cache_file", "", "serialized vehicle cache")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone, which says when its service day starts")
 	flag.Parse()
 
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+
 	m := parseFile(*inputFile)
 	reportTime := fileTime(*inputFile)
 
@@ -220,19 +251,41 @@ func main() {
 
 	db.LogMode(true)
 
-	db.AutoMigrate(&TripInstance{}, &BusPosition{})
+	// Not bus_positions.Migrate, whose TripInstance and BusPosition would
+	// add WMATA's columns to our tables of the same names.
+	db.AutoMigrate(&TripInstance{}, &BusPosition{}, &bus_positions.NonRevenuePosition{}, &position_quality.VehicleState{}, &fleet.Vehicle{}, &fleet.VehicleService{})
+	days, err := bus_positions.AgencyServiceDays("clever", location)
+	check(err)
 
 	cache := loadCache(*cacheFile)
+	tracker, err := position_quality.LoadTracker(db, "clever")
+	check(err)
+	var registry fleet.Batch
 
 	fmt.Printf("The cache now has %d entries.\n", len(cache))
 	for _, bp := range m.BusPositions {
 		fmt.Printf("bus %s has head sign %s\n", bp.Vehicle, bp.HeadSign)
-		if (bp.HeadSign == "Not in Service") || bp.HeadSign == "N/A" {
-			fmt.Printf("We will skip that one.\n")
+		if notInService(bp) {
+			fmt.Printf("We will record that one as out of service.\n")
+			_, err = bus_positions.LogNonRevenue(db, tracker, &registry, bus_positions.NonRevenuePosition{
+				Agency:      "clever",
+				VehicleID:   bp.Vehicle,
+				ReportedAt:  reportTime,
+				ServiceDate: days.DateOf(reportTime),
+				Lat:         bp.Lat,
+				Lon:         bp.Lon,
+				RouteID:     bp.Route,
+				BlockID:     bp.BlockID,
+				HeadSign:    bp.HeadSign,
+				RetrievedAt: reportTime,
+			})
+			check(err)
 		} else {
-			logPosition(db, cache, bp, reportTime)
+			logPosition(db, cache, tracker, &registry, bp, reportTime, days)
 		}
 	}
+	check(position_quality.SaveTracker(db, tracker))
+	check(registry.Save(db))
 	fmt.Printf("The cache now has %d entries.\n", len(cache))
 	if *cacheFile != "" {
 		writeCache(*cacheFile, cache)
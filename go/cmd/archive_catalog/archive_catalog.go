@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/catalog"
+	"github.com/markongithub/bus_data_archive/pkg/glacier_tier"
+	"github.com/markongithub/bus_data_archive/pkg/s3_archive"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	dataPath := flag.String("data_path", "", "agency directory containing short_term and archive, like organized_transit_data/wmatabus")
+	agency := flag.String("agency", "", "wmatabus, mtabus or clever. Defaults to the last part of -data_path.")
+	catalogDB := flag.String("catalog", "glacier_catalog.db", "the catalog database: a file for sqlite3, a connection string for postgres. glacier_tier keeps its records here too.")
+	dbDialect := flag.String("db_dialect", "sqlite3", "sqlite3 or postgres")
+	scan := flag.Bool("scan", true, "rescan every tier before answering")
+	useS3 := flag.Bool("s3", true, "include what's in S3 in the scan")
+	bucket := flag.String("bucket", s3_archive.PrimaryBucket, "the bucket to scan")
+	endpoint := flag.String("endpoint", "", "talk to something S3-compatible at this URL instead")
+	timezone := flag.String("timezone", "America/New_York", "for -start and -end")
+	startString := flag.String("start", "", "with -end, say where to find the data from here, like 2019-04-27T03:00:00")
+	endString := flag.String("end", "", "the end of the range for -start")
+	flag.Parse()
+
+	if *agency == "" {
+		*agency = filepath.Base(filepath.Clean(*dataPath))
+	}
+	db, err := gorm.Open(*dbDialect, *catalogDB)
+	check(err)
+	defer db.Close()
+	catalog.Migrate(db)
+	glacier_tier.Migrate(db)
+
+	if *scan {
+		fileLocation, err := bus_positions.AgencyLocation(*agency)
+		check(err)
+		s := catalog.NewScan(*agency, fileLocation)
+		if *dataPath != "" {
+			check(s.AddLocal(*dataPath))
+		}
+		if *useS3 {
+			sess := session.Must(session.NewSessionWithOptions(session.Options{
+				SharedConfigState: session.SharedConfigEnable,
+			}))
+			config := aws.NewConfig().WithRegion(s3_archive.PrimaryRegion)
+			if *endpoint != "" {
+				config = config.WithEndpoint(*endpoint).WithS3ForcePathStyle(true)
+			}
+			check(s.AddS3(s3.New(sess, config), *bucket))
+		}
+		check(s.AddGlacier(db))
+		check(s.Save(db))
+	}
+
+	if *startString == "" {
+		var days []catalog.DayCoverage
+		check(db.Where("agency = ?", *agency).Order("day").Find(&days).Error)
+		for _, dc := range days {
+			completeness := "not counted"
+			if dc.Counted {
+				completeness = fmt.Sprintf("%d snapshots, %d minutes missing", dc.SnapshotCount, dc.MissingMinutes)
+			}
+			fmt.Printf("%s: %s, in %s\n", dc.Day, completeness, strings.Join(dc.Tiers(), ", "))
+		}
+		return
+	}
+	location, err := time.LoadLocation(*timezone)
+	check(err)
+	start, err := time.ParseInLocation("2006-01-02T15:04:05", *startString, location)
+	check(err)
+	end, err := time.ParseInLocation("2006-01-02T15:04:05", *endString, location)
+	check(err)
+	where, err := catalog.Locate(db, *agency, start, end)
+	check(err)
+	for _, w := range where {
+		if len(w.Tiers) == 0 {
+			fmt.Printf("%s: we don't have it\n", w.Day)
+			continue
+		}
+		fmt.Printf("%s: %d of %d minutes missing\n", w.Day, w.MissingMinutes, w.Minutes)
+		for _, g := range w.Gaps {
+			fmt.Printf("  no snapshots for %d minutes from %s\n", g.Minutes, g.Start.In(location).Format(time.RFC3339))
+		}
+		for i, tier := range w.Tiers {
+			fmt.Printf("  %s: %s\n", tier, w.Sources[i])
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/blocks"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/clever_rows"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func wmataRuns(db *gorm.DB, date string, location *time.Location) []blocks.TripRun {
+	days, err := bus_positions.AgencyServiceDays("wmatabus", location)
+	check(err)
+	trips, err := bus_positions.TripsOnServiceDates(db, days, date, date)
+	check(err)
+	fmt.Printf("There are %d trips on service date %s.\n", len(trips), date)
+	spans, err := bus_positions.TripSpans(db, date)
+	check(err)
+	var output []blocks.TripRun
+	for _, trip := range trips {
+		span, present := spans[trip.ID]
+		if !present {
+			continue
+		}
+		firstSeen, err := bus_positions.ParseReportTime(span.FirstReported, location)
+		check(err)
+		lastSeen, err := bus_positions.ParseReportTime(span.LastReported, location)
+		check(err)
+		output = append(output, blocks.TripRun{
+			BlockID:   trip.BlockNumber,
+			VehicleID: trip.VehicleID,
+			RouteID:   trip.RouteID,
+			TripID:    trip.TripID,
+			FirstSeen: firstSeen,
+			LastSeen:  lastSeen,
+		})
+	}
+	return output
+}
+
+func cleverRuns(db *gorm.DB, date string, location *time.Location) []blocks.TripRun {
+	days, err := bus_positions.AgencyServiceDays("clever", location)
+	check(err)
+	trips, err := clever_rows.TripsOnServiceDate(db, days, date)
+	check(err)
+	fmt.Printf("There are %d trips first seen on service date %s.\n", len(trips), date)
+	output := make([]blocks.TripRun, 0, len(trips))
+	for _, trip := range trips {
+		output = append(output, blocks.TripRun{
+			BlockID:   trip.BlockID,
+			VehicleID: trip.Vehicle,
+			RouteID:   trip.Route,
+			Run:       trip.Run,
+			Operator:  trip.Op,
+			FirstSeen: trip.FirstSeen,
+			LastSeen:  trip.LastSeen,
+		})
+	}
+	return output
+}
+
+func main() {
+	agency := flag.String("agency", "wmata", "wmata or clever")
+	dbDialect := flag.String("db_dialect", "postgres", "postgres, or sqlite3 for the Clever database")
+	gtfsPath := flag.String("gtfs_path", "", "directory with the unzipped GTFS feed, to compare pull-outs against. Optional.")
+	date := flag.String("date", "", "service date to rebuild blocks for, YYYY-MM-DD")
+	late := flag.Duration("late", blocks.DefaultLatePullOut, "pull-outs later than this behind schedule are late")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+	var scheduled map[string]time.Time
+	if *gtfsPath != "" {
+		feed := gtfs_schedule.Load(*gtfsPath)
+		scheduled = blocks.ScheduledPullOuts(feed, strings.Replace(*date, "-", "", -1), location)
+	}
+
+	db, err := gorm.Open(*dbDialect, os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	db.AutoMigrate(&blocks.BlockDay{}, &blocks.Assignment{})
+
+	var runs []blocks.TripRun
+	switch *agency {
+	case "wmata":
+		runs = wmataRuns(db, *date, location)
+	case "clever":
+		runs = cleverRuns(db, *date, location)
+	default:
+		panic(fmt.Sprintf("Unexpected agency: %s", *agency))
+	}
+
+	days, assignments := blocks.BuildBlocks(*agency, *date, runs, scheduled, *late)
+	check(blocks.SaveBlocks(db, *agency, *date, days, assignments))
+	swaps, latePullOuts := 0, 0
+	for _, day := range days {
+		swaps += day.Swaps
+		if day.LatePullOut {
+			latePullOuts++
+		}
+	}
+	fmt.Printf("We saw %d blocks, with %d vehicle swaps and %d late pull-outs.\n", len(days), swaps, latePullOuts)
+}
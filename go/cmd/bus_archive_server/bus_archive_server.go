@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/archive_api"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	listen := flag.String("listen", ":8080", "address to serve on")
+	dbDialect := flag.String("db_dialect", "postgres", "postgres or sqlite3")
+	timeZone := flag.String("timezone", "US/Eastern", "the time zone WMATA's DateTimes are in")
+	maxConcurrent := flag.Int("max_concurrent", 8, "requests to work on at once before turning new ones away")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+
+	db, err := gorm.Open(*dbDialect, os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	server := &http.Server{
+		Addr:         *listen,
+		Handler:      archive_api.NewServer(db, location, *maxConcurrent),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+	fmt.Printf("Serving the archive on %s\n", *listen)
+	check(server.ListenAndServe())
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/compaction"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	input := flag.String("input", "", "a short_term/<day> directory or an archive/<day>.tar.gz")
+	outputDir := flag.String("output_dir", "", "root of the partitioned Parquet tree")
+	agency := flag.String("agency", "wmatabus", "agency partition to write under. The JSON has to be in jBusPositions format.")
+	timeZone := flag.String("timezone", "US/Eastern", "the time zone WMATA's DateTimes are in")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+	rows, err := compaction.CompactDay(*input, *outputDir, *agency, location)
+	check(err)
+	paths := make([]string, 0, len(rows))
+	for path := range rows {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	total := 0
+	for _, path := range paths {
+		fmt.Printf("%s: %d rows\n", path, rows[path])
+		total += rows[path]
+	}
+	fmt.Printf("Wrote %d rows to %d files.\n", total, len(paths))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/markongithub/bus_data_archive/pkg/adherence"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
+	"github.com/markongithub/bus_data_archive/pkg/stop_events"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func timedPositions(db *gorm.DB, trip bus_positions.TripInstance, location *time.Location) []stop_events.TimedPosition {
+	var positions []bus_positions.BusPosition
+	err := db.Scopes(position_quality.GoodPositions).Where("trip_instance_id = ?", trip.ID).Order("reported_at").Find(&positions).Error
+	check(err)
+	output := make([]stop_events.TimedPosition, 0, len(positions))
+	for _, bp := range positions {
+		reportedAt, err := bus_positions.ParseReportTime(bp.ReportedAt, location)
+		check(err)
+		output = append(output, stop_events.TimedPosition{
+			Time:      reportedAt,
+			Lat:       bp.Lat,
+			Lon:       bp.Lon,
+			Deviation: bp.Deviation,
+		})
+	}
+	return output
+}
+
+func main() {
+	gtfsPath := flag.String("gtfs_path", "", "directory with the unzipped GTFS feed")
+	date := flag.String("date", "", "compute trips on this service date, YYYY-MM-DD")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+	feed := gtfs_schedule.Load(*gtfsPath)
+
+	db, err := gorm.Open("postgres", os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	db.AutoMigrate(&adherence.StopArrival{})
+
+	days, err := bus_positions.AgencyServiceDays("wmatabus", location)
+	check(err)
+	trips, err := bus_positions.TripsOnServiceDates(db, days, *date, *date)
+	check(err)
+	fmt.Printf("There are %d trips on service date %s.\n", len(trips), *date)
+
+	for _, trip := range trips {
+		if _, present := feed.Trips[trip.TripID]; !present {
+			fmt.Printf("Trip %s is not in the GTFS feed. Skipping it.\n", trip.TripID)
+			continue
+		}
+		tripStart, err := bus_positions.ParseReportTime(trip.TripStartTime, location)
+		check(err)
+		positions := timedPositions(db, trip, location)
+		arrivals := adherence.ComputeStopArrivals(feed, trip.TripID, tripStart, positions)
+		fmt.Printf("Trip %s has %d positions and %d stop arrivals.\n", trip.TripID, len(positions), len(arrivals))
+		adherence.SaveStopArrivals(db, trip.ID, arrivals)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/archiver"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	dataPath := flag.String("data_path", "", "agency directory containing short_term and archive, like organized_transit_data/wmatabus")
+	agency := flag.String("agency", "", "wmatabus, mtabus or clever. Defaults to the last part of -data_path.")
+	day := flag.String("day", "", "UTC day to archive, like 2019-04-27. Defaults to yesterday.")
+	flag.Parse()
+
+	if *day == "" {
+		*day = time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	}
+	if *agency == "" {
+		*agency = filepath.Base(filepath.Clean(*dataPath))
+	}
+	location, err := bus_positions.AgencyLocation(*agency)
+	check(err)
+	m, err := archiver.ArchiveDay(*dataPath, *day, location)
+	check(err)
+	missing := 0
+	for _, gap := range m.Gaps {
+		missing += gap.Minutes
+	}
+	fmt.Printf("Archived %d files from %s into %s (%d bytes).\n", len(m.Files), *day, m.Archive, m.ArchiveSize)
+	fmt.Printf("%d of %d jBusPositions snapshots, missing %d minutes in %d gaps.\n",
+		m.SnapshotCount, archiver.ExpectedSnapshots, missing, len(m.Gaps))
+	fmt.Printf("Verified and wrote %s.\n", archiver.ManifestPath(*dataPath, *day))
+}
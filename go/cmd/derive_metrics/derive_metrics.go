@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/derived_metrics"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/map_matching"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	gtfsPath := flag.String("gtfs_path", "", "directory with the unzipped GTFS feed; without it we skip along-shape speeds and layovers")
+	start := flag.String("start", "", "first service date to recompute, YYYY-MM-DD")
+	end := flag.String("end", "", "last service date to recompute, YYYY-MM-DD")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+	endDate, err := time.Parse("2006-01-02", *end)
+	check(err)
+	var feed gtfs_schedule.Feed
+	if *gtfsPath != "" {
+		feed = gtfs_schedule.Load(*gtfsPath)
+	}
+
+	db, err := gorm.Open("postgres", os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	db.AutoMigrate(&map_matching.MatchedPosition{}, &derived_metrics.PositionMetric{}, &derived_metrics.DwellPeriod{})
+
+	days, err := bus_positions.AgencyServiceDays("wmatabus", location)
+	check(err)
+	trips, err := bus_positions.TripsOnServiceDates(db, days, *start, endDate.Format(bus_positions.ServiceDateFormat))
+	check(err)
+	fmt.Printf("There are %d trips on service dates %s through %s.\n", len(trips), *start, *end)
+
+	for _, trip := range trips {
+		var positions []bus_positions.BusPosition
+		err = db.Scopes(position_quality.GoodPositions).Where("trip_instance_id = ?", trip.ID).Order("reported_at, id").Find(&positions).Error
+		check(err)
+		var matched []map_matching.MatchedPosition
+		shapeLength := 0.0
+		if *gtfsPath != "" {
+			_, matched, _ = map_matching.MatchTrip(db, feed, trip)
+			if shape, ok := feed.TripShape(trip.TripID); ok {
+				shapeLength = shape.Length()
+			}
+		}
+		metrics, dwells := derived_metrics.ComputeMetrics(positions, matched, shapeLength, location)
+		fmt.Printf("Trip %s has %d positions and %d dwells.\n", trip.TripID, len(positions), len(dwells))
+		derived_metrics.SaveMetrics(db, trip.ID, metrics, dwells)
+	}
+}
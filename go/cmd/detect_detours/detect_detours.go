@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/detours"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/map_matching"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	gtfsPath := flag.String("gtfs_path", "", "directory with the unzipped GTFS feed")
+	date := flag.String("date", "", "look for detours on this service date, YYYY-MM-DD")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone")
+	minPositions := flag.Int("min_positions", detours.DefaultMinPositions, "off-route positions in a row it takes to count as leaving the shape")
+	maxGap := flag.Duration("max_gap", detours.DefaultMaxGap, "how far apart in time two trips can leave the shape and still be the same detour")
+	minTrips := flag.Int("min_trips", detours.DefaultMinTrips, "how many trips have to leave the shape before it's a detour")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+
+	feed := gtfs_schedule.Load(*gtfsPath)
+
+	db, err := gorm.Open("postgres", os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	db.AutoMigrate(&map_matching.MatchedPosition{}, &detours.Episode{})
+
+	days, err := bus_positions.AgencyServiceDays("wmatabus", location)
+	check(err)
+	trips, err := bus_positions.TripsOnServiceDates(db, days, *date, *date)
+	check(err)
+	fmt.Printf("There are %d trips on service date %s.\n", len(trips), *date)
+
+	var excursions []detours.Excursion
+	for _, trip := range trips {
+		found, ok, err := detours.TripExcursions(db, feed, trip, location, *minPositions)
+		check(err)
+		if !ok {
+			fmt.Printf("Trip %s is not in the GTFS feed or has no shape. Skipping it.\n", trip.TripID)
+			continue
+		}
+		excursions = append(excursions, found...)
+	}
+	episodes := detours.GroupEpisodes(*date, excursions, *maxGap, *minTrips)
+	fmt.Printf("We found %d excursions off the shape and %d detours.\n", len(excursions), len(episodes))
+	for _, ep := range episodes {
+		fmt.Printf("Route %s left shape %s between %.0f and %.0f meters on %d trips from %s to %s.\n",
+			ep.RouteID, ep.ShapeID, ep.LeftShapeAt, ep.RejoinedShapeAt, ep.Trips,
+			ep.Start.In(location).Format("15:04"), ep.End.In(location).Format("15:04"))
+	}
+	check(detours.SaveEpisodes(db, *date, episodes))
+}
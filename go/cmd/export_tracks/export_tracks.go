@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/track_export"
+)
+
+const timeFormat = "2006-01-02T15:04:05" // these are local
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func parseFlagTime(s string, location *time.Location) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	for _, layout := range []string{timeFormat, "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, location); err == nil {
+			return t
+		}
+	}
+	panic(fmt.Sprintf("could not parse %s as a date or time", s))
+}
+
+func pointsFromFiles(inputDir string, filter track_export.Filter, location *time.Location) []track_export.TrackPoint {
+	var output []track_export.TrackPoint
+	err := filepath.Walk(inputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, "buses") || !strings.HasSuffix(name, ".json") {
+			return nil
+		}
+		for _, bpr := range bus_positions.ParseFile(path).BusPositions {
+			p, err := track_export.FromReport(bpr, location)
+			if err != nil {
+				fmt.Printf("Skipping a report from %s: %s\n", path, err)
+				continue
+			}
+			if filter.Matches(p) {
+				output = append(output, p)
+			}
+		}
+		return nil
+	})
+	check(err)
+	return output
+}
+
+type positionRow struct {
+	VehicleID    string
+	TripID       string
+	RouteID      string
+	TripHeadSign string
+	ReportedAt   string
+	Lat          float64
+	Lon          float64
+	Deviation    float64
+}
+
+func pointsFromPostgres(filter track_export.Filter, location *time.Location) []track_export.TrackPoint {
+	db, err := gorm.Open("postgres", os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+	query := db.Table("bus_positions").
+		Select("trip_instances.vehicle_id, trip_instances.trip_id, trip_instances.route_id, trip_instances.trip_head_sign, bus_positions.reported_at, bus_positions.lat, bus_positions.lon, bus_positions.deviation").
+		Joins("JOIN trip_instances ON trip_instances.id = bus_positions.trip_instance_id").
+		Where("bus_positions.deleted_at IS NULL")
+	// ReportedAt sorts correctly as a string, so we can narrow things down in
+	// the database.
+	if !filter.Start.IsZero() {
+		query = query.Where("bus_positions.reported_at >= ?", filter.Start.In(location).Format(timeFormat))
+	}
+	if !filter.End.IsZero() {
+		query = query.Where("bus_positions.reported_at < ?", filter.End.In(location).Format(timeFormat))
+	}
+	if filter.RouteID != "" {
+		query = query.Where("trip_instances.route_id = ?", filter.RouteID)
+	}
+	if filter.VehicleID != "" {
+		query = query.Where("trip_instances.vehicle_id = ?", filter.VehicleID)
+	}
+	if filter.TripID != "" {
+		query = query.Where("trip_instances.trip_id = ?", filter.TripID)
+	}
+	var rows []positionRow
+	err = query.Scan(&rows).Error
+	check(err)
+	var output []track_export.TrackPoint
+	for _, row := range rows {
+		reportedAt, err := bus_positions.ParseReportTime(row.ReportedAt, location)
+		check(err)
+		p := track_export.TrackPoint{
+			VehicleID:    row.VehicleID,
+			TripID:       row.TripID,
+			RouteID:      row.RouteID,
+			TripHeadsign: row.TripHeadSign,
+			Time:         reportedAt,
+			Lat:          row.Lat,
+			Lon:          row.Lon,
+			Deviation:    row.Deviation,
+		}
+		if filter.Matches(p) {
+			output = append(output, p)
+		}
+	}
+	return output
+}
+
+// This is what wmata_buses_to_dynamo writes.
+type dynamoReport struct {
+	VehicleID    string
+	TripID       string
+	RouteID      string
+	TripHeadSign string
+	DateTime     string
+	Lat          json.Number
+	Lon          json.Number
+	Deviation    json.Number
+}
+
+func pointsFromDynamo(tableName string, filter track_export.Filter, location *time.Location) []track_export.TrackPoint {
+	if filter.Start.IsZero() || filter.End.IsZero() {
+		panic("Dynamo is partitioned by day, so we need a start and an end.")
+	}
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	svc := dynamodb.New(sess)
+	var output []track_export.TrackPoint
+	// wmata_bus_by_service_date is partitioned by service date and the older
+	// wmata_bus by UTC retrieval date, so look one day to either side.
+	for day := filter.Start.AddDate(0, 0, -1); day.Before(filter.End.AddDate(0, 0, 1)); day = day.AddDate(0, 0, 1) {
+		partitionKey := day.Format("2006-01-02")
+		fmt.Printf("Querying partition %s\n", partitionKey)
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("PartitionKey = :day"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":day": {S: aws.String(partitionKey)},
+			},
+		}
+		err := svc.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			var reports []dynamoReport
+			check(dynamodbattribute.UnmarshalListOfMaps(page.Items, &reports))
+			for _, r := range reports {
+				reportedAt, err := bus_positions.ParseReportTime(r.DateTime, location)
+				check(err)
+				lat, err := r.Lat.Float64()
+				check(err)
+				lon, err := r.Lon.Float64()
+				check(err)
+				deviation, _ := r.Deviation.Float64()
+				p := track_export.TrackPoint{
+					VehicleID:    r.VehicleID,
+					TripID:       r.TripID,
+					RouteID:      r.RouteID,
+					TripHeadsign: r.TripHeadSign,
+					Time:         reportedAt,
+					Lat:          lat,
+					Lon:          lon,
+					Deviation:    deviation,
+				}
+				if filter.Matches(p) {
+					output = append(output, p)
+				}
+			}
+			return true
+		})
+		check(err)
+	}
+	return output
+}
+
+func main() {
+	source := flag.String("source", "files", "files, postgres or dynamo")
+	inputDir := flag.String("input_dir", "", "directory of snapshot files, for -source=files")
+	dynamoTable := flag.String("dynamo_table", "wmata_bus_by_service_date", "table name, for -source=dynamo. wmata_bus has what we loaded before that table.")
+	format := flag.String("format", "geojson", "geojson, gpx or kml")
+	outputFile := flag.String("output_file", "", "where to write the tracks")
+	start := flag.String("start", "", "earliest report time, YYYY-MM-DD or YYYY-MM-DDTHH:MM:SS")
+	end := flag.String("end", "", "report times must be before this")
+	routeID := flag.String("route", "", "only this route")
+	vehicleID := flag.String("vehicle", "", "only this vehicle")
+	tripID := flag.String("trip", "", "only this trip")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+	filter := track_export.Filter{
+		Start:     parseFlagTime(*start, location),
+		End:       parseFlagTime(*end, location),
+		RouteID:   *routeID,
+		VehicleID: *vehicleID,
+		TripID:    *tripID,
+	}
+
+	var points []track_export.TrackPoint
+	switch *source {
+	case "files":
+		points = pointsFromFiles(*inputDir, filter, location)
+	case "postgres":
+		points = pointsFromPostgres(filter, location)
+	case "dynamo":
+		points = pointsFromDynamo(*dynamoTable, filter, location)
+	default:
+		panic(fmt.Sprintf("Unexpected source: %s", *source))
+	}
+	tracks := track_export.GroupTracks(points)
+	fmt.Printf("We found %d positions in %d tracks.\n", len(points), len(tracks))
+
+	f, err := os.Create(*outputFile)
+	check(err)
+	defer f.Close()
+	switch *format {
+	case "geojson":
+		err = track_export.WriteGeoJSON(f, tracks)
+	case "gpx":
+		err = track_export.WriteGPX(f, tracks)
+	case "kml":
+		err = track_export.WriteKML(f, tracks)
+	default:
+		panic(fmt.Sprintf("Unexpected format: %s", *format))
+	}
+	check(err)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/trip_delivery"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func observedTrips(db *gorm.DB, date string, location *time.Location) map[string]trip_delivery.ObservedTrip {
+	days, err := bus_positions.AgencyServiceDays("wmatabus", location)
+	check(err)
+	trips, err := bus_positions.TripsOnServiceDates(db, days, date, date)
+	check(err)
+	fmt.Printf("There are %d trips on service date %s.\n", len(trips), date)
+	spans, err := bus_positions.TripSpans(db, date)
+	check(err)
+	output := make(map[string]trip_delivery.ObservedTrip)
+	for _, trip := range trips {
+		span, present := spans[trip.ID]
+		if !present {
+			continue
+		}
+		firstSeen, err := bus_positions.ParseReportTime(span.FirstReported, location)
+		check(err)
+		lastSeen, err := bus_positions.ParseReportTime(span.LastReported, location)
+		check(err)
+		output[trip.TripID] = output[trip.TripID].Merge(trip_delivery.ObservedTrip{
+			TripID:    trip.TripID,
+			VehicleID: trip.VehicleID,
+			FirstSeen: firstSeen,
+			LastSeen:  lastSeen,
+			Positions: span.Positions,
+		})
+	}
+	return output
+}
+
+func writeSummary(filename string, routes []trip_delivery.RouteDelivery) {
+	f, err := os.Create(filename)
+	check(err)
+	defer f.Close()
+	w := csv.NewWriter(f)
+	check(w.Write([]string{"date", "route_id", "scheduled", "operated", "partial", "missing", "delivered_fraction"}))
+	for _, rd := range routes {
+		check(w.Write([]string{
+			rd.ServiceDate, rd.RouteID, strconv.Itoa(rd.Scheduled), strconv.Itoa(rd.Operated),
+			strconv.Itoa(rd.Partial), strconv.Itoa(rd.Missing),
+			strconv.FormatFloat(rd.DeliveredFraction, 'f', 3, 64),
+		}))
+	}
+	w.Flush()
+	check(w.Error())
+}
+
+func main() {
+	gtfsPath := flag.String("gtfs_path", "", "directory with the unzipped GTFS feed")
+	date := flag.String("date", "", "service date to check, YYYY-MM-DD")
+	operatedCoverage := flag.Float64("operated_coverage", trip_delivery.DefaultOperatedCoverage, "trips we saw for less than this fraction of their scheduled running time are only partially observed")
+	outputDir := flag.String("output_dir", ".", "where to write the per-route CSV file")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+	feed := gtfs_schedule.Load(*gtfsPath)
+
+	db, err := gorm.Open("postgres", os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	db.AutoMigrate(&trip_delivery.TripDelivery{}, &trip_delivery.RouteDelivery{})
+
+	scheduled := trip_delivery.ScheduledTrips(feed, strings.Replace(*date, "-", "", -1), location)
+	observed := observedTrips(db, *date, location)
+	unscheduled := 0
+	for tripID := range observed {
+		if _, present := feed.Trips[tripID]; !present {
+			unscheduled++
+		}
+	}
+	fmt.Printf("%d trips were scheduled. We saw %d, and %d of those aren't in the GTFS feed.\n", len(scheduled), len(observed), unscheduled)
+
+	trips := trip_delivery.Classify(scheduled, observed, *operatedCoverage)
+	routes := trip_delivery.Summarize(trips)
+	check(trip_delivery.SaveDelivery(db, *date, trips, routes))
+	writeSummary(filepath.Join(*outputDir, "trip_delivery-"+*date+".csv"), routes)
+	missing := 0
+	for _, rd := range routes {
+		missing += rd.Missing
+	}
+	fmt.Printf("%d scheduled trips are missing.\n", missing)
+}
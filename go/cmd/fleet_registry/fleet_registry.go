@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/fleet"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	dbDialect := flag.String("db_dialect", "postgres", "postgres, or sqlite3 for the Clever database")
+	metadataFile := flag.String("metadata", "", "CSV of vehicle_id,series,fuel_type,garage to copy onto the registry")
+	route := flag.String("route", "", "list the vehicles that ran this route")
+	start := flag.String("start", "", "first service date to look at, YYYY-MM-DD")
+	end := flag.String("end", "", "last service date to look at, YYYY-MM-DD. Defaults to -start.")
+	fuelType := flag.String("fuel_type", "", "only list vehicles with this fuel type, like hybrid")
+	flag.Parse()
+
+	db, err := gorm.Open(*dbDialect, os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	db.AutoMigrate(&fleet.Vehicle{}, &fleet.VehicleService{})
+
+	if *metadataFile != "" {
+		metadata, err := fleet.LoadMetadata(*metadataFile)
+		check(err)
+		check(fleet.ApplyMetadata(db, metadata))
+		fmt.Printf("We have metadata for %d vehicles.\n", len(metadata))
+	}
+
+	if *route == "" {
+		return
+	}
+	if *end == "" {
+		*end = *start
+	}
+	vehicles, err := fleet.VehiclesOnRoute(db, *route, *start, *end, *fuelType)
+	check(err)
+	fmt.Printf("%d vehicles ran route %s from %s to %s.\n", len(vehicles), *route, *start, *end)
+	for _, v := range vehicles {
+		fmt.Printf("%s\t%s\t%s\t%s\tfirst seen %s, last seen %s, %d days, %.0f km\n",
+			v.VehicleID, v.Series, v.FuelType, v.Garage,
+			v.FirstSeen.Format("2006-01-02"), v.LastSeen.Format("2006-01-02"), v.DaysActive, v.DistanceMeters/1000)
+	}
+}
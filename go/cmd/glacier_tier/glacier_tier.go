@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/glacier_tier"
+	"github.com/markongithub/bus_data_archive/pkg/s3_archive"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	action := flag.String("action", "", "freeze, restore, poll or download")
+	dataPath := flag.String("data_path", "", "agency directory containing archive, like organized_transit_data/wmatabus")
+	agency := flag.String("agency", "", "wmatabus, mtabus or clever. Defaults to the last part of -data_path.")
+	catalog := flag.String("catalog", "glacier_catalog.db", "the catalog database: a file for sqlite3, a connection string for postgres")
+	dbDialect := flag.String("db_dialect", "sqlite3", "sqlite3 or postgres")
+	minAgeDays := flag.Int("min_age_days", 90, "for freeze: archives at least this old go to Glacier")
+	keepLocal := flag.Bool("keep_local", false, "for freeze: don't delete the tarball afterwards")
+	day := flag.String("day", "", "for restore: the day to get back")
+	retrievalTier := flag.String("retrieval_tier", "Bulk", "for restore: Expedited, Standard or Bulk")
+	flag.Parse()
+
+	if *agency == "" {
+		*agency = filepath.Base(filepath.Clean(*dataPath))
+	}
+	db, err := gorm.Open(*dbDialect, *catalog)
+	check(err)
+	defer db.Close()
+	glacier_tier.Migrate(db)
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	tier := glacier_tier.Tier{DB: db, Vaults: glacier_tier.DefaultVaults(sess), Uploads: s3_archive.NewChecker(sess)}
+
+	switch *action {
+	case "freeze":
+		frozen, skipped, err := tier.Freeze(*dataPath, *agency, *minAgeDays, time.Now(), *keepLocal)
+		fmt.Printf("Moved %d days into Glacier. %d more are in Glacier but not S3 yet, so we kept them.\n", len(frozen), len(skipped))
+		check(err)
+	case "restore":
+		job, err := tier.StartRestore(*agency, *day, *retrievalTier)
+		check(err)
+		fmt.Printf("Started job %s. Poll for it in a few hours.\n", job.JobID)
+	case "poll":
+		jobs, err := tier.PollRestores()
+		check(err)
+		for _, job := range jobs {
+			fmt.Printf("%s: %s %s\n", job.JobID, job.Status, job.StatusMessage)
+		}
+	case "download":
+		days, err := tier.DownloadRestored(*dataPath, *agency)
+		fmt.Printf("Restored %v into %s.\n", days, filepath.Join(*dataPath, "archive"))
+		check(err)
+	default:
+		panic(fmt.Sprintf("Unexpected action: %s", *action))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/headways"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
+	"github.com/markongithub/bus_data_archive/pkg/stop_events"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func observedPassages(db *gorm.DB, feed gtfs_schedule.Feed, date string, location *time.Location, timepoints map[string]bool) []headways.Passage {
+	days, err := bus_positions.AgencyServiceDays("wmatabus", location)
+	check(err)
+	trips, err := bus_positions.TripsOnServiceDates(db, days, date, date)
+	check(err)
+	fmt.Printf("There are %d trips on service date %s.\n", len(trips), date)
+	var output []headways.Passage
+	for _, trip := range trips {
+		if _, present := feed.Trips[trip.TripID]; !present {
+			fmt.Printf("Trip %s is not in the GTFS feed. Skipping it.\n", trip.TripID)
+			continue
+		}
+		var positions []bus_positions.BusPosition
+		err = db.Scopes(position_quality.GoodPositions).Where("trip_instance_id = ?", trip.ID).Order("reported_at").Find(&positions).Error
+		check(err)
+		timed := make([]stop_events.TimedPosition, 0, len(positions))
+		for _, bp := range positions {
+			reportedAt, err := bus_positions.ParseReportTime(bp.ReportedAt, location)
+			check(err)
+			timed = append(timed, stop_events.TimedPosition{Time: reportedAt, Lat: bp.Lat, Lon: bp.Lon})
+		}
+		base := headways.Passage{
+			RouteID:      trip.RouteID,
+			DirectionNum: trip.DirectionNum,
+			VehicleID:    trip.VehicleID,
+			TripID:       trip.TripID,
+		}
+		output = append(output, headways.ObservedPassages(feed, trip.TripID, base, timed, timepoints)...)
+	}
+	return output
+}
+
+func minutes(d time.Duration) string {
+	return strconv.FormatFloat(d.Minutes(), 'f', 2, 64)
+}
+
+func writeHeadways(filename string, date string, hs []headways.Headway) {
+	f, err := os.Create(filename)
+	check(err)
+	defer f.Close()
+	w := csv.NewWriter(f)
+	check(w.Write([]string{"date", "route_id", "direction_num", "stop_id", "vehicle_id", "trip_id", "passage_time", "headway_minutes", "scheduled_headway_minutes", "status"}))
+	for _, h := range hs {
+		scheduled := ""
+		if h.ScheduledHeadway != 0 {
+			scheduled = minutes(h.ScheduledHeadway)
+		}
+		check(w.Write([]string{
+			date, h.RouteID, strconv.Itoa(h.DirectionNum), h.StopID, h.VehicleID, h.TripID,
+			h.Time.Format(time.RFC3339), minutes(h.Headway), scheduled, h.Status,
+		}))
+	}
+	w.Flush()
+	check(w.Error())
+}
+
+func writeSummary(filename string, date string, summaries []headways.RouteSummary) {
+	f, err := os.Create(filename)
+	check(err)
+	defer f.Close()
+	w := csv.NewWriter(f)
+	check(w.Write([]string{"date", "route_id", "direction_num", "observations", "mean_headway_minutes", "mean_scheduled_headway_minutes", "bunched", "gaps"}))
+	for _, s := range summaries {
+		check(w.Write([]string{
+			date, s.RouteID, strconv.Itoa(s.DirectionNum), strconv.Itoa(s.Observations),
+			strconv.FormatFloat(s.MeanHeadway, 'f', 2, 64),
+			strconv.FormatFloat(s.MeanScheduledHeadway, 'f', 2, 64),
+			strconv.Itoa(s.Bunched), strconv.Itoa(s.Gaps),
+		}))
+	}
+	w.Flush()
+	check(w.Error())
+}
+
+func main() {
+	gtfsPath := flag.String("gtfs_path", "", "directory with the unzipped GTFS feed")
+	date := flag.String("date", "", "service date to analyze, YYYY-MM-DD")
+	timepointList := flag.String("timepoints", "", "comma-separated stop IDs to measure headways at")
+	outputDir := flag.String("output_dir", ".", "where to write the CSV files")
+	bunched := flag.Float64("bunched", headways.DefaultThresholds.Bunched, "headways under this fraction of scheduled are bunched")
+	gap := flag.Float64("gap", headways.DefaultThresholds.Gap, "headways over this fraction of scheduled are gaps")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone")
+	flag.Parse()
+
+	if *timepointList == "" {
+		panic("You need to give me at least one timepoint.")
+	}
+	timepoints := make(map[string]bool)
+	for _, stopID := range strings.Split(*timepointList, ",") {
+		timepoints[strings.TrimSpace(stopID)] = true
+	}
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+	feed := gtfs_schedule.Load(*gtfsPath)
+
+	db, err := gorm.Open("postgres", os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	observed := observedPassages(db, feed, *date, location, timepoints)
+	scheduled := headways.ScheduledPassages(feed, strings.Replace(*date, "-", "", -1), location, timepoints)
+	fmt.Printf("We saw %d passages and expected %d.\n", len(observed), len(scheduled))
+
+	hs := headways.ComputeHeadways(observed, scheduled, headways.Thresholds{Bunched: *bunched, Gap: *gap})
+	writeHeadways(filepath.Join(*outputDir, "headways-"+*date+".csv"), *date, hs)
+	writeSummary(filepath.Join(*outputDir, "headway_summary-"+*date+".csv"), *date, headways.Summarize(hs))
+}
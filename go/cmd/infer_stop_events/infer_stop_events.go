@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/clever_rows"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
+	"github.com/markongithub/bus_data_archive/pkg/stop_events"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func inferWMATA(db *gorm.DB, feed gtfs_schedule.Feed, date string, location *time.Location) {
+	days, err := bus_positions.AgencyServiceDays("wmatabus", location)
+	check(err)
+	trips, err := bus_positions.TripsOnServiceDates(db, days, date, date)
+	check(err)
+	fmt.Printf("There are %d trips on service date %s.\n", len(trips), date)
+	for _, trip := range trips {
+		var positions []bus_positions.BusPosition
+		err = db.Scopes(position_quality.GoodPositions).Where("trip_instance_id = ?", trip.ID).Order("reported_at").Find(&positions).Error
+		check(err)
+		timed := make([]stop_events.TimedPosition, 0, len(positions))
+		for _, bp := range positions {
+			reportedAt, err := bus_positions.ParseReportTime(bp.ReportedAt, location)
+			check(err)
+			timed = append(timed, stop_events.TimedPosition{
+				Time:      reportedAt,
+				Lat:       bp.Lat,
+				Lon:       bp.Lon,
+				Deviation: bp.Deviation,
+			})
+		}
+		saveEvents(db, feed, "wmata", trip.ID, trip.TripID, timed)
+	}
+}
+
+func inferClever(db *gorm.DB, feed gtfs_schedule.Feed, date string, location *time.Location) {
+	days, err := bus_positions.AgencyServiceDays("clever", location)
+	check(err)
+	trips, err := clever_rows.TripsOnServiceDate(db, days, date)
+	check(err)
+	fmt.Printf("There are %d trips first seen on service date %s.\n", len(trips), date)
+	for _, trip := range trips {
+		if trip.TripIDGTFS == "" {
+			fmt.Printf("We never matched trip instance %d to GTFS. Skipping it.\n", trip.ID)
+			continue
+		}
+		var positions []clever_rows.BusPosition
+		err = db.Scopes(position_quality.GoodPositions).Where("trip_instance_id = ?", trip.ID).Order("retrieved_at").Find(&positions).Error
+		check(err)
+		timed := make([]stop_events.TimedPosition, 0, len(positions))
+		for _, bp := range positions {
+			// Clever doesn't tell us when the bus reported, so this is the best we have.
+			timed = append(timed, stop_events.TimedPosition{
+				Time: bp.RetrievedAt,
+				Lat:  bp.Lat,
+				Lon:  bp.Lon,
+			})
+		}
+		saveEvents(db, feed, "clever", trip.ID, trip.TripIDGTFS, timed)
+	}
+}
+
+func saveEvents(db *gorm.DB, feed gtfs_schedule.Feed, agency string, tripInstanceID uint, gtfsTripID string, positions []stop_events.TimedPosition) {
+	if _, present := feed.Trips[gtfsTripID]; !present {
+		fmt.Printf("Trip %s is not in the GTFS feed. Skipping it.\n", gtfsTripID)
+		return
+	}
+	events := stop_events.InferStopEvents(feed, gtfsTripID, positions)
+	fmt.Printf("Trip %s has %d positions and %d stop events.\n", gtfsTripID, len(positions), len(events))
+	stop_events.SaveStopEvents(db, agency, tripInstanceID, events)
+}
+
+func main() {
+	agency := flag.String("agency", "wmata", "wmata or clever")
+	dbDialect := flag.String("db_dialect", "postgres", "postgres, or sqlite3 for the Clever database")
+	gtfsPath := flag.String("gtfs_path", "", "directory with the unzipped GTFS feed")
+	date := flag.String("date", "", "infer events for trips on this date, YYYY-MM-DD")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+	feed := gtfs_schedule.Load(*gtfsPath)
+
+	db, err := gorm.Open(*dbDialect, os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	db.AutoMigrate(&stop_events.StopEvent{})
+
+	switch *agency {
+	case "wmata":
+		inferWMATA(db, feed, *date, location)
+	case "clever":
+		inferClever(db, feed, *date, location)
+	default:
+		panic(fmt.Sprintf("Unexpected agency: %s", *agency))
+	}
+}
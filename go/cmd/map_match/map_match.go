@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/map_matching"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	gtfsPath := flag.String("gtfs_path", "", "directory with the unzipped GTFS feed")
+	date := flag.String("date", "", "match trips on this service date, YYYY-MM-DD")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+
+	feed := gtfs_schedule.Load(*gtfsPath)
+
+	db, err := gorm.Open("postgres", os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	db.AutoMigrate(&map_matching.MatchedPosition{})
+
+	days, err := bus_positions.AgencyServiceDays("wmatabus", location)
+	check(err)
+	trips, err := bus_positions.TripsOnServiceDates(db, days, *date, *date)
+	check(err)
+	fmt.Printf("There are %d trips on service date %s.\n", len(trips), *date)
+
+	// MatchTrip already leaves out the positions that failed the quality
+	// checks, so there's no query for them here.
+	for _, trip := range trips {
+		_, matched, ok := map_matching.MatchTrip(db, feed, trip)
+		if !ok {
+			fmt.Printf("Trip %s is not in the GTFS feed or has no shape. Skipping it.\n", trip.TripID)
+			continue
+		}
+		offRoute := 0
+		for _, mp := range matched {
+			if mp.OffRoute {
+				offRoute++
+			}
+		}
+		fmt.Printf("Trip %s has %d positions, %d of them off route.\n", trip.TripID, len(matched), offRoute)
+	}
+}
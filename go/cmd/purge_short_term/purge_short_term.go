@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/glacier_tier"
+	"github.com/markongithub/bus_data_archive/pkg/purge"
+	"github.com/markongithub/bus_data_archive/pkg/s3_archive"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	dataPath := flag.String("data_path", "", "agency directory containing short_term and archive, like organized_transit_data/wmatabus")
+	agency := flag.String("agency", "", "wmatabus, mtabus or clever. Defaults to the last part of -data_path.")
+	retentionFlag := flag.String("retention", "", "days of short_term to keep per agency, like wmatabus=10,clever=30")
+	dryRun := flag.Bool("dry_run", false, "only say what would be deleted")
+	reverify := flag.Bool("reverify", false, "read every archive all the way through again before trusting it")
+	catalog := flag.String("catalog", "glacier_catalog.db", "glacier_tier's catalog, to find the days it moved into Glacier: a file for sqlite3, a connection string for postgres")
+	dbDialect := flag.String("db_dialect", "sqlite3", "sqlite3 or postgres")
+	flag.Parse()
+
+	if *agency == "" {
+		*agency = filepath.Base(filepath.Clean(*dataPath))
+	}
+	retention, err := purge.ParseRetention(*retentionFlag)
+	check(err)
+	days, ok := retention[*agency]
+	if !ok {
+		panic(fmt.Sprintf("No retention policy for agency %s", *agency))
+	}
+
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	db, err := gorm.Open(*dbDialect, *catalog)
+	check(err)
+	defer db.Close()
+	glacier_tier.Migrate(db)
+	tier := glacier_tier.Tier{DB: db, Vaults: glacier_tier.DefaultVaults(sess)}
+	decisions, err := purge.Plan(*dataPath, *agency, days, time.Now(), *reverify, s3_archive.NewChecker(sess), tier)
+	check(err)
+	check(purge.Execute(*dataPath, decisions, *dryRun))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/replay"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	listen := flag.String("listen", ":8080", "address to serve on")
+	dataDirs := flag.String("data_dirs", "", "comma-separated directories to index, like wmatabus/short_term,wmatabus/archive")
+	agency := flag.String("agency", "wmatabus", "whose snapshots these are. That says what time zone legacy filenames are in.")
+	start := flag.String("start", "", "simulated time to start at, like 2019-09-19T03:00:00Z. Without an offset it's in the same time zone as legacy filenames. Defaults to the first snapshot.")
+	speed := flag.Float64("speed", 1, "how many times faster than real time to play back. 0 means only move when someone POSTs to /replay/step or /replay/seek.")
+	flag.Parse()
+
+	location, err := bus_positions.AgencyLocation(*agency)
+	check(err)
+	index := replay.NewIndex(location)
+	for _, dir := range strings.Split(*dataDirs, ",") {
+		fmt.Printf("Indexing %s\n", dir)
+		check(index.AddDirectory(dir))
+	}
+	fmt.Printf("We have %d jBusPositions snapshots, %d vehicle position feeds and %d trip update feeds.\n",
+		index.Len(replay.BusPositions), index.Len(replay.VehiclePositions), index.Len(replay.TripUpdates))
+
+	var startTime time.Time
+	if *start == "" {
+		var ok bool
+		startTime, ok = index.First()
+		if !ok {
+			panic("There is nothing to replay.")
+		}
+	} else {
+		rt, err := bus_positions.ParseRetrievalTime(*start, location)
+		check(err)
+		startTime = rt.Time
+	}
+
+	server := replay.NewServer(index, replay.NewClock(startTime, *speed))
+	fmt.Printf("Replaying from %s on %s\n", startTime.Format(time.RFC3339), *listen)
+	check(http.ListenAndServe(*listen, server))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_realtime"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/predictions"
+	"github.com/markongithub/bus_data_archive/pkg/replay"
+	"github.com/markongithub/bus_data_archive/pkg/stop_events"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// actualArrivals are the stop events infer_stop_events found for trips on the
+// service date.
+func actualArrivals(db *gorm.DB, days bus_positions.ServiceDays, date string) map[predictions.TripStop]time.Time {
+	trips, err := bus_positions.TripsOnServiceDates(db, days, date, date)
+	check(err)
+	ids := make([]uint, 0, len(trips))
+	for _, trip := range trips {
+		ids = append(ids, trip.ID)
+	}
+	var events []stop_events.StopEvent
+	err = db.Where("agency = ? AND trip_instance_id IN (?)", "wmata", ids).Find(&events).Error
+	check(err)
+	fmt.Printf("There are %d trips on service date %s, with %d stop events.\n", len(trips), date, len(events))
+	output := make(map[predictions.TripStop]time.Time, len(events))
+	for _, se := range events {
+		output[predictions.TripStop{ServiceDate: date, TripID: se.GTFSTripID, StopID: se.StopID}] = se.ArrivalTime
+	}
+	return output
+}
+
+func newPredictionWriter(filename string) (*os.File, *csv.Writer) {
+	f, err := os.Create(filename)
+	check(err)
+	w := csv.NewWriter(f)
+	check(w.Write([]string{"date", "route_id", "trip_id", "vehicle_id", "stop_id", "stop_sequence", "issued_at", "predicted_at", "actual_at", "horizon_seconds", "error_seconds"}))
+	return f, w
+}
+
+func writePrediction(w *csv.Writer, sp predictions.ScoredPrediction) {
+	check(w.Write([]string{
+		sp.ServiceDate, sp.RouteID, sp.TripID, sp.VehicleID, sp.StopID, strconv.Itoa(sp.StopSequence),
+		sp.IssuedAt.Format(time.RFC3339), sp.PredictedAt.Format(time.RFC3339), sp.ActualAt.Format(time.RFC3339),
+		strconv.Itoa(int(sp.Horizon().Seconds())), strconv.Itoa(int(sp.Error.Seconds())),
+	}))
+}
+
+func main() {
+	dataDirs := flag.String("data_dirs", "", "comma-separated directories or tarballs with the day's gtfsrt-tu snapshots, like wmatabus/short_term/2019-09-19,wmatabus/short_term/2019-09-20")
+	date := flag.String("date", "", "service date to score, YYYY-MM-DD")
+	agency := flag.String("agency", "wmatabus", "whose snapshots these are. That says what time zone legacy filenames are in and when the service day starts.")
+	gtfsPath := flag.String("gtfs_path", "", "directory with the unzipped GTFS feed, for predictions that only give a delay. Optional.")
+	predictionsCSV := flag.String("predictions_csv", "", "also write every scored prediction to this CSV file. They all go in the stored_predictions table either way.")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+	days, err := bus_positions.AgencyServiceDays(*agency, location)
+	check(err)
+	fileLocation, err := bus_positions.AgencyLocation(*agency)
+	check(err)
+	var feed *gtfs_schedule.Feed
+	if *gtfsPath != "" {
+		loaded := gtfs_schedule.Load(*gtfsPath)
+		feed = &loaded
+	}
+
+	db, err := gorm.Open("postgres", os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	db.AutoMigrate(&predictions.Accuracy{}, &predictions.StoredPrediction{})
+
+	actuals := actualArrivals(db, days, *date)
+	// A day of predictions is too much to keep in memory, so we store them and
+	// add them to the summaries one snapshot at a time.
+	check(predictions.ClearPredictions(db, *date))
+	var summarizers []*predictions.Summarizer
+	for _, breakdown := range []string{predictions.ByHorizon, predictions.ByRoute, predictions.ByHour} {
+		summarizers = append(summarizers, predictions.NewSummarizer(days, breakdown))
+	}
+	var csvWriter *csv.Writer
+	if *predictionsCSV != "" {
+		f, w := newPredictionWriter(*predictionsCSV)
+		defer f.Close()
+		csvWriter = w
+	}
+	// The feed doesn't always change between polls, and counting the same
+	// predictions twice would skew the summaries.
+	seenHeaders := make(map[uint64]bool)
+	extracted, scored, repeats := 0, 0, 0
+	for _, dir := range strings.Split(*dataDirs, ",") {
+		fmt.Printf("Reading trip updates in %s\n", dir)
+		err = replay.Walk(dir, fileLocation, func(s replay.Snapshot, body []byte) error {
+			if s.Feed != replay.TripUpdates {
+				return nil
+			}
+			m, err := gtfs_realtime.Parse(body)
+			if err != nil || len(body) == 0 {
+				fmt.Printf("Skipping the trip updates snapshot from %s: %v\n", s.Time, err)
+				return nil
+			}
+			if m.Header.Timestamp != 0 {
+				if seenHeaders[m.Header.Timestamp] {
+					repeats++
+					return nil
+				}
+				seenHeaders[m.Header.Timestamp] = true
+			}
+			var onDate []predictions.Prediction
+			for _, p := range predictions.ExtractPredictions(m, s.Time, days, feed) {
+				if p.ServiceDate == *date {
+					onDate = append(onDate, p)
+				}
+			}
+			extracted += len(onDate)
+			if err = predictions.SavePredictions(db, onDate, actuals); err != nil {
+				return err
+			}
+			for _, sp := range predictions.Score(onDate, actuals) {
+				scored++
+				for _, summarizer := range summarizers {
+					if err = summarizer.Add(sp); err != nil {
+						return err
+					}
+				}
+				if csvWriter != nil {
+					writePrediction(csvWriter, sp)
+				}
+			}
+			return nil
+		})
+		check(err)
+	}
+	fmt.Printf("Skipped %d snapshots with the same header timestamp as an earlier one.\n", repeats)
+	fmt.Printf("We found %d predictions for service date %s and could score %d of them.\n", extracted, *date, scored)
+
+	var rows []predictions.Accuracy
+	for _, summarizer := range summarizers {
+		rows = append(rows, summarizer.Accuracy()...)
+	}
+	check(predictions.SaveAccuracy(db, *date, rows))
+	if csvWriter != nil {
+		csvWriter.Flush()
+		check(csvWriter.Error())
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/markongithub/bus_data_archive/pkg/s3_archive"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// archivedDays finds every day in archive/ that has a manifest.
+func archivedDays(dataPath string) []string {
+	manifests, err := filepath.Glob(filepath.Join(dataPath, "archive", "*.manifest.json"))
+	check(err)
+	var days []string
+	for _, manifest := range manifests {
+		days = append(days, strings.TrimSuffix(filepath.Base(manifest), ".manifest.json"))
+	}
+	sort.Strings(days)
+	return days
+}
+
+func main() {
+	dataPath := flag.String("data_path", "", "agency directory containing archive, like organized_transit_data/wmatabus")
+	agency := flag.String("agency", "", "wmatabus, mtabus or clever. Defaults to the last part of -data_path.")
+	days := flag.String("days", "", "comma-separated days to upload. Defaults to every day with a manifest.")
+	bucket := flag.String("bucket", s3_archive.PrimaryBucket, "bucket to upload to")
+	endpoint := flag.String("endpoint", "", "S3-compatible endpoint to use instead of AWS, like http://localhost:9000")
+	partSizeMB := flag.Int64("part_size_mb", s3_archive.DefaultPartSize/1024/1024, "multipart upload part size")
+	flag.Parse()
+
+	if *agency == "" {
+		*agency = filepath.Base(filepath.Clean(*dataPath))
+	}
+	toUpload := archivedDays(*dataPath)
+	if *days != "" {
+		toUpload = strings.Split(*days, ",")
+	}
+
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	uploader := s3_archive.NewUploader(sess, *bucket, *endpoint)
+	uploader.PartSize = *partSizeMB * 1024 * 1024
+	failures := 0
+	for _, day := range toUpload {
+		if err := uploader.UploadDay(*dataPath, *agency, day); err != nil {
+			fmt.Printf("Could not upload %s: %s\n", day, err)
+			failures++
+		}
+	}
+	if failures > 0 {
+		panic(fmt.Sprintf("%d of %d days failed to upload", failures, len(toUpload)))
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/clever_rows"
+	"github.com/markongithub/bus_data_archive/pkg/movements"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+type vehiclePoints map[string][]movements.Point
+
+// Glitches like 0,0 would add kilometers that no bus drove, so everything
+// here only reads positions that passed the quality checks.
+func addNonRevenue(db *gorm.DB, output vehiclePoints, agency string, date string) {
+	var positions []bus_positions.NonRevenuePosition
+	err := db.Scopes(position_quality.GoodPositions).Where("agency = ? AND service_date = ?", agency, date).Find(&positions).Error
+	check(err)
+	fmt.Printf("There are %d out-of-service positions on service date %s.\n", len(positions), date)
+	for _, p := range positions {
+		output[p.VehicleID] = append(output[p.VehicleID], movements.Point{At: p.ReportedAt, Lat: p.Lat, Lon: p.Lon})
+	}
+}
+
+func wmataPoints(db *gorm.DB, date string, location *time.Location) vehiclePoints {
+	days, err := bus_positions.AgencyServiceDays("wmatabus", location)
+	check(err)
+	trips, err := bus_positions.TripsOnServiceDates(db, days, date, date)
+	check(err)
+	fmt.Printf("There are %d trips on service date %s.\n", len(trips), date)
+	output := make(vehiclePoints)
+	for _, trip := range trips {
+		var positions []bus_positions.BusPosition
+		err = db.Scopes(position_quality.GoodPositions).Where("trip_instance_id = ?", trip.ID).Find(&positions).Error
+		check(err)
+		for _, bp := range positions {
+			reportedAt, err := bus_positions.ParseReportTime(bp.ReportedAt, location)
+			check(err)
+			output[trip.VehicleID] = append(output[trip.VehicleID], movements.Point{
+				At:             reportedAt,
+				Lat:            bp.Lat,
+				Lon:            bp.Lon,
+				TripInstanceID: trip.ID,
+				TripID:         trip.TripID,
+				RouteID:        trip.RouteID,
+			})
+		}
+	}
+	addNonRevenue(db, output, "wmatabus", date)
+	return output
+}
+
+func cleverPoints(db *gorm.DB, date string, location *time.Location) vehiclePoints {
+	days, err := bus_positions.AgencyServiceDays("clever", location)
+	check(err)
+	trips, err := clever_rows.TripsOnServiceDate(db, days, date)
+	check(err)
+	fmt.Printf("There are %d trips first seen on service date %s.\n", len(trips), date)
+	output := make(vehiclePoints)
+	for _, trip := range trips {
+		var positions []clever_rows.BusPosition
+		err = db.Scopes(position_quality.GoodPositions).Where("trip_instance_id = ?", trip.ID).Find(&positions).Error
+		check(err)
+		for _, bp := range positions {
+			output[trip.Vehicle] = append(output[trip.Vehicle], movements.Point{
+				At:             bp.RetrievedAt,
+				Lat:            bp.Lat,
+				Lon:            bp.Lon,
+				TripInstanceID: trip.ID,
+				// Clever trips don't have IDs of their own.
+				TripID:  strconv.Itoa(int(trip.ID)),
+				RouteID: trip.Route,
+			})
+		}
+	}
+	addNonRevenue(db, output, "clever", date)
+	return output
+}
+
+func main() {
+	agency := flag.String("agency", "wmatabus", "wmatabus or clever, the same names the loaders use")
+	dbDialect := flag.String("db_dialect", "postgres", "postgres, or sqlite3 for the Clever database")
+	date := flag.String("date", "", "service date to build movements for, YYYY-MM-DD")
+	minDwell := flag.Duration("min_dwell", movements.DefaultMinDwell, "how long an out-of-service bus has to stay put to count as parked")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+
+	db, err := gorm.Open(*dbDialect, os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	db.AutoMigrate(&bus_positions.NonRevenuePosition{}, &movements.Movement{})
+
+	var points vehiclePoints
+	switch *agency {
+	case "wmatabus", "wmata":
+		// Movements are stored under the loaders' name for the agency.
+		*agency = "wmatabus"
+		points = wmataPoints(db, *date, location)
+	case "clever":
+		points = cleverPoints(db, *date, location)
+	default:
+		panic(fmt.Sprintf("Unexpected agency: %s", *agency))
+	}
+
+	vehicles := make([]string, 0, len(points))
+	for vehicleID := range points {
+		vehicles = append(vehicles, vehicleID)
+	}
+	sort.Strings(vehicles)
+	var output []movements.Movement
+	meters := make(map[string]float64)
+	for _, vehicleID := range vehicles {
+		built := movements.BuildMovements(*agency, *date, vehicleID, points[vehicleID], *minDwell)
+		for _, m := range built {
+			meters[m.Type] += m.DistanceMeters
+			if m.Type == movements.TypePullOut {
+				fmt.Printf("Vehicle %s pulled out at %s to run trip %s.\n", vehicleID, m.Start.In(location).Format("15:04"), m.NextTripID)
+			}
+		}
+		output = append(output, built...)
+	}
+	check(movements.SaveMovements(db, *agency, *date, output))
+	fmt.Printf("%d vehicles made %d movements.\n", len(vehicles), len(output))
+	for _, movementType := range []string{movements.TypeRevenue, movements.TypePullOut, movements.TypeDeadhead, movements.TypePullIn} {
+		fmt.Printf("%s: %.1f km\n", movementType, meters[movementType]/1000)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
@@ -9,6 +10,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
 	"io/ioutil"
 	"os"
 	"time"
@@ -45,8 +47,12 @@ type BusPositionReport struct {
 
 type BusPositionReportDynamo struct {
 	BusPositionReport
-	PartitionKey string
-	RangeKey     string
+	PartitionKey     string
+	RangeKey         string
+	RetrievedAt      string
+	ReportAgeSeconds float64
+	// a position_quality flag, blank if it passed every check
+	Quality string
 }
 
 func ParseFile(filename string) BusPositionList {
@@ -72,15 +78,35 @@ func CheckInvariant(bpl BusPositionList) {
 	}
 }
 
-func ConvertToDynamoReport(b BusPositionReport, retrievedAt time.Time) BusPositionReportDynamo {
-	retrievedAtDate := retrievedAt.Format("2006-01-02")
+// The partition key is the service date, so an owl trip stays with the day it
+// started on. The range key uses the time the bus reported rather than the
+// time we retrieved it, so a report that shows up in several snapshots is
+// only stored once. The wmata_bus table we used to write to is keyed by the
+// UTC retrieval date and VehicleID#retrievedAt instead, so these go in a
+// table of their own and the old one stays as it was.
+func ConvertToDynamoReport(b BusPositionReport, retrievedAt time.Time, sd bus_positions.ServiceDays, tracker *position_quality.Tracker) BusPositionReportDynamo {
+	reportedAt, err := bus_positions.ParseReportTime(b.DateTime, sd.Location)
+	check(err)
+	serviceDate, err := sd.ReportDate(bus_positions.BusPositionReport{TripID: b.TripID, TripStartTime: b.TripStartTime, DateTime: b.DateTime})
+	check(err)
 	return BusPositionReportDynamo{
 		BusPositionReport: b,
-		PartitionKey:      retrievedAtDate,
-		RangeKey:          fmt.Sprintf("%s#%s", b.VehicleID, retrievedAt),
+		PartitionKey:      serviceDate,
+		RangeKey:          fmt.Sprintf("%s#%s", b.VehicleID, b.DateTime),
+		RetrievedAt:       retrievedAt.Format(time.RFC3339),
+		ReportAgeSeconds:  retrievedAt.Sub(reportedAt).Seconds(),
+		Quality:           checkQuality(tracker, b, reportedAt),
 	}
 }
 
+func checkQuality(tracker *position_quality.Tracker, b BusPositionReport, reportedAt time.Time) string {
+	lat, err := b.Lat.Float64()
+	check(err)
+	lon, err := b.Lon.Float64()
+	check(err)
+	return tracker.Check(b.VehicleID, position_quality.Fix{At: reportedAt, Lat: lat, Lon: lon})
+}
+
 //	retrievedAtDate := retrievedAt.Format("2006-01-02")
 //	output := &BusPositionReportDynamo{}
 //	RetrievedAtDate: retrievedAtDate,
@@ -102,15 +128,27 @@ func ConvertToDynamoReport(b BusPositionReport, retrievedAt time.Time) BusPositi
 
 func main() {
 	filename := flag.String("input_file", "", "JSON file with bus data")
-	// filename := flag.String("input_file", "", "JSON file with bus data")
+	timeZone := flag.String("timezone", "US/Eastern", "the time zone WMATA's DateTimes are in")
+	agency := flag.String("agency", "wmatabus", "whose poller saved the file. That says what time zone a legacy filename is in.")
+	tableName := flag.String("table", "wmata_bus_by_service_date", "DynamoDB table keyed by service date and VehicleID#DateTime")
+	qualityState := flag.String("quality_state", "", "file to keep each bus's last good position in between runs, for the position quality checks. The default is one per agency in the user's cache directory.")
 	flag.Parse()
 
 	m := ParseFile(*filename)
 	CheckInvariant(m)
-	reportTime := bus_positions.FileTime(*filename)
-
-	// location, err := time.LoadLocation("US/Eastern")
-	// check(err)
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+	fileLocation, err := bus_positions.AgencyLocation(*agency)
+	check(err)
+	reportTime, err := bus_positions.RetrievedAt(*filename, fileLocation)
+	check(err)
+	days, err := bus_positions.AgencyServiceDays(*agency, location)
+	check(err)
+	if *qualityState == "" {
+		*qualityState = position_quality.DefaultTrackerFile(*agency)
+	}
+	tracker, err := position_quality.ReadTrackerFile(*qualityState, *agency)
+	check(err)
 
 	// Initialize a session that the SDK will use to load
 	// credentials from the shared credentials file ~/.aws/credentials
@@ -122,11 +160,8 @@ func main() {
 	// Create DynamoDB client
 	svc := dynamodb.New(sess)
 
-	tableName := "wmata_bus"
-
 	for _, bp := range m.BusPositions {
-		// something something reportTime
-		bpd := ConvertToDynamoReport(bp, reportTime)
+		bpd := ConvertToDynamoReport(bp, reportTime, days, tracker)
 		av, err := dynamodbattribute.MarshalMap(bpd)
 		if err != nil {
 			fmt.Println("Got error marshalling map:")
@@ -134,20 +169,26 @@ func main() {
 			os.Exit(1)
 		}
 
-		// Create item in table
+		// Create item in table, unless an earlier snapshot already did
 		input := &dynamodb.PutItemInput{
-			Item:      av,
-			TableName: aws.String(tableName),
+			Item:                av,
+			TableName:           aws.String(*tableName),
+			ConditionExpression: aws.String("attribute_not_exists(RangeKey)"),
 		}
 
 		_, err = svc.PutItem(input)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			fmt.Println("We already have this report on vehicle " + bpd.VehicleID)
+			continue
+		}
 		if err != nil {
 			fmt.Println("Got error calling PutItem:")
 			fmt.Println(err.Error())
 			os.Exit(1)
 		}
 
-		fmt.Println("Successfully added the report on vehicle " + bpd.VehicleID + " to table " + tableName)
+		fmt.Println("Successfully added the report on vehicle " + bpd.VehicleID + " to table " + *tableName)
 		// snippet-end:[dynamodb.go.load_items.call]
 	}
+	check(position_quality.WriteTrackerFile(*qualityState, tracker))
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	filename := flag.String("input_file", "", "JSON file with bus data")
+	timeZone := flag.String("timezone", "US/Eastern", "the time zone WMATA's DateTimes are in")
+	agency := flag.String("agency", "wmatabus", "whose poller saved the file. That says what time zone a legacy filename is in and when the service day starts.")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+	m := bus_positions.ParseFile(*filename)
+	fileLocation, err := bus_positions.AgencyLocation(*agency)
+	check(err)
+	reportTime, err := bus_positions.RetrievedAt(*filename, fileLocation)
+	check(err)
+
+	db, err := gorm.Open("postgres", os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	bus_positions.Migrate(db)
+
+	days, err := bus_positions.AgencyServiceDays(*agency, location)
+	check(err)
+	check(bus_positions.BackfillServiceDates(db, days))
+	bus_positions.LoadSnapshot(db, *agency, m, reportTime, days)
+}
@@ -4,8 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"io/ioutil"
 	"time"
 
@@ -23,8 +25,10 @@ type BusPositionList struct {
 	BusPositions []BusPositionReport
 }
 
+// The same vehicle never reports the same DateTime twice, so the index is
+// what keeps a snapshot we load twice from storing its positions twice.
 type BusPositionReport struct {
-	VehicleID     string
+	VehicleID     string `gorm:"uniqueIndex:idx_denorm_vehicle_date_time"`
 	TripID        string
 	RouteID       string
 	DirectionNum  json.Number
@@ -33,7 +37,7 @@ type BusPositionReport struct {
 	TripStartTime string
 	TripEndTime   string
 	BlockNumber   string
-	DateTime      string
+	DateTime      string `gorm:"uniqueIndex:idx_denorm_vehicle_date_time"`
 	Lat           json.Number
 	Lon           json.Number
 	Deviation     json.Number
@@ -42,7 +46,11 @@ type BusPositionReport struct {
 type BusPositionReportSQLDenorm struct {
 	gorm.Model
 	BusPositionReport
-	RetrievedAt time.Time
+	RetrievedAt      time.Time
+	ReportAgeSeconds float64
+	ServiceDate      string `gorm:"index"`
+	// a position_quality flag, blank if it passed every check
+	Quality string
 }
 
 func ParseFile(filename string) BusPositionList {
@@ -68,22 +76,62 @@ func CheckInvariant(bpl BusPositionList) {
 	}
 }
 
-func ConvertToFlatRecord(b BusPositionReport, retrievedAt time.Time) BusPositionReportSQLDenorm {
+func checkQuality(tracker *position_quality.Tracker, b BusPositionReport, reportedAt time.Time) string {
+	lat, err := b.Lat.Float64()
+	check(err)
+	lon, err := b.Lon.Float64()
+	check(err)
+	return tracker.Check(b.VehicleID, position_quality.Fix{At: reportedAt, Lat: lat, Lon: lon})
+}
+
+func ConvertToFlatRecord(b BusPositionReport, retrievedAt time.Time, sd bus_positions.ServiceDays, tracker *position_quality.Tracker) BusPositionReportSQLDenorm {
+	reportedAt, err := bus_positions.ParseReportTime(b.DateTime, sd.Location)
+	check(err)
+	serviceDate, err := sd.ReportDate(bus_positions.BusPositionReport{TripID: b.TripID, TripStartTime: b.TripStartTime, DateTime: b.DateTime})
+	check(err)
 	return BusPositionReportSQLDenorm{
 		BusPositionReport: b,
 		RetrievedAt:       retrievedAt,
+		ReportAgeSeconds:  retrievedAt.Sub(reportedAt).Seconds(),
+		ServiceDate:       serviceDate,
+		Quality:           checkQuality(tracker, b, reportedAt),
 	}
 }
 
-func logPosition(db *gorm.DB, bpr BusPositionReport, reportTime time.Time) {
-	record := ConvertToFlatRecord(bpr, reportTime)
-	db.Create(&record)
+// logPosition skips reports we already stored from an earlier snapshot, and
+// returns false when it does.
+func logPosition(db *gorm.DB, bpr BusPositionReport, reportTime time.Time, sd bus_positions.ServiceDays, tracker *position_quality.Tracker) bool {
+	record := ConvertToFlatRecord(bpr, reportTime, sd, tracker)
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	check(result.Error)
+	return result.RowsAffected > 0
+}
+
+// migrate creates the table, but first removes the duplicate positions we
+// stored before we had idx_denorm_vehicle_date_time, since Postgres won't
+// build a unique index over them. It keeps the first copy of each.
+func migrate(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if migrator.HasTable(&BusPositionReportSQLDenorm{}) && !migrator.HasIndex(&BusPositionReportSQLDenorm{}, "idx_denorm_vehicle_date_time") {
+		err := db.Exec(`DELETE FROM bus_position_report_sql_denorms a
+			USING bus_position_report_sql_denorms b
+			WHERE a.vehicle_id = b.vehicle_id AND a.date_time = b.date_time AND a.id > b.id`).Error
+		if err != nil {
+			return err
+		}
+	}
+	return db.AutoMigrate(&BusPositionReportSQLDenorm{})
 }
 
 func main() {
 	filename := flag.String("input_file", "", "JSON file with bus data")
+	timeZone := flag.String("timezone", "US/Eastern", "the time zone WMATA's DateTimes are in")
+	agency := flag.String("agency", "wmatabus", "whose poller saved the file. That says what time zone a legacy filename is in.")
+	qualityState := flag.String("quality_state", "", "file to keep each bus's last good position in between runs, for the position quality checks. The default is one per agency in the user's cache directory.")
 	flag.Parse()
 
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
 	m := ParseFile(*filename)
 	CheckInvariant(m)
 
@@ -94,11 +142,26 @@ func main() {
 
 	// db.LogMode(true)
 
-	db.AutoMigrate(&BusPositionReportSQLDenorm{})
+	check(migrate(db))
 
-	reportTime := bus_positions.FileTime(*filename)
+	fileLocation, err := bus_positions.AgencyLocation(*agency)
+	check(err)
+	reportTime, err := bus_positions.RetrievedAt(*filename, fileLocation)
+	check(err)
+	days, err := bus_positions.AgencyServiceDays(*agency, location)
+	check(err)
 
+	if *qualityState == "" {
+		*qualityState = position_quality.DefaultTrackerFile(*agency)
+	}
+	tracker, err := position_quality.ReadTrackerFile(*qualityState, *agency)
+	check(err)
+	newReports := 0
 	for _, bp := range m.BusPositions {
-		logPosition(db, bp, reportTime)
+		if logPosition(db, bp, reportTime, days, tracker) {
+			newReports++
+		}
 	}
+	check(position_quality.WriteTrackerFile(*qualityState, tracker))
+	fmt.Printf("%d of %d reports were new.\n", newReports, len(m.BusPositions))
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_realtime"
+	"github.com/markongithub/bus_data_archive/pkg/replay"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func main() {
+	filename := flag.String("input_file", "", "gtfsrt-tu .pb file to record cancelled, added and skipped trips from")
+	reconcile := flag.String("reconcile", "", "service date, YYYY-MM-DD, to check against jBusPositions once it's over")
+	timeZone := flag.String("timezone", "US/Eastern", "the agency's time zone")
+	agency := flag.String("agency", "wmatabus", "whose poller saved the file. That says what time zone a legacy filename is in and when the service day starts.")
+	flag.Parse()
+
+	location, err := time.LoadLocation(*timeZone)
+	check(err)
+	days, err := bus_positions.AgencyServiceDays(*agency, location)
+	check(err)
+
+	db, err := gorm.Open("postgres", os.Getenv("DB_CONFIG"))
+	check(err)
+	defer db.Close()
+
+	db.AutoMigrate(&bus_positions.TripRelationship{})
+
+	if *filename != "" {
+		m, err := gtfs_realtime.ParseFile(*filename)
+		check(err)
+		fileLocation, err := bus_positions.AgencyLocation(*agency)
+		check(err)
+		// The feed's own timestamp wins if it has one, so we don't need to
+		// sort out the hour the clocks go back like RetrievedAt does.
+		feed, retrievedAt, ok := replay.ParseName(filepath.Base(*filename), fileLocation)
+		if !ok || feed != replay.TripUpdates {
+			panic(fmt.Sprintf("%s doesn't look like a trip updates snapshot", *filename))
+		}
+		recorded, err := bus_positions.LogTripUpdates(db, m, retrievedAt, days)
+		check(err)
+		fmt.Printf("We recorded %d schedule relationships from %d trip updates.\n", recorded, len(m.Entities))
+	}
+	if *reconcile != "" {
+		check(bus_positions.ReconcileTripRelationships(db, *reconcile))
+	}
+}
@@ -0,0 +1,87 @@
+package adherence
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/stop_events"
+)
+
+// StopArrival is our own estimate of when a trip reached a stop, so we can
+// compare our deviation with the one the agency reported.
+type StopArrival struct {
+	gorm.Model
+	TripInstanceID   uint `gorm:"index"`
+	GTFSTripID       string
+	StopID           string
+	StopSequence     int
+	DistAlong        float64
+	ScheduledArrival time.Time
+	EstimatedArrival time.Time
+	// Minutes late, with the same sign convention as WMATA's Deviation
+	Deviation float64
+	// The agency's Deviation interpolated to the same moment
+	AgencyDeviation float64
+}
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// ScheduledArrivals anchors the GTFS stop times to the trip's actual start
+// time. Going by offsets from the first departure means we never have to
+// figure out which service day a trip past midnight belongs to.
+func ScheduledArrivals(feed gtfs_schedule.Feed, gtfsTripID string, tripStart time.Time) []time.Time {
+	stopTimes := feed.StopTimesByTripID[gtfsTripID]
+	output := make([]time.Time, len(stopTimes))
+	for i, st := range stopTimes {
+		offset := time.Duration(st.Arrival-stopTimes[0].Departure) * time.Second
+		output[i] = tripStart.Add(offset)
+	}
+	return output
+}
+
+// ComputeStopArrivals needs positions in chronological order.
+func ComputeStopArrivals(feed gtfs_schedule.Feed, gtfsTripID string, tripStart time.Time, positions []stop_events.TimedPosition) []StopArrival {
+	shape, ok := feed.TripShape(gtfsTripID)
+	if !ok {
+		fmt.Printf("We have no shape for trip %s.\n", gtfsTripID)
+		return nil
+	}
+	snapped := stop_events.SnapToShape(shape, positions)
+	stopDistances := feed.StopDistances(gtfsTripID, shape)
+	scheduled := ScheduledArrivals(feed, gtfsTripID, tripStart)
+	var output []StopArrival
+	for i, st := range feed.StopTimesByTripID[gtfsTripID] {
+		crossing, ok := stop_events.FindCrossing(snapped, stopDistances[i])
+		if !ok {
+			continue
+		}
+		output = append(output, StopArrival{
+			GTFSTripID:       gtfsTripID,
+			StopID:           st.StopID,
+			StopSequence:     st.StopSequence,
+			DistAlong:        stopDistances[i],
+			ScheduledArrival: scheduled[i],
+			EstimatedArrival: crossing.Time,
+			Deviation:        crossing.Time.Sub(scheduled[i]).Minutes(),
+			AgencyDeviation:  crossing.Deviation,
+		})
+	}
+	return output
+}
+
+// SaveStopArrivals replaces whatever we computed for this trip last time.
+func SaveStopArrivals(db *gorm.DB, tripInstanceID uint, arrivals []StopArrival) {
+	err := db.Unscoped().Where("trip_instance_id = ?", tripInstanceID).Delete(StopArrival{}).Error
+	check(err)
+	for _, sa := range arrivals {
+		sa.TripInstanceID = tripInstanceID
+		err = db.Create(&sa).Error
+		check(err)
+	}
+}
@@ -0,0 +1,74 @@
+package adherence
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/stop_events"
+	"github.com/markongithub/bus_data_archive/pkg/test_util"
+	"gotest.tools/v3/assert"
+)
+
+func at(location *time.Location, hour, minute, second int) time.Time {
+	return time.Date(2019, 9, 19, hour, minute, second, 0, location)
+}
+
+func samplePositions(location *time.Location) []stop_events.TimedPosition {
+	return []stop_events.TimedPosition{
+		{Time: at(location, 8, 0, 30), Lat: 38.9, Lon: -77.0, Deviation: 0},
+		{Time: at(location, 8, 3, 0), Lat: 38.9001, Lon: -76.995, Deviation: 0},
+		{Time: at(location, 8, 7, 0), Lat: 38.8999, Lon: -76.988, Deviation: 2},
+		// way off the route, this should be ignored
+		{Time: at(location, 8, 9, 0), Lat: 38.95, Lon: -76.985, Deviation: 2},
+		{Time: at(location, 8, 12, 0), Lat: 38.9, Lon: -76.98, Deviation: 2},
+	}
+}
+
+func TestComputeStopArrivals(t *testing.T) {
+	location := test_util.Eastern()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	arrivals := ComputeStopArrivals(feed, "T1", at(location, 8, 0, 0), samplePositions(location))
+	assert.Equal(t, len(arrivals), 3)
+	assert.Equal(t, arrivals[0].EstimatedArrival, at(location, 8, 0, 30))
+	assert.Equal(t, arrivals[0].Deviation, 0.5)
+
+	// The bus crossed the second stop 5/7 of the way from 8:03 to 8:07.
+	assert.Equal(t, arrivals[1].ScheduledArrival, at(location, 8, 5, 0))
+	assert.Assert(t, math.Abs(arrivals[1].Deviation-(3+4.0*5/7-5)) < 0.05, "got %f", arrivals[1].Deviation)
+	assert.Assert(t, math.Abs(arrivals[1].AgencyDeviation-2.0*5/7) < 0.05, "got %f", arrivals[1].AgencyDeviation)
+
+	assert.Equal(t, arrivals[2].EstimatedArrival, at(location, 8, 12, 0))
+	assert.Equal(t, arrivals[2].Deviation, 2.0)
+}
+
+func TestComputeStopArrivalsPartialTrip(t *testing.T) {
+	location := test_util.Eastern()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	// We only started seeing the bus after the first stop.
+	arrivals := ComputeStopArrivals(feed, "T1", at(location, 8, 0, 0), samplePositions(location)[1:])
+	assert.Equal(t, len(arrivals), 2)
+	assert.Equal(t, arrivals[0].StopID, "1002")
+}
+
+func TestSaveStopArrivals(t *testing.T) {
+	location := test_util.Eastern()
+	db, err := gorm.Open("sqlite3", ":memory:")
+	check(err)
+	defer db.Close()
+	db.AutoMigrate(&StopArrival{})
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	arrivals := ComputeStopArrivals(feed, "T1", at(location, 8, 0, 0), samplePositions(location))
+	SaveStopArrivals(db, 7, arrivals)
+	// recomputing replaces the old rows instead of adding more
+	SaveStopArrivals(db, 7, arrivals)
+	SaveStopArrivals(db, 8, arrivals[:1])
+	var count int
+	db.Model(&StopArrival{}).Where("trip_instance_id = ?", 7).Count(&count)
+	assert.Equal(t, count, 3)
+	db.Model(&StopArrival{}).Count(&count)
+	assert.Equal(t, count, 4)
+}
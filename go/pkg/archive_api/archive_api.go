@@ -0,0 +1,364 @@
+package archive_api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/track_export"
+)
+
+const timeFormat = "2006-01-02T15:04:05" // these are local
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+	// longest time range a single track request can ask for
+	maxTrackRange = 7 * 24 * time.Hour
+)
+
+// Server serves read-only JSON and GeoJSON out of the normalized tables in
+// pkg/bus_positions.
+type Server struct {
+	db       *gorm.DB
+	location *time.Location
+	// one token per request we're willing to work on at once
+	slots chan struct{}
+}
+
+type Position struct {
+	VehicleID    string    `json:"vehicle_id"`
+	TripID       string    `json:"trip_id"`
+	RouteID      string    `json:"route_id"`
+	DirectionNum int       `json:"direction_num"`
+	TripHeadSign string    `json:"trip_headsign"`
+	ReportedAt   string    `json:"reported_at"`
+	RetrievedAt  time.Time `json:"retrieved_at"`
+	Lat          float64   `json:"lat"`
+	Lon          float64   `json:"lon"`
+	Deviation    float64   `json:"deviation"`
+}
+
+type Trip struct {
+	ID            uint   `json:"id"`
+	TripID        string `json:"trip_id"`
+	VehicleID     string `json:"vehicle_id"`
+	RouteID       string `json:"route_id"`
+	DirectionNum  int    `json:"direction_num"`
+	TripHeadSign  string `json:"trip_headsign"`
+	TripStartTime string `json:"trip_start_time"`
+	TripEndTime   string `json:"trip_end_time"`
+	BlockNumber   string `json:"block_number"`
+}
+
+// Page wraps every list we return. NextOffset is zero on the last page.
+type Page struct {
+	Items      interface{} `json:"items"`
+	Offset     int         `json:"offset"`
+	Limit      int         `json:"limit"`
+	NextOffset int         `json:"next_offset,omitempty"`
+}
+
+type SnapshotResponse struct {
+	RetrievedAt time.Time `json:"retrieved_at"`
+	Page
+}
+
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e httpError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return httpError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func NewServer(db *gorm.DB, location *time.Location, maxConcurrent int) *Server {
+	return &Server{db: db, location: location, slots: make(chan struct{}, maxConcurrent)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many requests in flight", http.StatusServiceUnavailable)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var body []byte
+	var contentType string
+	var err error
+	switch {
+	case len(parts) == 1 && parts[0] == "snapshot":
+		body, contentType, err = s.snapshot(r)
+	case len(parts) == 1 && parts[0] == "routes":
+		body, contentType, err = s.distinct(r, "route_id")
+	case len(parts) == 1 && parts[0] == "vehicles":
+		body, contentType, err = s.distinct(r, "vehicle_id")
+	case len(parts) == 3 && parts[0] == "routes" && parts[2] == "trips":
+		body, contentType, err = s.routeTrips(r, parts[1])
+	case len(parts) == 3 && parts[0] == "vehicles" && parts[2] == "track":
+		body, contentType, err = s.vehicleTrack(r, parts[1])
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if he, ok := err.(httpError); ok {
+			status = he.status
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeWithETag(w, r, body, contentType)
+}
+
+// The archive doesn't change once it's loaded, so a hash of the body makes a
+// fine ETag and clients can cache it for a while.
+func writeWithETag(w http.ResponseWriter, r *http.Request, body []byte, contentType string) {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+func pagination(r *http.Request) (int, int, error) {
+	limit := defaultLimit
+	offset := 0
+	var err error
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return 0, 0, badRequest("limit must be between 1 and %d", maxLimit)
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, badRequest("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// newPage expects one more item than the limit, if there is one, so it knows
+// whether there's another page.
+func newPage(items []interface{}, limit int, offset int) Page {
+	page := Page{Items: items, Offset: offset, Limit: limit}
+	if len(items) > limit {
+		page.Items = items[:limit]
+		page.NextOffset = offset + limit
+	}
+	return page
+}
+
+func (s *Server) parseTime(name string, value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, timeFormat, "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, s.location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, badRequest("could not parse %s %q", name, value)
+}
+
+func requireDate(r *http.Request) (string, error) {
+	date := r.URL.Query().Get("date")
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return "", badRequest("date must look like 2019-09-19")
+	}
+	return date, nil
+}
+
+func (s *Server) positionQuery() *gorm.DB {
+	return s.db.Table("bus_positions").
+		Select("trip_instances.vehicle_id, trip_instances.trip_id, trip_instances.route_id, trip_instances.direction_num, trip_instances.trip_head_sign, bus_positions.reported_at, bus_positions.retrieved_at, bus_positions.lat, bus_positions.lon, bus_positions.deviation").
+		Joins("JOIN trip_instances ON trip_instances.id = bus_positions.trip_instance_id").
+		Where("bus_positions.deleted_at IS NULL")
+}
+
+// snapshot returns what jBusPositions said at the last snapshot at or before
+// ?time. Since we only store each report once, that's every report we first
+// saw at or before the snapshot and last saw at or after it.
+func (s *Server) snapshot(r *http.Request) ([]byte, string, error) {
+	at, err := s.parseTime("time", r.URL.Query().Get("time"))
+	if err != nil {
+		return nil, "", err
+	}
+	limit, offset, err := pagination(r)
+	if err != nil {
+		return nil, "", err
+	}
+	var stats bus_positions.SnapshotStats
+	// Retrieval times are stored in UTC, and SQLite compares them as strings.
+	if s.db.Where("retrieved_at <= ?", at.UTC()).Order("retrieved_at desc").First(&stats).RecordNotFound() {
+		return nil, "", httpError{http.StatusNotFound, "no snapshot at or before that time"}
+	}
+	var rows []Position
+	err = s.positionQuery().
+		Where("bus_positions.retrieved_at <= ? AND (bus_positions.last_retrieved_at >= ? OR bus_positions.retrieved_at = ?)", stats.RetrievedAt, stats.RetrievedAt, stats.RetrievedAt).
+		Order("bus_positions.id").Offset(offset).Limit(limit + 1).Scan(&rows).Error
+	if err != nil {
+		return nil, "", err
+	}
+	if r.URL.Query().Get("format") == "geojson" {
+		if len(rows) > limit {
+			rows = rows[:limit]
+		}
+		points := make([]track_export.TrackPoint, 0, len(rows))
+		for _, p := range rows {
+			points = append(points, s.trackPoint(p))
+		}
+		return geoJSON(track_export.GroupTracks(points))
+	}
+	items := make([]interface{}, len(rows))
+	for i := range rows {
+		items[i] = rows[i]
+	}
+	return marshal(SnapshotResponse{RetrievedAt: stats.RetrievedAt, Page: newPage(items, limit, offset)})
+}
+
+func (s *Server) trackPoint(p Position) track_export.TrackPoint {
+	reportedAt, err := bus_positions.ParseReportTime(p.ReportedAt, s.location)
+	if err != nil {
+		reportedAt = p.RetrievedAt
+	}
+	return track_export.TrackPoint{
+		VehicleID:    p.VehicleID,
+		TripID:       p.TripID,
+		RouteID:      p.RouteID,
+		TripHeadsign: p.TripHeadSign,
+		Time:         reportedAt,
+		Lat:          p.Lat,
+		Lon:          p.Lon,
+		Deviation:    p.Deviation,
+	}
+}
+
+func (s *Server) vehicleTrack(r *http.Request, vehicleID string) ([]byte, string, error) {
+	start, err := s.parseTime("start", r.URL.Query().Get("start"))
+	if err != nil {
+		return nil, "", err
+	}
+	end, err := s.parseTime("end", r.URL.Query().Get("end"))
+	if err != nil {
+		return nil, "", err
+	}
+	if !end.After(start) || end.Sub(start) > maxTrackRange {
+		return nil, "", badRequest("end must be after start and no more than %s later", maxTrackRange)
+	}
+	var rows []Position
+	// ReportedAt sorts correctly as a string, as long as we compare it to
+	// local times. start and end are only local if they didn't have an offset.
+	err = s.positionQuery().
+		Where("trip_instances.vehicle_id = ?", vehicleID).
+		Where("bus_positions.reported_at >= ? AND bus_positions.reported_at < ?", start.In(s.location).Format(timeFormat), end.In(s.location).Format(timeFormat)).
+		Order("bus_positions.reported_at").Scan(&rows).Error
+	if err != nil {
+		return nil, "", err
+	}
+	points := make([]track_export.TrackPoint, 0, len(rows))
+	for _, p := range rows {
+		points = append(points, s.trackPoint(p))
+	}
+	return geoJSON(track_export.GroupTracks(points))
+}
+
+func (s *Server) routeTrips(r *http.Request, routeID string) ([]byte, string, error) {
+	date, err := requireDate(r)
+	if err != nil {
+		return nil, "", err
+	}
+	limit, offset, err := pagination(r)
+	if err != nil {
+		return nil, "", err
+	}
+	var trips []bus_positions.TripInstance
+	// A trip that starts after midnight belongs to the day before, so we go by
+	// service date rather than the calendar day it started on.
+	err = s.db.Where("route_id = ? AND service_date = ?", routeID, date).
+		Order("trip_start_time, id").Offset(offset).Limit(limit + 1).Find(&trips).Error
+	if err != nil {
+		return nil, "", err
+	}
+	items := make([]interface{}, len(trips))
+	for i, t := range trips {
+		items[i] = Trip{
+			ID:            t.ID,
+			TripID:        t.TripID,
+			VehicleID:     t.VehicleID,
+			RouteID:       t.RouteID,
+			DirectionNum:  t.DirectionNum,
+			TripHeadSign:  t.TripHeadSign,
+			TripStartTime: t.TripStartTime,
+			TripEndTime:   t.TripEndTime,
+			BlockNumber:   t.BlockNumber,
+		}
+	}
+	return marshal(newPage(items, limit, offset))
+}
+
+// distinct lists the routes or vehicles on trips on the service date ?date.
+func (s *Server) distinct(r *http.Request, column string) ([]byte, string, error) {
+	date, err := requireDate(r)
+	if err != nil {
+		return nil, "", err
+	}
+	limit, offset, err := pagination(r)
+	if err != nil {
+		return nil, "", err
+	}
+	var values []string
+	err = s.db.Model(&bus_positions.TripInstance{}).
+		Where("service_date = ?", date).
+		Order(column).Offset(offset).Limit(limit+1).
+		Pluck("DISTINCT "+column, &values).Error
+	if err != nil {
+		return nil, "", err
+	}
+	items := make([]interface{}, len(values))
+	for i := range values {
+		items[i] = values[i]
+	}
+	return marshal(newPage(items, limit, offset))
+}
+
+func marshal(v interface{}) ([]byte, string, error) {
+	b, err := json.Marshal(v)
+	return b, "application/json", err
+}
+
+func geoJSON(tracks []track_export.Track) ([]byte, string, error) {
+	var buf bytes.Buffer
+	err := track_export.WriteGeoJSON(&buf, tracks)
+	return buf.Bytes(), "application/geo+json", err
+}
@@ -0,0 +1,166 @@
+package archive_api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/test_util"
+	"gotest.tools/v3/assert"
+)
+
+func testServer(t *testing.T) (*Server, *gorm.DB) {
+	location := test_util.Eastern()
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	bus_positions.Migrate(db)
+	for _, filename := range []string{
+		"../bus_positions/test_data/buses2019-04-27T03:55:01.json",
+		"../bus_positions/test_data/buses2019-04-27T04:05:01.json",
+	} {
+		sd := bus_positions.ServiceDays{Location: location, RolloverHour: 4}
+		bus_positions.LoadSnapshot(db, "wmatabus", bus_positions.ParseFile(filename), bus_positions.FileTime(filename), sd)
+	}
+	return NewServer(db, location, 2), db
+}
+
+func get(s *Server, url string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", url, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func TestSnapshot(t *testing.T) {
+	s, db := testServer(t)
+	defer db.Close()
+	w := get(s, "/snapshot?time=2019-04-27T00:00:00", nil)
+	assert.Equal(t, w.Code, http.StatusOK)
+	var resp struct {
+		RetrievedAt time.Time  `json:"retrieved_at"`
+		Items       []Position `json:"items"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Assert(t, resp.RetrievedAt.Equal(time.Date(2019, 4, 27, 3, 55, 1, 0, time.UTC)))
+	assert.Equal(t, len(resp.Items), 2)
+	assert.Equal(t, resp.Items[0].VehicleID, "3171")
+
+	w = get(s, "/snapshot?time=2019-04-27T00:10:00&limit=1", nil)
+	var page Page
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, page.NextOffset, 1)
+	assert.Equal(t, len(page.Items.([]interface{})), 1)
+
+	w = get(s, "/snapshot?time=2019-04-26T00:00:00", nil)
+	assert.Equal(t, w.Code, http.StatusNotFound)
+	w = get(s, "/snapshot?time=yesterday", nil)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}
+
+func TestVehicleTrack(t *testing.T) {
+	s, db := testServer(t)
+	defer db.Close()
+	w := get(s, "/vehicles/8001/track?start=2019-04-27&end=2019-04-28", nil)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/geo+json")
+	var collection struct {
+		Features []struct {
+			Geometry struct {
+				Type string
+			}
+		}
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &collection))
+	assert.Equal(t, len(collection.Features), 2)
+	assert.Equal(t, collection.Features[0].Geometry.Type, "LineString")
+
+	// 8001 reported at 00:04 Eastern, which is 04:04 UTC.
+	w = get(s, "/vehicles/8001/track?start=2019-04-27T04:00:00Z&end=2019-04-27T04:10:00Z", nil)
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &collection))
+	assert.Equal(t, len(collection.Features), 2)
+	w = get(s, "/vehicles/8001/track?start=2019-04-27T00:00:00Z&end=2019-04-27T00:10:00Z", nil)
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &collection))
+	assert.Equal(t, len(collection.Features), 0)
+
+	w = get(s, "/vehicles/8001/track?start=2019-04-01&end=2019-04-28", nil)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}
+
+func TestRoutesAndVehicles(t *testing.T) {
+	s, db := testServer(t)
+	defer db.Close()
+	w := get(s, "/routes?date=2019-04-26", nil)
+	assert.Equal(t, w.Code, http.StatusOK)
+	var page struct {
+		Items []string `json:"items"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	// J12 and S2 started after midnight but they're still on the 26th.
+	assert.DeepEqual(t, page.Items, []string{"10A", "28A", "J12", "S2"})
+
+	w = get(s, "/vehicles?date=2019-04-26", nil)
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.DeepEqual(t, page.Items, []string{"2673", "3171", "6491", "8001"})
+
+	w = get(s, "/vehicles?date=2019-04-27", nil)
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, len(page.Items), 0)
+
+	w = get(s, "/routes/10A/trips?date=2019-04-26", nil)
+	var trips struct {
+		Items []Trip `json:"items"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &trips))
+	assert.Equal(t, len(trips.Items), 1)
+	assert.Equal(t, trips.Items[0].TripID, "914402060")
+
+	w = get(s, "/routes/J12/trips?date=2019-04-26", nil)
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &trips))
+	assert.Equal(t, len(trips.Items), 1)
+	assert.Equal(t, trips.Items[0].TripStartTime, "2019-04-27T00:01:00")
+	w = get(s, "/routes/J12/trips?date=2019-04-27", nil)
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &trips))
+	assert.Equal(t, len(trips.Items), 0)
+
+	w = get(s, "/routes?date=tuesday", nil)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+	w = get(s, "/nothing/here", nil)
+	assert.Equal(t, w.Code, http.StatusNotFound)
+}
+
+func TestETag(t *testing.T) {
+	s, db := testServer(t)
+	defer db.Close()
+	w := get(s, "/routes?date=2019-04-26", nil)
+	etag := w.Header().Get("ETag")
+	assert.Assert(t, etag != "")
+	w = get(s, "/routes?date=2019-04-26", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, w.Code, http.StatusNotModified)
+	assert.Equal(t, w.Body.Len(), 0)
+}
+
+func TestRequestLimits(t *testing.T) {
+	s, db := testServer(t)
+	defer db.Close()
+	w := get(s, "/routes?date=2019-04-26&limit=5000", nil)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+
+	req := httptest.NewRequest("POST", "/routes", nil)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed)
+
+	// fill up every slot
+	s.slots <- struct{}{}
+	s.slots <- struct{}{}
+	w = get(s, "/routes?date=2019-04-26", nil)
+	assert.Equal(t, w.Code, http.StatusServiceUnavailable)
+}
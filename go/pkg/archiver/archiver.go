@@ -0,0 +1,317 @@
+package archiver
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/replay"
+)
+
+// We poll once a minute, so a complete day has this many jBusPositions
+// snapshots.
+const ExpectedSnapshots = 24 * 60
+
+type ManifestFile struct {
+	// the name inside the tarball, like ./2019-04-27/buses2019-04-27T03:55:01.json
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// A Gap is a run of minutes with no jBusPositions snapshot.
+type Gap struct {
+	Start   time.Time `json:"start"`
+	Minutes int       `json:"minutes"`
+}
+
+// Manifest describes one day's tarball. We only write it once the tarball
+// has been read back and checked against it.
+type Manifest struct {
+	Day           string         `json:"day"`
+	Archive       string         `json:"archive"`
+	ArchiveSize   int64          `json:"archive_size"`
+	ArchiveSHA256 string         `json:"archive_sha256"`
+	Files         []ManifestFile `json:"files"`
+	// jBusPositions snapshots, which is what the gaps are measured against
+	SnapshotCount int `json:"snapshot_count"`
+	// snapshots of every feed, keyed by filename prefix
+	SnapshotCounts map[string]int `json:"snapshot_counts"`
+	Gaps           []Gap          `json:"gaps"`
+	CreatedAt      time.Time      `json:"created_at"`
+	VerifiedAt     time.Time      `json:"verified_at"`
+	// purge_old_data may delete short_term/<day> once this is true
+	PurgeEligible bool `json:"purge_eligible"`
+}
+
+func ArchivePath(dataPath string, day string) string {
+	return filepath.Join(dataPath, "archive", day+".tar.gz")
+}
+
+func ManifestPath(dataPath string, day string) string {
+	return filepath.Join(dataPath, "archive", day+".manifest.json")
+}
+
+func ReadManifest(path string) (Manifest, error) {
+	var m Manifest
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+// WriteManifest writes to a temporary file first so nobody ever sees half a
+// manifest.
+func WriteManifest(path string, m Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// FindGaps returns the runs of minutes in day (a UTC date like 2019-04-27)
+// that have no snapshot.
+func FindGaps(day time.Time, snapshotTimes []time.Time) []Gap {
+	var seen [ExpectedSnapshots]bool
+	for _, t := range snapshotTimes {
+		minute := int(t.Sub(day) / time.Minute)
+		if minute >= 0 && minute < ExpectedSnapshots {
+			seen[minute] = true
+		}
+	}
+	var gaps []Gap
+	for minute := 0; minute < ExpectedSnapshots; minute++ {
+		if seen[minute] {
+			continue
+		}
+		if len(gaps) > 0 {
+			last := &gaps[len(gaps)-1]
+			if last.Start.Add(time.Duration(last.Minutes) * time.Minute).Equal(day.Add(time.Duration(minute) * time.Minute)) {
+				last.Minutes++
+				continue
+			}
+		}
+		gaps = append(gaps, Gap{Start: day.Add(time.Duration(minute) * time.Minute), Minutes: 1})
+	}
+	return gaps
+}
+
+type hashingWriter struct {
+	w    io.Writer
+	hash io.Writer
+	size int64
+}
+
+func (h *hashingWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// writeTarball lays the day out the same way the old create_archive did,
+// with `tar -zcvf <day>.tar.gz ./<day>`, and returns what it wrote.
+func writeTarball(dayDir string, day string, archive string, location *time.Location) (Manifest, error) {
+	m := Manifest{Day: day, Archive: filepath.Base(archive), SnapshotCounts: make(map[string]int)}
+	names, err := ioutil.ReadDir(dayDir)
+	if err != nil {
+		return m, err
+	}
+	out, err := os.Create(archive)
+	if err != nil {
+		return m, err
+	}
+	defer out.Close()
+	archiveHash := sha256.New()
+	hw := &hashingWriter{w: out, hash: archiveHash}
+	gz := gzip.NewWriter(hw)
+	tw := tar.NewWriter(gz)
+
+	dirInfo, err := os.Stat(dayDir)
+	if err != nil {
+		return m, err
+	}
+	header, err := tar.FileInfoHeader(dirInfo, "")
+	if err != nil {
+		return m, err
+	}
+	header.Name = "./" + day + "/"
+	if err = tw.WriteHeader(header); err != nil {
+		return m, err
+	}
+
+	dayStart, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return m, err
+	}
+	for _, info := range names {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return m, err
+		}
+		header.Name = "./" + day + "/" + info.Name()
+		if err = tw.WriteHeader(header); err != nil {
+			return m, err
+		}
+		f, err := os.Open(filepath.Join(dayDir, info.Name()))
+		if err != nil {
+			return m, err
+		}
+		fileHash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(tw, fileHash), f)
+		f.Close()
+		if err != nil {
+			return m, err
+		}
+		if size != info.Size() {
+			return m, fmt.Errorf("%s changed size while we were archiving it", info.Name())
+		}
+		m.Files = append(m.Files, ManifestFile{Name: header.Name, Size: size, SHA256: hex.EncodeToString(fileHash.Sum(nil))})
+		if feed, _, ok := replay.ParseName(info.Name(), location); ok {
+			m.SnapshotCounts[string(feed)]++
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return m, err
+	}
+	if err = gz.Close(); err != nil {
+		return m, err
+	}
+	if err = out.Sync(); err != nil {
+		return m, err
+	}
+	m.ArchiveSize = hw.size
+	m.ArchiveSHA256 = hex.EncodeToString(archiveHash.Sum(nil))
+	m.SnapshotCount = m.SnapshotCounts[string(replay.BusPositions)]
+	// The index sorts out any names from the hour the clocks went back.
+	ix := replay.NewIndex(location)
+	if err = ix.AddDirectory(dayDir); err != nil {
+		return m, err
+	}
+	m.Gaps = FindGaps(dayStart, ix.Times(replay.BusPositions))
+	return m, nil
+}
+
+// Verify reads the whole tarball back and checks it against the manifest:
+// the tarball's own checksum, and every file's size and checksum, with
+// nothing missing and nothing extra.
+func Verify(archive string, m Manifest) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	archiveHash := sha256.New()
+	gz, err := gzip.NewReader(io.TeeReader(f, archiveHash))
+	if err != nil {
+		return err
+	}
+	expected := make(map[string]ManifestFile, len(m.Files))
+	for _, mf := range m.Files {
+		expected[mf.Name] = mf
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		mf, ok := expected[header.Name]
+		if !ok {
+			return fmt.Errorf("%s is in the tarball but not the manifest", header.Name)
+		}
+		delete(expected, header.Name)
+		fileHash := sha256.New()
+		size, err := io.Copy(fileHash, tr)
+		if err != nil {
+			return err
+		}
+		if size != mf.Size || hex.EncodeToString(fileHash.Sum(nil)) != mf.SHA256 {
+			return fmt.Errorf("%s in the tarball doesn't match the manifest", header.Name)
+		}
+	}
+	// gzip has its own trailer checksum, but only once we read to the end.
+	if _, err = io.Copy(ioutil.Discard, gz); err != nil {
+		return err
+	}
+	if _, err = io.Copy(archiveHash, f); err != nil {
+		return err
+	}
+	if len(expected) > 0 {
+		missing := make([]string, 0, len(expected))
+		for name := range expected {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("%d files in the manifest are missing from the tarball, starting with %s", len(missing), missing[0])
+	}
+	if hex.EncodeToString(archiveHash.Sum(nil)) != m.ArchiveSHA256 {
+		return fmt.Errorf("%s doesn't match the checksum in the manifest", archive)
+	}
+	return nil
+}
+
+// ArchiveDay tars up short_term/<day> under dataPath, verifies the tarball
+// and writes its manifest. It refuses to touch a day that already has a
+// tarball. Legacy filenames without an offset are read in location.
+func ArchiveDay(dataPath string, day string, location *time.Location) (Manifest, error) {
+	archive := ArchivePath(dataPath, day)
+	if _, err := os.Stat(archive); err == nil {
+		return Manifest{}, fmt.Errorf("%s already exists", archive)
+	}
+	if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+		return Manifest{}, err
+	}
+	tmp := archive + ".tmp"
+	m, err := writeTarball(filepath.Join(dataPath, "short_term", day), day, tmp, location)
+	if err != nil {
+		os.Remove(tmp)
+		return m, err
+	}
+	m.Archive = filepath.Base(archive)
+	m.CreatedAt = time.Now().UTC()
+	if err = Verify(tmp, m); err != nil {
+		os.Remove(tmp)
+		return m, fmt.Errorf("verifying %s: %s", tmp, err)
+	}
+	m.VerifiedAt = time.Now().UTC()
+	m.PurgeEligible = true
+	// The manifest goes first. A tarball without one would make us refuse to
+	// archive the day again, and nothing else could tell it had been verified.
+	manifest := ManifestPath(dataPath, day)
+	if err = WriteManifest(manifest, m); err != nil {
+		os.Remove(tmp)
+		return m, err
+	}
+	if err = os.Rename(tmp, archive); err != nil {
+		os.Remove(manifest)
+		os.Remove(tmp)
+		return m, err
+	}
+	return m, nil
+}
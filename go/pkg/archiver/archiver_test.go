@@ -0,0 +1,94 @@
+package archiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/replay"
+	"gotest.tools/v3/assert"
+)
+
+func testDataPath(t *testing.T) string {
+	dataPath, err := ioutil.TempDir("", "archiver")
+	assert.NilError(t, err)
+	day := filepath.Join(dataPath, "short_term/2019-04-27")
+	assert.NilError(t, os.MkdirAll(day, 0755))
+	for _, name := range []string{"buses2019-04-27T03:55:01.json", "buses2019-04-27T04:05:01.json"} {
+		b, err := ioutil.ReadFile("../bus_positions/test_data/" + name)
+		assert.NilError(t, err)
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(day, name), b, 0644))
+	}
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(day, "gtfsrt-vp-2019-04-27T03:55:01.pb"), []byte("vp"), 0644))
+	return dataPath
+}
+
+func TestFindGaps(t *testing.T) {
+	day := time.Date(2019, 4, 27, 0, 0, 0, 0, time.UTC)
+	var times []time.Time
+	for minute := 0; minute < ExpectedSnapshots; minute++ {
+		if minute >= 60 && minute < 63 || minute == ExpectedSnapshots-1 {
+			continue
+		}
+		// we rarely get them right on the minute
+		times = append(times, day.Add(time.Duration(minute)*time.Minute+time.Second))
+	}
+	assert.DeepEqual(t, FindGaps(day, times), []Gap{
+		{Start: day.Add(time.Hour), Minutes: 3},
+		{Start: day.Add(23*time.Hour + 59*time.Minute), Minutes: 1},
+	})
+	assert.DeepEqual(t, FindGaps(day, nil), []Gap{{Start: day, Minutes: ExpectedSnapshots}})
+}
+
+func TestArchiveDay(t *testing.T) {
+	dataPath := testDataPath(t)
+	defer os.RemoveAll(dataPath)
+	m, err := ArchiveDay(dataPath, "2019-04-27", time.UTC)
+	assert.NilError(t, err)
+	assert.Assert(t, m.PurgeEligible)
+	assert.Equal(t, len(m.Files), 3)
+	assert.Equal(t, m.Files[0].Name, "./2019-04-27/buses2019-04-27T03:55:01.json")
+	assert.Equal(t, m.Files[2].Size, int64(2))
+	assert.Equal(t, m.SnapshotCount, 2)
+	assert.Equal(t, m.SnapshotCounts["gtfsrt-vp-"], 1)
+	assert.Equal(t, len(m.Gaps), 3)
+	assert.Equal(t, m.Gaps[1].Start, time.Date(2019, 4, 27, 3, 56, 0, 0, time.UTC))
+	assert.Equal(t, m.Gaps[1].Minutes, 9)
+
+	onDisk, err := ReadManifest(ManifestPath(dataPath, "2019-04-27"))
+	assert.NilError(t, err)
+	assert.Equal(t, onDisk.ArchiveSHA256, m.ArchiveSHA256)
+	assert.NilError(t, Verify(ArchivePath(dataPath, "2019-04-27"), onDisk))
+
+	// the replay server can read what we wrote
+	ix := replay.NewIndex(time.UTC)
+	assert.NilError(t, ix.AddTarball(ArchivePath(dataPath, "2019-04-27")))
+	assert.Equal(t, ix.Len(replay.BusPositions), 2)
+
+	_, err = ArchiveDay(dataPath, "2019-04-27", time.UTC)
+	assert.ErrorContains(t, err, "already exists")
+}
+
+func TestVerifyCatchesProblems(t *testing.T) {
+	dataPath := testDataPath(t)
+	defer os.RemoveAll(dataPath)
+	m, err := ArchiveDay(dataPath, "2019-04-27", time.UTC)
+	assert.NilError(t, err)
+	archive := ArchivePath(dataPath, "2019-04-27")
+
+	wrongFile := m
+	wrongFile.Files = append([]ManifestFile{}, m.Files...)
+	wrongFile.Files[1].SHA256 = "nope"
+	assert.ErrorContains(t, Verify(archive, wrongFile), "doesn't match the manifest")
+
+	extraFile := m
+	extraFile.Files = append(append([]ManifestFile{}, m.Files...), ManifestFile{Name: "./2019-04-27/buses2019-04-27T05:00:01.json"})
+	assert.ErrorContains(t, Verify(archive, extraFile), "missing from the tarball")
+
+	b, err := ioutil.ReadFile(archive)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(archive, b[:len(b)-10], 0644))
+	assert.Assert(t, Verify(archive, m) != nil)
+}
@@ -0,0 +1,210 @@
+package blocks
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+)
+
+// A TripRun is one vehicle seen on one trip of a block. WMATA gives us the
+// block as BlockNumber; Clever calls it bid and also tells us the run and the
+// operator.
+type TripRun struct {
+	BlockID   string
+	VehicleID string
+	RouteID   string
+	TripID    string
+	Run       string
+	Operator  string
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// An Assignment is one vehicle's stint on a block: the trips it ran back to
+// back before another vehicle took over or the block ended. A block with a
+// swap has more than one.
+type Assignment struct {
+	gorm.Model
+	// "wmata" or "clever", like stop events
+	Agency      string `gorm:"index:idx_assignment_day"`
+	ServiceDate string `gorm:"index:idx_assignment_day"`
+	BlockID     string
+	// 1 for the vehicle that pulled out on the block
+	Sequence  int
+	VehicleID string `gorm:"index"`
+	// the vehicle this one took over from, if it's a swap
+	ReplacedVehicleID string
+	Run               string
+	Operator          string
+	// comma-separated, in the order the vehicle ran them
+	Routes    string
+	Trips     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// A BlockDay is how one block went on one service day.
+type BlockDay struct {
+	gorm.Model
+	Agency      string `gorm:"index:idx_block_day"`
+	ServiceDate string `gorm:"index:idx_block_day"`
+	BlockID     string
+	// when we first and last saw anything on the block
+	PullOut time.Time
+	PullIn  time.Time
+	// the first scheduled departure, if the block is in the GTFS feed
+	ScheduledPullOut *time.Time
+	// how late PullOut was against ScheduledPullOut
+	PullOutDelaySeconds float64
+	LatePullOut         bool
+	Trips               int
+	Vehicles            int
+	// times a different vehicle took over partway through
+	Swaps int
+	// comma-separated, in the order they were run
+	Routes string
+	// times the block went from one route straight onto another
+	Interlines int
+}
+
+// A pull-out more than this behind schedule is late.
+const DefaultLatePullOut = 5 * time.Minute
+
+// ScheduledPullOuts finds the first departure of every block scheduled on a
+// service date.
+func ScheduledPullOuts(feed gtfs_schedule.Feed, dateYYYYMMDD string, location *time.Location) map[string]time.Time {
+	dayStart := gtfs_schedule.ServiceDayStart(dateYYYYMMDD, location)
+	output := make(map[string]time.Time)
+	for _, tripID := range feed.TripsByDate(dateYYYYMMDD) {
+		blockID := feed.Trips[tripID].BlockID
+		stopTimes := feed.StopTimesByTripID[tripID]
+		if blockID == "" || len(stopTimes) == 0 {
+			continue
+		}
+		departure := dayStart.Add(time.Duration(stopTimes[0].Departure) * time.Second)
+		if first, present := output[blockID]; !present || departure.Before(first) {
+			output[blockID] = departure
+		}
+	}
+	return output
+}
+
+func appendRoute(routes []string, routeID string) []string {
+	if len(routes) > 0 && routes[len(routes)-1] == routeID {
+		return routes
+	}
+	return append(routes, routeID)
+}
+
+// BuildBlocks rebuilds one service day's blocks from the trips we saw on
+// them. Trips without a block are left out. scheduled can be nil if we have
+// no GTFS feed, or if the agency's block IDs don't match it.
+func BuildBlocks(agency string, serviceDate string, runs []TripRun, scheduled map[string]time.Time, late time.Duration) ([]BlockDay, []Assignment) {
+	byBlock := make(map[string][]TripRun)
+	var blockIDs []string
+	for _, run := range runs {
+		if run.BlockID == "" {
+			continue
+		}
+		if _, present := byBlock[run.BlockID]; !present {
+			blockIDs = append(blockIDs, run.BlockID)
+		}
+		byBlock[run.BlockID] = append(byBlock[run.BlockID], run)
+	}
+	sort.Strings(blockIDs)
+
+	var days []BlockDay
+	var assignments []Assignment
+	for _, blockID := range blockIDs {
+		group := byBlock[blockID]
+		sort.Slice(group, func(i, j int) bool { return group[i].FirstSeen.Before(group[j].FirstSeen) })
+		day := BlockDay{
+			Agency:      agency,
+			ServiceDate: serviceDate,
+			BlockID:     blockID,
+			PullOut:     group[0].FirstSeen,
+			Trips:       len(group),
+		}
+		var routes []string
+		vehicles := make(map[string]bool)
+		var stints []Assignment
+		var stintRoutes []string
+		for i, run := range group {
+			if run.LastSeen.After(day.PullIn) {
+				day.PullIn = run.LastSeen
+			}
+			if i > 0 && run.RouteID != group[i-1].RouteID {
+				day.Interlines++
+			}
+			routes = appendRoute(routes, run.RouteID)
+			vehicles[run.VehicleID] = true
+			if len(stints) == 0 || stints[len(stints)-1].VehicleID != run.VehicleID {
+				if len(stints) > 0 {
+					stints[len(stints)-1].Routes = strings.Join(stintRoutes, ",")
+				}
+				stint := Assignment{
+					Agency:      agency,
+					ServiceDate: serviceDate,
+					BlockID:     blockID,
+					Sequence:    len(stints) + 1,
+					VehicleID:   run.VehicleID,
+					Run:         run.Run,
+					Operator:    run.Operator,
+					FirstSeen:   run.FirstSeen,
+				}
+				if len(stints) > 0 {
+					stint.ReplacedVehicleID = stints[len(stints)-1].VehicleID
+				}
+				stints = append(stints, stint)
+				stintRoutes = nil
+			}
+			stint := &stints[len(stints)-1]
+			stint.Trips++
+			if run.LastSeen.After(stint.LastSeen) {
+				stint.LastSeen = run.LastSeen
+			}
+			stintRoutes = appendRoute(stintRoutes, run.RouteID)
+		}
+		stints[len(stints)-1].Routes = strings.Join(stintRoutes, ",")
+		day.Routes = strings.Join(routes, ",")
+		day.Vehicles = len(vehicles)
+		day.Swaps = len(stints) - 1
+		if pullOut, present := scheduled[blockID]; present {
+			day.ScheduledPullOut = &pullOut
+			day.PullOutDelaySeconds = day.PullOut.Sub(pullOut).Seconds()
+			day.LatePullOut = day.PullOut.Sub(pullOut) > late
+		}
+		days = append(days, day)
+		assignments = append(assignments, stints...)
+	}
+	return days, assignments
+}
+
+// SaveBlocks replaces whatever we rebuilt for this agency and service date
+// last time.
+func SaveBlocks(db *gorm.DB, agency string, serviceDate string, days []BlockDay, assignments []Assignment) error {
+	err := db.Unscoped().Where("agency = ? AND service_date = ?", agency, serviceDate).Delete(BlockDay{}).Error
+	if err != nil {
+		return err
+	}
+	err = db.Unscoped().Where("agency = ? AND service_date = ?", agency, serviceDate).Delete(Assignment{}).Error
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		day.Agency, day.ServiceDate = agency, serviceDate
+		if err = db.Create(&day).Error; err != nil {
+			return err
+		}
+	}
+	for _, a := range assignments {
+		a.Agency, a.ServiceDate = agency, serviceDate
+		if err = db.Create(&a).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package blocks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/test_util"
+	"gotest.tools/v3/assert"
+)
+
+func at(location *time.Location, hour, minute int) time.Time {
+	return time.Date(2019, 9, 19, hour, minute, 0, 0, location)
+}
+
+func testRuns(location *time.Location) []TripRun {
+	return []TripRun{
+		// 3171 pulls out late on B1, runs a 10A and hands the block over to
+		// 3172, which interlines onto the 10B.
+		{BlockID: "B1", VehicleID: "3172", RouteID: "10B", TripID: "T5", FirstSeen: at(location, 8, 31), LastSeen: at(location, 8, 50)},
+		{BlockID: "B1", VehicleID: "3171", RouteID: "10A", TripID: "T1", FirstSeen: at(location, 8, 9), LastSeen: at(location, 8, 12)},
+		{BlockID: "B1", VehicleID: "3172", RouteID: "10A", TripID: "T2", FirstSeen: at(location, 8, 14), LastSeen: at(location, 8, 26)},
+		{BlockID: "B2", VehicleID: "8001", RouteID: "10A", TripID: "T3", Run: "12", Operator: "4410", FirstSeen: at(location, 8, 31), LastSeen: at(location, 8, 41)},
+		{VehicleID: "9999", RouteID: "10A", TripID: "T9", FirstSeen: at(location, 9, 0), LastSeen: at(location, 9, 10)},
+	}
+}
+
+func TestScheduledPullOuts(t *testing.T) {
+	location := test_util.Eastern()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	scheduled := ScheduledPullOuts(feed, "20190919", location)
+	assert.DeepEqual(t, scheduled, map[string]time.Time{
+		"B1": at(location, 8, 0),
+		"B2": at(location, 8, 30),
+	})
+}
+
+func TestBuildBlocks(t *testing.T) {
+	location := test_util.Eastern()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	scheduled := ScheduledPullOuts(feed, "20190919", location)
+	days, assignments := BuildBlocks("clever", "2019-09-19", testRuns(location), scheduled, DefaultLatePullOut)
+
+	assert.Equal(t, len(days), 2)
+	b1 := days[0]
+	assert.Equal(t, b1.BlockID, "B1")
+	assert.Equal(t, b1.PullOut, at(location, 8, 9))
+	assert.Equal(t, b1.PullIn, at(location, 8, 50))
+	assert.Equal(t, b1.PullOutDelaySeconds, 540.0)
+	assert.Assert(t, b1.LatePullOut)
+	assert.Equal(t, b1.Trips, 3)
+	assert.Equal(t, b1.Vehicles, 2)
+	assert.Equal(t, b1.Swaps, 1)
+	assert.Equal(t, b1.Routes, "10A,10B")
+	assert.Equal(t, b1.Interlines, 1)
+	b2 := days[1]
+	assert.Assert(t, !b2.LatePullOut)
+	assert.Equal(t, b2.Swaps, 0)
+
+	assert.Equal(t, len(assignments), 3)
+	assert.Equal(t, assignments[0].VehicleID, "3171")
+	assert.Equal(t, assignments[0].Routes, "10A")
+	assert.Equal(t, assignments[1].VehicleID, "3172")
+	assert.Equal(t, assignments[1].Sequence, 2)
+	assert.Equal(t, assignments[1].ReplacedVehicleID, "3171")
+	assert.Equal(t, assignments[1].Routes, "10A,10B")
+	assert.Equal(t, assignments[1].Trips, 2)
+	assert.Equal(t, assignments[1].FirstSeen, at(location, 8, 14))
+	assert.Equal(t, assignments[1].LastSeen, at(location, 8, 50))
+	assert.Equal(t, assignments[2].Run, "12")
+	assert.Equal(t, assignments[2].Operator, "4410")
+
+	// Without a schedule we can't say anything about pull-outs being late.
+	days, _ = BuildBlocks("wmata", "2019-09-19", testRuns(location), nil, DefaultLatePullOut)
+	assert.Assert(t, days[0].ScheduledPullOut == nil)
+	assert.Assert(t, !days[0].LatePullOut)
+}
+
+func TestSaveBlocks(t *testing.T) {
+	location := test_util.Eastern()
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	defer db.Close()
+	db.AutoMigrate(&BlockDay{}, &Assignment{})
+
+	days, assignments := BuildBlocks("wmata", "2019-09-19", testRuns(location), nil, DefaultLatePullOut)
+	assert.NilError(t, SaveBlocks(db, "wmata", "2019-09-19", days, assignments))
+	assert.NilError(t, SaveBlocks(db, "wmata", "2019-09-19", days, assignments))
+	assert.NilError(t, SaveBlocks(db, "clever", "2019-09-19", days[:1], assignments[:1]))
+
+	var count int
+	db.Model(&BlockDay{}).Where("agency = ?", "wmata").Count(&count)
+	assert.Equal(t, count, 2)
+	db.Model(&Assignment{}).Count(&count)
+	assert.Equal(t, count, 4)
+}
@@ -5,8 +5,9 @@ import (
 	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/markongithub/bus_data_archive/pkg/fleet"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
 	"io/ioutil"
-	"regexp"
 	"time"
 )
 
@@ -45,17 +46,59 @@ type TripInstance struct {
 	TripStartTime string `gorm:"unique_index:idx_trip_id_start_time"`
 	TripEndTime   string
 	BlockNumber   string
-	BusPositions  []BusPosition
+	// the transit service day, which for a trip past midnight is the day
+	// before
+	ServiceDate  string `gorm:"index"`
+	BusPositions []BusPosition
 }
 
+// Buses that stop reporting keep showing up in every snapshot with the same
+// DateTime, so we only store a report the first time we see it. RetrievedAt
+// is when we first saw it and LastRetrievedAt is when we last saw it.
 type BusPosition struct {
 	gorm.Model
-	RetrievedAt    time.Time
-	ReportedAt     string
-	TripInstanceID uint `gorm:"index"`
-	Lat            float64
-	Lon            float64
-	Deviation      float64
+	RetrievedAt      time.Time
+	ReportedAt       string `gorm:"index"`
+	TripInstanceID   uint   `gorm:"index"`
+	Lat              float64
+	Lon              float64
+	Deviation        float64
+	ReportAgeSeconds float64
+	LastRetrievedAt  time.Time
+	TimesSeen        int
+	// the same as its trip's
+	ServiceDate string `gorm:"index"`
+	// a position_quality flag, blank if it passed every check
+	Quality string
+}
+
+// A report older than this when we retrieve it means the bus has probably
+// stopped reporting.
+const StaleAfter = 3 * time.Minute
+
+// SnapshotStats says how fresh the reports in one snapshot file were.
+type SnapshotStats struct {
+	gorm.Model
+	Agency      string    `gorm:"unique_index:idx_snapshot_stats"`
+	RetrievedAt time.Time `gorm:"unique_index:idx_snapshot_stats"`
+	Reports     int
+	// reports we had not seen in an earlier snapshot
+	NewReports     int
+	StaleReports   int
+	MeanAgeSeconds float64
+	MaxAgeSeconds  float64
+}
+
+// Migrate creates every table LoadSnapshot writes to, including the quality
+// and fleet ones.
+func Migrate(db *gorm.DB) {
+	db.AutoMigrate(&TripInstance{}, &BusPosition{}, &SnapshotStats{}, &NonRevenuePosition{}, &TripRelationship{}, &position_quality.VehicleState{}, &fleet.Vehicle{}, &fleet.VehicleService{})
+	// SnapshotStats used to be unique by retrieval time alone, and only the
+	// WMATA loader wrote them.
+	if db.Dialect().HasIndex(db.NewScope(&SnapshotStats{}).TableName(), "uix_snapshot_stats_retrieved_at") {
+		db.Model(&SnapshotStats{}).RemoveIndex("uix_snapshot_stats_retrieved_at")
+	}
+	db.Model(&SnapshotStats{}).Where("agency = '' OR agency IS NULL").Update("agency", "wmatabus")
 }
 
 func check(e error) {
@@ -64,21 +107,22 @@ func check(e error) {
 	}
 }
 
+// FileTime reads the time in a filename like 6/buses2019-03-26T23:28:01.json,
+// taking a legacy name without an offset to be UTC. RetrievedAt knows about
+// other time zones and the repeated hour when the clocks go back.
 func FileTime(filePath string) time.Time {
-	// 6/buses2019-03-26T23:28:01.json
-	r, _ := regexp.Compile("/buses(....-..-..T..:..:..)\\.json")
-	result := r.FindStringSubmatch(filePath)
-	if result == nil {
-		panic("could not parse time from filename")
-	}
-	t1, err := time.Parse(
-		"2006-01-02T15:04:05", result[1])
+	rt, err := FileRetrievalTime(filePath, time.UTC)
 	check(err)
-	return t1
+	return rt.Time
+}
 
+// ParseReportTime parses times like DateTime and TripStartTime, which WMATA
+// gives us in local time without an offset.
+func ParseReportTime(s string, location *time.Location) (time.Time, error) {
+	return time.ParseInLocation(timeFormat, s, location)
 }
 
-func tripFromReport(bpr BusPositionReport) TripInstance {
+func tripFromReport(bpr BusPositionReport, serviceDate string) TripInstance {
 	return TripInstance{
 		VehicleID:     bpr.VehicleID,
 		TripID:        bpr.TripID,
@@ -89,23 +133,116 @@ func tripFromReport(bpr BusPositionReport) TripInstance {
 		TripStartTime: bpr.TripStartTime,
 		TripEndTime:   bpr.TripEndTime,
 		BlockNumber:   bpr.BlockNumber,
+		ServiceDate:   serviceDate,
+	}
+}
+
+// ReportAge is how old the report was when we retrieved it.
+func ReportAge(bpr BusPositionReport, retrievedAt time.Time, location *time.Location) (time.Duration, error) {
+	reportedAt, err := ParseReportTime(bpr.DateTime, location)
+	if err != nil {
+		return 0, err
 	}
+	return retrievedAt.Sub(reportedAt), nil
 }
 
-func logPosition(db *gorm.DB, bpr BusPositionReport, reportTime time.Time) {
-	var err error
-	trip := tripFromReport(bpr)
+// logPosition returns false if we had already stored this report from an
+// earlier snapshot.
+func logPosition(db *gorm.DB, agency string, tracker *position_quality.Tracker, registry *fleet.Batch, bpr BusPositionReport, reportTime time.Time, age time.Duration, sd ServiceDays) bool {
+	serviceDate, err := sd.ReportDate(bpr)
+	check(err)
+	trip := tripFromReport(bpr, serviceDate)
 	err = db.Where(TripInstance{TripID: trip.TripID, TripStartTime: trip.TripStartTime}).FirstOrCreate(&trip).Error
 	check(err)
+	if trip.ServiceDate == "" {
+		// loaded before we kept service dates
+		err = db.Model(&trip).Update("service_date", serviceDate).Error
+		check(err)
+	}
+	existing := BusPosition{}
+	if !db.Where("trip_instance_id = ? AND reported_at = ?", trip.ID, bpr.DateTime).First(&existing).RecordNotFound() {
+		err = db.Model(&existing).Updates(map[string]interface{}{
+			"last_retrieved_at": reportTime,
+			"times_seen":        existing.TimesSeen + 1,
+		}).Error
+		check(err)
+		return false
+	}
+	reportedAt, err := ParseReportTime(bpr.DateTime, sd.Location)
+	check(err)
 	bp := BusPosition{
-		RetrievedAt: reportTime,
-		ReportedAt:  bpr.DateTime,
+		RetrievedAt:      reportTime,
+		ReportedAt:       bpr.DateTime,
+		Lat:              bpr.Lat,
+		Lon:              bpr.Lon,
+		Deviation:        bpr.Deviation,
+		ReportAgeSeconds: age.Seconds(),
+		LastRetrievedAt:  reportTime,
+		TimesSeen:        1,
+		ServiceDate:      trip.ServiceDate,
+		Quality:          tracker.Check(bpr.VehicleID, position_quality.Fix{At: reportedAt, Lat: bpr.Lat, Lon: bpr.Lon}),
+	}
+	err = db.Model(&trip).Association("BusPositions").Append(bp).Error
+	check(err)
+	if bp.Quality != position_quality.Good {
+		// A glitch would throw off the fleet registry's distances.
+		return true
+	}
+	registry.Add(fleet.Observation{
+		Agency:      agency,
+		VehicleID:   bpr.VehicleID,
+		RouteID:     bpr.RouteID,
+		BlockID:     bpr.BlockNumber,
+		ServiceDate: trip.ServiceDate,
+		At:          reportedAt,
 		Lat:         bpr.Lat,
 		Lon:         bpr.Lon,
-		Deviation:   bpr.Deviation,
+	})
+	return true
+}
+
+// LoadSnapshot stores every new report in one snapshot file, with the ones
+// not on a trip as NonRevenuePositions, adds it to the fleet registry and
+// records how stale the snapshot was. sd.Location is where WMATA's DateTimes
+// are.
+func LoadSnapshot(db *gorm.DB, agency string, m BusPositionList, retrievedAt time.Time, sd ServiceDays) SnapshotStats {
+	stats := SnapshotStats{Agency: agency, RetrievedAt: retrievedAt, Reports: len(m.BusPositions)}
+	tracker, err := position_quality.LoadTracker(db, agency)
+	check(err)
+	var registry fleet.Batch
+	totalAge := 0.0
+	for _, bpr := range m.BusPositions {
+		age, err := ReportAge(bpr, retrievedAt, sd.Location)
+		check(err)
+		totalAge += age.Seconds()
+		if age.Seconds() > stats.MaxAgeSeconds {
+			stats.MaxAgeSeconds = age.Seconds()
+		}
+		if age > StaleAfter {
+			stats.StaleReports++
+		}
+		isNew := false
+		if IsNonRevenue(bpr) {
+			isNew = logNonRevenueReport(db, agency, tracker, &registry, bpr, retrievedAt, sd)
+		} else {
+			isNew = logPosition(db, agency, tracker, &registry, bpr, retrievedAt, age, sd)
+		}
+		if isNew {
+			stats.NewReports++
+		}
 	}
-	err = db.Model(&trip).Association("BusPositions").Append(bp).Error
+	if stats.Reports > 0 {
+		stats.MeanAgeSeconds = totalAge / float64(stats.Reports)
+	}
+	check(position_quality.SaveTracker(db, tracker))
+	check(registry.Save(db))
+	// Loading the same file twice replaces its stats.
+	err = db.Unscoped().Where("agency = ? AND retrieved_at = ?", agency, retrievedAt).Delete(SnapshotStats{}).Error
+	check(err)
+	err = db.Create(&stats).Error
 	check(err)
+	fmt.Printf("%d of %d reports were new and %d were stale.\n", stats.NewReports, stats.Reports, stats.StaleReports)
+	return stats
 }
 
 func subtractDayFromStartTime(bpr BusPositionReport, startTime time.Time) BusPositionReport {
@@ -4,6 +4,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/fleet"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
 	"gotest.tools/v3/assert"
 )
 
@@ -80,3 +84,128 @@ func TestFixBadTripDataAfterMidnight(t *testing.T) {
 //	_, isBad = fixBadTripData(fixed, location)
 //	assert.Equal(t, isBad, false)
 //}
+
+func TestReportAge(t *testing.T) {
+	location := getTimeZone()
+	filename := "test_data/buses2019-04-27T03:55:01.json"
+	m := ParseFile(filename)
+	age, err := ReportAge(m.BusPositions[0], FileTime(filename), location)
+	assert.NilError(t, err)
+	assert.Equal(t, age, 15*time.Second)
+}
+
+func TestLoadSnapshotDeduplicates(t *testing.T) {
+	location := getTimeZone()
+	db, err := gorm.Open("sqlite3", ":memory:")
+	check(err)
+	defer db.Close()
+	Migrate(db)
+
+	filename := "test_data/buses2019-04-27T03:55:01.json"
+	m := ParseFile(filename)
+	retrievedAt := FileTime(filename)
+	sd := ServiceDays{Location: location, RolloverHour: 4}
+	stats := LoadSnapshot(db, "wmatabus", m, retrievedAt, sd)
+	assert.Equal(t, stats.Reports, 2)
+	assert.Equal(t, stats.NewReports, 2)
+	assert.Equal(t, stats.StaleReports, 0)
+
+	// The next snapshot has the same reports, as if both buses went quiet.
+	later := retrievedAt.Add(5 * time.Minute)
+	stats = LoadSnapshot(db, "wmatabus", m, later, sd)
+	assert.Equal(t, stats.NewReports, 0)
+	assert.Equal(t, stats.StaleReports, 2)
+	assert.Assert(t, stats.MaxAgeSeconds > 300)
+
+	var positions []BusPosition
+	db.Order("id").Find(&positions)
+	assert.Equal(t, len(positions), 2)
+	assert.Equal(t, positions[0].TimesSeen, 2)
+	assert.Equal(t, positions[0].RetrievedAt, retrievedAt)
+	assert.Equal(t, positions[0].LastRetrievedAt.Unix(), later.Unix())
+	assert.Equal(t, positions[0].ReportAgeSeconds, 15.0)
+
+	var count int
+	db.Model(&SnapshotStats{}).Where("agency = ?", "wmatabus").Count(&count)
+	assert.Equal(t, count, 2)
+}
+
+func TestMigrateSnapshotStats(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	check(err)
+	defer db.Close()
+	// the table as it was before it had an agency
+	check(db.Exec("CREATE TABLE snapshot_stats (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime, retrieved_at datetime, reports integer)").Error)
+	check(db.Exec("CREATE UNIQUE INDEX uix_snapshot_stats_retrieved_at ON snapshot_stats(retrieved_at)").Error)
+	retrievedAt := time.Date(2019, 4, 27, 3, 55, 1, 0, time.UTC)
+	check(db.Exec("INSERT INTO snapshot_stats (retrieved_at, reports) VALUES (?, 2)", retrievedAt).Error)
+
+	Migrate(db)
+	var stats SnapshotStats
+	check(db.First(&stats).Error)
+	assert.Equal(t, stats.Agency, "wmatabus")
+	// Another agency can have a snapshot from the same second.
+	assert.NilError(t, db.Create(&SnapshotStats{Agency: "mtabus", RetrievedAt: retrievedAt}).Error)
+	assert.Assert(t, db.Create(&SnapshotStats{Agency: "mtabus", RetrievedAt: retrievedAt}).Error != nil)
+}
+
+func TestLoadSnapshotNonRevenue(t *testing.T) {
+	location := getTimeZone()
+	db, err := gorm.Open("sqlite3", ":memory:")
+	check(err)
+	defer db.Close()
+	Migrate(db)
+
+	filename := "test_data/buses2019-04-27T03:55:01.json"
+	m := ParseFile(filename)
+	// the second bus is deadheading
+	m.BusPositions[1].TripID = ""
+	m.BusPositions[1].TripStartTime = ""
+	retrievedAt := FileTime(filename)
+	sd := ServiceDays{Location: location, RolloverHour: 4}
+	stats := LoadSnapshot(db, "wmatabus", m, retrievedAt, sd)
+	assert.Equal(t, stats.NewReports, 2)
+	stats = LoadSnapshot(db, "wmatabus", m, retrievedAt.Add(time.Minute), sd)
+	assert.Equal(t, stats.NewReports, 0)
+
+	var count int
+	db.Model(&TripInstance{}).Count(&count)
+	assert.Equal(t, count, 1)
+	var positions []NonRevenuePosition
+	db.Find(&positions)
+	assert.Equal(t, len(positions), 1)
+	assert.Equal(t, positions[0].VehicleID, m.BusPositions[1].VehicleID)
+	assert.Equal(t, positions[0].ServiceDate, "2019-04-26")
+	assert.Equal(t, positions[0].TimesSeen, 2)
+
+	// It still counts toward the bus's day in the fleet registry.
+	var vehicle fleet.Vehicle
+	assert.NilError(t, db.Where("vehicle_id = ?", positions[0].VehicleID).First(&vehicle).Error)
+	assert.Equal(t, vehicle.DaysActive, 1)
+	assert.Equal(t, vehicle.Routes, "")
+}
+
+func TestLoadSnapshotQuality(t *testing.T) {
+	location := getTimeZone()
+	db, err := gorm.Open("sqlite3", ":memory:")
+	check(err)
+	defer db.Close()
+	Migrate(db)
+
+	filename := "test_data/buses2019-04-27T03:55:01.json"
+	m := ParseFile(filename)
+	m.BusPositions[1].Lat, m.BusPositions[1].Lon = 0, 0
+	LoadSnapshot(db, "wmatabus", m, FileTime(filename), ServiceDays{Location: location, RolloverHour: 4})
+
+	var positions []BusPosition
+	db.Order("id").Find(&positions)
+	assert.Equal(t, len(positions), 2)
+	assert.Equal(t, positions[0].Quality, position_quality.Good)
+	assert.Equal(t, positions[1].Quality, position_quality.ZeroCoordinates)
+	db.Scopes(position_quality.GoodPositions).Find(&positions)
+	assert.Equal(t, len(positions), 1)
+	// The glitch stays out of the fleet registry.
+	var count int
+	db.Model(&fleet.Vehicle{}).Count(&count)
+	assert.Equal(t, count, 1)
+}
@@ -0,0 +1,92 @@
+package bus_positions
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/fleet"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
+)
+
+// A NonRevenuePosition is a report from a bus that isn't on a revenue trip:
+// pulling out of the garage, deadheading between trips, pulling in or parked.
+// WMATA gives these a blank TripID and Clever a headsign like "Not in
+// Service". We keep them out of TripInstance, where every one of them would
+// be merged into one meaningless trip.
+type NonRevenuePosition struct {
+	gorm.Model
+	Agency      string    `gorm:"unique_index:idx_non_revenue_report"`
+	VehicleID   string    `gorm:"unique_index:idx_non_revenue_report"`
+	ReportedAt  time.Time `gorm:"unique_index:idx_non_revenue_report"`
+	ServiceDate string    `gorm:"index"`
+	Lat         float64
+	Lon         float64
+	// Some feeds still say which route or block the bus is about to run.
+	RouteID         string
+	BlockID         string
+	HeadSign        string
+	RetrievedAt     time.Time
+	LastRetrievedAt time.Time
+	TimesSeen       int
+	// a position_quality flag, blank if it passed every check
+	Quality string
+}
+
+// IsNonRevenue says whether WMATA sent the report for a bus that isn't on a
+// trip.
+func IsNonRevenue(bpr BusPositionReport) bool {
+	return bpr.TripID == ""
+}
+
+// LogNonRevenue checks a non-revenue position, stores it and adds it to the
+// registry batch if it's good. It returns false if we had already stored it
+// from an earlier snapshot.
+func LogNonRevenue(db *gorm.DB, tracker *position_quality.Tracker, registry *fleet.Batch, p NonRevenuePosition) (bool, error) {
+	existing := NonRevenuePosition{}
+	key := NonRevenuePosition{Agency: p.Agency, VehicleID: p.VehicleID, ReportedAt: p.ReportedAt}
+	if !db.Where(key).First(&existing).RecordNotFound() {
+		err := db.Model(&existing).Updates(map[string]interface{}{
+			"last_retrieved_at": p.RetrievedAt,
+			"times_seen":        existing.TimesSeen + 1,
+		}).Error
+		return false, err
+	}
+	p.LastRetrievedAt, p.TimesSeen = p.RetrievedAt, 1
+	p.Quality = tracker.Check(p.VehicleID, position_quality.Fix{At: p.ReportedAt, Lat: p.Lat, Lon: p.Lon})
+	if err := db.Create(&p).Error; err != nil {
+		return false, err
+	}
+	if p.Quality != position_quality.Good {
+		return true, nil
+	}
+	// No RouteID, because the bus wasn't carrying anyone on the route.
+	registry.Add(fleet.Observation{
+		Agency:      p.Agency,
+		VehicleID:   p.VehicleID,
+		BlockID:     p.BlockID,
+		ServiceDate: p.ServiceDate,
+		At:          p.ReportedAt,
+		Lat:         p.Lat,
+		Lon:         p.Lon,
+	})
+	return true, nil
+}
+
+func logNonRevenueReport(db *gorm.DB, agency string, tracker *position_quality.Tracker, registry *fleet.Batch, bpr BusPositionReport, retrievedAt time.Time, sd ServiceDays) bool {
+	reportedAt, err := ParseReportTime(bpr.DateTime, sd.Location)
+	check(err)
+	isNew, err := LogNonRevenue(db, tracker, registry, NonRevenuePosition{
+		Agency:      agency,
+		VehicleID:   bpr.VehicleID,
+		ReportedAt:  reportedAt,
+		ServiceDate: sd.DateOf(reportedAt),
+		Lat:         bpr.Lat,
+		Lon:         bpr.Lon,
+		RouteID:     bpr.RouteID,
+		BlockID:     bpr.BlockNumber,
+		HeadSign:    bpr.TripHeadSign,
+		RetrievedAt: retrievedAt,
+	})
+	check(err)
+	return isNew
+}
@@ -0,0 +1,231 @@
+package bus_positions
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// get_bus_positions used to name files by whatever clock the machine had,
+// like buses2019-04-27T03:55:01.json. Now it names them in UTC with a Z, like
+// buses2019-04-27T03:55:01Z.json, and a name with a Z or an offset means
+// exactly what it says.
+const explicitFileTimeFormat = "2006-01-02T15:04:05Z07:00"
+
+var fileTimeRegexp = regexp.MustCompile(`/buses(....-..-..T..:..:..(?:Z|[+-]..:..)?)\.json`)
+
+// AgencyTimezones is the clock each agency's poller named its legacy files
+// by. Everything we've checked was UTC: the names in test_data match the
+// GTFS-RT header timestamps and come a few seconds after the reports' local
+// DateTimes. UTC never repeats an hour, so for now no name is Ambiguous and
+// ResolveAmbiguous, RetrievedAt's directory scan and replay's Index.resolve
+// never have anything to do. They're for an agency we find whose poller ran
+// on local time.
+var AgencyTimezones = map[string]string{
+	"wmatabus": "UTC",
+	"mtabus":   "UTC",
+	"clever":   "UTC",
+}
+
+// AgencyLocation is the location to read the agency's legacy filenames in.
+func AgencyLocation(agency string) (*time.Location, error) {
+	tz, ok := AgencyTimezones[agency]
+	if !ok {
+		return nil, fmt.Errorf("we don't know what time zone %s's filenames are in", agency)
+	}
+	return time.LoadLocation(tz)
+}
+
+// RetrievalTime is when a snapshot was saved, going by its filename.
+type RetrievalTime struct {
+	Time time.Time
+	// the name had a Z or an offset
+	Explicit bool
+	// The clocks went back, so this wall time happened twice and the snapshot
+	// could be from either. Time is the first and Later is the second.
+	Ambiguous bool
+	Later     time.Time
+}
+
+// ParseRetrievalTime reads the time part of a filename, like
+// 2019-04-27T03:55:01Z. Legacy times without an offset are read in location.
+func ParseRetrievalTime(s string, location *time.Location) (RetrievalTime, error) {
+	if len(s) > len(timeFormat) {
+		t, err := time.Parse(explicitFileTimeFormat, s)
+		return RetrievalTime{Time: t.UTC(), Explicit: true}, err
+	}
+	t, err := time.ParseInLocation(timeFormat, s, location)
+	if err != nil {
+		return RetrievalTime{}, err
+	}
+	// Try the offsets from a day either side. Both fit if the wall time
+	// happened twice.
+	var readings []time.Time
+	wall, _ := time.Parse(timeFormat, s)
+	for _, neighbor := range []time.Time{t.AddDate(0, 0, -1), t.AddDate(0, 0, 1)} {
+		_, offset := neighbor.Zone()
+		u := wall.Add(-time.Duration(offset) * time.Second)
+		if u.In(location).Format(timeFormat) != s {
+			continue
+		}
+		if len(readings) == 0 || !u.Equal(readings[0]) {
+			readings = append(readings, u.UTC())
+		}
+	}
+	if len(readings) < 2 {
+		return RetrievalTime{Time: t.UTC()}, nil
+	}
+	if readings[1].Before(readings[0]) {
+		readings[0], readings[1] = readings[1], readings[0]
+	}
+	return RetrievalTime{Time: readings[0], Ambiguous: true, Later: readings[1]}, nil
+}
+
+// FileRetrievalTime reads the time from a jBusPositions filename.
+func FileRetrievalTime(filePath string, location *time.Location) (RetrievalTime, error) {
+	result := fileTimeRegexp.FindStringSubmatch(filePath)
+	if result == nil {
+		return RetrievalTime{}, fmt.Errorf("could not parse time from %s", filePath)
+	}
+	return ParseRetrievalTime(result[1], location)
+}
+
+// Fingerprint is which trip each vehicle was on in one snapshot. Snapshots a
+// minute apart have nearly the same one and snapshots an hour apart don't.
+func Fingerprint(m BusPositionList) map[string]string {
+	output := make(map[string]string, len(m.BusPositions))
+	for _, bpr := range m.BusPositions {
+		output[bpr.VehicleID] = bpr.TripID
+	}
+	return output
+}
+
+// similarity is the share of vehicles in either snapshot that are on the same
+// trip in both.
+func similarity(a, b map[string]string) float64 {
+	union := len(b)
+	shared := 0
+	for vehicle, trip := range a {
+		other, ok := b[vehicle]
+		if !ok {
+			union++
+		} else if other == trip {
+			shared++
+		}
+	}
+	if union == 0 {
+		return 0
+	}
+	return float64(shared) / float64(union)
+}
+
+// ResolveAmbiguous picks a reading for every ambiguous time. times must be in
+// filename order, which puts both passes through the repeated hour between
+// the last snapshot before it and the first one after it. A snapshot from the
+// first pass is always closer in time to the one before, and one from the
+// second pass to the one after, so each goes with whichever neighbor it looks
+// more like. When that doesn't help we take the later reading, because the
+// poller overwrote any file whose name came up a second time.
+func ResolveAmbiguous(times []RetrievalTime, fingerprint func(i int) (map[string]string, error)) ([]time.Time, error) {
+	output := make([]time.Time, len(times))
+	fingerprints := make(map[int]map[string]string)
+	get := func(i int) (map[string]string, error) {
+		if i < 0 || i >= len(times) {
+			return nil, nil
+		}
+		if fp, ok := fingerprints[i]; ok {
+			return fp, nil
+		}
+		fp, err := fingerprint(i)
+		fingerprints[i] = fp
+		return fp, err
+	}
+	for i := 0; i < len(times); i++ {
+		if !times[i].Ambiguous {
+			output[i] = times[i].Time
+			continue
+		}
+		end := i
+		for end < len(times) && times[end].Ambiguous {
+			end++
+		}
+		before, err := get(i - 1)
+		if err != nil {
+			return nil, err
+		}
+		after, err := get(end)
+		if err != nil {
+			return nil, err
+		}
+		for ; i < end; i++ {
+			fp, err := get(i)
+			if err != nil {
+				return nil, err
+			}
+			if similarity(fp, before) > similarity(fp, after) {
+				output[i] = times[i].Time
+			} else {
+				output[i] = times[i].Later
+			}
+		}
+		i--
+	}
+	return output, nil
+}
+
+func readList(filePath string) (BusPositionList, error) {
+	var m BusPositionList
+	b, err := ioutil.ReadFile(filePath)
+	if err == nil {
+		err = json.Unmarshal(b, &m)
+	}
+	return m, err
+}
+
+// RetrievedAt is when the poller saved a jBusPositions file. If the name is
+// ambiguous it looks at the other snapshots in the same directory to decide.
+func RetrievedAt(filePath string, location *time.Location) (time.Time, error) {
+	rt, err := FileRetrievalTime(filePath, location)
+	if err != nil || !rt.Ambiguous {
+		return rt.Time, err
+	}
+	dir := filepath.Dir(filePath)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var names []string
+	var times []RetrievalTime
+	mine := -1
+	// ReadDir sorts by name.
+	for _, info := range infos {
+		other, err := FileRetrievalTime("/"+info.Name(), location)
+		if err != nil {
+			continue
+		}
+		if info.Name() == filepath.Base(filePath) {
+			mine = len(names)
+		}
+		names = append(names, filepath.Join(dir, info.Name()))
+		times = append(times, other)
+	}
+	if mine < 0 {
+		return time.Time{}, fmt.Errorf("%s is not in %s", filePath, dir)
+	}
+	resolved, err := ResolveAmbiguous(times, func(i int) (map[string]string, error) {
+		// A corrupt neighbor just doesn't look like anything.
+		m, err := readList(names[i])
+		if err != nil {
+			fmt.Printf("Can't compare %s to its neighbors: %s\n", names[i], err)
+			return nil, nil
+		}
+		return Fingerprint(m), nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return resolved[mine], nil
+}
@@ -0,0 +1,103 @@
+package bus_positions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func utc(hour int, minute int, second int) time.Time {
+	return time.Date(2019, 11, 3, hour, minute, second, 0, time.UTC)
+}
+
+func TestParseRetrievalTime(t *testing.T) {
+	location := getTimeZone()
+	rt, err := ParseRetrievalTime("2019-11-03T05:30:01Z", location)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rt, RetrievalTime{Time: utc(5, 30, 1), Explicit: true})
+	rt, err = ParseRetrievalTime("2019-11-03T01:30:01-05:00", location)
+	assert.NilError(t, err)
+	assert.Equal(t, rt.Time, utc(6, 30, 1))
+
+	// Legacy names are in whatever zone we say.
+	rt, err = ParseRetrievalTime("2019-11-03T05:30:01", time.UTC)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rt, RetrievalTime{Time: utc(5, 30, 1)})
+	rt, err = ParseRetrievalTime("2019-11-03T00:59:01", location)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rt, RetrievalTime{Time: utc(4, 59, 1)})
+
+	// The clocks went back at 2am, so 1:30 happened twice.
+	rt, err = ParseRetrievalTime("2019-11-03T01:30:01", location)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rt, RetrievalTime{Time: utc(5, 30, 1), Ambiguous: true, Later: utc(6, 30, 1)})
+	rt, err = ParseRetrievalTime("2019-11-03T02:00:01", location)
+	assert.NilError(t, err)
+	assert.Assert(t, !rt.Ambiguous)
+
+	_, err = ParseRetrievalTime("2019-11-03 01:30:01", location)
+	assert.Assert(t, err != nil)
+}
+
+func TestFileTime(t *testing.T) {
+	assert.Equal(t, FileTime("6/buses2019-03-26T23:28:01.json"), time.Date(2019, 3, 26, 23, 28, 1, 0, time.UTC))
+	assert.Equal(t, FileTime("6/buses2019-11-03T01:30:01-05:00.json"), utc(6, 30, 1))
+	_, err := FileRetrievalTime("6/gtfsrt-vp-2019-03-26T23:28:01.pb", time.UTC)
+	assert.ErrorContains(t, err, "could not parse time")
+}
+
+func TestResolveAmbiguous(t *testing.T) {
+	location := getTimeZone()
+	var times []RetrievalTime
+	for _, name := range []string{"2019-11-03T00:59:01", "2019-11-03T01:30:01", "2019-11-03T01:30:31", "2019-11-03T01:59:01", "2019-11-03T02:00:01"} {
+		rt, err := ParseRetrievalTime(name, location)
+		assert.NilError(t, err)
+		times = append(times, rt)
+	}
+	fingerprints := []map[string]string{
+		{"2001": "A", "2002": "B"},
+		// still on the same trips as at 00:59
+		{"2001": "A", "2002": "B"},
+		// the trips from after 2am
+		{"2002": "C", "2003": "D"},
+		// nobody out, so no help
+		{},
+		{"2002": "C", "2003": "D"},
+	}
+	var asked []int
+	resolved, err := ResolveAmbiguous(times, func(i int) (map[string]string, error) {
+		asked = append(asked, i)
+		return fingerprints[i], nil
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, resolved, []time.Time{utc(4, 59, 1), utc(5, 30, 1), utc(6, 30, 31), utc(6, 59, 1), utc(7, 0, 1)})
+	assert.DeepEqual(t, asked, []int{0, 4, 1, 2, 3})
+}
+
+func TestRetrievedAt(t *testing.T) {
+	location := getTimeZone()
+	dir, err := ioutil.TempDir("", "retrieval_time")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	for name, body := range map[string]string{
+		"buses2019-11-03T00:59:01.json": `{"BusPositions":[{"VehicleID":"2001","TripID":"A"}]}`,
+		"buses2019-11-03T01:00:01.json": `{"BusPositions":[{"VehicleID":"2001","TripID":"A"}]}`,
+		"buses2019-11-03T01:00:31.json": `{"BusPositions":[{"VehicleID":"2001","TripID":"C"}]}`,
+		"buses2019-11-03T02:00:01.json": `{"BusPositions":[{"VehicleID":"2001","TripID":"C"}]}`,
+	} {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644))
+	}
+	retrievedAt, err := RetrievedAt(filepath.Join(dir, "buses2019-11-03T01:00:01.json"), location)
+	assert.NilError(t, err)
+	assert.Equal(t, retrievedAt, utc(5, 0, 1))
+	retrievedAt, err = RetrievedAt(filepath.Join(dir, "buses2019-11-03T01:00:31.json"), location)
+	assert.NilError(t, err)
+	assert.Equal(t, retrievedAt, utc(6, 0, 31))
+	retrievedAt, err = RetrievedAt(filepath.Join(dir, "buses2019-11-03T02:00:01.json"), location)
+	assert.NilError(t, err)
+	assert.Equal(t, retrievedAt, utc(7, 0, 1))
+}
@@ -0,0 +1,194 @@
+package bus_positions
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ServiceDateFormat is how we write service dates. GTFS writes them without
+// the dashes.
+const ServiceDateFormat = "2006-01-02"
+
+// AgencyRolloverHours is the local hour each agency's service day starts at.
+// Anything before it belongs to the day before, which is why GTFS has times
+// like 25:10:00. Metrobus runs owl trips until after 3am; Centro's last buses
+// are in by 1.
+var AgencyRolloverHours = map[string]int{
+	"wmatabus": 4,
+	"mtabus":   4,
+	"clever":   3,
+}
+
+// ServiceDays says which service day a moment belongs to.
+type ServiceDays struct {
+	Location     *time.Location
+	RolloverHour int
+}
+
+// AgencyServiceDays uses the agency's rollover hour. location is where the
+// agency's local times are.
+func AgencyServiceDays(agency string, location *time.Location) (ServiceDays, error) {
+	hour, ok := AgencyRolloverHours[agency]
+	if !ok {
+		return ServiceDays{}, fmt.Errorf("we don't know when %s's service day starts", agency)
+	}
+	return ServiceDays{Location: location, RolloverHour: hour}, nil
+}
+
+// Start is what GTFS times on the date are relative to: noon minus 12 hours,
+// which is midnight except on days when the clocks change.
+func (sd ServiceDays) Start(date string) (time.Time, error) {
+	day, err := time.ParseInLocation(ServiceDateFormat, date, sd.Location)
+	if err != nil {
+		return time.Time{}, err
+	}
+	noon := time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, sd.Location)
+	return noon.Add(-12 * time.Hour), nil
+}
+
+// GTFSTime is the moment a GTFS time like 25:10:00, in seconds, means on the
+// date.
+func (sd ServiceDays) GTFSTime(date string, seconds int) (time.Time, error) {
+	start, err := sd.Start(date)
+	return start.Add(time.Duration(seconds) * time.Second), err
+}
+
+// DateOf is the service date t falls in, going by the clock alone.
+func (sd ServiceDays) DateOf(t time.Time) string {
+	local := t.In(sd.Location)
+	if local.Hour() < sd.RolloverHour {
+		local = local.AddDate(0, 0, -1)
+	}
+	return local.Format(ServiceDateFormat)
+}
+
+// FeedDate is the service date of a GTFS-RT entity: its trip's start_date,
+// YYYYMMDD, if it has one, and otherwise whenever the feed was retrieved.
+func (sd ServiceDays) FeedDate(startDate string, retrievedAt time.Time) string {
+	if t, err := time.Parse("20060102", startDate); err == nil {
+		return t.Format(ServiceDateFormat)
+	}
+	return sd.DateOf(retrievedAt)
+}
+
+// Hour is how many hours into the date's service day t is, so 1am the next
+// morning is hour 25, like in GTFS.
+func (sd ServiceDays) Hour(date string, t time.Time) (int, error) {
+	start, err := sd.Start(date)
+	if err != nil {
+		return 0, err
+	}
+	hour := int(t.Sub(start) / time.Hour)
+	if hour < 0 {
+		hour = 0
+	}
+	return hour, nil
+}
+
+// TripDate is the service date of a trip that starts at tripStart and was
+// seen at seenAt. WMATA's TripStartTime sometimes has the wrong calendar day
+// (see fixBadTripData), so we only trust its time of day: it's the service
+// day, out of the one around seenAt and the ones either side, where that
+// start time comes closest to seenAt.
+func (sd ServiceDays) TripDate(tripStart time.Time, seenAt time.Time) string {
+	local := tripStart.In(sd.Location)
+	seconds := local.Hour()*3600 + local.Minute()*60 + local.Second()
+	if local.Hour() < sd.RolloverHour {
+		seconds += 24 * 3600
+	}
+	seen, _ := time.ParseInLocation(ServiceDateFormat, sd.DateOf(seenAt), sd.Location)
+	var best string
+	var bestDistance time.Duration
+	for _, days := range []int{-1, 0, 1} {
+		date := seen.AddDate(0, 0, days).Format(ServiceDateFormat)
+		start, err := sd.GTFSTime(date, seconds)
+		check(err)
+		distance := seenAt.Sub(start)
+		if distance < 0 {
+			distance = -distance
+		}
+		if best == "" || distance < bestDistance {
+			best, bestDistance = date, distance
+		}
+	}
+	return best
+}
+
+// ReportDate is the service date of one jBusPositions report: its trip's, or
+// if it isn't on a trip, whenever it was reported.
+func (sd ServiceDays) ReportDate(bpr BusPositionReport) (string, error) {
+	reportedAt, err := ParseReportTime(bpr.DateTime, sd.Location)
+	if err != nil {
+		return "", err
+	}
+	if bpr.TripID == "" || bpr.TripStartTime == "" {
+		return sd.DateOf(reportedAt), nil
+	}
+	tripStart, err := ParseReportTime(bpr.TripStartTime, sd.Location)
+	if err != nil {
+		return "", err
+	}
+	return sd.TripDate(tripStart, reportedAt), nil
+}
+
+// BackfillServiceDates fills in the service date of trips and positions
+// loaded before we had one, going by each trip's earliest position. The
+// loader runs it once each time it starts, and after the first time there's
+// nothing left for it to do.
+func BackfillServiceDates(db *gorm.DB, sd ServiceDays) error {
+	var trips []TripInstance
+	if err := db.Where("service_date = '' OR service_date IS NULL").Find(&trips).Error; err != nil {
+		return err
+	}
+	for _, trip := range trips {
+		var first BusPosition
+		if db.Where("trip_instance_id = ?", trip.ID).Order("reported_at").First(&first).RecordNotFound() {
+			continue
+		}
+		date, err := sd.ReportDate(BusPositionReport{TripID: trip.TripID, TripStartTime: trip.TripStartTime, DateTime: first.ReportedAt})
+		if err != nil {
+			return err
+		}
+		if err = db.Model(&trip).Update("service_date", date).Error; err != nil {
+			return err
+		}
+		err = db.Model(&BusPosition{}).Where("trip_instance_id = ?", trip.ID).Update("service_date", date).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TripsOnServiceDates finds every trip on the service dates from start to
+// end, YYYY-MM-DD.
+func TripsOnServiceDates(db *gorm.DB, sd ServiceDays, start string, end string) ([]TripInstance, error) {
+	var trips []TripInstance
+	err := db.Where("service_date >= ? AND service_date <= ?", start, end).Order("trip_start_time").Find(&trips).Error
+	return trips, err
+}
+
+// A TripSpan is when we first and last heard from a trip, going by its
+// positions' DateTimes.
+type TripSpan struct {
+	TripInstanceID uint
+	FirstReported  string
+	LastReported   string
+	Positions      int
+}
+
+// TripSpans finds the span of every trip with positions on a service date,
+// keyed by trip instance ID.
+func TripSpans(db *gorm.DB, date string) (map[uint]TripSpan, error) {
+	var spans []TripSpan
+	err := db.Model(&BusPosition{}).
+		Select("trip_instance_id, min(reported_at) AS first_reported, max(reported_at) AS last_reported, count(*) AS positions").
+		Where("service_date = ?", date).Group("trip_instance_id").Scan(&spans).Error
+	output := make(map[uint]TripSpan, len(spans))
+	for _, span := range spans {
+		output[span.TripInstanceID] = span
+	}
+	return output, err
+}
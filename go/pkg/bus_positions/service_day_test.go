@@ -0,0 +1,92 @@
+package bus_positions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"gotest.tools/v3/assert"
+)
+
+func TestServiceDays(t *testing.T) {
+	location := getTimeZone()
+	sd := ServiceDays{Location: location, RolloverHour: 4}
+	assert.Equal(t, sd.DateOf(time.Date(2019, 4, 27, 3, 59, 0, 0, location)), "2019-04-26")
+	assert.Equal(t, sd.DateOf(time.Date(2019, 4, 27, 4, 0, 0, 0, location)), "2019-04-27")
+	assert.Equal(t, sd.FeedDate("20190425", time.Date(2019, 4, 27, 4, 0, 0, 0, location)), "2019-04-25")
+	assert.Equal(t, sd.FeedDate("", time.Date(2019, 4, 27, 4, 0, 0, 0, location)), "2019-04-27")
+
+	// 25:10:00 on the 26th is 1:10 the next morning
+	gtfsTime, err := sd.GTFSTime("2019-04-26", 25*3600+10*60)
+	assert.NilError(t, err)
+	assert.Equal(t, gtfsTime, time.Date(2019, 4, 27, 1, 10, 0, 0, location))
+	hour, err := sd.Hour("2019-04-26", gtfsTime)
+	assert.NilError(t, err)
+	assert.Equal(t, hour, 25)
+
+	// The clocks went back at 2am, so GTFS times that day start at 1am, the
+	// first time it was 1am.
+	start, err := sd.Start("2019-11-03")
+	assert.NilError(t, err)
+	assert.Assert(t, start.Equal(time.Date(2019, 11, 3, 5, 0, 0, 0, time.UTC)))
+}
+
+func TestTripDate(t *testing.T) {
+	location := getTimeZone()
+	sd := ServiceDays{Location: location, RolloverHour: 4}
+	// An owl trip that left at 1:30am is seen at 1:45am: that's still the
+	// service day before.
+	seen := time.Date(2019, 4, 27, 1, 45, 0, 0, location)
+	assert.Equal(t, sd.TripDate(time.Date(2019, 4, 27, 1, 30, 0, 0, location), seen), "2019-04-26")
+	// A trip that left at 11pm is seen after midnight.
+	assert.Equal(t, sd.TripDate(time.Date(2019, 4, 27, 23, 0, 0, 0, location), seen), "2019-04-26")
+	// A trip leaving at 4:15 is an early one on the next service day, even
+	// though we saw it going into service 40 minutes before.
+	early := time.Date(2019, 4, 27, 3, 35, 0, 0, location)
+	assert.Equal(t, sd.TripDate(time.Date(2019, 4, 20, 4, 15, 0, 0, location), early), "2019-04-27")
+
+	m := ParseFile("test_data/buses2019-04-27T03:55:01.json")
+	for _, bpr := range m.BusPositions {
+		date, err := sd.ReportDate(bpr)
+		assert.NilError(t, err)
+		assert.Equal(t, date, "2019-04-26")
+	}
+}
+
+func TestTripsOnServiceDates(t *testing.T) {
+	location := getTimeZone()
+	sd := ServiceDays{Location: location, RolloverHour: 4}
+	db, err := gorm.Open("sqlite3", ":memory:")
+	check(err)
+	defer db.Close()
+	Migrate(db)
+
+	filename := "test_data/buses2019-04-27T03:55:01.json"
+	LoadSnapshot(db, "wmatabus", ParseFile(filename), FileTime(filename), sd)
+	// pretend these were loaded before we kept service dates
+	db.Model(&TripInstance{}).Update("service_date", "")
+	db.Model(&BusPosition{}).Update("service_date", "")
+	trips, err := TripsOnServiceDates(db, sd, "2019-04-26", "2019-04-26")
+	assert.NilError(t, err)
+	assert.Equal(t, len(trips), 0)
+
+	assert.NilError(t, BackfillServiceDates(db, sd))
+	trips, err = TripsOnServiceDates(db, sd, "2019-04-27", "2019-04-27")
+	assert.NilError(t, err)
+	assert.Equal(t, len(trips), 0)
+	trips, err = TripsOnServiceDates(db, sd, "2019-04-26", "2019-04-26")
+	assert.NilError(t, err)
+	assert.Equal(t, len(trips), 2)
+	var positions []BusPosition
+	db.Where("service_date = ?", "2019-04-26").Find(&positions)
+	assert.Equal(t, len(positions), 2)
+
+	spans, err := TripSpans(db, "2019-04-26")
+	assert.NilError(t, err)
+	assert.Equal(t, len(spans), 2)
+	span := spans[trips[0].ID]
+	assert.Equal(t, span.Positions, 1)
+	assert.Equal(t, span.FirstReported, positions[0].ReportedAt)
+	assert.Equal(t, span.LastReported, positions[0].ReportedAt)
+}
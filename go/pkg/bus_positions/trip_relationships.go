@@ -0,0 +1,150 @@
+package bus_positions
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_realtime"
+)
+
+// SkippedStops is the Relationship we record for a stop a trip update says
+// the trip will skip.
+const SkippedStops = "SKIPPED"
+
+// A TripRelationship is one thing GTFS-RT TripUpdates told us about a trip on
+// a service date, like that it was CANCELED, and when it first and last said
+// so. We don't record SCHEDULED, which is nearly every trip, unless we've
+// already recorded something else for the trip; then it means the trip was
+// put back.
+type TripRelationship struct {
+	gorm.Model
+	ServiceDate string `gorm:"unique_index:idx_trip_relationship"`
+	TripID      string `gorm:"unique_index:idx_trip_relationship"`
+	// a TripScheduleRelationship like CANCELED or ADDED, or SkippedStops
+	Relationship string `gorm:"unique_index:idx_trip_relationship"`
+	// the skipped stop, for SkippedStops
+	StopID        string `gorm:"unique_index:idx_trip_relationship"`
+	RouteID       string
+	FirstAsserted time.Time
+	LastAsserted  time.Time
+	// how many snapshots said so
+	Snapshots int
+	// These are filled in by ReconcileTripRelationships. TripInstanceID is 0
+	// if the trip never showed up in jBusPositions.
+	TripInstanceID uint `gorm:"index"`
+	Observed       bool
+	// positions we got for the trip after FirstAsserted, which for a
+	// cancelled trip means it probably ran after all
+	PositionsAfterAsserted int
+	ReconciledAt           *time.Time
+}
+
+func assertRelationship(db *gorm.DB, r TripRelationship, assertedAt time.Time) error {
+	key := TripRelationship{ServiceDate: r.ServiceDate, TripID: r.TripID, Relationship: r.Relationship, StopID: r.StopID}
+	existing := key
+	if db.Where(key).First(&existing).RecordNotFound() {
+		r.FirstAsserted, r.LastAsserted, r.Snapshots = assertedAt, assertedAt, 1
+		return db.Create(&r).Error
+	}
+	updates := map[string]interface{}{"snapshots": existing.Snapshots + 1}
+	if assertedAt.Before(existing.FirstAsserted) {
+		updates["first_asserted"] = assertedAt
+	}
+	if assertedAt.After(existing.LastAsserted) {
+		updates["last_asserted"] = assertedAt
+	}
+	return db.Model(&existing).Updates(updates).Error
+}
+
+// LogTripUpdates records the schedule relationships in one TripUpdates
+// snapshot. It returns how many it recorded.
+func LogTripUpdates(db *gorm.DB, m gtfs_realtime.FeedMessage, retrievedAt time.Time, sd ServiceDays) (int, error) {
+	assertedAt := retrievedAt
+	if m.Header.Timestamp != 0 {
+		assertedAt = time.Unix(int64(m.Header.Timestamp), 0)
+	}
+	recorded := 0
+	for _, e := range m.Entities {
+		tu := e.TripUpdate
+		if tu == nil || e.IsDeleted || tu.Trip.TripID == "" {
+			continue
+		}
+		trip := TripRelationship{
+			ServiceDate:  sd.FeedDate(tu.Trip.StartDate, assertedAt),
+			TripID:       tu.Trip.TripID,
+			RouteID:      tu.Trip.RouteID,
+			Relationship: tu.Trip.ScheduleRelationship.String(),
+		}
+		if tu.Trip.ScheduleRelationship == gtfs_realtime.TripScheduled {
+			var count int
+			// Skipped stops don't count, because a trip that skips a stop was
+			// never taken away to be put back.
+			err := db.Model(&TripRelationship{}).Where("service_date = ? AND trip_id = ? AND relationship <> ?", trip.ServiceDate, trip.TripID, SkippedStops).Count(&count).Error
+			if err != nil {
+				return recorded, err
+			}
+			if count > 0 {
+				if err = assertRelationship(db, trip, assertedAt); err != nil {
+					return recorded, err
+				}
+				recorded++
+			}
+		} else {
+			if err := assertRelationship(db, trip, assertedAt); err != nil {
+				return recorded, err
+			}
+			recorded++
+		}
+		for _, u := range tu.StopTimeUpdates {
+			if u.ScheduleRelationship != gtfs_realtime.StopSkipped {
+				continue
+			}
+			skipped := trip
+			skipped.Relationship = SkippedStops
+			skipped.StopID = u.StopID
+			if err := assertRelationship(db, skipped, assertedAt); err != nil {
+				return recorded, err
+			}
+			recorded++
+		}
+	}
+	return recorded, nil
+}
+
+// ReconcileTripRelationships checks everything TripUpdates told us about
+// trips on a service date against what we saw in jBusPositions.
+func ReconcileTripRelationships(db *gorm.DB, date string) error {
+	var relationships []TripRelationship
+	if err := db.Where("service_date = ?", date).Find(&relationships).Error; err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, r := range relationships {
+		updates := map[string]interface{}{
+			"trip_instance_id":         uint(0),
+			"observed":                 false,
+			"positions_after_asserted": 0,
+			"reconciled_at":            now,
+		}
+		var trip TripInstance
+		if !db.Where("trip_id = ? AND service_date = ?", r.TripID, date).First(&trip).RecordNotFound() {
+			updates["trip_instance_id"] = trip.ID
+			var positions []BusPosition
+			if err := db.Where("trip_instance_id = ?", trip.ID).Find(&positions).Error; err != nil {
+				return err
+			}
+			updates["observed"] = len(positions) > 0
+			after := 0
+			for _, bp := range positions {
+				if bp.RetrievedAt.After(r.FirstAsserted) {
+					after++
+				}
+			}
+			updates["positions_after_asserted"] = after
+		}
+		if err := db.Model(&r).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
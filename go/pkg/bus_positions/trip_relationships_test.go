@@ -0,0 +1,77 @@
+package bus_positions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_realtime"
+	"gotest.tools/v3/assert"
+)
+
+func TestTripRelationships(t *testing.T) {
+	location := getTimeZone()
+	sd := ServiceDays{Location: location, RolloverHour: 4}
+	db, err := gorm.Open("sqlite3", ":memory:")
+	check(err)
+	defer db.Close()
+	Migrate(db)
+
+	// 914402060 is scheduled and 921172060 is cancelled.
+	m, err := gtfs_realtime.ParseFile("../gtfs_realtime/test_data/gtfsrt-tu-2019-04-27T03:55:01.pb")
+	assert.NilError(t, err)
+	retrievedAt := time.Date(2019, 4, 27, 3, 55, 1, 0, time.UTC)
+	recorded, err := LogTripUpdates(db, m, retrievedAt, sd)
+	assert.NilError(t, err)
+	assert.Equal(t, recorded, 1)
+	m.Header.Timestamp += 60
+	_, err = LogTripUpdates(db, m, retrievedAt.Add(time.Minute), sd)
+	assert.NilError(t, err)
+
+	// Then it's put back, and a stop on the other trip is skipped.
+	m.Header.Timestamp += 60
+	m.Entities[1].TripUpdate.Trip.ScheduleRelationship = gtfs_realtime.TripScheduled
+	m.Entities[0].TripUpdate.StopTimeUpdates[1].ScheduleRelationship = gtfs_realtime.StopSkipped
+	recorded, err = LogTripUpdates(db, m, retrievedAt.Add(2*time.Minute), sd)
+	assert.NilError(t, err)
+	assert.Equal(t, recorded, 2)
+
+	// The stop is still skipped, which doesn't make 914402060 a trip that was
+	// put back.
+	m.Header.Timestamp += 60
+	recorded, err = LogTripUpdates(db, m, retrievedAt.Add(3*time.Minute), sd)
+	assert.NilError(t, err)
+	assert.Equal(t, recorded, 2)
+
+	var relationships []TripRelationship
+	db.Order("id").Find(&relationships)
+	assert.Equal(t, len(relationships), 3)
+	cancelled := relationships[0]
+	assert.Equal(t, cancelled.ServiceDate, "2019-04-26")
+	assert.Equal(t, cancelled.TripID, "921172060")
+	assert.Equal(t, cancelled.RouteID, "28A")
+	assert.Equal(t, cancelled.Relationship, "CANCELED")
+	assert.Equal(t, cancelled.Snapshots, 2)
+	assert.Equal(t, cancelled.FirstAsserted.Unix(), retrievedAt.Unix())
+	assert.Equal(t, cancelled.LastAsserted.Unix(), retrievedAt.Add(time.Minute).Unix())
+	assert.Equal(t, relationships[1].Relationship, SkippedStops)
+	assert.Equal(t, relationships[1].StopID, "1002")
+	assert.Equal(t, relationships[1].Snapshots, 2)
+	assert.Equal(t, relationships[2].Relationship, "SCHEDULED")
+	assert.Equal(t, relationships[2].TripID, "921172060")
+
+	// The cancelled bus kept reporting anyway.
+	filename := "test_data/buses2019-04-27T03:55:01.json"
+	buses := ParseFile(filename)
+	LoadSnapshot(db, "wmatabus", buses, FileTime(filename), sd)
+	buses.BusPositions[1].DateTime = "2019-04-26T23:58:52"
+	LoadSnapshot(db, "wmatabus", buses, FileTime(filename).Add(4*time.Minute), sd)
+
+	assert.NilError(t, ReconcileTripRelationships(db, "2019-04-26"))
+	assert.NilError(t, db.First(&cancelled, cancelled.ID).Error)
+	assert.Assert(t, cancelled.TripInstanceID != 0)
+	assert.Assert(t, cancelled.Observed)
+	assert.Equal(t, cancelled.PositionsAfterAsserted, 1)
+	assert.Assert(t, cancelled.ReconciledAt != nil)
+}
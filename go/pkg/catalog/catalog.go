@@ -0,0 +1,435 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/archiver"
+	"github.com/markongithub/bus_data_archive/pkg/glacier_tier"
+	"github.com/markongithub/bus_data_archive/pkg/replay"
+	"github.com/markongithub/bus_data_archive/pkg/s3_archive"
+)
+
+// Places a day can live, cheapest to get at first.
+const (
+	ShortTerm    = "short_term"
+	LocalArchive = "archive"
+	S3           = "s3"
+	Glacier      = "glacier"
+)
+
+var tiers = []string{ShortTerm, LocalArchive, S3, Glacier}
+
+// DayCoverage says how complete one agency's UTC day is and where to find
+// it.
+type DayCoverage struct {
+	gorm.Model
+	Agency string `gorm:"unique_index:idx_day_coverage"`
+	Day    string `gorm:"unique_index:idx_day_coverage"`
+	// false if all we know is that an archive exists
+	Counted bool
+	// jBusPositions snapshots, out of archiver.ExpectedSnapshots
+	SnapshotCount  int
+	MissingMinutes int
+	// the snapshot files themselves, and the tarball if there is one
+	Bytes        int64
+	ArchiveBytes int64
+	ShortTerm    bool
+	LocalArchive bool
+	S3           bool
+	Glacier      bool
+	// where in each tier
+	ShortTermPath    string
+	LocalArchivePath string
+	S3URL            string
+	GlacierVault     string
+	GlacierArchiveID string
+	ScannedAt        time.Time
+	Gaps             []CoverageGap
+}
+
+type CoverageGap struct {
+	gorm.Model
+	DayCoverageID uint `gorm:"index"`
+	Start         time.Time
+	Minutes       int
+}
+
+func Migrate(db *gorm.DB) {
+	db.AutoMigrate(&DayCoverage{}, &CoverageGap{})
+}
+
+// Scan gathers coverage for one agency from every place we look, then saves
+// it all at once.
+type Scan struct {
+	Agency   string
+	location *time.Location
+	days     map[string]*DayCoverage
+	// how many snapshots the counts and gaps for each day came from, so the
+	// most complete copy wins
+	countedFrom map[string]int
+	// the tiers we looked in. Save keeps what we knew about the others.
+	scanned map[string]bool
+}
+
+// NewScan reads legacy filenames without an offset in location.
+func NewScan(agency string, location *time.Location) *Scan {
+	return &Scan{Agency: agency, location: location, days: make(map[string]*DayCoverage), countedFrom: make(map[string]int), scanned: make(map[string]bool)}
+}
+
+func (s *Scan) day(day string) *DayCoverage {
+	dc, ok := s.days[day]
+	if !ok {
+		dc = &DayCoverage{Agency: s.Agency, Day: day, MissingMinutes: archiver.ExpectedSnapshots}
+		s.days[day] = dc
+		s.countedFrom[day] = -1
+	}
+	return dc
+}
+
+// count keeps the coverage numbers from whichever copy of the day has the
+// most snapshots.
+func (s *Scan) count(day string, snapshots int, gaps []archiver.Gap, bytes int64) {
+	dc := s.day(day)
+	if snapshots <= s.countedFrom[day] {
+		return
+	}
+	s.countedFrom[day] = snapshots
+	dc.Counted = true
+	dc.SnapshotCount = snapshots
+	dc.MissingMinutes = 0
+	dc.Gaps = nil
+	for _, g := range gaps {
+		dc.MissingMinutes += g.Minutes
+		dc.Gaps = append(dc.Gaps, CoverageGap{Start: g.Start, Minutes: g.Minutes})
+	}
+	if bytes > 0 {
+		dc.Bytes = bytes
+	}
+}
+
+func (s *Scan) countManifest(m archiver.Manifest) {
+	var bytes int64
+	for _, f := range m.Files {
+		bytes += f.Size
+	}
+	s.count(m.Day, m.SnapshotCount, m.Gaps, bytes)
+	s.day(m.Day).ArchiveBytes = m.ArchiveSize
+}
+
+func parseDay(day string) (time.Time, bool) {
+	t, err := time.Parse("2006-01-02", day)
+	return t, err == nil
+}
+
+// AddLocal scans an agency directory's short_term and archive.
+func (s *Scan) AddLocal(dataPath string) error {
+	s.scanned[ShortTerm] = true
+	s.scanned[LocalArchive] = true
+	shortTerm := filepath.Join(dataPath, "short_term")
+	infos, err := ioutil.ReadDir(shortTerm)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, info := range infos {
+		dayStart, ok := parseDay(info.Name())
+		if !info.IsDir() || !ok {
+			continue
+		}
+		dir := filepath.Join(shortTerm, info.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		var bytes int64
+		for _, f := range files {
+			if _, _, ok := replay.ParseName(f.Name(), s.location); ok {
+				bytes += f.Size()
+			}
+		}
+		ix := replay.NewIndex(s.location)
+		if err = ix.AddDirectory(dir); err != nil {
+			return err
+		}
+		times := ix.Times(replay.BusPositions)
+		dc := s.day(info.Name())
+		dc.ShortTerm = true
+		dc.ShortTermPath = dir
+		s.count(info.Name(), len(times), archiver.FindGaps(dayStart, times), bytes)
+	}
+
+	archives, err := filepath.Glob(filepath.Join(dataPath, "archive", "*.tar.gz"))
+	if err != nil {
+		return err
+	}
+	for _, archive := range archives {
+		day := strings.TrimSuffix(filepath.Base(archive), ".tar.gz")
+		dayStart, ok := parseDay(day)
+		if !ok {
+			continue
+		}
+		dc := s.day(day)
+		dc.LocalArchive = true
+		dc.LocalArchivePath = archive
+		if _, err := os.Stat(archiver.ManifestPath(dataPath, day)); err == nil {
+			continue // we'll read the manifest below
+		}
+		// Tarballs from before we wrote manifests have to be read.
+		ix := replay.NewIndex(s.location)
+		if err = ix.AddTarball(archive); err != nil {
+			return fmt.Errorf("%s: %s", archive, err)
+		}
+		times := ix.Times(replay.BusPositions)
+		s.count(day, len(times), archiver.FindGaps(dayStart, times), 0)
+		if info, err := os.Stat(archive); err == nil {
+			dc.ArchiveBytes = info.Size()
+		}
+	}
+
+	manifests, err := filepath.Glob(filepath.Join(dataPath, "archive", "*.manifest.json"))
+	if err != nil {
+		return err
+	}
+	for _, manifest := range manifests {
+		m, err := archiver.ReadManifest(manifest)
+		if err != nil {
+			return fmt.Errorf("%s: %s", manifest, err)
+		}
+		s.countManifest(m)
+	}
+	return nil
+}
+
+// AddS3 lists the agency's archives in the bucket. For days we haven't seen
+// locally it reads the manifest out of S3 too.
+func (s *Scan) AddS3(svc s3iface.S3API, bucket string) error {
+	s.scanned[S3] = true
+	manifestKeys := make(map[string]string)
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(path.Join("archive", s.Agency) + "/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			key := aws.StringValue(obj.Key)
+			name := path.Base(key)
+			switch {
+			case strings.HasSuffix(name, ".tar.gz"):
+				day := strings.TrimSuffix(name, ".tar.gz")
+				if _, ok := parseDay(day); !ok || key != s3_archive.ArchiveKey(s.Agency, day) {
+					continue
+				}
+				dc := s.day(day)
+				dc.S3 = true
+				dc.S3URL = fmt.Sprintf("s3://%s/%s", bucket, key)
+				if dc.ArchiveBytes == 0 {
+					dc.ArchiveBytes = aws.Int64Value(obj.Size)
+				}
+			case strings.HasSuffix(name, ".manifest.json"):
+				manifestKeys[strings.TrimSuffix(name, ".manifest.json")] = key
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for day, key := range manifestKeys {
+		if dc, ok := s.days[day]; ok && dc.Counted {
+			continue
+		}
+		out, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		if err != nil {
+			return err
+		}
+		var m archiver.Manifest
+		err = json.NewDecoder(out.Body).Decode(&m)
+		out.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3://%s/%s: %s", bucket, key, err)
+		}
+		s.countManifest(m)
+	}
+	return nil
+}
+
+// AddGlacier reads what glacier_tier recorded in its catalog tables.
+func (s *Scan) AddGlacier(db *gorm.DB) error {
+	s.scanned[Glacier] = true
+	if !db.HasTable(&glacier_tier.GlacierArchive{}) {
+		return nil
+	}
+	var archives []glacier_tier.GlacierArchive
+	if err := db.Where("agency = ?", s.Agency).Order("id").Find(&archives).Error; err != nil {
+		return err
+	}
+	for _, ga := range archives {
+		dc := s.day(ga.Day)
+		if dc.Glacier {
+			continue // the first vault is the one we restore from
+		}
+		dc.Glacier = true
+		dc.GlacierVault = ga.Vault
+		dc.GlacierArchiveID = ga.ArchiveID
+		if dc.ArchiveBytes == 0 {
+			dc.ArchiveBytes = ga.Size
+		}
+	}
+	return nil
+}
+
+// keepUnscanned copies what we knew about the tiers this scan didn't look in,
+// and the old counts if they came from a copy this scan didn't find.
+func (s *Scan) keepUnscanned(dc *DayCoverage, old DayCoverage) {
+	if !s.scanned[ShortTerm] {
+		dc.ShortTerm, dc.ShortTermPath = old.ShortTerm, old.ShortTermPath
+	}
+	if !s.scanned[LocalArchive] {
+		dc.LocalArchive, dc.LocalArchivePath = old.LocalArchive, old.LocalArchivePath
+	}
+	if !s.scanned[S3] {
+		dc.S3, dc.S3URL = old.S3, old.S3URL
+	}
+	if !s.scanned[Glacier] {
+		dc.Glacier, dc.GlacierVault, dc.GlacierArchiveID = old.Glacier, old.GlacierVault, old.GlacierArchiveID
+	}
+	if dc.ArchiveBytes == 0 {
+		dc.ArchiveBytes = old.ArchiveBytes
+	}
+	partial := len(s.scanned) < len(tiers)
+	if !old.Counted || (dc.Counted && (!partial || dc.SnapshotCount >= old.SnapshotCount)) {
+		return
+	}
+	dc.Counted, dc.SnapshotCount, dc.MissingMinutes = true, old.SnapshotCount, old.MissingMinutes
+	if dc.Bytes == 0 {
+		dc.Bytes = old.Bytes
+	}
+	dc.Gaps = nil
+	for _, g := range old.Gaps {
+		dc.Gaps = append(dc.Gaps, CoverageGap{Start: g.Start, Minutes: g.Minutes})
+	}
+}
+
+// Save replaces what we had for the days we scanned, except for what's in
+// tiers the scan didn't look in.
+func (s *Scan) Save(db *gorm.DB) error {
+	days := make([]string, 0, len(s.days))
+	for day := range s.days {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	now := time.Now().UTC()
+	for _, day := range days {
+		dc := s.days[day]
+		dc.ScannedAt = now
+		var old DayCoverage
+		if !db.Preload("Gaps").Where("agency = ? AND day = ?", s.Agency, day).First(&old).RecordNotFound() {
+			s.keepUnscanned(dc, old)
+			if err := db.Unscoped().Where("day_coverage_id = ?", old.ID).Delete(CoverageGap{}).Error; err != nil {
+				return err
+			}
+			if err := db.Unscoped().Delete(&old).Error; err != nil {
+				return err
+			}
+		}
+		if err := db.Create(dc).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tiers lists where the day is, cheapest first.
+func (dc DayCoverage) Tiers() []string {
+	var output []string
+	present := map[string]bool{ShortTerm: dc.ShortTerm, LocalArchive: dc.LocalArchive, S3: dc.S3, Glacier: dc.Glacier}
+	for _, tier := range tiers {
+		if present[tier] {
+			output = append(output, tier)
+		}
+	}
+	return output
+}
+
+// Where is where to get one day's part of a time range.
+type Where struct {
+	Day string
+	// cheapest first, and empty if we have nothing for the day
+	Tiers   []string
+	Sources []string
+	// false if we have the day but don't know how complete it is
+	Counted bool
+	// minutes of the range that fall on this day, and how many of those have
+	// no snapshot
+	Minutes        int
+	MissingMinutes int
+	Gaps           []CoverageGap
+}
+
+func overlap(aStart, aEnd, bStart, bEnd time.Time) time.Duration {
+	start, end := aStart, aEnd
+	if bStart.After(start) {
+		start = bStart
+	}
+	if bEnd.Before(end) {
+		end = bEnd
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// Locate answers "where do I get data from start to end?", one UTC day at a
+// time.
+func Locate(db *gorm.DB, agency string, start time.Time, end time.Time) ([]Where, error) {
+	start, end = start.UTC(), end.UTC()
+	var output []Where
+	for dayStart := start.Truncate(24 * time.Hour); dayStart.Before(end); dayStart = dayStart.AddDate(0, 0, 1) {
+		dayEnd := dayStart.AddDate(0, 0, 1)
+		w := Where{Day: dayStart.Format("2006-01-02"), Minutes: int(overlap(start, end, dayStart, dayEnd) / time.Minute)}
+		var dc DayCoverage
+		if db.Preload("Gaps").Where("agency = ? AND day = ?", agency, w.Day).First(&dc).RecordNotFound() {
+			w.MissingMinutes = w.Minutes
+			output = append(output, w)
+			continue
+		}
+		w.Tiers = dc.Tiers()
+		w.Counted = dc.Counted
+		if !dc.Counted {
+			w.MissingMinutes = w.Minutes
+		}
+		for _, tier := range w.Tiers {
+			switch tier {
+			case ShortTerm:
+				w.Sources = append(w.Sources, dc.ShortTermPath)
+			case LocalArchive:
+				w.Sources = append(w.Sources, dc.LocalArchivePath)
+			case S3:
+				w.Sources = append(w.Sources, dc.S3URL)
+			case Glacier:
+				w.Sources = append(w.Sources, fmt.Sprintf("glacier:%s/%s", dc.GlacierVault, dc.GlacierArchiveID))
+			}
+		}
+		for _, g := range dc.Gaps {
+			gapStart := g.Start.UTC()
+			minutes := int(overlap(start, end, gapStart, gapStart.Add(time.Duration(g.Minutes)*time.Minute)) / time.Minute)
+			if minutes > 0 {
+				w.Gaps = append(w.Gaps, g)
+				w.MissingMinutes += minutes
+			}
+		}
+		output = append(output, w)
+	}
+	return output, nil
+}
@@ -0,0 +1,145 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/archiver"
+	"github.com/markongithub/bus_data_archive/pkg/glacier_tier"
+	"github.com/markongithub/bus_data_archive/pkg/s3_archive"
+	"gotest.tools/v3/assert"
+)
+
+type fakeBucket struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+func (f fakeBucket) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	page := &s3.ListObjectsV2Output{}
+	for key, b := range f.objects {
+		page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(int64(len(b)))})
+	}
+	fn(page, true)
+	return nil
+}
+
+func (f fakeBucket) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(f.objects[aws.StringValue(input.Key)]))}, nil
+}
+
+func writeSnapshots(t *testing.T, dir string, times ...string) {
+	assert.NilError(t, os.MkdirAll(dir, 0755))
+	for _, tm := range times {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "buses"+tm+".json"), []byte(`{"BusPositions":[]}`), 0644))
+	}
+}
+
+func TestScanAndLocate(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "catalog")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dataPath)
+	// 2019-09-18 is archived and then frozen, 2019-09-19 is still in
+	// short_term and 2019-09-20 only made it to S3.
+	writeSnapshots(t, filepath.Join(dataPath, "short_term/2019-09-18"), "2019-09-18T03:00:01", "2019-09-18T03:01:01")
+	_, err = archiver.ArchiveDay(dataPath, "2019-09-18", time.UTC)
+	assert.NilError(t, err)
+	var times []string
+	for minute := 0; minute < 24*60; minute++ {
+		// the poller was down from 04:00 to 04:30
+		if minute >= 240 && minute < 270 {
+			continue
+		}
+		times = append(times, time.Date(2019, 9, 19, 0, minute, 1, 0, time.UTC).Format("2006-01-02T15:04:05"))
+	}
+	writeSnapshots(t, filepath.Join(dataPath, "short_term/2019-09-19"), times...)
+
+	manifest, err := json.Marshal(archiver.Manifest{Day: "2019-09-20", SnapshotCount: 1430, ArchiveSize: 99,
+		Gaps: []archiver.Gap{{Start: time.Date(2019, 9, 20, 12, 0, 0, 0, time.UTC), Minutes: 10}}})
+	assert.NilError(t, err)
+	bucket := fakeBucket{objects: map[string][]byte{
+		s3_archive.ArchiveKey("wmatabus", "2019-09-20"):  []byte("tarball"),
+		s3_archive.ManifestKey("wmatabus", "2019-09-20"): manifest,
+		s3_archive.ArchiveKey("wmatabus", "2019-09-21"):  []byte("tarball"),
+	}}
+
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	defer db.Close()
+	Migrate(db)
+	glacier_tier.Migrate(db)
+	db.Create(&glacier_tier.GlacierArchive{Agency: "wmatabus", Day: "2019-09-18", Vault: "bus-data-vault-00", ArchiveID: "abc"})
+
+	scan := NewScan("wmatabus", time.UTC)
+	assert.NilError(t, scan.AddLocal(dataPath))
+	assert.NilError(t, scan.AddS3(bucket, "busdata-01-us-west-2"))
+	assert.NilError(t, scan.AddGlacier(db))
+	assert.NilError(t, scan.Save(db))
+	// scanning again replaces what we had
+	assert.NilError(t, scan.Save(db))
+
+	var days []DayCoverage
+	db.Preload("Gaps").Order("day").Find(&days)
+	assert.Equal(t, len(days), 4)
+	assert.DeepEqual(t, days[0].Tiers(), []string{ShortTerm, LocalArchive, Glacier})
+	assert.Equal(t, days[0].SnapshotCount, 2)
+	assert.Equal(t, days[1].SnapshotCount, 1410)
+	assert.Equal(t, days[1].MissingMinutes, 30)
+	assert.Equal(t, len(days[1].Gaps), 1)
+	assert.DeepEqual(t, days[2].Tiers(), []string{S3})
+	assert.Equal(t, days[2].SnapshotCount, 1430)
+	assert.Equal(t, days[2].ArchiveBytes, int64(99))
+	assert.Assert(t, !days[3].Counted)
+
+	where, err := Locate(db, "wmatabus", time.Date(2019, 9, 19, 3, 0, 0, 0, time.UTC), time.Date(2019, 9, 19, 5, 0, 0, 0, time.UTC))
+	assert.NilError(t, err)
+	assert.Equal(t, len(where), 1)
+	assert.DeepEqual(t, where[0].Tiers, []string{ShortTerm})
+	assert.DeepEqual(t, where[0].Sources, []string{filepath.Join(dataPath, "short_term/2019-09-19")})
+	assert.Equal(t, where[0].Minutes, 120)
+	assert.Equal(t, where[0].MissingMinutes, 30)
+
+	where, err = Locate(db, "wmatabus", time.Date(2019, 9, 20, 23, 0, 0, 0, time.UTC), time.Date(2019, 9, 23, 0, 0, 0, 0, time.UTC))
+	assert.NilError(t, err)
+	assert.Equal(t, len(where), 3)
+	assert.Equal(t, where[0].Sources[0], "s3://busdata-01-us-west-2/archive/wmatabus/2019/09/20/2019-09-20.tar.gz")
+	assert.Equal(t, where[0].MissingMinutes, 0)
+	assert.Equal(t, where[1].MissingMinutes, 24*60)
+	assert.Equal(t, len(where[2].Tiers), 0)
+
+	// A scan of just the local directories doesn't forget what's in S3 and
+	// Glacier.
+	scan = NewScan("wmatabus", time.UTC)
+	assert.NilError(t, scan.AddLocal(dataPath))
+	assert.NilError(t, scan.Save(db))
+	days = nil
+	db.Preload("Gaps").Order("day").Find(&days)
+	assert.Equal(t, len(days), 4)
+	assert.DeepEqual(t, days[0].Tiers(), []string{ShortTerm, LocalArchive, Glacier})
+	assert.Equal(t, days[0].GlacierArchiveID, "abc")
+	assert.Equal(t, days[1].SnapshotCount, 1410)
+	assert.DeepEqual(t, days[2].Tiers(), []string{S3})
+
+	// and one of just S3 keeps the counts from short_term for a day it only
+	// found a tarball for
+	scan = NewScan("wmatabus", time.UTC)
+	bucket.objects[s3_archive.ArchiveKey("wmatabus", "2019-09-19")] = []byte("tarball")
+	assert.NilError(t, scan.AddS3(bucket, "busdata-01-us-west-2"))
+	assert.NilError(t, scan.Save(db))
+	days = nil
+	db.Preload("Gaps").Order("day").Find(&days)
+	assert.DeepEqual(t, days[1].Tiers(), []string{ShortTerm, S3})
+	assert.Assert(t, days[1].Counted)
+	assert.Equal(t, days[1].MissingMinutes, 30)
+	assert.Equal(t, len(days[1].Gaps), 1)
+}
@@ -0,0 +1,52 @@
+// Package clever_rows reads the tables clever_tmp writes. That code is still
+// a main package, so we can't import its types, and these are just the
+// columns we need from them.
+package clever_rows
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+)
+
+type TripInstance struct {
+	gorm.Model
+	Vehicle    string
+	Route      string
+	Run        string
+	Op         string
+	BlockID    string
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	TripIDGTFS string
+}
+
+func (TripInstance) TableName() string {
+	return "trip_instances"
+}
+
+type BusPosition struct {
+	gorm.Model
+	TripInstanceID uint
+	Lat            float64
+	Lon            float64
+	RetrievedAt    time.Time
+}
+
+func (BusPosition) TableName() string {
+	return "bus_positions"
+}
+
+// TripsOnServiceDate finds the trips we first saw on the service date.
+// Clever trips don't have a service date, so that's the best we can do.
+func TripsOnServiceDate(db *gorm.DB, days bus_positions.ServiceDays, date string) ([]TripInstance, error) {
+	dayStart, err := days.Start(date)
+	if err != nil {
+		return nil, err
+	}
+	from := dayStart.Add(time.Duration(days.RolloverHour) * time.Hour)
+	var trips []TripInstance
+	err = db.Where("first_seen >= ? AND first_seen < ?", from, from.AddDate(0, 0, 1)).Find(&trips).Error
+	return trips, err
+}
@@ -0,0 +1,41 @@
+package clever_rows
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/test_util"
+	"gotest.tools/v3/assert"
+)
+
+func TestTripsOnServiceDate(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	defer db.Close()
+	db.AutoMigrate(&TripInstance{}, &BusPosition{})
+	location := test_util.Eastern()
+	days := bus_positions.ServiceDays{Location: location, RolloverHour: 4}
+	for _, firstSeen := range []time.Time{
+		time.Date(2019, 9, 19, 3, 59, 0, 0, location),
+		time.Date(2019, 9, 19, 4, 0, 0, 0, location),
+		time.Date(2019, 9, 19, 23, 30, 0, 0, location),
+		// an owl trip after midnight
+		time.Date(2019, 9, 20, 1, 0, 0, 0, location),
+		time.Date(2019, 9, 20, 4, 0, 0, 0, location),
+	} {
+		assert.NilError(t, db.Create(&TripInstance{FirstSeen: firstSeen}).Error)
+	}
+
+	trips, err := TripsOnServiceDate(db, days, "2019-09-19")
+	assert.NilError(t, err)
+	var ids []uint
+	for _, trip := range trips {
+		ids = append(ids, trip.ID)
+	}
+	assert.DeepEqual(t, ids, []uint{2, 3, 4})
+	_, err = TripsOnServiceDate(db, days, "yesterday")
+	assert.Assert(t, err != nil)
+}
@@ -0,0 +1,455 @@
+package compaction
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_realtime"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
+	"github.com/markongithub/bus_data_archive/pkg/replay"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// The datasets we write. Each one is its own table, partitioned underneath by
+// agency, service date and hour of the service day, like
+// bus_positions/agency=wmatabus/date=2019-04-26/hour=23/part-0.parquet
+// Hours go past 23 the way GTFS times do, so positions from an owl trip at
+// 1am stay with the day the trip started, in hour=25.
+const (
+	BusPositionsDataset     = "bus_positions"
+	VehiclePositionsDataset = "vehicle_positions"
+	TripUpdatesDataset      = "trip_updates"
+)
+
+// Row groups hold this many bytes in memory before they're flushed.
+const rowGroupSize = 16 * 1024 * 1024
+
+// All the timestamps are milliseconds since the epoch in UTC.
+
+// BusPositionRow is a BusPositionReport plus when we retrieved it.
+type BusPositionRow struct {
+	RetrievedAt   int64   `parquet:"name=retrieved_at, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	ServiceDate   string  `parquet:"name=service_date, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	VehicleID     string  `parquet:"name=vehicle_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	TripID        string  `parquet:"name=trip_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	RouteID       string  `parquet:"name=route_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	DirectionNum  int32   `parquet:"name=direction_num, type=INT32"`
+	DirectionText string  `parquet:"name=direction_text, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	TripHeadSign  string  `parquet:"name=trip_headsign, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	TripStartTime int64   `parquet:"name=trip_start_time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	TripEndTime   int64   `parquet:"name=trip_end_time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	BlockNumber   string  `parquet:"name=block_number, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	ReportedAt    int64   `parquet:"name=reported_at, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Lat           float64 `parquet:"name=lat, type=DOUBLE"`
+	Lon           float64 `parquet:"name=lon, type=DOUBLE"`
+	Deviation     float64 `parquet:"name=deviation, type=DOUBLE"`
+	// a position_quality flag, blank if it passed every check
+	Quality string `parquet:"name=quality, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+}
+
+// VehiclePositionRow is one entity from a GTFS-RT vehicle positions feed.
+type VehiclePositionRow struct {
+	RetrievedAt          int64    `parquet:"name=retrieved_at, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	ServiceDate          string   `parquet:"name=service_date, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	FeedTimestamp        int64    `parquet:"name=feed_timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	EntityID             string   `parquet:"name=entity_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	VehicleID            string   `parquet:"name=vehicle_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	VehicleLabel         string   `parquet:"name=vehicle_label, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	TripID               string   `parquet:"name=trip_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	RouteID              string   `parquet:"name=route_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	DirectionID          *int32   `parquet:"name=direction_id, type=INT32, repetitiontype=OPTIONAL"`
+	StartDate            string   `parquet:"name=start_date, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	StartTime            string   `parquet:"name=start_time, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	ScheduleRelationship string   `parquet:"name=schedule_relationship, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Lat                  float64  `parquet:"name=lat, type=DOUBLE"`
+	Lon                  float64  `parquet:"name=lon, type=DOUBLE"`
+	Bearing              *float32 `parquet:"name=bearing, type=FLOAT, repetitiontype=OPTIONAL"`
+	Speed                *float32 `parquet:"name=speed, type=FLOAT, repetitiontype=OPTIONAL"`
+	CurrentStopSequence  *int32   `parquet:"name=current_stop_sequence, type=INT32, repetitiontype=OPTIONAL"`
+	CurrentStatus        int32    `parquet:"name=current_status, type=INT32"`
+	StopID               string   `parquet:"name=stop_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Timestamp            *int64   `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+	Quality              string   `parquet:"name=quality, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+}
+
+// TripUpdateRow is one stop time update from a GTFS-RT trip updates feed. A
+// trip update with no stop time updates, like a cancellation, gets one row
+// with the stop columns empty.
+type TripUpdateRow struct {
+	RetrievedAt              int64  `parquet:"name=retrieved_at, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	ServiceDate              string `parquet:"name=service_date, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	FeedTimestamp            int64  `parquet:"name=feed_timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	EntityID                 string `parquet:"name=entity_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TripID                   string `parquet:"name=trip_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	RouteID                  string `parquet:"name=route_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	StartDate                string `parquet:"name=start_date, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	StartTime                string `parquet:"name=start_time, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	TripScheduleRelationship string `parquet:"name=trip_schedule_relationship, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	VehicleID                string `parquet:"name=vehicle_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Timestamp                *int64 `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+	StopSequence             *int32 `parquet:"name=stop_sequence, type=INT32, repetitiontype=OPTIONAL"`
+	StopID                   string `parquet:"name=stop_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	StopScheduleRelationship string `parquet:"name=stop_schedule_relationship, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	ArrivalDelay             *int32 `parquet:"name=arrival_delay, type=INT32, repetitiontype=OPTIONAL"`
+	ArrivalTime              *int64 `parquet:"name=arrival_time, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+	DepartureDelay           *int32 `parquet:"name=departure_delay, type=INT32, repetitiontype=OPTIONAL"`
+	DepartureTime            *int64 `parquet:"name=departure_time, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func secondsToMillis(s uint64) int64 {
+	return int64(s) * 1000
+}
+
+func optionalMillis(s uint64) *int64 {
+	if s == 0 {
+		return nil
+	}
+	v := secondsToMillis(s)
+	return &v
+}
+
+func optionalInt32(v *uint32) *int32 {
+	if v == nil {
+		return nil
+	}
+	output := int32(*v)
+	return &output
+}
+
+// PartitionPath is where rows from the hour of the service date go.
+func PartitionPath(outputDir string, dataset string, agency string, serviceDate string, hour int) string {
+	return filepath.Join(outputDir, dataset, "agency="+agency, "date="+serviceDate,
+		fmt.Sprintf("hour=%02d", hour), "part-0.parquet")
+}
+
+type partitionWriter struct {
+	file   source.ParquetFile
+	writer *writer.ParquetWriter
+	rows   int
+}
+
+// Compactor keeps one Parquet file open per dataset and hour, since tarballs
+// don't hand us the snapshots in order.
+type Compactor struct {
+	outputDir string
+	agency    string
+	days      bus_positions.ServiceDays
+	writers   map[string]*partitionWriter
+	// Tarballs aren't in order either, so some positions only get compared
+	// to a later one.
+	quality *position_quality.Tracker
+	// Skipped counts snapshots we couldn't parse, like empty files from
+	// failed downloads.
+	Skipped int
+}
+
+// NewCompactor wants the agency's service days, in the location WMATA's local
+// DateTimes are in.
+func NewCompactor(outputDir string, agency string, days bus_positions.ServiceDays) *Compactor {
+	return &Compactor{
+		outputDir: outputDir,
+		agency:    agency,
+		days:      days,
+		writers:   make(map[string]*partitionWriter),
+		quality:   position_quality.NewTracker(agency),
+	}
+}
+
+func (c *Compactor) write(dataset string, serviceDate string, retrievedAt time.Time, row interface{}) error {
+	hour, err := c.days.Hour(serviceDate, retrievedAt)
+	if err != nil {
+		return err
+	}
+	path := PartitionPath(c.outputDir, dataset, c.agency, serviceDate, hour)
+	pw, ok := c.writers[path]
+	if !ok {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		file, err := local.NewLocalFileWriter(path)
+		if err != nil {
+			return err
+		}
+		var schema interface{}
+		switch dataset {
+		case BusPositionsDataset:
+			schema = new(BusPositionRow)
+		case VehiclePositionsDataset:
+			schema = new(VehiclePositionRow)
+		case TripUpdatesDataset:
+			schema = new(TripUpdateRow)
+		}
+		w, err := writer.NewParquetWriter(file, schema, 1)
+		if err != nil {
+			return err
+		}
+		w.RowGroupSize = rowGroupSize
+		w.CompressionType = parquet.CompressionCodec_SNAPPY
+		pw = &partitionWriter{file: file, writer: w}
+		c.writers[path] = pw
+	}
+	pw.rows++
+	return pw.writer.Write(row)
+}
+
+// Add converts one snapshot into rows.
+func (c *Compactor) Add(s replay.Snapshot, body []byte) error {
+	switch s.Feed {
+	case replay.BusPositions:
+		return c.addBusPositions(s.Time, body)
+	case replay.VehiclePositions:
+		return c.addVehiclePositions(s.Time, body)
+	case replay.TripUpdates:
+		return c.addTripUpdates(s.Time, body)
+	}
+	return nil
+}
+
+func (c *Compactor) reportMillis(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := bus_positions.ParseReportTime(s, c.days.Location)
+	if err != nil {
+		return 0, err
+	}
+	return millis(t), nil
+}
+
+func (c *Compactor) addBusPositions(retrievedAt time.Time, body []byte) error {
+	var m bus_positions.BusPositionList
+	if err := json.Unmarshal(body, &m); err != nil {
+		fmt.Printf("Skipping the jBusPositions snapshot from %s: %s\n", retrievedAt, err)
+		c.Skipped++
+		return nil
+	}
+	for _, bpr := range m.BusPositions {
+		row := BusPositionRow{
+			RetrievedAt:   millis(retrievedAt),
+			VehicleID:     bpr.VehicleID,
+			TripID:        bpr.TripID,
+			RouteID:       bpr.RouteID,
+			DirectionNum:  int32(bpr.DirectionNum),
+			DirectionText: bpr.DirectionText,
+			TripHeadSign:  bpr.TripHeadSign,
+			BlockNumber:   bpr.BlockNumber,
+			Lat:           bpr.Lat,
+			Lon:           bpr.Lon,
+			Deviation:     bpr.Deviation,
+		}
+		var err error
+		if row.ServiceDate, err = c.days.ReportDate(bpr); err != nil {
+			return err
+		}
+		if row.ReportedAt, err = c.reportMillis(bpr.DateTime); err != nil {
+			return err
+		}
+		if row.TripStartTime, err = c.reportMillis(bpr.TripStartTime); err != nil {
+			return err
+		}
+		if row.TripEndTime, err = c.reportMillis(bpr.TripEndTime); err != nil {
+			return err
+		}
+		reportedAt := retrievedAt
+		if row.ReportedAt != 0 {
+			reportedAt = time.Unix(0, row.ReportedAt*int64(time.Millisecond))
+		}
+		row.Quality = c.quality.Check(bpr.VehicleID, position_quality.Fix{At: reportedAt, Lat: bpr.Lat, Lon: bpr.Lon})
+		if err = c.write(BusPositionsDataset, row.ServiceDate, retrievedAt, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Compactor) parseFeed(name string, retrievedAt time.Time, body []byte) (gtfs_realtime.FeedMessage, bool) {
+	m, err := gtfs_realtime.Parse(body)
+	if err != nil || len(body) == 0 {
+		fmt.Printf("Skipping the %s snapshot from %s: %v\n", name, retrievedAt, err)
+		c.Skipped++
+		return m, false
+	}
+	return m, true
+}
+
+// serviceDate is the trip's start_date if the feed gives one, and otherwise
+// goes by when we retrieved it.
+func (c *Compactor) serviceDate(trip *gtfs_realtime.TripDescriptor, retrievedAt time.Time) string {
+	if trip == nil {
+		return c.days.DateOf(retrievedAt)
+	}
+	return c.days.FeedDate(trip.StartDate, retrievedAt)
+}
+
+func (c *Compactor) addVehiclePositions(retrievedAt time.Time, body []byte) error {
+	m, ok := c.parseFeed("vehicle positions", retrievedAt, body)
+	if !ok {
+		return nil
+	}
+	for _, e := range m.Entities {
+		vp := e.Vehicle
+		if vp == nil {
+			continue
+		}
+		row := VehiclePositionRow{
+			RetrievedAt:         millis(retrievedAt),
+			ServiceDate:         c.serviceDate(vp.Trip, retrievedAt),
+			FeedTimestamp:       secondsToMillis(m.Header.Timestamp),
+			EntityID:            e.ID,
+			CurrentStopSequence: optionalInt32(vp.CurrentStopSequence),
+			CurrentStatus:       vp.CurrentStatus,
+			StopID:              vp.StopID,
+			Timestamp:           optionalMillis(vp.Timestamp),
+		}
+		if vp.Vehicle != nil {
+			row.VehicleID = vp.Vehicle.ID
+			row.VehicleLabel = vp.Vehicle.Label
+		}
+		if vp.Trip != nil {
+			row.TripID = vp.Trip.TripID
+			row.RouteID = vp.Trip.RouteID
+			row.DirectionID = optionalInt32(vp.Trip.DirectionID)
+			row.StartDate = vp.Trip.StartDate
+			row.StartTime = vp.Trip.StartTime
+			row.ScheduleRelationship = vp.Trip.ScheduleRelationship.String()
+		}
+		if vp.Position != nil {
+			row.Lat = float64(vp.Position.Latitude)
+			row.Lon = float64(vp.Position.Longitude)
+			row.Bearing = vp.Position.Bearing
+			row.Speed = vp.Position.Speed
+		}
+		vehicleID := row.VehicleID
+		if vehicleID == "" {
+			vehicleID = e.ID
+		}
+		reportedAt := retrievedAt
+		if vp.Timestamp != 0 {
+			reportedAt = time.Unix(int64(vp.Timestamp), 0)
+		} else if m.Header.Timestamp != 0 {
+			reportedAt = time.Unix(int64(m.Header.Timestamp), 0)
+		}
+		row.Quality = c.quality.Check(vehicleID, position_quality.Fix{At: reportedAt, Lat: row.Lat, Lon: row.Lon})
+		if err := c.write(VehiclePositionsDataset, row.ServiceDate, retrievedAt, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Compactor) addTripUpdates(retrievedAt time.Time, body []byte) error {
+	m, ok := c.parseFeed("trip updates", retrievedAt, body)
+	if !ok {
+		return nil
+	}
+	for _, e := range m.Entities {
+		tu := e.TripUpdate
+		if tu == nil {
+			continue
+		}
+		trip := TripUpdateRow{
+			RetrievedAt:              millis(retrievedAt),
+			ServiceDate:              c.serviceDate(&tu.Trip, retrievedAt),
+			FeedTimestamp:            secondsToMillis(m.Header.Timestamp),
+			EntityID:                 e.ID,
+			TripID:                   tu.Trip.TripID,
+			RouteID:                  tu.Trip.RouteID,
+			StartDate:                tu.Trip.StartDate,
+			StartTime:                tu.Trip.StartTime,
+			TripScheduleRelationship: tu.Trip.ScheduleRelationship.String(),
+			Timestamp:                optionalMillis(tu.Timestamp),
+		}
+		if tu.Vehicle != nil {
+			trip.VehicleID = tu.Vehicle.ID
+		}
+		if len(tu.StopTimeUpdates) == 0 {
+			if err := c.write(TripUpdatesDataset, trip.ServiceDate, retrievedAt, trip); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, u := range tu.StopTimeUpdates {
+			row := trip
+			row.StopSequence = optionalInt32(u.StopSequence)
+			row.StopID = u.StopID
+			row.StopScheduleRelationship = u.ScheduleRelationship.String()
+			if u.Arrival != nil {
+				row.ArrivalDelay = u.Arrival.Delay
+				row.ArrivalTime = eventMillis(u.Arrival)
+			}
+			if u.Departure != nil {
+				row.DepartureDelay = u.Departure.Delay
+				row.DepartureTime = eventMillis(u.Departure)
+			}
+			if err := c.write(TripUpdatesDataset, row.ServiceDate, retrievedAt, row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func eventMillis(e *gtfs_realtime.StopTimeEvent) *int64 {
+	if e.Time == nil {
+		return nil
+	}
+	v := *e.Time * 1000
+	return &v
+}
+
+// Close finishes every file and returns how many rows went into each one.
+func (c *Compactor) Close() (map[string]int, error) {
+	paths := make([]string, 0, len(c.writers))
+	for path := range c.writers {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	rows := make(map[string]int, len(paths))
+	var firstErr error
+	for _, path := range paths {
+		pw := c.writers[path]
+		if err := pw.writer.WriteStop(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := pw.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		rows[path] = pw.rows
+	}
+	c.writers = make(map[string]*partitionWriter)
+	return rows, firstErr
+}
+
+// CompactDay converts everything under input, which can be a
+// short_term/<day> directory or an archive/<day>.tar.gz, into Parquet.
+// location is for WMATA's DateTimes and the agency's service days; legacy
+// filenames are read in the agency's bus_positions.AgencyLocation.
+func CompactDay(input string, outputDir string, agency string, location *time.Location) (map[string]int, error) {
+	fileLocation, err := bus_positions.AgencyLocation(agency)
+	if err != nil {
+		return nil, err
+	}
+	days, err := bus_positions.AgencyServiceDays(agency, location)
+	if err != nil {
+		return nil, err
+	}
+	c := NewCompactor(outputDir, agency, days)
+	err = replay.Walk(input, fileLocation, c.Add)
+	rows, closeErr := c.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return rows, err
+}
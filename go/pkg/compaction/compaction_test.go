@@ -0,0 +1,82 @@
+package compaction
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/test_util"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"gotest.tools/v3/assert"
+)
+
+func copyFile(t *testing.T, from string, toDir string) {
+	b, err := ioutil.ReadFile(from)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(toDir, filepath.Base(from)), b, 0644))
+}
+
+func readRows(t *testing.T, path string, rows interface{}, schema interface{}) {
+	fr, err := local.NewLocalFileReader(path)
+	assert.NilError(t, err)
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, schema, 1)
+	assert.NilError(t, err)
+	defer pr.ReadStop()
+	assert.NilError(t, pr.Read(rows))
+}
+
+func TestCompactDay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compaction")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	day := filepath.Join(dir, "short_term/2019-04-27")
+	assert.NilError(t, os.MkdirAll(day, 0755))
+	copyFile(t, "../bus_positions/test_data/buses2019-04-27T03:55:01.json", day)
+	copyFile(t, "../bus_positions/test_data/buses2019-04-27T04:05:01.json", day)
+	copyFile(t, "../gtfs_realtime/test_data/gtfsrt-vp-2019-04-27T03:55:01.pb", day)
+	copyFile(t, "../gtfs_realtime/test_data/gtfsrt-tu-2019-04-27T03:55:01.pb", day)
+	// wget leaves these behind when the API is down
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(day, "buses2019-04-27T04:06:01.json"), nil, 0644))
+
+	output := filepath.Join(dir, "parquet")
+	location := test_util.Eastern()
+	rows, err := CompactDay(day, output, "wmatabus", location)
+	assert.NilError(t, err)
+	// 03:55 UTC is 23:55 the night before in Washington, and 04:05 is five
+	// past midnight, which is still the same service day.
+	busesPath := PartitionPath(output, BusPositionsDataset, "wmatabus", "2019-04-26", 23)
+	assert.Equal(t, busesPath, filepath.Join(output, "bus_positions/agency=wmatabus/date=2019-04-26/hour=23/part-0.parquet"))
+	assert.DeepEqual(t, rows, map[string]int{
+		busesPath: 2,
+		PartitionPath(output, BusPositionsDataset, "wmatabus", "2019-04-26", 24):     2,
+		PartitionPath(output, VehiclePositionsDataset, "wmatabus", "2019-04-26", 23): 2,
+		PartitionPath(output, TripUpdatesDataset, "wmatabus", "2019-04-26", 23):      3,
+	})
+
+	buses := make([]BusPositionRow, 2)
+	readRows(t, busesPath, &buses, new(BusPositionRow))
+	assert.Equal(t, buses[0].VehicleID, "3171")
+	assert.Equal(t, buses[0].ServiceDate, "2019-04-26")
+	assert.Equal(t, buses[0].RetrievedAt, millis(time.Date(2019, 4, 27, 3, 55, 1, 0, time.UTC)))
+	assert.Equal(t, buses[0].ReportedAt, millis(time.Date(2019, 4, 26, 23, 54, 46, 0, location)))
+	assert.Equal(t, buses[0].TripHeadSign, "HUNTINGTON STATION N")
+	assert.Equal(t, buses[0].Lat, 38.795212)
+
+	vehicles := make([]VehiclePositionRow, 2)
+	readRows(t, PartitionPath(output, VehiclePositionsDataset, "wmatabus", "2019-04-26", 23), &vehicles, new(VehiclePositionRow))
+	assert.Equal(t, vehicles[0].VehicleID, "3171")
+	assert.Equal(t, *vehicles[0].Bearing, float32(180))
+	assert.Equal(t, *vehicles[0].Timestamp, int64(1556337286000))
+	assert.Assert(t, vehicles[1].Bearing == nil)
+
+	updates := make([]TripUpdateRow, 3)
+	readRows(t, PartitionPath(output, TripUpdatesDataset, "wmatabus", "2019-04-26", 23), &updates, new(TripUpdateRow))
+	assert.Equal(t, updates[1].StopID, "1002")
+	assert.Equal(t, *updates[1].DepartureDelay, int32(90))
+	assert.Equal(t, updates[2].TripScheduleRelationship, "CANCELED")
+	assert.Assert(t, updates[2].StopSequence == nil)
+}
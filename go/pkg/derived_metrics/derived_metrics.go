@@ -0,0 +1,145 @@
+package derived_metrics
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/geo"
+	"github.com/markongithub/bus_data_archive/pkg/map_matching"
+)
+
+// A bus that moves less than this between reports is standing still. GPS
+// wanders a bit even when the bus doesn't.
+const stationaryMeters = 15.0
+
+// A dwell this close to either end of the shape is a layover, not a stop.
+const terminalMeters = 150.0
+
+// PositionMetric describes how the bus got to a position from the one before
+// it on the same trip. The first position on a trip has no metric.
+type PositionMetric struct {
+	gorm.Model
+	BusPositionID  uint `gorm:"unique_index"`
+	TripInstanceID uint `gorm:"index"`
+	Seconds        float64
+	// Straight line
+	HaversineMeters float64
+	HaversineSpeed  float64 // meters per second
+	// Along the trip's shape, if we had one
+	ShapeMeters float64
+	ShapeSpeed  float64 // meters per second
+	Stationary  bool
+}
+
+// A DwellPeriod is a run of consecutive positions where the bus didn't move.
+type DwellPeriod struct {
+	gorm.Model
+	TripInstanceID     uint `gorm:"index"`
+	FirstBusPositionID uint
+	LastBusPositionID  uint
+	Start              time.Time
+	End                time.Time
+	Seconds            float64
+	Lat                float64
+	Lon                float64
+	ShapeDistTraveled  float64
+	Layover            bool
+}
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// ComputeMetrics needs positions in chronological order. matched can be nil
+// if the trip has no shape, and then we skip the along-shape numbers and
+// can't tell a layover from any other dwell. shapeLength is in meters.
+func ComputeMetrics(positions []bus_positions.BusPosition, matched []map_matching.MatchedPosition, shapeLength float64, location *time.Location) ([]PositionMetric, []DwellPeriod) {
+	matchesByID := make(map[uint]map_matching.MatchedPosition, len(matched))
+	for _, mp := range matched {
+		matchesByID[mp.BusPositionID] = mp
+	}
+	times := make([]time.Time, len(positions))
+	for i, bp := range positions {
+		t, err := bus_positions.ParseReportTime(bp.ReportedAt, location)
+		check(err)
+		times[i] = t
+	}
+
+	var metrics []PositionMetric
+	var dwells []DwellPeriod
+	var dwell *DwellPeriod
+	closeDwell := func() {
+		if dwell == nil {
+			return
+		}
+		dwell.Seconds = dwell.End.Sub(dwell.Start).Seconds()
+		dwells = append(dwells, *dwell)
+		dwell = nil
+	}
+	for i := 1; i < len(positions); i++ {
+		prev, cur := positions[i-1], positions[i]
+		m := PositionMetric{
+			BusPositionID:   cur.ID,
+			TripInstanceID:  cur.TripInstanceID,
+			Seconds:         times[i].Sub(times[i-1]).Seconds(),
+			HaversineMeters: geo.Haversine(prev.Lat, prev.Lon, cur.Lat, cur.Lon),
+		}
+		prevMatch, prevOK := matchesByID[prev.ID]
+		curMatch, curOK := matchesByID[cur.ID]
+		if prevOK && curOK && !prevMatch.OffRoute && !curMatch.OffRoute {
+			m.ShapeMeters = curMatch.ShapeDistTraveled - prevMatch.ShapeDistTraveled
+		}
+		// Two snapshots can carry the same report, and then we can't say
+		// anything about speed.
+		if m.Seconds > 0 {
+			m.HaversineSpeed = m.HaversineMeters / m.Seconds
+			m.ShapeSpeed = m.ShapeMeters / m.Seconds
+		}
+		m.Stationary = m.HaversineMeters < stationaryMeters
+		metrics = append(metrics, m)
+
+		if !m.Stationary {
+			closeDwell()
+			continue
+		}
+		if dwell == nil {
+			dwell = &DwellPeriod{
+				TripInstanceID:     prev.TripInstanceID,
+				FirstBusPositionID: prev.ID,
+				Start:              times[i-1],
+				Lat:                prev.Lat,
+				Lon:                prev.Lon,
+			}
+			if prevOK && !prevMatch.OffRoute {
+				dwell.ShapeDistTraveled = prevMatch.ShapeDistTraveled
+				dwell.Layover = shapeLength > 0 &&
+					(prevMatch.ShapeDistTraveled < terminalMeters || shapeLength-prevMatch.ShapeDistTraveled < terminalMeters)
+			}
+		}
+		dwell.LastBusPositionID = cur.ID
+		dwell.End = times[i]
+	}
+	closeDwell()
+	return metrics, dwells
+}
+
+// SaveMetrics replaces whatever we computed for this trip last time.
+func SaveMetrics(db *gorm.DB, tripInstanceID uint, metrics []PositionMetric, dwells []DwellPeriod) {
+	err := db.Unscoped().Where("trip_instance_id = ?", tripInstanceID).Delete(PositionMetric{}).Error
+	check(err)
+	err = db.Unscoped().Where("trip_instance_id = ?", tripInstanceID).Delete(DwellPeriod{}).Error
+	check(err)
+	for _, m := range metrics {
+		m.TripInstanceID = tripInstanceID
+		err = db.Create(&m).Error
+		check(err)
+	}
+	for _, d := range dwells {
+		d.TripInstanceID = tripInstanceID
+		err = db.Create(&d).Error
+		check(err)
+	}
+}
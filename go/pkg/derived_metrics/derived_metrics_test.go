@@ -0,0 +1,77 @@
+package derived_metrics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/map_matching"
+	"github.com/markongithub/bus_data_archive/pkg/test_util"
+	"gotest.tools/v3/assert"
+)
+
+// The bus lays over at the start of the route, drives 432 meters in two
+// minutes, stops for a minute in the middle of the route and then drives on.
+func samplePositions() []bus_positions.BusPosition {
+	positions := []bus_positions.BusPosition{
+		{ReportedAt: "2019-09-19T07:55:00", Lat: 38.9, Lon: -77.0},
+		{ReportedAt: "2019-09-19T07:58:00", Lat: 38.90001, Lon: -77.0},
+		{ReportedAt: "2019-09-19T08:00:00", Lat: 38.9, Lon: -76.995},
+		{ReportedAt: "2019-09-19T08:01:00", Lat: 38.90005, Lon: -76.995},
+		{ReportedAt: "2019-09-19T08:03:00", Lat: 38.9, Lon: -76.99},
+	}
+	for i := range positions {
+		positions[i].ID = uint(i + 1)
+		positions[i].TripInstanceID = 1
+	}
+	return positions
+}
+
+func TestComputeMetricsWithoutShape(t *testing.T) {
+	metrics, dwells := ComputeMetrics(samplePositions(), nil, 0, test_util.Eastern())
+	assert.Equal(t, len(metrics), 4)
+	assert.Equal(t, metrics[0].BusPositionID, uint(2))
+	assert.Equal(t, metrics[0].Seconds, 180.0)
+	assert.Assert(t, metrics[0].Stationary)
+	assert.Assert(t, !metrics[1].Stationary)
+	assert.Assert(t, math.Abs(metrics[1].HaversineSpeed-432.9/120) < 0.05, "got %f", metrics[1].HaversineSpeed)
+	assert.Equal(t, metrics[1].ShapeSpeed, 0.0)
+
+	assert.Equal(t, len(dwells), 2)
+	assert.Equal(t, dwells[0].FirstBusPositionID, uint(1))
+	assert.Equal(t, dwells[0].LastBusPositionID, uint(2))
+	assert.Equal(t, dwells[0].Seconds, 180.0)
+	// without a shape we can't know this was a layover
+	assert.Assert(t, !dwells[0].Layover)
+	assert.Equal(t, dwells[1].Seconds, 60.0)
+}
+
+func TestComputeMetricsWithShape(t *testing.T) {
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	shape, _ := feed.TripShape("T1")
+	positions := samplePositions()
+	matched := map_matching.MatchPositions("S1", shape, positions)
+	metrics, dwells := ComputeMetrics(positions, matched, shape.Length(), test_util.Eastern())
+	assert.Assert(t, math.Abs(metrics[1].ShapeMeters-432.9) < 1, "got %f", metrics[1].ShapeMeters)
+	assert.Assert(t, metrics[1].ShapeSpeed > 3.5)
+	assert.Assert(t, dwells[0].Layover)
+	assert.Assert(t, !dwells[1].Layover)
+}
+
+func TestSaveMetrics(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	check(err)
+	defer db.Close()
+	db.AutoMigrate(&PositionMetric{}, &DwellPeriod{})
+	metrics, dwells := ComputeMetrics(samplePositions(), nil, 0, test_util.Eastern())
+	SaveMetrics(db, 1, metrics, dwells)
+	SaveMetrics(db, 1, metrics, dwells)
+	var count int
+	db.Model(&PositionMetric{}).Count(&count)
+	assert.Equal(t, count, 4)
+	db.Model(&DwellPeriod{}).Count(&count)
+	assert.Equal(t, count, 2)
+}
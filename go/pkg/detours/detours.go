@@ -0,0 +1,295 @@
+package detours
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/geo"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/map_matching"
+)
+
+// Fewer off-route positions in a row than this is more likely a GPS glitch
+// than a detour.
+const DefaultMinPositions = 3
+
+// Excursions on the same shape more than this far apart in time are separate
+// episodes.
+const DefaultMaxGap = time.Hour
+
+// It's only a detour if more than one trip did it. One bus leaving the shape
+// is a driver who got lost, or the wrong trip ID.
+const DefaultMinTrips = 2
+
+// Two excursions are on the same stretch of the shape if they left and
+// rejoined it within this many meters of each other.
+const SpanSlackMeters = 300.0
+
+const (
+	ReviewConfirmed = "confirmed"
+	ReviewRejected  = "rejected"
+)
+
+// An Excursion is one trip's run of consecutive off-route positions.
+type Excursion struct {
+	TripInstanceID uint
+	TripID         string
+	RouteID        string
+	ShapeID        string
+	VehicleID      string
+	// when the first and last off-route positions were reported
+	Start time.Time
+	End   time.Time
+	// Meters along the shape where the bus was last on it before leaving and
+	// first on it again after. If the trip started or ended off the shape
+	// these come from the nearest off-route position instead.
+	LeftShapeAt     float64
+	RejoinedShapeAt float64
+	Positions       int
+	// what the bus actually drove, from the last position on the shape to the
+	// first one back on it
+	Path []geo.Point
+}
+
+// An Episode is a detour: excursions by several trips on the same route,
+// leaving and rejoining the shape at about the same places within a few
+// hours of each other. We store them for someone to review.
+type Episode struct {
+	gorm.Model
+	ServiceDate string `gorm:"index"`
+	RouteID     string
+	ShapeID     string
+	Start       time.Time
+	End         time.Time
+	Trips       int
+	// comma-separated, sorted
+	TripIDs  string `gorm:"type:text"`
+	Vehicles string `gorm:"type:text"`
+	// the widest stretch of the shape any of the excursions skipped
+	LeftShapeAt     float64
+	RejoinedShapeAt float64
+	// a GeoJSON LineString of the path driven by the excursion with the most
+	// positions
+	Geometry string `gorm:"type:text"`
+	// blank until someone looks at it, then ReviewConfirmed or ReviewRejected
+	Review      string
+	ReviewNotes string `gorm:"type:text"`
+}
+
+// FindExcursions finds the runs of at least minPositions off-route positions
+// in one trip. matched must be positions projected onto the trip's shape, in
+// the same order.
+func FindExcursions(trip bus_positions.TripInstance, positions []bus_positions.BusPosition, matched []map_matching.MatchedPosition, location *time.Location, minPositions int) ([]Excursion, error) {
+	if len(matched) != len(positions) {
+		return nil, fmt.Errorf("trip %s has %d positions but %d matches", trip.TripID, len(positions), len(matched))
+	}
+	var output []Excursion
+	var current *Excursion
+	lastOnRoute := -1
+	finish := func() {
+		if current != nil && current.Positions >= minPositions {
+			output = append(output, *current)
+		}
+		current = nil
+	}
+	for i, mp := range matched {
+		bp := positions[i]
+		if mp.BusPositionID != bp.ID {
+			return nil, fmt.Errorf("trip %s's matches aren't in the same order as its positions", trip.TripID)
+		}
+		if !mp.OffRoute {
+			if current != nil {
+				current.RejoinedShapeAt = mp.ShapeDistTraveled
+				current.Path = append(current.Path, geo.Point{Lat: bp.Lat, Lon: bp.Lon})
+				finish()
+			}
+			lastOnRoute = i
+			continue
+		}
+		reportedAt, err := bus_positions.ParseReportTime(bp.ReportedAt, location)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			current = &Excursion{
+				TripInstanceID: trip.ID,
+				TripID:         trip.TripID,
+				RouteID:        trip.RouteID,
+				ShapeID:        mp.ShapeID,
+				VehicleID:      trip.VehicleID,
+				Start:          reportedAt,
+				LeftShapeAt:    mp.ShapeDistTraveled,
+			}
+			if lastOnRoute >= 0 {
+				current.LeftShapeAt = matched[lastOnRoute].ShapeDistTraveled
+				current.Path = append(current.Path, geo.Point{Lat: positions[lastOnRoute].Lat, Lon: positions[lastOnRoute].Lon})
+			}
+		}
+		current.End = reportedAt
+		current.RejoinedShapeAt = mp.ShapeDistTraveled
+		current.Positions++
+		current.Path = append(current.Path, geo.Point{Lat: bp.Lat, Lon: bp.Lon})
+	}
+	finish()
+	return output, nil
+}
+
+// TripExcursions matches the trip to its shape, using map_matching's cache,
+// and finds its excursions. The bool is false if the trip isn't in the feed.
+func TripExcursions(db *gorm.DB, feed gtfs_schedule.Feed, trip bus_positions.TripInstance, location *time.Location, minPositions int) ([]Excursion, bool, error) {
+	positions, matched, ok := map_matching.MatchTrip(db, feed, trip)
+	if !ok {
+		return nil, false, nil
+	}
+	excursions, err := FindExcursions(trip, positions, matched, location, minPositions)
+	return excursions, true, err
+}
+
+func overlaps(e Excursion, ep *Episode) bool {
+	return e.LeftShapeAt <= ep.RejoinedShapeAt+SpanSlackMeters && e.RejoinedShapeAt >= ep.LeftShapeAt-SpanSlackMeters
+}
+
+func sortedSet(set map[string]bool) string {
+	values := make([]string, 0, len(set))
+	for v := range set {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
+
+type lineString struct {
+	Type        string       `json:"type"`
+	Coordinates [][2]float64 `json:"coordinates"`
+}
+
+// GeoJSON encodes a path as a GeoJSON LineString geometry.
+func GeoJSON(path []geo.Point) string {
+	coordinates := make([][2]float64, 0, len(path))
+	for _, p := range path {
+		coordinates = append(coordinates, [2]float64{p.Lon, p.Lat})
+	}
+	encoded, err := json.Marshal(lineString{"LineString", coordinates})
+	if err != nil {
+		// can't happen with a slice of floats
+		panic(err)
+	}
+	return string(encoded)
+}
+
+// GroupEpisodes groups excursions on the same route and shape into episodes.
+// An excursion joins an episode if it skipped about the same stretch of the
+// shape and started no more than maxGap after the episode's last excursion
+// ended. Episodes with fewer than minTrips trips are dropped.
+func GroupEpisodes(serviceDate string, excursions []Excursion, maxGap time.Duration, minTrips int) []Episode {
+	sorted := append([]Excursion(nil), excursions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].RouteID != sorted[j].RouteID {
+			return sorted[i].RouteID < sorted[j].RouteID
+		}
+		if sorted[i].ShapeID != sorted[j].ShapeID {
+			return sorted[i].ShapeID < sorted[j].ShapeID
+		}
+		return sorted[i].Start.Before(sorted[j].Start)
+	})
+
+	type group struct {
+		episode      Episode
+		trips        map[string]bool
+		vehicles     map[string]bool
+		longestTrace Excursion
+	}
+	var groups []*group
+	for _, e := range sorted {
+		var joined *group
+		for _, g := range groups {
+			ep := &g.episode
+			if ep.RouteID == e.RouteID && ep.ShapeID == e.ShapeID && !e.Start.After(ep.End.Add(maxGap)) && overlaps(e, ep) {
+				joined = g
+				break
+			}
+		}
+		if joined == nil {
+			joined = &group{
+				episode: Episode{
+					ServiceDate:     serviceDate,
+					RouteID:         e.RouteID,
+					ShapeID:         e.ShapeID,
+					Start:           e.Start,
+					End:             e.End,
+					LeftShapeAt:     e.LeftShapeAt,
+					RejoinedShapeAt: e.RejoinedShapeAt,
+				},
+				trips:    map[string]bool{},
+				vehicles: map[string]bool{},
+			}
+			groups = append(groups, joined)
+		}
+		ep := &joined.episode
+		if e.End.After(ep.End) {
+			ep.End = e.End
+		}
+		if e.LeftShapeAt < ep.LeftShapeAt {
+			ep.LeftShapeAt = e.LeftShapeAt
+		}
+		if e.RejoinedShapeAt > ep.RejoinedShapeAt {
+			ep.RejoinedShapeAt = e.RejoinedShapeAt
+		}
+		joined.trips[e.TripID] = true
+		if e.VehicleID != "" {
+			joined.vehicles[e.VehicleID] = true
+		}
+		if e.Positions > joined.longestTrace.Positions {
+			joined.longestTrace = e
+		}
+	}
+
+	var output []Episode
+	for _, g := range groups {
+		if len(g.trips) < minTrips {
+			continue
+		}
+		ep := g.episode
+		ep.Trips = len(g.trips)
+		ep.TripIDs = sortedSet(g.trips)
+		ep.Vehicles = sortedSet(g.vehicles)
+		ep.Geometry = GeoJSON(g.longestTrace.Path)
+		output = append(output, ep)
+	}
+	return output
+}
+
+// SaveEpisodes replaces the episodes we found for the service date last time.
+// Episodes someone has already reviewed are kept, and a new episode on the
+// same shape at the same time as a reviewed one is not saved again.
+func SaveEpisodes(db *gorm.DB, serviceDate string, episodes []Episode) error {
+	err := db.Unscoped().Where("service_date = ? AND review = ?", serviceDate, "").Delete(Episode{}).Error
+	if err != nil {
+		return err
+	}
+	var reviewed []Episode
+	if err = db.Where("service_date = ?", serviceDate).Find(&reviewed).Error; err != nil {
+		return err
+	}
+	for _, ep := range episodes {
+		duplicate := false
+		for _, r := range reviewed {
+			if r.RouteID == ep.RouteID && r.ShapeID == ep.ShapeID && !ep.Start.After(r.End) && !ep.End.Before(r.Start) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+		if err = db.Create(&ep).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package detours
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/map_matching"
+	"github.com/markongithub/bus_data_archive/pkg/test_util"
+	"gotest.tools/v3/assert"
+)
+
+// The bus starts on S1, leaves it about 550 meters north for three positions
+// and rejoins it at the third shape point, 867 meters along.
+func detourPositions(hour int, detour bool) []bus_positions.BusPosition {
+	lats := []float64{38.9, 38.9, 38.9, 38.9, 38.9}
+	if detour {
+		lats = []float64{38.9, 38.905, 38.905, 38.905, 38.9}
+	}
+	lons := []float64{-77.0, -76.995, -76.993, -76.991, -76.99}
+	var positions []bus_positions.BusPosition
+	for i := range lats {
+		positions = append(positions, bus_positions.BusPosition{
+			ReportedAt:  fmt.Sprintf("2019-09-19T%02d:%02d:00", hour, i*2),
+			Lat:         lats[i],
+			Lon:         lons[i],
+			ServiceDate: "2019-09-19",
+		})
+	}
+	return positions
+}
+
+func TestFindExcursions(t *testing.T) {
+	location := test_util.Eastern()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	shape, ok := feed.TripShape("T1")
+	assert.Assert(t, ok)
+	positions := detourPositions(8, true)
+	matched := map_matching.MatchPositions("S1", shape, positions)
+	trip := bus_positions.TripInstance{TripID: "T1", RouteID: "10A", VehicleID: "3171"}
+
+	excursions, err := FindExcursions(trip, positions, matched, location, DefaultMinPositions)
+	assert.NilError(t, err)
+	assert.Equal(t, len(excursions), 1)
+	e := excursions[0]
+	assert.Equal(t, e.Positions, 3)
+	assert.Equal(t, e.Start, time.Date(2019, 9, 19, 8, 2, 0, 0, location))
+	assert.Equal(t, e.End, time.Date(2019, 9, 19, 8, 6, 0, 0, location))
+	assert.Equal(t, e.LeftShapeAt, 0.0)
+	assert.Assert(t, e.RejoinedShapeAt > 860 && e.RejoinedShapeAt < 870)
+	// from the last position on the shape to the first one back on it
+	assert.Equal(t, len(e.Path), 5)
+
+	// two off-route positions aren't enough
+	excursions, err = FindExcursions(trip, positions, matched, location, 4)
+	assert.NilError(t, err)
+	assert.Equal(t, len(excursions), 0)
+
+	// a position that wasn't matched would throw off every one after it
+	_, err = FindExcursions(trip, positions, matched[1:], location, DefaultMinPositions)
+	assert.ErrorContains(t, err, "5 positions but 4 matches")
+}
+
+func TestDetectAndSaveEpisodes(t *testing.T) {
+	location := test_util.Eastern()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	defer db.Close()
+	db.AutoMigrate(&bus_positions.TripInstance{}, &bus_positions.BusPosition{}, &map_matching.MatchedPosition{}, &Episode{})
+
+	// T1 and T2 detour, T3 doesn't, and T1 again much later by itself.
+	trips := []struct {
+		tripID    string
+		startTime string
+		vehicleID string
+		hour      int
+		detour    bool
+	}{
+		{"T1", "2019-09-19T08:00:00", "3171", 8, true},
+		{"T2", "2019-09-19T08:15:00", "3172", 9, true},
+		{"T3", "2019-09-19T08:30:00", "3173", 10, false},
+		{"T1", "2019-09-20T08:00:00", "3171", 18, true},
+	}
+	var excursions []Excursion
+	for _, tr := range trips {
+		trip := bus_positions.TripInstance{TripID: tr.tripID, RouteID: "10A", VehicleID: tr.vehicleID, TripStartTime: tr.startTime, ServiceDate: "2019-09-19"}
+		assert.NilError(t, db.Create(&trip).Error)
+		for _, bp := range detourPositions(tr.hour, tr.detour) {
+			bp.TripInstanceID = trip.ID
+			assert.NilError(t, db.Create(&bp).Error)
+		}
+		found, ok, err := TripExcursions(db, feed, trip, location, DefaultMinPositions)
+		assert.NilError(t, err)
+		assert.Assert(t, ok)
+		excursions = append(excursions, found...)
+	}
+	assert.Equal(t, len(excursions), 3)
+
+	episodes := GroupEpisodes("2019-09-19", excursions, DefaultMaxGap, DefaultMinTrips)
+	assert.Equal(t, len(episodes), 1)
+	ep := episodes[0]
+	assert.Equal(t, ep.RouteID, "10A")
+	assert.Equal(t, ep.ShapeID, "S1")
+	assert.Equal(t, ep.Trips, 2)
+	assert.Equal(t, ep.TripIDs, "T1,T2")
+	assert.Equal(t, ep.Vehicles, "3171,3172")
+	assert.Equal(t, ep.Start, time.Date(2019, 9, 19, 8, 2, 0, 0, location))
+	assert.Equal(t, ep.End, time.Date(2019, 9, 19, 9, 6, 0, 0, location))
+	assert.Equal(t, ep.Geometry, `{"type":"LineString","coordinates":[[-77,38.9],[-76.995,38.905],[-76.993,38.905],[-76.991,38.905],[-76.99,38.9]]}`)
+
+	// A reviewed episode survives being found again.
+	assert.NilError(t, SaveEpisodes(db, "2019-09-19", episodes))
+	var saved Episode
+	assert.NilError(t, db.First(&saved).Error)
+	assert.NilError(t, db.Model(&saved).Update("review", ReviewConfirmed).Error)
+	assert.NilError(t, SaveEpisodes(db, "2019-09-19", episodes))
+	var count int
+	db.Model(&Episode{}).Count(&count)
+	assert.Equal(t, count, 1)
+}
@@ -0,0 +1,295 @@
+package fleet
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/geo"
+)
+
+// A Vehicle is everything we've worked out about one bus from watching it.
+// The loaders keep it up to date; Series, FuelType and Garage only come from
+// a fleet metadata file.
+type Vehicle struct {
+	gorm.Model
+	VehicleID string `gorm:"unique_index"`
+	// comma-separated and sorted, like "clever,wmatabus". Each agency has its
+	// own database, so in practice this is one agency.
+	Agencies  string
+	Routes    string
+	Blocks    string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// service days we saw it on
+	DaysActive int
+	// the sum of the straight lines between its positions
+	DistanceMeters float64
+	// where it was at LastSeen, so we can add on the next leg
+	LastLat  float64
+	LastLon  float64
+	Series   string
+	FuelType string
+	Garage   string
+}
+
+// A VehicleService says a vehicle ran a route on a block on a service day.
+// This is what we join against to ask which buses ran a route last month.
+type VehicleService struct {
+	gorm.Model
+	VehicleID    string `gorm:"unique_index:idx_vehicle_service"`
+	ServiceDate  string `gorm:"unique_index:idx_vehicle_service;index"`
+	Agency       string `gorm:"unique_index:idx_vehicle_service"`
+	RouteID      string `gorm:"unique_index:idx_vehicle_service;index"`
+	BlockID      string `gorm:"unique_index:idx_vehicle_service"`
+	Observations int
+}
+
+// An Observation is one new position report from either feed.
+type Observation struct {
+	Agency      string
+	VehicleID   string
+	RouteID     string
+	BlockID     string
+	ServiceDate string
+	At          time.Time
+	Lat         float64
+	Lon         float64
+}
+
+func addToSet(set string, value string) string {
+	if value == "" {
+		return set
+	}
+	var values []string
+	if set != "" {
+		values = strings.Split(set, ",")
+	}
+	for _, v := range values {
+		if v == value {
+			return set
+		}
+	}
+	values = append(values, value)
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
+
+// A Batch holds a snapshot's observations so the registry can be updated
+// with a couple of queries per vehicle rather than several per report.
+type Batch struct {
+	observations []Observation
+}
+
+func (b *Batch) Add(o Observation) {
+	b.observations = append(b.observations, o)
+}
+
+type serviceKey struct {
+	VehicleID   string
+	ServiceDate string
+	Agency      string
+	RouteID     string
+	BlockID     string
+}
+
+type vehicleDate struct {
+	VehicleID   string
+	ServiceDate string
+}
+
+// Save adds everything in the batch to the registry, in the order it was
+// added, and empties it. Reports have to come in roughly chronological order
+// for the distance to mean anything; one older than the last we saw doesn't
+// add any.
+func (b *Batch) Save(db *gorm.DB) error {
+	if len(b.observations) == 0 {
+		return nil
+	}
+	idSet := make(map[string]bool)
+	dateSet := make(map[string]bool)
+	for _, o := range b.observations {
+		idSet[o.VehicleID] = true
+		dateSet[o.ServiceDate] = true
+	}
+	ids := make([]string, 0, len(idSet))
+	for id := range idSet {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	dates := make([]string, 0, len(dateSet))
+	for date := range dateSet {
+		dates = append(dates, date)
+	}
+
+	var existing []Vehicle
+	if err := db.Where("vehicle_id IN (?)", ids).Find(&existing).Error; err != nil {
+		return err
+	}
+	vehicles := make(map[string]*Vehicle, len(ids))
+	for i := range existing {
+		vehicles[existing[i].VehicleID] = &existing[i]
+	}
+	var existingServices []VehicleService
+	if err := db.Where("vehicle_id IN (?) AND service_date IN (?)", ids, dates).Find(&existingServices).Error; err != nil {
+		return err
+	}
+	services := make(map[serviceKey]*VehicleService, len(existingServices))
+	daysSeen := make(map[vehicleDate]bool)
+	for i := range existingServices {
+		s := &existingServices[i]
+		services[serviceKey{s.VehicleID, s.ServiceDate, s.Agency, s.RouteID, s.BlockID}] = s
+		daysSeen[vehicleDate{s.VehicleID, s.ServiceDate}] = true
+	}
+	var changedServices []*VehicleService
+	changed := make(map[*VehicleService]bool)
+
+	for _, o := range b.observations {
+		v, ok := vehicles[o.VehicleID]
+		if !ok {
+			v = &Vehicle{VehicleID: o.VehicleID}
+			vehicles[o.VehicleID] = v
+		}
+		day := vehicleDate{o.VehicleID, o.ServiceDate}
+		if !daysSeen[day] && o.ServiceDate != "" {
+			v.DaysActive++
+		}
+		daysSeen[day] = true
+		key := serviceKey{o.VehicleID, o.ServiceDate, o.Agency, o.RouteID, o.BlockID}
+		service, ok := services[key]
+		if !ok {
+			service = &VehicleService{VehicleID: o.VehicleID, ServiceDate: o.ServiceDate, Agency: o.Agency, RouteID: o.RouteID, BlockID: o.BlockID}
+			services[key] = service
+		}
+		service.Observations++
+		if !changed[service] {
+			changed[service] = true
+			changedServices = append(changedServices, service)
+		}
+
+		v.Agencies = addToSet(v.Agencies, o.Agency)
+		v.Routes = addToSet(v.Routes, o.RouteID)
+		v.Blocks = addToSet(v.Blocks, o.BlockID)
+		switch {
+		case v.LastSeen.IsZero():
+			// new, or only in the metadata until now
+			v.FirstSeen, v.LastSeen, v.LastLat, v.LastLon = o.At, o.At, o.Lat, o.Lon
+		case o.At.After(v.LastSeen):
+			v.DistanceMeters += geo.Haversine(v.LastLat, v.LastLon, o.Lat, o.Lon)
+			v.LastSeen, v.LastLat, v.LastLon = o.At, o.Lat, o.Lon
+		case o.At.Before(v.FirstSeen):
+			v.FirstSeen = o.At
+		}
+	}
+
+	for _, service := range changedServices {
+		if err := db.Save(service).Error; err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		if err := db.Save(vehicles[id]).Error; err != nil {
+			return err
+		}
+	}
+	b.observations = nil
+	return nil
+}
+
+// Observe adds one report to the registry. Loaders that see many reports at
+// once should use a Batch instead.
+func Observe(db *gorm.DB, o Observation) error {
+	var b Batch
+	b.Add(o)
+	return b.Save(db)
+}
+
+// Metadata is one row of the fleet metadata file, which is a CSV like
+//
+//	vehicle_id,series,fuel_type,garage
+//	3171,2016 New Flyer XDE40,hybrid,Landover
+//
+// Only vehicle_id is required.
+type Metadata struct {
+	VehicleID string
+	Series    string
+	FuelType  string
+	Garage    string
+}
+
+func ReadMetadata(r io.Reader) ([]Metadata, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, present := columns["vehicle_id"]; !present {
+		return nil, fmt.Errorf("the fleet metadata has no vehicle_id column")
+	}
+	get := func(record []string, name string) string {
+		i, present := columns[name]
+		if !present || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	output := make([]Metadata, 0, len(records)-1)
+	for _, record := range records[1:] {
+		output = append(output, Metadata{
+			VehicleID: get(record, "vehicle_id"),
+			Series:    get(record, "series"),
+			FuelType:  get(record, "fuel_type"),
+			Garage:    get(record, "garage"),
+		})
+	}
+	return output, nil
+}
+
+func LoadMetadata(path string) ([]Metadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadMetadata(f)
+}
+
+// ApplyMetadata copies the metadata onto the registry, adding vehicles we
+// haven't seen yet so they're there when they show up.
+func ApplyMetadata(db *gorm.DB, metadata []Metadata) error {
+	for _, m := range metadata {
+		var v Vehicle
+		if err := db.Where(Vehicle{VehicleID: m.VehicleID}).FirstOrInit(&v).Error; err != nil {
+			return err
+		}
+		v.Series, v.FuelType, v.Garage = m.Series, m.FuelType, m.Garage
+		if err := db.Save(&v).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VehiclesOnRoute finds the vehicles that ran a route on the service dates
+// from start to end, YYYY-MM-DD. An empty fuelType means any fuel.
+func VehiclesOnRoute(db *gorm.DB, routeID string, start string, end string, fuelType string) ([]Vehicle, error) {
+	query := db.Joins("JOIN vehicle_services ON vehicle_services.vehicle_id = vehicles.vehicle_id AND vehicle_services.deleted_at IS NULL").
+		Where("vehicle_services.route_id = ? AND vehicle_services.service_date >= ? AND vehicle_services.service_date <= ?", routeID, start, end)
+	if fuelType != "" {
+		query = query.Where("vehicles.fuel_type = ?", fuelType)
+	}
+	var vehicles []Vehicle
+	err := query.Select("DISTINCT vehicles.*").Order("vehicles.vehicle_id").Find(&vehicles).Error
+	return vehicles, err
+}
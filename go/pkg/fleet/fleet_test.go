@@ -0,0 +1,115 @@
+package fleet
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"gotest.tools/v3/assert"
+)
+
+func at(day, hour, minute int) time.Time {
+	return time.Date(2019, 9, day, hour, minute, 0, 0, time.UTC)
+}
+
+func testDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	db.AutoMigrate(&Vehicle{}, &VehicleService{})
+	return db
+}
+
+func TestObserve(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	observations := []Observation{
+		{Agency: "wmatabus", VehicleID: "3171", RouteID: "10A", BlockID: "B1", ServiceDate: "2019-09-19", At: at(19, 8, 0), Lat: 38.9, Lon: -77.0},
+		{Agency: "wmatabus", VehicleID: "3171", RouteID: "10A", BlockID: "B1", ServiceDate: "2019-09-19", At: at(19, 8, 1), Lat: 38.9, Lon: -76.99},
+		{Agency: "wmatabus", VehicleID: "3171", RouteID: "10B", BlockID: "B1", ServiceDate: "2019-09-19", At: at(19, 8, 30), Lat: 38.9, Lon: -76.98},
+		{Agency: "wmatabus", VehicleID: "3171", RouteID: "10A", BlockID: "B7", ServiceDate: "2019-09-20", At: at(20, 8, 0), Lat: 38.9, Lon: -76.98},
+		// late and out of order, so it doesn't count toward the distance
+		{Agency: "wmatabus", VehicleID: "3171", RouteID: "10A", BlockID: "B1", ServiceDate: "2019-09-19", At: at(19, 7, 59), Lat: 39.9, Lon: -76.98},
+		{Agency: "wmatabus", VehicleID: "8001", RouteID: "10A", BlockID: "B2", ServiceDate: "2019-09-19", At: at(19, 9, 0), Lat: 38.9, Lon: -77.0},
+	}
+	for _, o := range observations {
+		assert.NilError(t, Observe(db, o))
+	}
+
+	var v Vehicle
+	assert.NilError(t, db.Where("vehicle_id = ?", "3171").First(&v).Error)
+	assert.Equal(t, v.Agencies, "wmatabus")
+	assert.Equal(t, v.Routes, "10A,10B")
+	assert.Equal(t, v.Blocks, "B1,B7")
+	assert.Equal(t, v.DaysActive, 2)
+	assert.Equal(t, v.FirstSeen.Unix(), at(19, 7, 59).Unix())
+	assert.Equal(t, v.LastSeen.Unix(), at(20, 8, 0).Unix())
+	// two legs of about 866m each, and then it sat in the garage overnight
+	assert.Assert(t, v.DistanceMeters > 1700 && v.DistanceMeters < 1760, v.DistanceMeters)
+
+	var service VehicleService
+	assert.NilError(t, db.Where("vehicle_id = ? AND service_date = ? AND route_id = ?", "3171", "2019-09-19", "10A").First(&service).Error)
+	assert.Equal(t, service.Observations, 3)
+}
+
+func TestBatch(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	var b Batch
+	b.Add(Observation{Agency: "wmatabus", VehicleID: "3171", RouteID: "10A", BlockID: "B1", ServiceDate: "2019-09-19", At: at(19, 8, 0), Lat: 38.9, Lon: -77.0})
+	b.Add(Observation{Agency: "wmatabus", VehicleID: "8001", RouteID: "10A", BlockID: "B2", ServiceDate: "2019-09-19", At: at(19, 8, 0), Lat: 38.9, Lon: -77.0})
+	b.Add(Observation{Agency: "wmatabus", VehicleID: "3171", RouteID: "10A", BlockID: "B1", ServiceDate: "2019-09-19", At: at(19, 8, 1), Lat: 38.9, Lon: -76.99})
+	assert.NilError(t, b.Save(db))
+	// the next snapshot picks up where that one left off
+	b.Add(Observation{Agency: "wmatabus", VehicleID: "3171", RouteID: "10A", BlockID: "B1", ServiceDate: "2019-09-19", At: at(19, 8, 2), Lat: 38.9, Lon: -76.98})
+	assert.NilError(t, b.Save(db))
+	assert.NilError(t, b.Save(db))
+
+	var v Vehicle
+	assert.NilError(t, db.Where("vehicle_id = ?", "3171").First(&v).Error)
+	assert.Equal(t, v.DaysActive, 1)
+	assert.Assert(t, v.DistanceMeters > 1700 && v.DistanceMeters < 1760, v.DistanceMeters)
+	var services []VehicleService
+	assert.NilError(t, db.Order("vehicle_id").Find(&services).Error)
+	assert.Equal(t, len(services), 2)
+	assert.Equal(t, services[0].Observations, 3)
+	assert.Equal(t, services[1].Observations, 1)
+}
+
+func TestMetadata(t *testing.T) {
+	metadata, err := ReadMetadata(strings.NewReader("vehicle_id,garage,fuel_type\n3171,Landover,hybrid\n9000,Bladensburg,electric\n"))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, metadata, []Metadata{
+		{VehicleID: "3171", FuelType: "hybrid", Garage: "Landover"},
+		{VehicleID: "9000", FuelType: "electric", Garage: "Bladensburg"},
+	})
+	_, err = ReadMetadata(strings.NewReader("bus,garage\n3171,Landover\n"))
+	assert.ErrorContains(t, err, "vehicle_id")
+
+	db := testDB(t)
+	defer db.Close()
+	assert.NilError(t, Observe(db, Observation{Agency: "wmatabus", VehicleID: "3171", RouteID: "10A", ServiceDate: "2019-09-19", At: at(19, 8, 0), Lat: 38.9, Lon: -77.0}))
+	assert.NilError(t, Observe(db, Observation{Agency: "wmatabus", VehicleID: "8001", RouteID: "10A", ServiceDate: "2019-09-19", At: at(19, 8, 0), Lat: 38.9, Lon: -77.0}))
+	assert.NilError(t, ApplyMetadata(db, metadata))
+	// 9000 shows up for the first time after the metadata did
+	assert.NilError(t, Observe(db, Observation{Agency: "wmatabus", VehicleID: "9000", RouteID: "10A", ServiceDate: "2019-09-20", At: at(20, 8, 0), Lat: 38.9, Lon: -77.0}))
+	assert.NilError(t, Observe(db, Observation{Agency: "wmatabus", VehicleID: "3171", RouteID: "10A", ServiceDate: "2019-10-01", At: time.Date(2019, 10, 1, 8, 0, 0, 0, time.UTC), Lat: 38.9, Lon: -77.0}))
+
+	var v Vehicle
+	assert.NilError(t, db.Where("vehicle_id = ?", "9000").First(&v).Error)
+	assert.Equal(t, v.Garage, "Bladensburg")
+	assert.Equal(t, v.DistanceMeters, 0.0)
+	assert.Equal(t, v.FirstSeen.Unix(), at(20, 8, 0).Unix())
+
+	vehicles, err := VehiclesOnRoute(db, "10A", "2019-09-01", "2019-09-30", "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(vehicles), 3)
+	vehicles, err = VehiclesOnRoute(db, "10A", "2019-09-01", "2019-09-30", "hybrid")
+	assert.NilError(t, err)
+	assert.Equal(t, len(vehicles), 1)
+	assert.Equal(t, vehicles[0].VehicleID, "3171")
+	vehicles, err = VehiclesOnRoute(db, "10B", "2019-09-01", "2019-09-30", "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(vehicles), 0)
+}
@@ -0,0 +1,133 @@
+package geo
+
+import (
+	"math"
+)
+
+const earthRadiusMeters = 6371008.8
+
+type Point struct {
+	Lat float64
+	Lon float64
+}
+
+// A Polyline is something like a GTFS shape. Dist holds the cumulative
+// distance in meters from the first point to each point.
+type Polyline struct {
+	Points []Point
+	Dist   []float64
+}
+
+type Projection struct {
+	// Meters along the polyline from its first point
+	DistAlong float64
+	// Meters between the original point and the polyline
+	Error   float64
+	Segment int
+	Lat     float64
+	Lon     float64
+}
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// Haversine returns the great circle distance in meters.
+func Haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*
+			math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+func NewPolyline(points []Point) Polyline {
+	dist := make([]float64, len(points))
+	for i := 1; i < len(points); i++ {
+		dist[i] = dist[i-1] + Haversine(points[i-1].Lat, points[i-1].Lon, points[i].Lat, points[i].Lon)
+	}
+	return Polyline{Points: points, Dist: dist}
+}
+
+func (p Polyline) Length() float64 {
+	if len(p.Dist) == 0 {
+		return 0
+	}
+	return p.Dist[len(p.Dist)-1]
+}
+
+// Over a single segment of a bus route a flat projection is plenty accurate.
+func localXY(origin Point, lat, lon float64) (float64, float64) {
+	x := toRadians(lon-origin.Lon) * math.Cos(toRadians(origin.Lat)) * earthRadiusMeters
+	y := toRadians(lat-origin.Lat) * earthRadiusMeters
+	return x, y
+}
+
+func (p Polyline) projectOntoSegment(i int, lat, lon float64) Projection {
+	a := p.Points[i]
+	b := p.Points[i+1]
+	bx, by := localXY(a, b.Lat, b.Lon)
+	px, py := localXY(a, lat, lon)
+	t := 0.0
+	if lengthSquared := bx*bx + by*by; lengthSquared > 0 {
+		t = (px*bx + py*by) / lengthSquared
+	}
+	if t < 0 {
+		t = 0
+	} else if t > 1 {
+		t = 1
+	}
+	projLat := a.Lat + t*(b.Lat-a.Lat)
+	projLon := a.Lon + t*(b.Lon-a.Lon)
+	return Projection{
+		DistAlong: p.Dist[i] + t*(p.Dist[i+1]-p.Dist[i]),
+		Error:     Haversine(lat, lon, projLat, projLon),
+		Segment:   i,
+		Lat:       projLat,
+		Lon:       projLon,
+	}
+}
+
+// Project finds the closest point on the whole polyline.
+func (p Polyline) Project(lat, lon float64) Projection {
+	return p.ProjectFrom(lat, lon, 0, 0)
+}
+
+// ProjectFrom only considers segments from fromSegment onward, which is how we
+// keep a bus moving forward along its shape. Shapes that loop back on
+// themselves will have several segments about equally close, so we take the
+// earliest one that is within slack meters of the best.
+func (p Polyline) ProjectFrom(lat, lon float64, fromSegment int, slack float64) Projection {
+	if len(p.Points) == 0 {
+		return Projection{}
+	}
+	if len(p.Points) == 1 {
+		return Projection{
+			Error: Haversine(lat, lon, p.Points[0].Lat, p.Points[0].Lon),
+			Lat:   p.Points[0].Lat,
+			Lon:   p.Points[0].Lon,
+		}
+	}
+	if fromSegment < 0 {
+		fromSegment = 0
+	}
+	if fromSegment > len(p.Points)-2 {
+		fromSegment = len(p.Points) - 2
+	}
+	candidates := make([]Projection, 0, len(p.Points)-1-fromSegment)
+	best := math.Inf(1)
+	for i := fromSegment; i < len(p.Points)-1; i++ {
+		proj := p.projectOntoSegment(i, lat, lon)
+		candidates = append(candidates, proj)
+		if proj.Error < best {
+			best = proj.Error
+		}
+	}
+	for _, proj := range candidates {
+		if proj.Error <= best+slack {
+			return proj
+		}
+	}
+	panic("no candidate projection was within slack of the best one")
+}
@@ -0,0 +1,39 @@
+package geo
+
+import (
+	"math"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func almostEqual(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestHaversine(t *testing.T) {
+	// Metro Center to Gallery Place is about 400 meters.
+	d := Haversine(38.898303, -77.028099, 38.898303, -77.023500)
+	assert.Assert(t, almostEqual(d, 398, 2), "got %f", d)
+	assert.Equal(t, Haversine(38.9, -77.0, 38.9, -77.0), 0.0)
+}
+
+func TestProject(t *testing.T) {
+	line := NewPolyline([]Point{{38.9, -77.0}, {38.9, -76.99}, {38.9, -76.98}})
+	assert.Assert(t, almostEqual(line.Length(), 1731, 2), "got %f", line.Length())
+	// a little north of the middle of the first segment
+	proj := line.Project(38.9005, -76.995)
+	assert.Equal(t, proj.Segment, 0)
+	assert.Assert(t, almostEqual(proj.DistAlong, line.Length()/4, 1), "got %f", proj.DistAlong)
+	assert.Assert(t, almostEqual(proj.Error, 55.6, 1), "got %f", proj.Error)
+}
+
+func TestProjectFromLoop(t *testing.T) {
+	// out and back along the same street
+	line := NewPolyline([]Point{{38.9, -77.0}, {38.9, -76.99}, {38.9, -77.0}})
+	proj := line.ProjectFrom(38.9, -76.995, 0, 10)
+	assert.Equal(t, proj.Segment, 0)
+	proj = line.ProjectFrom(38.9, -76.995, 1, 10)
+	assert.Equal(t, proj.Segment, 1)
+	assert.Assert(t, almostEqual(proj.DistAlong, line.Length()*3/4, 1), "got %f", proj.DistAlong)
+}
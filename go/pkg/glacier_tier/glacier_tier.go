@@ -0,0 +1,354 @@
+package glacier_tier
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/archiver"
+	"github.com/markongithub/bus_data_archive/pkg/purge"
+)
+
+// GlacierArchive records one day's tarball in one vault. Glacier can't list
+// a vault's contents quickly, so without this we'd never find it again.
+type GlacierArchive struct {
+	gorm.Model
+	Agency    string `gorm:"unique_index:idx_glacier_archive"`
+	Day       string `gorm:"unique_index:idx_glacier_archive"`
+	Vault     string `gorm:"unique_index:idx_glacier_archive"`
+	ArchiveID string
+	// the tarball's sha256 from the manifest, and the tree hash Glacier
+	// agreed with
+	SHA256   string
+	TreeHash string
+	Size     int64
+}
+
+// Restore job statuses. The first three are Glacier's.
+const (
+	RestoreInProgress = "InProgress"
+	RestoreSucceeded  = "Succeeded"
+	RestoreFailed     = "Failed"
+	// we've copied it back into archive/
+	RestoreDownloaded = "Downloaded"
+)
+
+type RestoreJob struct {
+	gorm.Model
+	GlacierArchiveID uint `gorm:"index"`
+	JobID            string
+	// Glacier's retrieval tier: Expedited, Standard or Bulk
+	Tier          string
+	Status        string `gorm:"index"`
+	StatusMessage string
+	CompletedAt   time.Time
+}
+
+func Migrate(db *gorm.DB) {
+	db.AutoMigrate(&GlacierArchive{}, &RestoreJob{})
+}
+
+type Vault struct {
+	Name   string
+	Client glacieriface.GlacierAPI
+}
+
+// DefaultVaults are the two in terraform. Restores come from the first one.
+func DefaultVaults(sess *session.Session) []Vault {
+	return []Vault{
+		{Name: "bus-data-vault-00", Client: glacier.New(sess, aws.NewConfig().WithRegion("us-west-2"))},
+		{Name: "bus-data-vault-00-eu-west-1", Client: glacier.New(sess, aws.NewConfig().WithRegion("eu-west-1"))},
+	}
+}
+
+type Tier struct {
+	DB     *gorm.DB
+	Vaults []Vault
+	// Glacier is the third copy, not the only one, so we don't delete a
+	// tarball until this finds it in both S3 buckets too.
+	Uploads purge.UploadChecker
+}
+
+// "-" means whichever account the credentials belong to.
+const accountID = "-"
+
+func (t Tier) vault(name string) (Vault, bool) {
+	for _, v := range t.Vaults {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Vault{}, false
+}
+
+func (t Tier) catalogued(agency string, day string, vault string) bool {
+	var count int
+	t.DB.Model(&GlacierArchive{}).Where("agency = ? AND day = ? AND vault = ?", agency, day, vault).Count(&count)
+	return count > 0
+}
+
+// Frozen is purge.FrozenChecker, so purge can trust a day whose tarball we
+// deleted.
+func (t Tier) Frozen(agency string, day string) (bool, error) {
+	for _, v := range t.Vaults {
+		var count int
+		err := t.DB.Model(&GlacierArchive{}).Where("agency = ? AND day = ? AND vault = ?", agency, day, v.Name).Count(&count).Error
+		if err != nil || count == 0 {
+			return false, err
+		}
+	}
+	return len(t.Vaults) > 0, nil
+}
+
+func (t Tier) upload(v Vault, agency string, m archiver.Manifest, archive string) (GlacierArchive, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return GlacierArchive{}, err
+	}
+	defer f.Close()
+	treeHash := hex.EncodeToString(glacier.ComputeHashes(f).TreeHash)
+	out, err := v.Client.UploadArchive(&glacier.UploadArchiveInput{
+		AccountId:          aws.String(accountID),
+		VaultName:          aws.String(v.Name),
+		ArchiveDescription: aws.String(fmt.Sprintf("%s/%s sha256:%s", agency, m.Archive, m.ArchiveSHA256)),
+		Checksum:           aws.String(treeHash),
+		Body:               f,
+	})
+	if err != nil {
+		return GlacierArchive{}, err
+	}
+	if aws.StringValue(out.Checksum) != treeHash {
+		return GlacierArchive{}, fmt.Errorf("%s got a tree hash of %s for %s, not %s", v.Name, aws.StringValue(out.Checksum), archive, treeHash)
+	}
+	ga := GlacierArchive{
+		Agency:    agency,
+		Day:       m.Day,
+		Vault:     v.Name,
+		ArchiveID: aws.StringValue(out.ArchiveId),
+		SHA256:    m.ArchiveSHA256,
+		TreeHash:  treeHash,
+		Size:      m.ArchiveSize,
+	}
+	return ga, t.DB.Create(&ga).Error
+}
+
+// What FreezeDay did with the local tarball
+const (
+	// every vault and both S3 buckets have it, so we deleted it
+	FreezeDeleted = "deleted"
+	// every vault has it and we were asked to keep it
+	FreezeKept = "kept"
+	// every vault has it but S3 doesn't yet, so we kept it for now
+	FreezeSkipped = "skipped"
+)
+
+// FreezeDay copies one day's verified tarball into every vault and, once
+// they and both S3 buckets all have it, deletes the local copy unless
+// keepLocal. The manifest stays behind.
+func (t Tier) FreezeDay(dataPath string, agency string, day string, keepLocal bool) (string, error) {
+	m, err := archiver.ReadManifest(archiver.ManifestPath(dataPath, day))
+	if err != nil {
+		return "", err
+	}
+	if !m.PurgeEligible {
+		return "", fmt.Errorf("the archive for %s hasn't been verified", day)
+	}
+	archive := archiver.ArchivePath(dataPath, day)
+	for _, v := range t.Vaults {
+		if t.catalogued(agency, day, v.Name) {
+			continue
+		}
+		fmt.Printf("Uploading %s to %s\n", archive, v.Name)
+		if _, err = t.upload(v, agency, m, archive); err != nil {
+			return "", err
+		}
+	}
+	if keepLocal {
+		return FreezeKept, nil
+	}
+	if t.Uploads == nil {
+		return "", fmt.Errorf("we can't check S3 for %s, so we can't delete it", archive)
+	}
+	uploaded, reason, err := t.Uploads.Uploaded(agency, m)
+	if err != nil {
+		return "", err
+	}
+	if !uploaded {
+		fmt.Printf("Keeping %s because %s.\n", archive, reason)
+		return FreezeSkipped, nil
+	}
+	fmt.Printf("Every vault and bucket has %s, so we're deleting it.\n", archive)
+	if err = os.Remove(archive); err != nil {
+		return "", err
+	}
+	return FreezeDeleted, nil
+}
+
+// Freeze moves every archived day older than minAgeDays into Glacier. It
+// returns the days it finished, meaning it deleted them or was asked to keep
+// them, and the days it has to come back for once S3 has them.
+func (t Tier) Freeze(dataPath string, agency string, minAgeDays int, now time.Time, keepLocal bool) ([]string, []string, error) {
+	archives, err := filepath.Glob(filepath.Join(dataPath, "archive", "*.tar.gz"))
+	if err != nil {
+		return nil, nil, err
+	}
+	cutoff := now.UTC().AddDate(0, 0, -minAgeDays)
+	var frozen, skipped []string
+	for _, archive := range archives {
+		day := strings.TrimSuffix(filepath.Base(archive), ".tar.gz")
+		t0, err := time.Parse("2006-01-02", day)
+		if err != nil || !t0.AddDate(0, 0, 1).Before(cutoff) {
+			continue
+		}
+		status, err := t.FreezeDay(dataPath, agency, day, keepLocal)
+		if err != nil {
+			return frozen, skipped, fmt.Errorf("%s: %s", day, err)
+		}
+		if status == FreezeSkipped {
+			skipped = append(skipped, day)
+		} else {
+			frozen = append(frozen, day)
+		}
+	}
+	sort.Strings(frozen)
+	sort.Strings(skipped)
+	return frozen, skipped, nil
+}
+
+// StartRestore asks the first vault that has the day to get it ready for
+// download. That takes hours.
+func (t Tier) StartRestore(agency string, day string, retrievalTier string) (RestoreJob, error) {
+	for _, v := range t.Vaults {
+		var ga GlacierArchive
+		if t.DB.Where("agency = ? AND day = ? AND vault = ?", agency, day, v.Name).First(&ga).RecordNotFound() {
+			continue
+		}
+		out, err := v.Client.InitiateJob(&glacier.InitiateJobInput{
+			AccountId: aws.String(accountID),
+			VaultName: aws.String(v.Name),
+			JobParameters: &glacier.JobParameters{
+				Type:      aws.String("archive-retrieval"),
+				ArchiveId: aws.String(ga.ArchiveID),
+				Tier:      aws.String(retrievalTier),
+			},
+		})
+		if err != nil {
+			return RestoreJob{}, err
+		}
+		job := RestoreJob{GlacierArchiveID: ga.ID, JobID: aws.StringValue(out.JobId), Tier: retrievalTier, Status: RestoreInProgress}
+		return job, t.DB.Create(&job).Error
+	}
+	return RestoreJob{}, fmt.Errorf("no vault has %s for %s", day, agency)
+}
+
+// PollRestores asks Glacier about every job that's still in progress.
+func (t Tier) PollRestores() ([]RestoreJob, error) {
+	var jobs []RestoreJob
+	if err := t.DB.Where("status = ?", RestoreInProgress).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	for i := range jobs {
+		var ga GlacierArchive
+		if err := t.DB.First(&ga, jobs[i].GlacierArchiveID).Error; err != nil {
+			return jobs, err
+		}
+		v, ok := t.vault(ga.Vault)
+		if !ok {
+			return jobs, fmt.Errorf("we don't know about vault %s", ga.Vault)
+		}
+		out, err := v.Client.DescribeJob(&glacier.DescribeJobInput{
+			AccountId: aws.String(accountID),
+			VaultName: aws.String(v.Name),
+			JobId:     aws.String(jobs[i].JobID),
+		})
+		if err != nil {
+			return jobs, err
+		}
+		if aws.StringValue(out.StatusCode) == RestoreInProgress {
+			continue
+		}
+		jobs[i].Status = aws.StringValue(out.StatusCode)
+		jobs[i].StatusMessage = aws.StringValue(out.StatusMessage)
+		jobs[i].CompletedAt = time.Now().UTC()
+		if err = t.DB.Save(&jobs[i]).Error; err != nil {
+			return jobs, err
+		}
+	}
+	return jobs, nil
+}
+
+// DownloadRestored copies every finished restore for the agency back into
+// archive/, checking it against the manifest before it replaces anything.
+func (t Tier) DownloadRestored(dataPath string, agency string) ([]string, error) {
+	var jobs []RestoreJob
+	err := t.DB.Joins("JOIN glacier_archives ON glacier_archives.id = restore_jobs.glacier_archive_id").
+		Where("restore_jobs.status = ? AND glacier_archives.agency = ?", RestoreSucceeded, agency).
+		Find(&jobs).Error
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, job := range jobs {
+		var ga GlacierArchive
+		if err = t.DB.First(&ga, job.GlacierArchiveID).Error; err != nil {
+			return days, err
+		}
+		if err = t.download(dataPath, ga, job); err != nil {
+			return days, fmt.Errorf("%s: %s", ga.Day, err)
+		}
+		job.Status = RestoreDownloaded
+		if err = t.DB.Save(&job).Error; err != nil {
+			return days, err
+		}
+		days = append(days, ga.Day)
+	}
+	return days, nil
+}
+
+func (t Tier) download(dataPath string, ga GlacierArchive, job RestoreJob) error {
+	m, err := archiver.ReadManifest(archiver.ManifestPath(dataPath, ga.Day))
+	if err != nil {
+		return err
+	}
+	v, ok := t.vault(ga.Vault)
+	if !ok {
+		return fmt.Errorf("we don't know about vault %s", ga.Vault)
+	}
+	out, err := v.Client.GetJobOutput(&glacier.GetJobOutputInput{
+		AccountId: aws.String(accountID),
+		VaultName: aws.String(v.Name),
+		JobId:     aws.String(job.JobID),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+	archive := archiver.ArchivePath(dataPath, ga.Day)
+	tmp := archive + ".restored"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, out.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = archiver.Verify(tmp, m)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, archive)
+}
@@ -0,0 +1,231 @@
+package glacier_tier
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/archiver"
+	"github.com/markongithub/bus_data_archive/pkg/purge"
+	"gotest.tools/v3/assert"
+)
+
+type fakeVault struct {
+	glacieriface.GlacierAPI
+	archives map[string][]byte
+	jobs     map[string]string // job ID to archive ID
+	status   string
+}
+
+func newFakeVault() *fakeVault {
+	return &fakeVault{archives: make(map[string][]byte), jobs: make(map[string]string), status: RestoreInProgress}
+}
+
+func (f *fakeVault) UploadArchive(input *glacier.UploadArchiveInput) (*glacier.ArchiveCreationOutput, error) {
+	b, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("archive-%d", len(f.archives))
+	f.archives[id] = b
+	treeHash := hex.EncodeToString(glacier.ComputeHashes(bytes.NewReader(b)).TreeHash)
+	return &glacier.ArchiveCreationOutput{ArchiveId: aws.String(id), Checksum: aws.String(treeHash)}, nil
+}
+
+func (f *fakeVault) InitiateJob(input *glacier.InitiateJobInput) (*glacier.InitiateJobOutput, error) {
+	id := fmt.Sprintf("job-%d", len(f.jobs))
+	f.jobs[id] = aws.StringValue(input.JobParameters.ArchiveId)
+	return &glacier.InitiateJobOutput{JobId: aws.String(id)}, nil
+}
+
+func (f *fakeVault) DescribeJob(input *glacier.DescribeJobInput) (*glacier.JobDescription, error) {
+	return &glacier.JobDescription{JobId: input.JobId, StatusCode: aws.String(f.status)}, nil
+}
+
+func (f *fakeVault) GetJobOutput(input *glacier.GetJobOutputInput) (*glacier.GetJobOutputOutput, error) {
+	b := f.archives[f.jobs[aws.StringValue(input.JobId)]]
+	return &glacier.GetJobOutputOutput{Body: ioutil.NopCloser(bytes.NewReader(b))}, nil
+}
+
+type fakeChecker map[string]bool
+
+func (f fakeChecker) Uploaded(agency string, m archiver.Manifest) (bool, string, error) {
+	if f[m.Day] {
+		return true, "", nil
+	}
+	return false, "it isn't in S3", nil
+}
+
+func archivedDays(t *testing.T, days ...string) string {
+	dataPath, err := ioutil.TempDir("", "glacier_tier")
+	assert.NilError(t, err)
+	for _, day := range days {
+		dir := filepath.Join(dataPath, "short_term", day)
+		assert.NilError(t, os.MkdirAll(dir, 0755))
+		b, err := ioutil.ReadFile("../bus_positions/test_data/buses2019-04-27T03:55:01.json")
+		assert.NilError(t, err)
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "buses"+day+"T03:55:01.json"), b, 0644))
+		_, err = archiver.ArchiveDay(dataPath, day, time.UTC)
+		assert.NilError(t, err)
+	}
+	return dataPath
+}
+
+func testTier(t *testing.T) (Tier, *fakeVault, *fakeVault) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	Migrate(db)
+	primary, twin := newFakeVault(), newFakeVault()
+	vaults := []Vault{{"bus-data-vault-00", primary}, {"bus-data-vault-00-eu-west-1", twin}}
+	return Tier{DB: db, Vaults: vaults, Uploads: fakeChecker{"2019-04-27": true}}, primary, twin
+}
+
+func TestFreeze(t *testing.T) {
+	dataPath := archivedDays(t, "2019-04-27", "2019-05-30")
+	defer os.RemoveAll(dataPath)
+	tier, primary, twin := testTier(t)
+	defer tier.DB.Close()
+
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	frozen, skipped, err := tier.Freeze(dataPath, "wmatabus", 30, now, false)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, frozen, []string{"2019-04-27"})
+	assert.Equal(t, len(skipped), 0)
+	assert.Equal(t, len(primary.archives), 1)
+	assert.Equal(t, len(twin.archives), 1)
+	_, err = os.Stat(archiver.ArchivePath(dataPath, "2019-04-27"))
+	assert.Assert(t, os.IsNotExist(err))
+	_, err = os.Stat(archiver.ManifestPath(dataPath, "2019-04-27"))
+	assert.NilError(t, err)
+	_, err = os.Stat(archiver.ArchivePath(dataPath, "2019-05-30"))
+	assert.NilError(t, err)
+
+	var catalog []GlacierArchive
+	tier.DB.Order("vault").Find(&catalog)
+	assert.Equal(t, len(catalog), 2)
+	assert.Equal(t, catalog[0].Vault, "bus-data-vault-00")
+	assert.Equal(t, catalog[0].ArchiveID, "archive-0")
+	assert.Equal(t, len(catalog[0].TreeHash), 64)
+}
+
+func TestFreezeKeepsWhatIsNotInS3(t *testing.T) {
+	dataPath := archivedDays(t, "2019-04-27")
+	defer os.RemoveAll(dataPath)
+	tier, primary, _ := testTier(t)
+	defer tier.DB.Close()
+	tier.Uploads = fakeChecker{}
+
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	frozen, skipped, err := tier.Freeze(dataPath, "wmatabus", 30, now, false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(frozen), 0)
+	assert.DeepEqual(t, skipped, []string{"2019-04-27"})
+	assert.Equal(t, len(primary.archives), 1)
+	_, err = os.Stat(archiver.ArchivePath(dataPath, "2019-04-27"))
+	assert.NilError(t, err)
+
+	status, err := tier.FreezeDay(dataPath, "wmatabus", "2019-04-27", true)
+	assert.NilError(t, err)
+	assert.Equal(t, status, FreezeKept)
+
+	tier.Uploads = nil
+	_, err = tier.FreezeDay(dataPath, "wmatabus", "2019-04-27", false)
+	assert.ErrorContains(t, err, "can't check S3")
+	_, err = os.Stat(archiver.ArchivePath(dataPath, "2019-04-27"))
+	assert.NilError(t, err)
+}
+
+func TestPurgeAfterFreeze(t *testing.T) {
+	dataPath := archivedDays(t, "2019-04-27", "2019-04-28")
+	defer os.RemoveAll(dataPath)
+	tier, _, _ := testTier(t)
+	defer tier.DB.Close()
+	tier.Uploads = fakeChecker{"2019-04-27": true, "2019-04-28": true}
+
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	frozen, _, err := tier.Freeze(dataPath, "wmatabus", 30, now, false)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, frozen, []string{"2019-04-27", "2019-04-28"})
+	// This one disappeared without ever going to Glacier.
+	tier.DB.Unscoped().Where("day = ?", "2019-04-28").Delete(&GlacierArchive{})
+
+	decisions, err := purge.Plan(dataPath, "wmatabus", 10, now, true, tier.Uploads, tier)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decisions, []purge.Decision{
+		{Day: "2019-04-27", Delete: true, Reason: "archived, verified and uploaded"},
+		{Day: "2019-04-28", Reason: "there is no archive"},
+	})
+	assert.NilError(t, purge.Execute(dataPath, decisions, false))
+	_, err = os.Stat(filepath.Join(dataPath, "short_term", "2019-04-27"))
+	assert.Assert(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dataPath, "short_term", "2019-04-28"))
+	assert.NilError(t, err)
+}
+
+func TestRestore(t *testing.T) {
+	dataPath := archivedDays(t, "2019-04-27")
+	defer os.RemoveAll(dataPath)
+	tier, primary, _ := testTier(t)
+	defer tier.DB.Close()
+	m, err := archiver.ReadManifest(archiver.ManifestPath(dataPath, "2019-04-27"))
+	assert.NilError(t, err)
+	status, err := tier.FreezeDay(dataPath, "wmatabus", "2019-04-27", false)
+	assert.NilError(t, err)
+	assert.Equal(t, status, FreezeDeleted)
+
+	_, err = tier.StartRestore("wmatabus", "2019-04-28", "Bulk")
+	assert.ErrorContains(t, err, "no vault has")
+	job, err := tier.StartRestore("wmatabus", "2019-04-27", "Bulk")
+	assert.NilError(t, err)
+	assert.Equal(t, job.Status, RestoreInProgress)
+
+	jobs, err := tier.PollRestores()
+	assert.NilError(t, err)
+	assert.Equal(t, jobs[0].Status, RestoreInProgress)
+	days, err := tier.DownloadRestored(dataPath, "wmatabus")
+	assert.NilError(t, err)
+	assert.Equal(t, len(days), 0)
+
+	primary.status = RestoreSucceeded
+	jobs, err = tier.PollRestores()
+	assert.NilError(t, err)
+	assert.Equal(t, jobs[0].Status, RestoreSucceeded)
+	days, err = tier.DownloadRestored(dataPath, "wmatabus")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, days, []string{"2019-04-27"})
+	assert.NilError(t, archiver.Verify(archiver.ArchivePath(dataPath, "2019-04-27"), m))
+
+	var saved RestoreJob
+	tier.DB.First(&saved, job.ID)
+	assert.Equal(t, saved.Status, RestoreDownloaded)
+}
+
+func TestRestoreRejectsCorruptDownloads(t *testing.T) {
+	dataPath := archivedDays(t, "2019-04-27")
+	defer os.RemoveAll(dataPath)
+	tier, primary, _ := testTier(t)
+	defer tier.DB.Close()
+	status, err := tier.FreezeDay(dataPath, "wmatabus", "2019-04-27", false)
+	assert.NilError(t, err)
+	assert.Equal(t, status, FreezeDeleted)
+	primary.archives["archive-0"] = []byte("not a tarball")
+	_, err = tier.StartRestore("wmatabus", "2019-04-27", "Standard")
+	assert.NilError(t, err)
+	primary.status = RestoreSucceeded
+	_, err = tier.PollRestores()
+	assert.NilError(t, err)
+	_, err = tier.DownloadRestored(dataPath, "wmatabus")
+	assert.Assert(t, err != nil)
+	_, err = os.Stat(archiver.ArchivePath(dataPath, "2019-04-27"))
+	assert.Assert(t, os.IsNotExist(err))
+}
@@ -0,0 +1,412 @@
+package gtfs_realtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// These follow https://developers.google.com/transit/gtfs-realtime/reference
+// but only carry the fields we archive. Optional numbers are pointers so we
+// can tell "not sent" from zero.
+
+type FeedMessage struct {
+	Header   FeedHeader
+	Entities []FeedEntity
+}
+
+type FeedHeader struct {
+	GTFSRealtimeVersion string
+	Incrementality      int32
+	// POSIX seconds
+	Timestamp uint64
+}
+
+type FeedEntity struct {
+	ID         string
+	IsDeleted  bool
+	TripUpdate *TripUpdate
+	Vehicle    *VehiclePosition
+}
+
+type TripScheduleRelationship int32
+
+const (
+	TripScheduled   TripScheduleRelationship = 0
+	TripAdded       TripScheduleRelationship = 1
+	TripUnscheduled TripScheduleRelationship = 2
+	TripCanceled    TripScheduleRelationship = 3
+	TripReplacement TripScheduleRelationship = 5
+	TripDuplicated  TripScheduleRelationship = 6
+	TripDeleted     TripScheduleRelationship = 7
+)
+
+var tripScheduleRelationshipNames = map[TripScheduleRelationship]string{
+	TripScheduled:   "SCHEDULED",
+	TripAdded:       "ADDED",
+	TripUnscheduled: "UNSCHEDULED",
+	TripCanceled:    "CANCELED",
+	TripReplacement: "REPLACEMENT",
+	TripDuplicated:  "DUPLICATED",
+	TripDeleted:     "DELETED",
+}
+
+func (r TripScheduleRelationship) String() string {
+	if name, ok := tripScheduleRelationshipNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", int32(r))
+}
+
+type StopScheduleRelationship int32
+
+const (
+	StopScheduled   StopScheduleRelationship = 0
+	StopSkipped     StopScheduleRelationship = 1
+	StopNoData      StopScheduleRelationship = 2
+	StopUnscheduled StopScheduleRelationship = 3
+)
+
+var stopScheduleRelationshipNames = map[StopScheduleRelationship]string{
+	StopScheduled:   "SCHEDULED",
+	StopSkipped:     "SKIPPED",
+	StopNoData:      "NO_DATA",
+	StopUnscheduled: "UNSCHEDULED",
+}
+
+func (r StopScheduleRelationship) String() string {
+	if name, ok := stopScheduleRelationshipNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", int32(r))
+}
+
+type TripDescriptor struct {
+	TripID               string
+	RouteID              string
+	DirectionID          *uint32
+	StartTime            string
+	StartDate            string
+	ScheduleRelationship TripScheduleRelationship
+}
+
+type VehicleDescriptor struct {
+	ID           string
+	Label        string
+	LicensePlate string
+}
+
+type Position struct {
+	Latitude  float32
+	Longitude float32
+	Bearing   *float32
+	Odometer  *float64
+	// meters per second
+	Speed *float32
+}
+
+type VehiclePosition struct {
+	Trip                *TripDescriptor
+	Vehicle             *VehicleDescriptor
+	Position            *Position
+	CurrentStopSequence *uint32
+	StopID              string
+	// INCOMING_AT, STOPPED_AT or IN_TRANSIT_TO, which is the default
+	CurrentStatus int32
+	Timestamp     uint64
+}
+
+const (
+	IncomingAt  int32 = 0
+	StoppedAt   int32 = 1
+	InTransitTo int32 = 2
+)
+
+type StopTimeEvent struct {
+	// seconds late
+	Delay *int32
+	// POSIX seconds
+	Time        *int64
+	Uncertainty *int32
+}
+
+type StopTimeUpdate struct {
+	StopSequence         *uint32
+	StopID               string
+	Arrival              *StopTimeEvent
+	Departure            *StopTimeEvent
+	ScheduleRelationship StopScheduleRelationship
+}
+
+type TripUpdate struct {
+	Trip            TripDescriptor
+	Vehicle         *VehicleDescriptor
+	StopTimeUpdates []StopTimeUpdate
+	Timestamp       uint64
+	Delay           *int32
+}
+
+// field is one decoded key/value from the wire. Varints and both fixed sizes
+// land in number.
+type field struct {
+	num    protowire.Number
+	typ    protowire.Type
+	number uint64
+	bytes  []byte
+}
+
+func (f field) uint32() *uint32 {
+	v := uint32(f.number)
+	return &v
+}
+
+func (f field) int32() *int32 {
+	v := int32(f.number)
+	return &v
+}
+
+func (f field) int64() *int64 {
+	v := int64(f.number)
+	return &v
+}
+
+func (f field) float32() float32 {
+	return math.Float32frombits(uint32(f.number))
+}
+
+func (f field) float64() float64 {
+	return math.Float64frombits(f.number)
+}
+
+// eachField calls fn on every field in one message, skipping groups.
+func eachField(b []byte, fn func(field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.number, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.number = uint64(v)
+		case protowire.Fixed64Type:
+			f.number, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse decodes a serialized FeedMessage, like the .pb files
+// get_bus_positions saves.
+func Parse(b []byte) (FeedMessage, error) {
+	var m FeedMessage
+	err := eachField(b, func(f field) error {
+		switch f.num {
+		case 1:
+			return parseHeader(f.bytes, &m.Header)
+		case 2:
+			var e FeedEntity
+			if err := parseEntity(f.bytes, &e); err != nil {
+				return err
+			}
+			m.Entities = append(m.Entities, e)
+		}
+		return nil
+	})
+	return m, err
+}
+
+func ParseFile(filename string) (FeedMessage, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return FeedMessage{}, err
+	}
+	return Parse(b)
+}
+
+func parseHeader(b []byte, h *FeedHeader) error {
+	return eachField(b, func(f field) error {
+		switch f.num {
+		case 1:
+			h.GTFSRealtimeVersion = string(f.bytes)
+		case 2:
+			h.Incrementality = int32(f.number)
+		case 3:
+			h.Timestamp = f.number
+		}
+		return nil
+	})
+}
+
+func parseEntity(b []byte, e *FeedEntity) error {
+	return eachField(b, func(f field) error {
+		switch f.num {
+		case 1:
+			e.ID = string(f.bytes)
+		case 2:
+			e.IsDeleted = f.number != 0
+		case 3:
+			e.TripUpdate = &TripUpdate{}
+			return parseTripUpdate(f.bytes, e.TripUpdate)
+		case 4:
+			e.Vehicle = &VehiclePosition{CurrentStatus: InTransitTo}
+			return parseVehiclePosition(f.bytes, e.Vehicle)
+		}
+		return nil
+	})
+}
+
+func parseTripDescriptor(b []byte, t *TripDescriptor) error {
+	return eachField(b, func(f field) error {
+		switch f.num {
+		case 1:
+			t.TripID = string(f.bytes)
+		case 2:
+			t.StartTime = string(f.bytes)
+		case 3:
+			t.StartDate = string(f.bytes)
+		case 4:
+			t.ScheduleRelationship = TripScheduleRelationship(f.number)
+		case 5:
+			t.RouteID = string(f.bytes)
+		case 6:
+			t.DirectionID = f.uint32()
+		}
+		return nil
+	})
+}
+
+func parseVehicleDescriptor(b []byte, v *VehicleDescriptor) error {
+	return eachField(b, func(f field) error {
+		switch f.num {
+		case 1:
+			v.ID = string(f.bytes)
+		case 2:
+			v.Label = string(f.bytes)
+		case 3:
+			v.LicensePlate = string(f.bytes)
+		}
+		return nil
+	})
+}
+
+func parsePosition(b []byte, p *Position) error {
+	return eachField(b, func(f field) error {
+		switch f.num {
+		case 1:
+			p.Latitude = f.float32()
+		case 2:
+			p.Longitude = f.float32()
+		case 3:
+			v := f.float32()
+			p.Bearing = &v
+		case 4:
+			v := f.float64()
+			p.Odometer = &v
+		case 5:
+			v := f.float32()
+			p.Speed = &v
+		}
+		return nil
+	})
+}
+
+func parseVehiclePosition(b []byte, vp *VehiclePosition) error {
+	return eachField(b, func(f field) error {
+		switch f.num {
+		case 1:
+			vp.Trip = &TripDescriptor{}
+			return parseTripDescriptor(f.bytes, vp.Trip)
+		case 2:
+			vp.Position = &Position{}
+			return parsePosition(f.bytes, vp.Position)
+		case 3:
+			vp.CurrentStopSequence = f.uint32()
+		case 4:
+			vp.CurrentStatus = int32(f.number)
+		case 5:
+			vp.Timestamp = f.number
+		case 7:
+			vp.StopID = string(f.bytes)
+		case 8:
+			vp.Vehicle = &VehicleDescriptor{}
+			return parseVehicleDescriptor(f.bytes, vp.Vehicle)
+		}
+		return nil
+	})
+}
+
+func parseStopTimeEvent(b []byte, e *StopTimeEvent) error {
+	return eachField(b, func(f field) error {
+		switch f.num {
+		case 1:
+			e.Delay = f.int32()
+		case 2:
+			e.Time = f.int64()
+		case 3:
+			e.Uncertainty = f.int32()
+		}
+		return nil
+	})
+}
+
+func parseStopTimeUpdate(b []byte, u *StopTimeUpdate) error {
+	return eachField(b, func(f field) error {
+		switch f.num {
+		case 1:
+			u.StopSequence = f.uint32()
+		case 2:
+			u.Arrival = &StopTimeEvent{}
+			return parseStopTimeEvent(f.bytes, u.Arrival)
+		case 3:
+			u.Departure = &StopTimeEvent{}
+			return parseStopTimeEvent(f.bytes, u.Departure)
+		case 4:
+			u.StopID = string(f.bytes)
+		case 5:
+			u.ScheduleRelationship = StopScheduleRelationship(f.number)
+		}
+		return nil
+	})
+}
+
+func parseTripUpdate(b []byte, tu *TripUpdate) error {
+	return eachField(b, func(f field) error {
+		switch f.num {
+		case 1:
+			return parseTripDescriptor(f.bytes, &tu.Trip)
+		case 2:
+			var u StopTimeUpdate
+			if err := parseStopTimeUpdate(f.bytes, &u); err != nil {
+				return err
+			}
+			tu.StopTimeUpdates = append(tu.StopTimeUpdates, u)
+		case 3:
+			tu.Vehicle = &VehicleDescriptor{}
+			return parseVehicleDescriptor(f.bytes, tu.Vehicle)
+		case 4:
+			tu.Timestamp = f.number
+		case 5:
+			tu.Delay = f.int32()
+		}
+		return nil
+	})
+}
@@ -0,0 +1,61 @@
+package gtfs_realtime
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParseVehiclePositions(t *testing.T) {
+	m, err := ParseFile("test_data/gtfsrt-vp-2019-04-27T03:55:01.pb")
+	assert.NilError(t, err)
+	assert.Equal(t, m.Header.GTFSRealtimeVersion, "2.0")
+	assert.Equal(t, m.Header.Timestamp, uint64(1556337301))
+	assert.Equal(t, len(m.Entities), 2)
+
+	vp := m.Entities[0].Vehicle
+	assert.Assert(t, vp != nil)
+	assert.Equal(t, vp.Trip.TripID, "914402060")
+	assert.Equal(t, vp.Trip.RouteID, "10A")
+	assert.Equal(t, *vp.Trip.DirectionID, uint32(1))
+	assert.Equal(t, vp.Trip.StartDate, "20190426")
+	assert.Equal(t, vp.Vehicle.ID, "3171")
+	assert.Equal(t, vp.Position.Latitude, float32(38.795212))
+	assert.Equal(t, *vp.Position.Bearing, float32(180))
+	assert.Equal(t, *vp.CurrentStopSequence, uint32(5))
+	assert.Equal(t, vp.CurrentStatus, StoppedAt)
+	assert.Equal(t, vp.StopID, "1001")
+	assert.Equal(t, vp.Timestamp, uint64(1556337286))
+
+	// nothing optional was sent for this one
+	vp = m.Entities[1].Vehicle
+	assert.Assert(t, vp.Position.Bearing == nil)
+	assert.Assert(t, vp.CurrentStopSequence == nil)
+	assert.Equal(t, vp.CurrentStatus, InTransitTo)
+	assert.Equal(t, *vp.Trip.DirectionID, uint32(0))
+}
+
+func TestParseTripUpdates(t *testing.T) {
+	m, err := ParseFile("test_data/gtfsrt-tu-2019-04-27T03:55:01.pb")
+	assert.NilError(t, err)
+	assert.Equal(t, len(m.Entities), 2)
+
+	tu := m.Entities[0].TripUpdate
+	assert.Equal(t, tu.Trip.TripID, "914402060")
+	assert.Equal(t, tu.Vehicle.ID, "3171")
+	assert.Equal(t, len(tu.StopTimeUpdates), 2)
+	assert.Equal(t, tu.StopTimeUpdates[0].StopID, "1001")
+	assert.Equal(t, *tu.StopTimeUpdates[0].Arrival.Delay, int32(60))
+	assert.Assert(t, tu.StopTimeUpdates[0].Departure == nil)
+	assert.Equal(t, *tu.StopTimeUpdates[1].Departure.Time, int64(1556337510))
+
+	tu = m.Entities[1].TripUpdate
+	assert.Equal(t, tu.Trip.ScheduleRelationship, TripCanceled)
+	assert.Equal(t, tu.Trip.ScheduleRelationship.String(), "CANCELED")
+	assert.Equal(t, len(tu.StopTimeUpdates), 0)
+}
+
+func TestParseGarbage(t *testing.T) {
+	_, err := Parse([]byte{0x0a, 0xff})
+	assert.Assert(t, err != nil)
+}
@@ -0,0 +1,387 @@
+package gtfs_schedule
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/geo"
+)
+
+// This only reads the parts of a static GTFS feed
+// (https://developers.google.com/transit/gtfs/reference) that we use to
+// compare against what the buses actually did.
+
+type Stop struct {
+	StopID   string
+	StopName string
+	Lat      float64
+	Lon      float64
+}
+
+type Trip struct {
+	RouteID      string
+	ServiceID    string
+	TripID       string
+	TripHeadsign string
+	DirectionID  int
+	BlockID      string
+	ShapeID      string
+}
+
+type StopTime struct {
+	TripID       string
+	StopID       string
+	StopSequence int
+	// Seconds after the start of the service day. These can be past 24:00:00.
+	Arrival   int
+	Departure int
+	// The feed left this stop's times blank, as feeds may for stops that
+	// aren't timepoints, so Load interpolated them.
+	Interpolated bool
+}
+
+type ShapePoint struct {
+	ShapeID  string
+	Lat      float64
+	Lon      float64
+	Sequence int
+}
+
+type Calendar struct {
+	ServiceID string
+	// indexed by time.Weekday, so Sunday first
+	Weekdays  [7]bool
+	StartDate string // YYYYMMDD
+	EndDate   string
+}
+
+type CalendarDate struct {
+	ServiceID     string
+	Date          string // YYYYMMDD
+	ExceptionType int
+}
+
+type Feed struct {
+	Calendars     []Calendar
+	CalendarDates []CalendarDate
+	Stops         map[string]Stop
+	Trips         map[string]Trip
+	// sorted by StopSequence
+	StopTimesByTripID map[string][]StopTime
+	// sorted by Sequence
+	ShapePointsByShapeID map[string][]ShapePoint
+}
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// ParseTime turns "25:10:00" into the number of seconds since the start of the
+// service day.
+func ParseTime(s string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("could not parse GTFS time %q", s)
+	}
+	total := 0
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse GTFS time %q: %v", s, err)
+		}
+		total = total*60 + n
+	}
+	return total, nil
+}
+
+// readTable calls handleRow once per row with a map from column name to value.
+// If the file does not exist and it is not required we just return.
+func readTable(gtfsPath string, filename string, required bool, handleRow func(map[string]string)) {
+	f, err := os.Open(filepath.Join(gtfsPath, filename))
+	if os.IsNotExist(err) && !required {
+		return
+	}
+	check(err)
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	check(err)
+	for i := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff"))
+	}
+	row := make(map[string]string, len(header))
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		check(err)
+		for i, name := range header {
+			if i < len(record) {
+				row[name] = strings.TrimSpace(record[i])
+			} else {
+				row[name] = ""
+			}
+		}
+		handleRow(row)
+	}
+}
+
+func parseFloat(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	check(err)
+	return f
+}
+
+func parseIntOrZero(s string) int {
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	check(err)
+	return n
+}
+
+func Load(gtfsPath string) Feed {
+	fmt.Printf("I will attempt to load the GTFS feed in %s\n", gtfsPath)
+	feed := Feed{
+		Stops:                make(map[string]Stop),
+		Trips:                make(map[string]Trip),
+		StopTimesByTripID:    make(map[string][]StopTime),
+		ShapePointsByShapeID: make(map[string][]ShapePoint),
+	}
+	readTable(gtfsPath, "stops.txt", true, func(row map[string]string) {
+		feed.Stops[row["stop_id"]] = Stop{
+			StopID:   row["stop_id"],
+			StopName: row["stop_name"],
+			Lat:      parseFloat(row["stop_lat"]),
+			Lon:      parseFloat(row["stop_lon"]),
+		}
+	})
+	readTable(gtfsPath, "trips.txt", true, func(row map[string]string) {
+		feed.Trips[row["trip_id"]] = Trip{
+			RouteID:      row["route_id"],
+			ServiceID:    row["service_id"],
+			TripID:       row["trip_id"],
+			TripHeadsign: row["trip_headsign"],
+			DirectionID:  parseIntOrZero(row["direction_id"]),
+			BlockID:      row["block_id"],
+			ShapeID:      row["shape_id"],
+		}
+	})
+	readTable(gtfsPath, "stop_times.txt", true, func(row map[string]string) {
+		st := StopTime{
+			TripID:       row["trip_id"],
+			StopID:       row["stop_id"],
+			StopSequence: parseIntOrZero(row["stop_sequence"]),
+		}
+		arrival, departure := row["arrival_time"], row["departure_time"]
+		// Either one stands in for the other if only one is blank.
+		if arrival == "" {
+			arrival = departure
+		}
+		if departure == "" {
+			departure = arrival
+		}
+		if arrival == "" {
+			st.Interpolated = true
+		} else {
+			var err error
+			st.Arrival, err = ParseTime(arrival)
+			check(err)
+			st.Departure, err = ParseTime(departure)
+			check(err)
+		}
+		feed.StopTimesByTripID[st.TripID] = append(feed.StopTimesByTripID[st.TripID], st)
+	})
+	readTable(gtfsPath, "calendar.txt", false, func(row map[string]string) {
+		calendar := Calendar{
+			ServiceID: row["service_id"],
+			StartDate: row["start_date"],
+			EndDate:   row["end_date"],
+		}
+		days := []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+		for i, day := range days {
+			calendar.Weekdays[i] = row[day] == "1"
+		}
+		feed.Calendars = append(feed.Calendars, calendar)
+	})
+	readTable(gtfsPath, "calendar_dates.txt", false, func(row map[string]string) {
+		feed.CalendarDates = append(feed.CalendarDates, CalendarDate{
+			ServiceID:     row["service_id"],
+			Date:          row["date"],
+			ExceptionType: parseIntOrZero(row["exception_type"]),
+		})
+	})
+	readTable(gtfsPath, "shapes.txt", false, func(row map[string]string) {
+		sp := ShapePoint{
+			ShapeID:  row["shape_id"],
+			Lat:      parseFloat(row["shape_pt_lat"]),
+			Lon:      parseFloat(row["shape_pt_lon"]),
+			Sequence: parseIntOrZero(row["shape_pt_sequence"]),
+		}
+		feed.ShapePointsByShapeID[sp.ShapeID] = append(feed.ShapePointsByShapeID[sp.ShapeID], sp)
+	})
+	for _, stopTimes := range feed.StopTimesByTripID {
+		sort.Slice(stopTimes, func(i, j int) bool {
+			return stopTimes[i].StopSequence < stopTimes[j].StopSequence
+		})
+		feed.interpolate(stopTimes)
+	}
+	for _, points := range feed.ShapePointsByShapeID {
+		sort.Slice(points, func(i, j int) bool {
+			return points[i].Sequence < points[j].Sequence
+		})
+	}
+	fmt.Printf("The feed has %d stops and %d trips.\n", len(feed.Stops), len(feed.Trips))
+	return feed
+}
+
+// interpolate fills in the blank times between two timepoints in proportion
+// to the straight-line distance between the stops, which is close enough to
+// how far the bus goes between them. A trip that starts or ends with blank
+// times shouldn't happen, but we give those stops the nearest timepoint's
+// times.
+func (feed Feed) interpolate(stopTimes []StopTime) {
+	distances := make([]float64, len(stopTimes))
+	for i := 1; i < len(stopTimes); i++ {
+		prev, cur := feed.Stops[stopTimes[i-1].StopID], feed.Stops[stopTimes[i].StopID]
+		distances[i] = distances[i-1] + geo.Haversine(prev.Lat, prev.Lon, cur.Lat, cur.Lon)
+	}
+	last := -1
+	for i := range stopTimes {
+		if stopTimes[i].Interpolated {
+			continue
+		}
+		if last < 0 {
+			for j := 0; j < i; j++ {
+				stopTimes[j].Arrival, stopTimes[j].Departure = stopTimes[i].Arrival, stopTimes[i].Arrival
+			}
+		}
+		for j := last + 1; last >= 0 && j < i; j++ {
+			fraction := float64(j-last) / float64(i-last)
+			if span := distances[i] - distances[last]; span > 0 {
+				fraction = (distances[j] - distances[last]) / span
+			}
+			t := stopTimes[last].Departure + int(math.Round(fraction*float64(stopTimes[i].Arrival-stopTimes[last].Departure)))
+			stopTimes[j].Arrival, stopTimes[j].Departure = t, t
+		}
+		last = i
+	}
+	for j := last + 1; last >= 0 && j < len(stopTimes); j++ {
+		stopTimes[j].Arrival, stopTimes[j].Departure = stopTimes[last].Departure, stopTimes[last].Departure
+	}
+}
+
+// TripShape returns the trip's shape as a polyline. Feeds without shapes.txt
+// get a polyline connecting the stops, which is crude but better than nothing.
+func (feed Feed) TripShape(tripID string) (geo.Polyline, bool) {
+	trip, present := feed.Trips[tripID]
+	if !present {
+		return geo.Polyline{}, false
+	}
+	var points []geo.Point
+	if shapePoints := feed.ShapePointsByShapeID[trip.ShapeID]; trip.ShapeID != "" && len(shapePoints) > 1 {
+		for _, sp := range shapePoints {
+			points = append(points, geo.Point{Lat: sp.Lat, Lon: sp.Lon})
+		}
+	} else {
+		for _, st := range feed.StopTimesByTripID[tripID] {
+			stop := feed.Stops[st.StopID]
+			points = append(points, geo.Point{Lat: stop.Lat, Lon: stop.Lon})
+		}
+	}
+	if len(points) < 2 {
+		return geo.Polyline{}, false
+	}
+	return geo.NewPolyline(points), true
+}
+
+// StopDistances projects each of the trip's stops onto its shape, in order, so
+// we know how far along the route each stop is.
+func (feed Feed) StopDistances(tripID string, shape geo.Polyline) []float64 {
+	stopTimes := feed.StopTimesByTripID[tripID]
+	output := make([]float64, len(stopTimes))
+	segment := 0
+	for i, st := range stopTimes {
+		stop := feed.Stops[st.StopID]
+		proj := shape.ProjectFrom(stop.Lat, stop.Lon, segment, 20)
+		output[i] = proj.DistAlong
+		// two stops on the same segment could still come out backwards
+		if i > 0 && output[i] < output[i-1] {
+			output[i] = output[i-1]
+		}
+		segment = proj.Segment
+	}
+	return output
+}
+
+// ServiceIDsByDate is the same logic as serviceIDsByDate in clever_tmp, on our
+// own types.
+func (feed Feed) ServiceIDsByDate(dateYYYYMMDD string) []string {
+	date, err := time.Parse("20060102", dateYYYYMMDD)
+	check(err)
+	validCalendars := make(map[string]bool)
+	for _, calendar := range feed.Calendars {
+		if calendar.StartDate <= dateYYYYMMDD && calendar.EndDate >= dateYYYYMMDD {
+			if calendar.Weekdays[date.Weekday()] {
+				validCalendars[calendar.ServiceID] = true
+			}
+		}
+	}
+	for _, calendarDate := range feed.CalendarDates {
+		if calendarDate.Date == dateYYYYMMDD {
+			switch calendarDate.ExceptionType {
+			case 1:
+				validCalendars[calendarDate.ServiceID] = true
+			case 2:
+				delete(validCalendars, calendarDate.ServiceID)
+			default:
+				panic(fmt.Sprintf("Unexpected exception type: %d", calendarDate.ExceptionType))
+			}
+		}
+	}
+	output := make([]string, 0, len(validCalendars))
+	for k := range validCalendars {
+		output = append(output, k)
+	}
+	sort.Strings(output)
+	return output
+}
+
+// TripsByDate returns the IDs of every trip scheduled to run on that service
+// date, sorted.
+func (feed Feed) TripsByDate(dateYYYYMMDD string) []string {
+	serviceIDs := make(map[string]bool)
+	for _, serviceID := range feed.ServiceIDsByDate(dateYYYYMMDD) {
+		serviceIDs[serviceID] = true
+	}
+	var output []string
+	for tripID, trip := range feed.Trips {
+		if serviceIDs[trip.ServiceID] {
+			output = append(output, tripID)
+		}
+	}
+	sort.Strings(output)
+	return output
+}
+
+// ServiceDayStart is what GTFS times are relative to: noon minus 12 hours,
+// which is midnight except on days when the clocks change.
+func ServiceDayStart(dateYYYYMMDD string, location *time.Location) time.Time {
+	date, err := time.ParseInLocation("20060102", dateYYYYMMDD, location)
+	check(err)
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, location)
+	return noon.Add(-12 * time.Hour)
+}
@@ -0,0 +1,70 @@
+package gtfs_schedule
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParseTime(t *testing.T) {
+	seconds, err := ParseTime("08:05:30")
+	assert.NilError(t, err)
+	assert.Equal(t, seconds, 8*3600+5*60+30)
+	seconds, err = ParseTime("25:10:00")
+	assert.NilError(t, err)
+	assert.Equal(t, seconds, 25*3600+10*60)
+	_, err = ParseTime("8:05")
+	assert.ErrorContains(t, err, "could not parse")
+}
+
+func TestLoad(t *testing.T) {
+	feed := Load("test_data/tiny")
+	assert.Equal(t, len(feed.Stops), 3)
+	assert.Equal(t, feed.Trips["T1"].RouteID, "10A")
+	stopTimes := feed.StopTimesByTripID["T1"]
+	assert.Equal(t, len(stopTimes), 3)
+	assert.Equal(t, stopTimes[1].StopID, "1002")
+	assert.Equal(t, stopTimes[2].Arrival, 8*3600+10*60)
+	assert.Equal(t, len(feed.ShapePointsByShapeID["S1"]), 4)
+	// 1002 is halfway between the other two stops, and the feed left its
+	// times blank.
+	stopTimes = feed.StopTimesByTripID["T4"]
+	assert.Assert(t, stopTimes[1].Interpolated)
+	assert.Assert(t, !stopTimes[2].Interpolated)
+	assert.Equal(t, stopTimes[1].Arrival, 24*3600+15*60)
+	assert.Equal(t, stopTimes[1].Departure, 24*3600+15*60)
+}
+
+func TestStopDistances(t *testing.T) {
+	feed := Load("test_data/tiny")
+	shape, ok := feed.TripShape("T1")
+	assert.Assert(t, ok)
+	distances := feed.StopDistances("T1", shape)
+	assert.Equal(t, len(distances), 3)
+	assert.Equal(t, distances[0], 0.0)
+	assert.Assert(t, distances[1] > 860 && distances[1] < 870, "got %f", distances[1])
+	assert.Assert(t, distances[2] > distances[1])
+}
+
+func TestServiceIDsByDate(t *testing.T) {
+	feed := Load("test_data/tiny")
+	// a Thursday
+	assert.DeepEqual(t, feed.ServiceIDsByDate("20190919"), []string{"1"})
+	// a Saturday
+	assert.DeepEqual(t, feed.ServiceIDsByDate("20190921"), []string{"2"})
+	// Thanksgiving runs a Sunday schedule
+	assert.DeepEqual(t, feed.ServiceIDsByDate("20191128"), []string{"2"})
+	assert.DeepEqual(t, feed.ServiceIDsByDate("20200102"), []string{})
+	assert.DeepEqual(t, feed.TripsByDate("20190919"), []string{"T1", "T2", "T3"})
+}
+
+func TestServiceDayStart(t *testing.T) {
+	location, err := time.LoadLocation("US/Eastern")
+	check(err)
+	start := ServiceDayStart("20190919", location)
+	assert.Equal(t, start, time.Date(2019, 9, 19, 0, 0, 0, 0, location))
+	// The clocks fell back at 2 AM, so noon minus 12 hours is 1 AM EDT.
+	start = ServiceDayStart("20191103", location)
+	assert.Assert(t, start.Equal(time.Date(2019, 11, 3, 5, 0, 0, 0, time.UTC)), "got %s", start)
+}
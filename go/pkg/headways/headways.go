@@ -0,0 +1,226 @@
+package headways
+
+import (
+	"sort"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/stop_events"
+)
+
+// A Passage is a bus going by a timepoint, either for real or on paper.
+type Passage struct {
+	RouteID      string
+	DirectionNum int
+	StopID       string
+	VehicleID    string
+	TripID       string
+	Time         time.Time
+}
+
+type Headway struct {
+	Passage
+	Headway time.Duration
+	// zero if we couldn't line this passage up with the schedule
+	ScheduledHeadway time.Duration
+	Status           string
+}
+
+const (
+	StatusOK      = "ok"
+	StatusBunched = "bunched"
+	StatusGap     = "gap"
+	StatusUnknown = "unknown"
+)
+
+// Thresholds are fractions of the scheduled headway. A bus that shows up less
+// than Bunched times the scheduled headway after the previous one is bunched.
+type Thresholds struct {
+	Bunched float64
+	Gap     float64
+}
+
+var DefaultThresholds = Thresholds{Bunched: 0.5, Gap: 1.5}
+
+type RouteSummary struct {
+	RouteID      string
+	DirectionNum int
+	Observations int
+	// in minutes
+	MeanHeadway          float64
+	MeanScheduledHeadway float64
+	Bunched              int
+	Gaps                 int
+}
+
+type groupKey struct {
+	RouteID      string
+	DirectionNum int
+	StopID       string
+}
+
+func keyOf(p Passage) groupKey {
+	return groupKey{p.RouteID, p.DirectionNum, p.StopID}
+}
+
+func groupAndSort(passages []Passage) map[groupKey][]Passage {
+	output := make(map[groupKey][]Passage)
+	for _, p := range passages {
+		output[keyOf(p)] = append(output[keyOf(p)], p)
+	}
+	for _, group := range output {
+		sort.Slice(group, func(i, j int) bool { return group[i].Time.Before(group[j].Time) })
+	}
+	return output
+}
+
+// ScheduledPassages lists every scheduled departure from the timepoints on a
+// service date.
+func ScheduledPassages(feed gtfs_schedule.Feed, dateYYYYMMDD string, location *time.Location, timepoints map[string]bool) []Passage {
+	dayStart := gtfs_schedule.ServiceDayStart(dateYYYYMMDD, location)
+	var output []Passage
+	for _, tripID := range feed.TripsByDate(dateYYYYMMDD) {
+		trip := feed.Trips[tripID]
+		for _, st := range feed.StopTimesByTripID[tripID] {
+			if !timepoints[st.StopID] {
+				continue
+			}
+			output = append(output, Passage{
+				RouteID:      trip.RouteID,
+				DirectionNum: trip.DirectionID,
+				StopID:       st.StopID,
+				TripID:       tripID,
+				Time:         dayStart.Add(time.Duration(st.Departure) * time.Second),
+			})
+		}
+	}
+	return output
+}
+
+// ObservedPassages works out when one trip went by each of the timepoints.
+// The route, direction, vehicle and trip are copied from trip.
+func ObservedPassages(feed gtfs_schedule.Feed, gtfsTripID string, trip Passage, positions []stop_events.TimedPosition, timepoints map[string]bool) []Passage {
+	shape, ok := feed.TripShape(gtfsTripID)
+	if !ok {
+		return nil
+	}
+	snapped := stop_events.SnapToShape(shape, positions)
+	stopDistances := feed.StopDistances(gtfsTripID, shape)
+	var output []Passage
+	for i, st := range feed.StopTimesByTripID[gtfsTripID] {
+		if !timepoints[st.StopID] {
+			continue
+		}
+		crossing, ok := stop_events.FindCrossing(snapped, stopDistances[i])
+		if !ok {
+			continue
+		}
+		p := trip
+		p.StopID = st.StopID
+		p.Time = crossing.Time
+		output = append(output, p)
+	}
+	return output
+}
+
+// scheduledHeadwayAt finds the scheduled headway in effect at time t: the gap
+// between the last scheduled passage at or before t and the one before that.
+func scheduledHeadwayAt(scheduled []Passage, t time.Time) time.Duration {
+	k := sort.Search(len(scheduled), func(i int) bool { return scheduled[i].Time.After(t) }) - 1
+	if k < 1 {
+		return 0
+	}
+	return scheduled[k].Time.Sub(scheduled[k-1].Time)
+}
+
+// ComputeHeadways returns one Headway for every observed passage except the
+// first one at each timepoint, which has nothing to follow.
+func ComputeHeadways(observed []Passage, scheduled []Passage, thresholds Thresholds) []Headway {
+	observedGroups := groupAndSort(observed)
+	scheduledGroups := groupAndSort(scheduled)
+	var keys []groupKey
+	for key := range observedGroups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].RouteID != keys[j].RouteID {
+			return keys[i].RouteID < keys[j].RouteID
+		}
+		if keys[i].DirectionNum != keys[j].DirectionNum {
+			return keys[i].DirectionNum < keys[j].DirectionNum
+		}
+		return keys[i].StopID < keys[j].StopID
+	})
+	var output []Headway
+	for _, key := range keys {
+		group := observedGroups[key]
+		for i := 1; i < len(group); i++ {
+			h := Headway{
+				Passage:          group[i],
+				Headway:          group[i].Time.Sub(group[i-1].Time),
+				ScheduledHeadway: scheduledHeadwayAt(scheduledGroups[key], group[i].Time),
+			}
+			switch {
+			case h.ScheduledHeadway == 0:
+				h.Status = StatusUnknown
+			case float64(h.Headway) < thresholds.Bunched*float64(h.ScheduledHeadway):
+				h.Status = StatusBunched
+			case float64(h.Headway) > thresholds.Gap*float64(h.ScheduledHeadway):
+				h.Status = StatusGap
+			default:
+				h.Status = StatusOK
+			}
+			output = append(output, h)
+		}
+	}
+	return output
+}
+
+// Summarize rolls headways up by route and direction. Headways we couldn't
+// match to the schedule count toward MeanHeadway but nothing else.
+func Summarize(headways []Headway) []RouteSummary {
+	type routeKey struct {
+		RouteID      string
+		DirectionNum int
+	}
+	summaries := make(map[routeKey]*RouteSummary)
+	var keys []routeKey
+	scheduledCounts := make(map[routeKey]int)
+	for _, h := range headways {
+		key := routeKey{h.RouteID, h.DirectionNum}
+		summary, present := summaries[key]
+		if !present {
+			summary = &RouteSummary{RouteID: h.RouteID, DirectionNum: h.DirectionNum}
+			summaries[key] = summary
+			keys = append(keys, key)
+		}
+		summary.Observations++
+		summary.MeanHeadway += h.Headway.Minutes()
+		if h.ScheduledHeadway != 0 {
+			scheduledCounts[key]++
+			summary.MeanScheduledHeadway += h.ScheduledHeadway.Minutes()
+		}
+		switch h.Status {
+		case StatusBunched:
+			summary.Bunched++
+		case StatusGap:
+			summary.Gaps++
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].RouteID != keys[j].RouteID {
+			return keys[i].RouteID < keys[j].RouteID
+		}
+		return keys[i].DirectionNum < keys[j].DirectionNum
+	})
+	output := make([]RouteSummary, 0, len(keys))
+	for _, key := range keys {
+		summary := summaries[key]
+		summary.MeanHeadway /= float64(summary.Observations)
+		if scheduledCounts[key] > 0 {
+			summary.MeanScheduledHeadway /= float64(scheduledCounts[key])
+		}
+		output = append(output, *summary)
+	}
+	return output
+}
@@ -0,0 +1,82 @@
+package headways
+
+import (
+	"testing"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/stop_events"
+	"github.com/markongithub/bus_data_archive/pkg/test_util"
+	"gotest.tools/v3/assert"
+)
+
+func at(location *time.Location, hour, minute int) time.Time {
+	return time.Date(2019, 9, 19, hour, minute, 0, 0, location)
+}
+
+func passage(location *time.Location, vehicle string, hour, minute int) Passage {
+	return Passage{RouteID: "10A", StopID: "1002", VehicleID: vehicle, Time: at(location, hour, minute)}
+}
+
+func TestScheduledPassages(t *testing.T) {
+	location := test_util.Eastern()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	scheduled := ScheduledPassages(feed, "20190919", location, map[string]bool{"1002": true})
+	assert.Equal(t, len(scheduled), 3)
+	assert.Equal(t, scheduled[0].Time, at(location, 8, 5))
+	assert.Equal(t, scheduled[2].TripID, "T3")
+}
+
+func TestObservedPassages(t *testing.T) {
+	location := test_util.Eastern()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	positions := []stop_events.TimedPosition{
+		{Time: at(location, 8, 0), Lat: 38.9, Lon: -77.0},
+		{Time: at(location, 8, 4), Lat: 38.9, Lon: -76.995},
+		{Time: at(location, 8, 8), Lat: 38.9, Lon: -76.985},
+	}
+	trip := Passage{RouteID: "10A", VehicleID: "3171", TripID: "T1"}
+	observed := ObservedPassages(feed, "T1", trip, positions, map[string]bool{"1002": true})
+	assert.Equal(t, len(observed), 1)
+	assert.Equal(t, observed[0].StopID, "1002")
+	assert.Equal(t, observed[0].VehicleID, "3171")
+	assert.Equal(t, observed[0].Time.Round(time.Second), at(location, 8, 6))
+}
+
+func TestComputeHeadways(t *testing.T) {
+	location := test_util.Eastern()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	// scheduled every 15 minutes at 8:05, 8:20 and 8:35
+	scheduled := ScheduledPassages(feed, "20190919", location, map[string]bool{"1002": true})
+	observed := []Passage{
+		passage(location, "3", 8, 45),
+		passage(location, "1", 8, 6),
+		passage(location, "2", 8, 10),
+	}
+	hs := ComputeHeadways(observed, scheduled, DefaultThresholds)
+	assert.Equal(t, len(hs), 2)
+	assert.Equal(t, hs[0].VehicleID, "2")
+	assert.Equal(t, hs[0].Headway, 4*time.Minute)
+	assert.Equal(t, hs[0].ScheduledHeadway, time.Duration(0))
+	assert.Equal(t, hs[0].Status, StatusUnknown)
+	assert.Equal(t, hs[1].Headway, 35*time.Minute)
+	assert.Equal(t, hs[1].ScheduledHeadway, 15*time.Minute)
+	assert.Equal(t, hs[1].Status, StatusGap)
+
+	observed = []Passage{
+		passage(location, "1", 8, 20),
+		passage(location, "2", 8, 36),
+		passage(location, "3", 8, 38),
+	}
+	hs = ComputeHeadways(observed, scheduled, DefaultThresholds)
+	assert.Equal(t, hs[0].Status, StatusOK)
+	assert.Equal(t, hs[1].Status, StatusBunched)
+
+	summaries := Summarize(hs)
+	assert.Equal(t, len(summaries), 1)
+	assert.Equal(t, summaries[0].Observations, 2)
+	assert.Equal(t, summaries[0].MeanHeadway, 9.0)
+	assert.Equal(t, summaries[0].MeanScheduledHeadway, 15.0)
+	assert.Equal(t, summaries[0].Bunched, 1)
+	assert.Equal(t, summaries[0].Gaps, 0)
+}
@@ -0,0 +1,131 @@
+package map_matching
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/geo"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
+)
+
+// Positions further than this from the shape are flagged as off-route. Plain
+// GPS error is rarely more than 30 meters, so this is a detour or the wrong
+// trip.
+const OffRouteMeters = 100.0
+
+// MatchedPosition is a BusPosition projected onto its trip's shape. We store
+// these because projecting a whole day of positions is not cheap.
+type MatchedPosition struct {
+	gorm.Model
+	BusPositionID  uint `gorm:"unique_index"`
+	TripInstanceID uint `gorm:"index"`
+	ShapeID        string
+	// Meters along our polyline of the shape. Feeds don't agree on units for
+	// the shape_dist_traveled in shapes.txt, so we don't use theirs.
+	ShapeDistTraveled float64
+	// Meters between the reported position and the shape
+	Error    float64
+	OffRoute bool
+}
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// MatchPositions projects positions, which must be in chronological order,
+// onto the shape. Like stop_events.SnapToShape it only lets the bus move
+// forward, but it keeps the off-route positions instead of dropping them, and
+// they don't move the bus along.
+func MatchPositions(shapeID string, shape geo.Polyline, positions []bus_positions.BusPosition) []MatchedPosition {
+	output := make([]MatchedPosition, 0, len(positions))
+	segment := 0
+	lastDist := 0.0
+	for _, bp := range positions {
+		proj := shape.ProjectFrom(bp.Lat, bp.Lon, segment, 50)
+		mp := MatchedPosition{
+			BusPositionID:     bp.ID,
+			TripInstanceID:    bp.TripInstanceID,
+			ShapeID:           shapeID,
+			ShapeDistTraveled: proj.DistAlong,
+			Error:             proj.Error,
+			OffRoute:          proj.Error > OffRouteMeters,
+		}
+		if !mp.OffRoute {
+			if mp.ShapeDistTraveled < lastDist {
+				mp.ShapeDistTraveled = lastDist
+			}
+			lastDist = mp.ShapeDistTraveled
+			segment = proj.Segment
+		}
+		output = append(output, mp)
+	}
+	return output
+}
+
+func positionsForTrip(db *gorm.DB, tripInstanceID uint) []bus_positions.BusPosition {
+	var positions []bus_positions.BusPosition
+	err := db.Scopes(position_quality.GoodPositions).Where("trip_instance_id = ?", tripInstanceID).Order("reported_at, id").Find(&positions).Error
+	check(err)
+	return positions
+}
+
+// MatchTrip returns the trip's positions in chronological order and what
+// each one matched, in the same order. The matches come from the cache if we
+// have them for every position and the trip's current shape, and otherwise
+// are computed and saved. The bool is false if the trip isn't in the feed.
+func MatchTrip(db *gorm.DB, feed gtfs_schedule.Feed, trip bus_positions.TripInstance) ([]bus_positions.BusPosition, []MatchedPosition, bool) {
+	gtfsTrip, present := feed.Trips[trip.TripID]
+	if !present {
+		return nil, nil, false
+	}
+	var cached []MatchedPosition
+	err := db.Where("trip_instance_id = ?", trip.ID).Find(&cached).Error
+	check(err)
+	positions := positionsForTrip(db, trip.ID)
+	if len(cached) == len(positions) && len(cached) > 0 && cached[0].ShapeID == gtfsTrip.ShapeID {
+		if ordered, ok := orderLike(cached, positions); ok {
+			return positions, ordered, true
+		}
+	}
+	shape, ok := feed.TripShape(trip.TripID)
+	if !ok {
+		return nil, nil, false
+	}
+	fmt.Printf("Matching %d positions on trip %s to shape %s.\n", len(positions), trip.TripID, gtfsTrip.ShapeID)
+	matched := MatchPositions(gtfsTrip.ShapeID, shape, positions)
+	SaveMatches(db, trip.ID, matched)
+	return positions, matched, true
+}
+
+// orderLike returns false if any of the positions isn't in matched, which
+// happens when a position's quality changed since we cached the matches.
+func orderLike(matched []MatchedPosition, positions []bus_positions.BusPosition) ([]MatchedPosition, bool) {
+	byPositionID := make(map[uint]MatchedPosition, len(matched))
+	for _, mp := range matched {
+		byPositionID[mp.BusPositionID] = mp
+	}
+	output := make([]MatchedPosition, 0, len(positions))
+	for _, bp := range positions {
+		mp, ok := byPositionID[bp.ID]
+		if !ok {
+			return nil, false
+		}
+		output = append(output, mp)
+	}
+	return output, true
+}
+
+// SaveMatches replaces whatever we matched for this trip last time.
+func SaveMatches(db *gorm.DB, tripInstanceID uint, matched []MatchedPosition) {
+	err := db.Unscoped().Where("trip_instance_id = ?", tripInstanceID).Delete(MatchedPosition{}).Error
+	check(err)
+	for i := range matched {
+		matched[i].TripInstanceID = tripInstanceID
+		err = db.Create(&matched[i]).Error
+		check(err)
+	}
+}
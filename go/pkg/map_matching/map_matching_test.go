@@ -0,0 +1,86 @@
+package map_matching
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/position_quality"
+	"gotest.tools/v3/assert"
+)
+
+func sampleDB() (*gorm.DB, bus_positions.TripInstance) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	check(err)
+	db.AutoMigrate(&bus_positions.TripInstance{}, &bus_positions.BusPosition{}, &MatchedPosition{})
+	trip := bus_positions.TripInstance{TripID: "T1", TripStartTime: "2019-09-19T08:00:00"}
+	check(db.Create(&trip).Error)
+	positions := []bus_positions.BusPosition{
+		{ReportedAt: "2019-09-19T08:00:00", Lat: 38.9, Lon: -77.0},
+		{ReportedAt: "2019-09-19T08:03:00", Lat: 38.9001, Lon: -76.995},
+		// on a detour
+		{ReportedAt: "2019-09-19T08:05:00", Lat: 38.905, Lon: -76.99},
+		{ReportedAt: "2019-09-19T08:07:00", Lat: 38.9, Lon: -76.985},
+	}
+	for _, bp := range positions {
+		bp.TripInstanceID = trip.ID
+		check(db.Create(&bp).Error)
+	}
+	return db, trip
+}
+
+func TestMatchTrip(t *testing.T) {
+	db, trip := sampleDB()
+	defer db.Close()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	positions, matched, ok := MatchTrip(db, feed, trip)
+	assert.Assert(t, ok)
+	assert.Equal(t, len(matched), 4)
+	for i := range matched {
+		assert.Equal(t, matched[i].BusPositionID, positions[i].ID)
+	}
+	assert.Equal(t, matched[0].ShapeID, "S1")
+	assert.Equal(t, matched[0].ShapeDistTraveled, 0.0)
+	assert.Assert(t, matched[1].Error > 10 && matched[1].Error < 12, "got %f", matched[1].Error)
+	assert.Assert(t, !matched[1].OffRoute)
+	assert.Assert(t, matched[2].OffRoute)
+	assert.Assert(t, matched[2].Error > 500, "got %f", matched[2].Error)
+	assert.Assert(t, !matched[3].OffRoute)
+	assert.Assert(t, matched[3].ShapeDistTraveled > matched[1].ShapeDistTraveled)
+
+	// The second time it comes from the cache.
+	_, again, ok := MatchTrip(db, feed, trip)
+	assert.Assert(t, ok)
+	assert.Equal(t, again[2].ID, matched[2].ID)
+
+	// Flagging one position and adding another keeps the count the same, but
+	// the cache no longer covers every position.
+	check(db.Model(&positions[1]).Update("quality", position_quality.FrozenGPS).Error)
+	check(db.Create(&bus_positions.BusPosition{TripInstanceID: trip.ID, ReportedAt: "2019-09-19T08:08:30", Lat: 38.9, Lon: -76.985}).Error)
+	positions, again, ok = MatchTrip(db, feed, trip)
+	assert.Assert(t, ok)
+	assert.Equal(t, len(again), 4)
+	for i := range again {
+		assert.Equal(t, again[i].BusPositionID, positions[i].ID)
+	}
+
+	// A new position means the cache is stale.
+	check(db.Create(&bus_positions.BusPosition{TripInstanceID: trip.ID, ReportedAt: "2019-09-19T08:09:00", Lat: 38.9, Lon: -76.98}).Error)
+	_, again, ok = MatchTrip(db, feed, trip)
+	assert.Assert(t, ok)
+	assert.Equal(t, len(again), 5)
+	var count int
+	db.Model(&MatchedPosition{}).Count(&count)
+	assert.Equal(t, count, 5)
+}
+
+func TestMatchTripNotInFeed(t *testing.T) {
+	db, trip := sampleDB()
+	defer db.Close()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	trip.TripID = "nope"
+	_, _, ok := MatchTrip(db, feed, trip)
+	assert.Assert(t, !ok)
+}
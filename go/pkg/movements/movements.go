@@ -0,0 +1,187 @@
+package movements
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/geo"
+)
+
+const (
+	TypeRevenue = "revenue"
+	// out of service before the vehicle's first revenue trip of the day
+	TypePullOut = "pull_out"
+	// out of service between two revenue trips
+	TypeDeadhead = "deadhead"
+	// out of service after the last revenue trip
+	TypePullIn = "pull_in"
+	// parked out of service, which is usually at the garage
+	TypeGarage = "garage"
+)
+
+// An out-of-service vehicle that stays within DwellRadiusMeters for at least
+// this long is parked.
+const DefaultMinDwell = 15 * time.Minute
+
+// GPS wanders a bit even when the bus is parked.
+const DwellRadiusMeters = 150.0
+
+// A Point is one position of a vehicle. TripInstanceID is 0 if the vehicle
+// wasn't on a revenue trip.
+type Point struct {
+	At             time.Time
+	Lat            float64
+	Lon            float64
+	TripInstanceID uint
+	TripID         string
+	RouteID        string
+}
+
+// A Movement is a stretch of one vehicle's service day, either a revenue trip
+// or something it did out of service.
+type Movement struct {
+	gorm.Model
+	Agency      string `gorm:"index:idx_movement_day"`
+	ServiceDate string `gorm:"index:idx_movement_day"`
+	VehicleID   string `gorm:"index"`
+	Type        string
+	Start       time.Time
+	End         time.Time
+	Positions   int
+	// This includes the distance from where the movement before it ended,
+	// so the movements add up to everywhere the vehicle went.
+	DistanceMeters float64
+	// for TypeRevenue
+	TripInstanceID uint
+	TripID         string
+	RouteID        string
+	// for everything else, the revenue trips on either side of it, if any
+	PreviousTripID string
+	NextTripID     string
+	StartLat       float64
+	StartLon       float64
+	EndLat         float64
+	EndLon         float64
+}
+
+type piece struct {
+	points []Point
+	parked bool
+}
+
+// splitParked splits out-of-service points into the stretches where the
+// vehicle was parked and the ones where it was moving.
+func splitParked(points []Point, minDwell time.Duration) []piece {
+	var output []piece
+	pieceStart := 0
+	i := 0
+	for i < len(points) {
+		j := i
+		for j+1 < len(points) && geo.Haversine(points[i].Lat, points[i].Lon, points[j+1].Lat, points[j+1].Lon) <= DwellRadiusMeters {
+			j++
+		}
+		if points[j].At.Sub(points[i].At) < minDwell {
+			i++
+			continue
+		}
+		if i > pieceStart {
+			output = append(output, piece{points: points[pieceStart:i]})
+		}
+		output = append(output, piece{points: points[i : j+1], parked: true})
+		pieceStart = j + 1
+		i = j + 1
+	}
+	if pieceStart < len(points) {
+		output = append(output, piece{points: points[pieceStart:]})
+	}
+	return output
+}
+
+// BuildMovements splits one vehicle's positions on a service day into
+// movements. Out-of-service stretches where it stayed put for minDwell or
+// longer are TypeGarage, and the rest are pull-outs, deadheads or pull-ins
+// depending on where they fall between its revenue trips.
+func BuildMovements(agency, serviceDate, vehicleID string, points []Point, minDwell time.Duration) []Movement {
+	sorted := append([]Point(nil), points...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].At.Before(sorted[j].At) })
+
+	var pieces []piece
+	for start := 0; start < len(sorted); {
+		end := start + 1
+		for end < len(sorted) && sorted[end].TripInstanceID == sorted[start].TripInstanceID {
+			end++
+		}
+		if sorted[start].TripInstanceID != 0 {
+			pieces = append(pieces, piece{points: sorted[start:end]})
+		} else {
+			pieces = append(pieces, splitParked(sorted[start:end], minDwell)...)
+		}
+		start = end
+	}
+
+	output := make([]Movement, 0, len(pieces))
+	previousTripID := ""
+	for i, p := range pieces {
+		first, last := p.points[0], p.points[len(p.points)-1]
+		m := Movement{
+			Agency:         agency,
+			ServiceDate:    serviceDate,
+			VehicleID:      vehicleID,
+			Start:          first.At,
+			End:            last.At,
+			Positions:      len(p.points),
+			TripInstanceID: first.TripInstanceID,
+			StartLat:       first.Lat,
+			StartLon:       first.Lon,
+			EndLat:         last.Lat,
+			EndLon:         last.Lon,
+		}
+		if i > 0 {
+			m.DistanceMeters += geo.Haversine(output[i-1].EndLat, output[i-1].EndLon, first.Lat, first.Lon)
+		}
+		for k := 1; k < len(p.points); k++ {
+			m.DistanceMeters += geo.Haversine(p.points[k-1].Lat, p.points[k-1].Lon, p.points[k].Lat, p.points[k].Lon)
+		}
+		if first.TripInstanceID != 0 {
+			m.Type, m.TripID, m.RouteID = TypeRevenue, first.TripID, first.RouteID
+			previousTripID = first.TripID
+		} else {
+			m.PreviousTripID = previousTripID
+			for _, later := range pieces[i+1:] {
+				if later.points[0].TripInstanceID != 0 {
+					m.NextTripID = later.points[0].TripID
+					break
+				}
+			}
+			switch {
+			case p.parked:
+				m.Type = TypeGarage
+			case m.PreviousTripID == "" && m.NextTripID != "":
+				m.Type = TypePullOut
+			case m.PreviousTripID != "" && m.NextTripID == "":
+				m.Type = TypePullIn
+			default:
+				// between trips, or a day with no revenue trips at all
+				m.Type = TypeDeadhead
+			}
+		}
+		output = append(output, m)
+	}
+	return output
+}
+
+// SaveMovements replaces whatever we built for the agency and service date
+// last time.
+func SaveMovements(db *gorm.DB, agency string, serviceDate string, movements []Movement) error {
+	err := db.Unscoped().Where("agency = ? AND service_date = ?", agency, serviceDate).Delete(Movement{}).Error
+	if err != nil {
+		return err
+	}
+	for _, m := range movements {
+		if err = db.Create(&m).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package movements
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"gotest.tools/v3/assert"
+)
+
+// The bus sits at the garage, pulls out to run T1, deadheads to the start of
+// T2, runs it, pulls in and parks again.
+func samplePoints() []Point {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2019, 9, 19, hour, minute, 0, 0, time.UTC)
+	}
+	outOfService := func(hour, minute int, lat, lon float64) Point {
+		return Point{At: at(hour, minute), Lat: lat, Lon: lon}
+	}
+	onTrip := func(id uint, tripID string, hour, minute int, lat, lon float64) Point {
+		return Point{At: at(hour, minute), Lat: lat, Lon: lon, TripInstanceID: id, TripID: tripID, RouteID: "10A"}
+	}
+	return []Point{
+		outOfService(5, 0, 38.95, -77.0),
+		outOfService(5, 10, 38.9501, -77.0),
+		outOfService(5, 30, 38.95, -77.0001),
+		outOfService(5, 35, 38.93, -77.0),
+		outOfService(5, 40, 38.91, -77.0),
+		onTrip(1, "T1", 5, 45, 38.9, -77.0),
+		onTrip(1, "T1", 5, 55, 38.9, -76.98),
+		outOfService(6, 0, 38.9, -76.99),
+		onTrip(2, "T2", 6, 5, 38.9, -77.0),
+		onTrip(2, "T2", 6, 15, 38.9, -76.98),
+		outOfService(6, 25, 38.93, -76.99),
+		outOfService(6, 30, 38.95, -77.0),
+		outOfService(7, 0, 38.95, -77.0),
+	}
+}
+
+func TestBuildMovements(t *testing.T) {
+	points := samplePoints()
+	// out of order, like positions from two tables
+	points[0], points[5] = points[5], points[0]
+	movements := BuildMovements("wmatabus", "2019-09-19", "3171", points, DefaultMinDwell)
+
+	var types []string
+	for _, m := range movements {
+		types = append(types, m.Type)
+	}
+	assert.DeepEqual(t, types, []string{TypeGarage, TypePullOut, TypeRevenue, TypeDeadhead, TypeRevenue, TypePullIn, TypeGarage})
+
+	garage := movements[0]
+	assert.Equal(t, garage.Positions, 3)
+	assert.Equal(t, garage.NextTripID, "T1")
+	pullOut := movements[1]
+	assert.Equal(t, pullOut.Start, time.Date(2019, 9, 19, 5, 35, 0, 0, time.UTC))
+	assert.Equal(t, pullOut.PreviousTripID, "")
+	assert.Equal(t, pullOut.NextTripID, "T1")
+	// from the garage to its last position before T1
+	assert.Assert(t, pullOut.DistanceMeters > 4400 && pullOut.DistanceMeters < 4500)
+	assert.Equal(t, movements[2].TripID, "T1")
+	assert.Equal(t, movements[2].TripInstanceID, uint(1))
+	deadhead := movements[3]
+	assert.Equal(t, deadhead.PreviousTripID, "T1")
+	assert.Equal(t, deadhead.NextTripID, "T2")
+	assert.Equal(t, movements[5].PreviousTripID, "T2")
+	assert.Equal(t, movements[6].Start, time.Date(2019, 9, 19, 6, 30, 0, 0, time.UTC))
+
+	// A bus that never went into service only deadheads and parks.
+	movements = BuildMovements("wmatabus", "2019-09-19", "3171", samplePoints()[:5], DefaultMinDwell)
+	assert.Equal(t, len(movements), 2)
+	assert.Equal(t, movements[1].Type, TypeDeadhead)
+}
+
+func TestSaveMovements(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	defer db.Close()
+	db.AutoMigrate(&Movement{})
+
+	movements := BuildMovements("wmatabus", "2019-09-19", "3171", samplePoints(), DefaultMinDwell)
+	assert.NilError(t, SaveMovements(db, "wmatabus", "2019-09-19", movements))
+	assert.NilError(t, SaveMovements(db, "wmatabus", "2019-09-19", movements[:2]))
+	clever := BuildMovements("clever", "2019-09-19", "1501", samplePoints(), DefaultMinDwell)
+	assert.NilError(t, SaveMovements(db, "clever", "2019-09-19", clever))
+	var count int
+	db.Model(&Movement{}).Where("agency = ?", "wmatabus").Count(&count)
+	assert.Equal(t, count, 2)
+}
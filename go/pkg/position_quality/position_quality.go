@@ -0,0 +1,281 @@
+package position_quality
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/geo"
+)
+
+// Each position gets one of these as its Quality, for whichever check it
+// failed first.
+const (
+	// Good is blank so positions loaded before we had these checks count as
+	// good.
+	Good = ""
+	// 0,0 is what some AVL units report before they get a fix.
+	ZeroCoordinates = "zero"
+	OutsideArea     = "outside_area"
+	// It got too far from the last good position too quickly.
+	ImpossibleSpeed = "impossible_speed"
+	// The same coordinates for too long while the timestamps kept advancing.
+	// The bus may really be parked, but we can't tell.
+	FrozenGPS = "frozen"
+)
+
+// About 80 mph. Nothing we track goes that fast, even on the highway.
+const MaxSpeedMetersPerSecond = 36.0
+
+// GPS jitter over a few seconds can look fast, so a jump has to be at least
+// this far to be impossible.
+const MinJumpMeters = 500.0
+
+// After this long the last good position doesn't say much about where the
+// bus could be now.
+const MaxSpeedCheckGap = 30 * time.Minute
+
+// We accept the first position we see for a vehicle without checking its
+// speed, since there's nothing to compare it to. If it was a bad one, every
+// good position after it looks like an impossible jump, so this many in a row
+// that agree with each other take its place.
+const ReanchorAfter = 3
+
+// Real GPS wanders a little even when the bus is parked, so exactly the same
+// coordinates for this long means the unit stopped updating them.
+const FrozenAfter = 10 * time.Minute
+
+type BoundingBox struct {
+	MinLat float64
+	MaxLat float64
+	MinLon float64
+	MaxLon float64
+}
+
+func (b BoundingBox) Contains(lat, lon float64) bool {
+	return lat >= b.MinLat && lat <= b.MaxLat && lon >= b.MinLon && lon <= b.MaxLon
+}
+
+// AgencyBounds is everywhere each agency's buses go, with some room to spare
+// for trips to the garage.
+var AgencyBounds = map[string]BoundingBox{
+	// DC, suburban Maryland and Northern Virginia
+	"wmatabus": {MinLat: 38.5, MaxLat: 39.4, MinLon: -77.7, MaxLon: -76.6},
+	// the five boroughs and the express buses to Westchester
+	"mtabus": {MinLat: 40.45, MaxLat: 41.1, MinLon: -74.3, MaxLon: -73.65},
+	// Centro's Syracuse, Utica, Rome, Auburn and Oswego systems
+	"clever": {MinLat: 42.7, MaxLat: 43.6, MinLon: -76.8, MaxLon: -75.0},
+}
+
+// A Fix is a position as far as the checks are concerned. At is when the
+// vehicle reported it, or when we retrieved it if the feed doesn't say.
+type Fix struct {
+	At  time.Time
+	Lat float64
+	Lon float64
+}
+
+// VehicleState is what the checks remember about a vehicle between
+// positions.
+type VehicleState struct {
+	gorm.Model
+	Agency    string `gorm:"unique_index:idx_vehicle_state"`
+	VehicleID string `gorm:"unique_index:idx_vehicle_state"`
+	// the latest position that was Good or FrozenGPS
+	At  time.Time
+	Lat float64
+	Lon float64
+	// when it first reported exactly Lat, Lon
+	UnchangedSince time.Time
+	// the latest of the positions since then that failed the speed check
+	// but agreed with each other, and how many of them there were
+	CandidateAt    time.Time
+	CandidateLat   float64
+	CandidateLon   float64
+	CandidateCount int
+}
+
+// A Tracker runs the checks on one agency's positions. The speed and frozen
+// checks compare each position to the vehicle's last good one, so every
+// loader has to keep a Tracker around between snapshots, either in the
+// database with LoadTracker or in a file with ReadTrackerFile.
+type Tracker struct {
+	Agency   string
+	Vehicles map[string]VehicleState
+	changed  map[string]bool
+}
+
+// NewTracker starts with no history. For an agency that isn't in AgencyBounds
+// the position only has to be somewhere on Earth.
+func NewTracker(agency string) *Tracker {
+	return &Tracker{Agency: agency, Vehicles: make(map[string]VehicleState), changed: make(map[string]bool)}
+}
+
+func (t *Tracker) bounds() BoundingBox {
+	if b, ok := AgencyBounds[t.Agency]; ok {
+		return b
+	}
+	return BoundingBox{MinLat: -90, MaxLat: 90, MinLon: -180, MaxLon: 180}
+}
+
+// Check returns the quality of the vehicle's position and remembers it if
+// it's good. A position older than the last good one, which happens when we
+// load snapshots out of order, is still checked for speed but doesn't replace
+// it.
+func (t *Tracker) Check(vehicleID string, fix Fix) string {
+	if fix.Lat == 0 && fix.Lon == 0 {
+		return ZeroCoordinates
+	}
+	if !t.bounds().Contains(fix.Lat, fix.Lon) {
+		return OutsideArea
+	}
+	state, seen := t.Vehicles[vehicleID]
+	if !seen {
+		t.remember(vehicleID, VehicleState{Agency: t.Agency, VehicleID: vehicleID, At: fix.At, Lat: fix.Lat, Lon: fix.Lon, UnchangedSince: fix.At})
+		return Good
+	}
+	if impossibleJump(state.At, state.Lat, state.Lon, fix) {
+		if state.CandidateCount > 0 && !impossibleJump(state.CandidateAt, state.CandidateLat, state.CandidateLon, fix) {
+			state.CandidateCount++
+		} else {
+			state.CandidateCount = 1
+		}
+		state.CandidateAt, state.CandidateLat, state.CandidateLon = fix.At, fix.Lat, fix.Lon
+		if state.CandidateCount < ReanchorAfter {
+			t.remember(vehicleID, state)
+			return ImpossibleSpeed
+		}
+		// The vehicle has been somewhere else all along, so that's the
+		// position to check against now.
+		t.remember(vehicleID, VehicleState{Model: state.Model, Agency: t.Agency, VehicleID: vehicleID, At: fix.At, Lat: fix.Lat, Lon: fix.Lon, UnchangedSince: fix.At})
+		return Good
+	}
+	state.CandidateCount = 0
+	unchanged := fix.Lat == state.Lat && fix.Lon == state.Lon
+	elapsed := fix.At.Sub(state.At)
+	if elapsed <= 0 {
+		t.remember(vehicleID, state)
+		return Good
+	}
+	quality := Good
+	if unchanged {
+		if fix.At.Sub(state.UnchangedSince) >= FrozenAfter {
+			quality = FrozenGPS
+		}
+	} else {
+		state.Lat, state.Lon, state.UnchangedSince = fix.Lat, fix.Lon, fix.At
+	}
+	state.At = fix.At
+	t.remember(vehicleID, state)
+	return quality
+}
+
+// impossibleJump says whether the vehicle couldn't have gotten from the
+// earlier position to fix in the time between them.
+func impossibleJump(at time.Time, lat float64, lon float64, fix Fix) bool {
+	if fix.Lat == lat && fix.Lon == lon {
+		return false
+	}
+	gap := time.Duration(math.Abs(float64(fix.At.Sub(at))))
+	if gap > MaxSpeedCheckGap {
+		return false
+	}
+	meters := geo.Haversine(lat, lon, fix.Lat, fix.Lon)
+	return meters > MinJumpMeters && meters > MaxSpeedMetersPerSecond*gap.Seconds()
+}
+
+func (t *Tracker) remember(vehicleID string, state VehicleState) {
+	t.Vehicles[vehicleID] = state
+	t.changed[vehicleID] = true
+}
+
+// LoadTracker picks up where the agency's last snapshot left off.
+func LoadTracker(db *gorm.DB, agency string) (*Tracker, error) {
+	t := NewTracker(agency)
+	var states []VehicleState
+	if err := db.Where("agency = ?", agency).Find(&states).Error; err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		t.Vehicles[state.VehicleID] = state
+	}
+	return t, nil
+}
+
+// SaveTracker stores the vehicles whose state changed since LoadTracker.
+func SaveTracker(db *gorm.DB, t *Tracker) error {
+	for vehicleID := range t.changed {
+		state := t.Vehicles[vehicleID]
+		if err := db.Save(&state).Error; err != nil {
+			return err
+		}
+		t.Vehicles[vehicleID] = state
+	}
+	t.changed = make(map[string]bool)
+	return nil
+}
+
+// ReadTrackerFile is LoadTracker for loaders that can't use it, like the
+// DynamoDB one and the one on the newer gorm. A missing file means we're
+// starting from scratch.
+func ReadTrackerFile(filename string, agency string) (*Tracker, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return NewTracker(agency), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := NewTracker(agency)
+	if err = gob.NewDecoder(f).Decode(&t.Vehicles); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// DefaultTrackerFile is where those loaders keep the agency's tracker between
+// runs. Each run only sees one snapshot, so without it the speed and frozen
+// checks would never have anything to compare to.
+func DefaultTrackerFile(agency string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "bus_data_archive", "position_quality_"+agency+".gob")
+}
+
+// WriteTrackerFile is SaveTracker for ReadTrackerFile. It writes a temporary
+// file next to the old one and renames it into place, so a run that dies
+// halfway leaves the old state rather than a truncated file.
+func WriteTrackerFile(filename string, t *Tracker) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(t.Vehicles)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// GoodPositions is a gorm scope for positions that passed every check,
+// including the ones loaded before we had a quality column.
+func GoodPositions(db *gorm.DB) *gorm.DB {
+	return db.Where("quality IS NULL OR quality = ?", Good)
+}
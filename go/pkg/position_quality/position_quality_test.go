@@ -0,0 +1,109 @@
+package position_quality
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"gotest.tools/v3/assert"
+)
+
+func at(minute int) time.Time {
+	return time.Date(2019, 9, 19, 12, minute, 0, 0, time.UTC)
+}
+
+func TestCheck(t *testing.T) {
+	tracker := NewTracker("wmatabus")
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(0), Lat: 0, Lon: 0}), ZeroCoordinates)
+	// Syracuse
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(0), Lat: 43.05, Lon: -76.15}), OutsideArea)
+	assert.Equal(t, len(tracker.Vehicles), 0)
+
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(1), Lat: 38.9, Lon: -77.0}), Good)
+	// 5.5 kilometers in a minute
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(2), Lat: 38.95, Lon: -77.0}), ImpossibleSpeed)
+	// The glitch didn't move the bus, so this is a short hop from 12:01.
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(3), Lat: 38.901, Lon: -77.0}), Good)
+	// An earlier snapshot loaded late is checked against the later position.
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(2), Lat: 38.95, Lon: -77.0}), ImpossibleSpeed)
+	assert.Equal(t, tracker.Vehicles["3171"].At, at(3))
+	// Half an hour later it could be anywhere.
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(40), Lat: 38.95, Lon: -77.0}), Good)
+
+	// The same coordinates for ten minutes while the clock keeps going
+	for minute := 41; minute < 50; minute++ {
+		assert.Equal(t, tracker.Check("3171", Fix{At: at(minute), Lat: 38.95, Lon: -77.0}), Good)
+	}
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(50), Lat: 38.95, Lon: -77.0}), FrozenGPS)
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(51), Lat: 38.95001, Lon: -77.0}), Good)
+
+	// We don't know where this agency runs, so anywhere on Earth will do.
+	assert.Equal(t, NewTracker("someoneelse").Check("1501", Fix{At: at(0), Lat: 43.05, Lon: -76.15}), Good)
+}
+
+func TestReanchor(t *testing.T) {
+	tracker := NewTracker("wmatabus")
+	// The first position was a glitch, but we had nothing to compare it to.
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(0), Lat: 39.2, Lon: -77.0}), Good)
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(1), Lat: 38.9, Lon: -77.0}), ImpossibleSpeed)
+	// Glitches that don't agree with each other start over.
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(2), Lat: 38.7, Lon: -77.0}), ImpossibleSpeed)
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(3), Lat: 38.9, Lon: -77.0}), ImpossibleSpeed)
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(4), Lat: 38.901, Lon: -77.0}), ImpossibleSpeed)
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(5), Lat: 38.902, Lon: -77.0}), Good)
+	assert.Equal(t, tracker.Vehicles["3171"].Lat, 38.902)
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(6), Lat: 38.903, Lon: -77.0}), Good)
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(7), Lat: 39.2, Lon: -77.0}), ImpossibleSpeed)
+}
+
+func TestSaveTracker(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	defer db.Close()
+	db.AutoMigrate(&VehicleState{})
+
+	tracker, err := LoadTracker(db, "wmatabus")
+	assert.NilError(t, err)
+	tracker.Check("3171", Fix{At: at(1), Lat: 38.9, Lon: -77.0})
+	assert.NilError(t, SaveTracker(db, tracker))
+	tracker.Check("3171", Fix{At: at(2), Lat: 38.901, Lon: -77.0})
+	assert.NilError(t, SaveTracker(db, tracker))
+
+	// The next snapshot picks up where this one left off.
+	tracker, err = LoadTracker(db, "wmatabus")
+	assert.NilError(t, err)
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(3), Lat: 38.95, Lon: -77.0}), ImpossibleSpeed)
+	var count int
+	db.Model(&VehicleState{}).Count(&count)
+	assert.Equal(t, count, 1)
+	other, err := LoadTracker(db, "clever")
+	assert.NilError(t, err)
+	assert.Equal(t, len(other.Vehicles), 0)
+}
+
+func TestTrackerFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "position_quality")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "wmatabus", "quality.gob")
+
+	tracker, err := ReadTrackerFile(filename, "wmatabus")
+	assert.NilError(t, err)
+	tracker.Check("3171", Fix{At: at(1), Lat: 38.9, Lon: -77.0})
+	assert.NilError(t, WriteTrackerFile(filename, tracker))
+
+	tracker, err = ReadTrackerFile(filename, "wmatabus")
+	assert.NilError(t, err)
+	assert.Equal(t, tracker.Check("3171", Fix{At: at(2), Lat: 38.95, Lon: -77.0}), ImpossibleSpeed)
+
+	// Writing over it doesn't leave the temporary file behind.
+	assert.NilError(t, WriteTrackerFile(filename, tracker))
+	infos, err := ioutil.ReadDir(filepath.Dir(filename))
+	assert.NilError(t, err)
+	assert.Equal(t, len(infos), 1)
+	assert.Equal(t, infos[0].Name(), "quality.gob")
+}
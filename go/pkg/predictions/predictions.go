@@ -0,0 +1,382 @@
+package predictions
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_realtime"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+)
+
+// A Prediction is one stop time update from one TripUpdates snapshot: at
+// IssuedAt, the feed said the bus would get to the stop at PredictedAt.
+type Prediction struct {
+	ServiceDate  string
+	TripID       string
+	RouteID      string
+	VehicleID    string
+	StopID       string
+	StopSequence int
+	IssuedAt     time.Time
+	PredictedAt  time.Time
+}
+
+// Horizon is how far ahead the prediction was.
+func (p Prediction) Horizon() time.Duration {
+	return p.PredictedAt.Sub(p.IssuedAt)
+}
+
+// predictedTime prefers an absolute time. WMATA sometimes only sends a
+// delay, which we can only use if the trip is in the GTFS feed.
+func predictedTime(e *gtfs_realtime.StopTimeEvent, scheduled time.Time, haveScheduled bool) (time.Time, bool) {
+	if e == nil {
+		return time.Time{}, false
+	}
+	if e.Time != nil {
+		return time.Unix(*e.Time, 0), true
+	}
+	if e.Delay != nil && haveScheduled {
+		return scheduled.Add(time.Duration(*e.Delay) * time.Second), true
+	}
+	return time.Time{}, false
+}
+
+// scheduledArrival finds a stop on a trip in the GTFS feed, by sequence if
+// the update has one and by stop ID if it doesn't.
+func scheduledArrival(feed *gtfs_schedule.Feed, days bus_positions.ServiceDays, serviceDate string, tripID string, u gtfs_realtime.StopTimeUpdate) (time.Time, int, bool) {
+	if feed == nil {
+		return time.Time{}, 0, false
+	}
+	for _, st := range feed.StopTimesByTripID[tripID] {
+		if (u.StopSequence != nil && st.StopSequence == int(*u.StopSequence)) || (u.StopSequence == nil && st.StopID == u.StopID) {
+			t, err := days.GTFSTime(serviceDate, st.Arrival)
+			return t, st.StopSequence, err == nil
+		}
+	}
+	return time.Time{}, 0, false
+}
+
+// ExtractPredictions pulls every arrival prediction still in the future out
+// of one TripUpdates snapshot. A stop with no arrival prediction uses its
+// departure prediction instead. feed can be nil, in which case updates that
+// only have a delay are left out.
+func ExtractPredictions(m gtfs_realtime.FeedMessage, retrievedAt time.Time, days bus_positions.ServiceDays, feed *gtfs_schedule.Feed) []Prediction {
+	issuedAt := retrievedAt
+	if m.Header.Timestamp != 0 {
+		issuedAt = time.Unix(int64(m.Header.Timestamp), 0)
+	}
+	var output []Prediction
+	for _, e := range m.Entities {
+		tu := e.TripUpdate
+		if tu == nil || e.IsDeleted || tu.Trip.ScheduleRelationship == gtfs_realtime.TripCanceled {
+			continue
+		}
+		serviceDate := days.FeedDate(tu.Trip.StartDate, issuedAt)
+		vehicleID := ""
+		if tu.Vehicle != nil {
+			vehicleID = tu.Vehicle.ID
+		}
+		for _, u := range tu.StopTimeUpdates {
+			if u.ScheduleRelationship != gtfs_realtime.StopScheduled {
+				continue
+			}
+			scheduled, sequence, haveScheduled := scheduledArrival(feed, days, serviceDate, tu.Trip.TripID, u)
+			if u.StopSequence != nil {
+				sequence = int(*u.StopSequence)
+			}
+			predictedAt, ok := predictedTime(u.Arrival, scheduled, haveScheduled)
+			if !ok {
+				predictedAt, ok = predictedTime(u.Departure, scheduled, haveScheduled)
+			}
+			if !ok || predictedAt.Before(issuedAt) {
+				continue
+			}
+			output = append(output, Prediction{
+				ServiceDate:  serviceDate,
+				TripID:       tu.Trip.TripID,
+				RouteID:      tu.Trip.RouteID,
+				VehicleID:    vehicleID,
+				StopID:       u.StopID,
+				StopSequence: sequence,
+				IssuedAt:     issuedAt,
+				PredictedAt:  predictedAt,
+			})
+		}
+	}
+	return output
+}
+
+// A TripStop is what we line predictions and actual arrivals up by.
+type TripStop struct {
+	ServiceDate string
+	TripID      string
+	StopID      string
+}
+
+// A ScoredPrediction is a prediction and when the bus really got there.
+// Error is positive when the bus was later than predicted.
+type ScoredPrediction struct {
+	Prediction
+	ActualAt time.Time
+	Error    time.Duration
+}
+
+// Score pairs predictions with actual arrivals, like the ones
+// infer_stop_events works out. Predictions for stops we never saw the bus
+// get to are left out.
+func Score(predictions []Prediction, actuals map[TripStop]time.Time) []ScoredPrediction {
+	var output []ScoredPrediction
+	for _, p := range predictions {
+		actualAt, present := actuals[TripStop{p.ServiceDate, p.TripID, p.StopID}]
+		if !present {
+			continue
+		}
+		output = append(output, ScoredPrediction{Prediction: p, ActualAt: actualAt, Error: actualAt.Sub(p.PredictedAt)})
+	}
+	return output
+}
+
+// HorizonBuckets are the upper ends of the buckets we report on. Anything
+// further out goes in the last one.
+var HorizonBuckets = []time.Duration{2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 20 * time.Minute, 30 * time.Minute}
+
+// HorizonBucket names the bucket a horizon goes in, like "5-10m" or "30m+".
+func HorizonBucket(horizon time.Duration) string {
+	lower := 0
+	for _, upper := range HorizonBuckets {
+		if horizon < upper {
+			return strconv.Itoa(lower) + "-" + strconv.Itoa(int(upper.Minutes())) + "m"
+		}
+		lower = int(upper.Minutes())
+	}
+	return strconv.Itoa(lower) + "m+"
+}
+
+const (
+	ByHorizon = "horizon"
+	ByRoute   = "route"
+	ByHour    = "hour"
+)
+
+// Accuracy sums up the prediction errors in one horizon bucket, either for
+// every route at every time of day, or broken down by route or by the
+// service-day hour the prediction was made in.
+type Accuracy struct {
+	gorm.Model
+	ServiceDate string `gorm:"index"`
+	// ByHorizon, ByRoute or ByHour
+	Breakdown     string
+	HorizonBucket string
+	// empty unless Breakdown is ByRoute
+	RouteID string
+	// -1 unless Breakdown is ByHour. Like GTFS, 1am is 25.
+	Hour        int
+	Predictions int
+	// positive means buses were later than predicted
+	MeanErrorSeconds         float64
+	MeanAbsoluteErrorSeconds float64
+	// to the second
+	P90AbsoluteErrorSeconds float64
+	// the fraction of predictions that were right to within a minute
+	WithinOneMinute float64
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+type summaryKey struct {
+	ServiceDate   string
+	HorizonBucket string
+	RouteID       string
+	Hour          int
+}
+
+type runningSummary struct {
+	predictions      int
+	sumError         float64
+	sumAbsoluteError float64
+	withinOneMinute  int
+	// how many predictions were off by each number of seconds
+	absoluteSeconds map[int64]int
+}
+
+// A Summarizer works out what Summarize does one scored prediction at a time,
+// so a whole day of them never has to be in memory at once.
+type Summarizer struct {
+	days      bus_positions.ServiceDays
+	breakdown string
+	groups    map[summaryKey]*runningSummary
+}
+
+func NewSummarizer(days bus_positions.ServiceDays, breakdown string) *Summarizer {
+	return &Summarizer{days: days, breakdown: breakdown, groups: make(map[summaryKey]*runningSummary)}
+}
+
+func (s *Summarizer) Add(sp ScoredPrediction) error {
+	key := summaryKey{ServiceDate: sp.ServiceDate, HorizonBucket: HorizonBucket(sp.Horizon()), Hour: -1}
+	switch s.breakdown {
+	case ByRoute:
+		key.RouteID = sp.RouteID
+	case ByHour:
+		hour, err := s.days.Hour(sp.ServiceDate, sp.IssuedAt)
+		if err != nil {
+			return err
+		}
+		key.Hour = hour
+	}
+	g, ok := s.groups[key]
+	if !ok {
+		g = &runningSummary{absoluteSeconds: make(map[int64]int)}
+		s.groups[key] = g
+	}
+	g.predictions++
+	g.sumError += sp.Error.Seconds()
+	g.sumAbsoluteError += abs(sp.Error).Seconds()
+	if abs(sp.Error) <= time.Minute {
+		g.withinOneMinute++
+	}
+	g.absoluteSeconds[int64(math.Round(abs(sp.Error).Seconds()))]++
+	return nil
+}
+
+// p90 uses the nearest rank.
+func (g *runningSummary) p90() float64 {
+	seconds := make([]int64, 0, len(g.absoluteSeconds))
+	for s := range g.absoluteSeconds {
+		seconds = append(seconds, s)
+	}
+	sort.Slice(seconds, func(i, j int) bool { return seconds[i] < seconds[j] })
+	rank := (g.predictions*9 + 9) / 10
+	seen := 0
+	for _, s := range seconds {
+		seen += g.absoluteSeconds[s]
+		if seen >= rank {
+			return float64(s)
+		}
+	}
+	return 0
+}
+
+// Accuracy sums up everything added so far, by horizon bucket and then by
+// breakdown, in order.
+func (s *Summarizer) Accuracy() []Accuracy {
+	output := make([]Accuracy, 0, len(s.groups))
+	for key, g := range s.groups {
+		output = append(output, Accuracy{
+			ServiceDate:              key.ServiceDate,
+			Breakdown:                s.breakdown,
+			HorizonBucket:            key.HorizonBucket,
+			RouteID:                  key.RouteID,
+			Hour:                     key.Hour,
+			Predictions:              g.predictions,
+			MeanErrorSeconds:         g.sumError / float64(g.predictions),
+			MeanAbsoluteErrorSeconds: g.sumAbsoluteError / float64(g.predictions),
+			P90AbsoluteErrorSeconds:  g.p90(),
+			WithinOneMinute:          float64(g.withinOneMinute) / float64(g.predictions),
+		})
+	}
+	bucketOrder := make(map[string]int)
+	for i := 0; i <= len(HorizonBuckets); i++ {
+		var horizon time.Duration
+		if i > 0 {
+			horizon = HorizonBuckets[i-1]
+		}
+		bucketOrder[HorizonBucket(horizon)] = i
+	}
+	sort.Slice(output, func(i, j int) bool {
+		a, b := output[i], output[j]
+		if a.ServiceDate != b.ServiceDate {
+			return a.ServiceDate < b.ServiceDate
+		}
+		if a.HorizonBucket != b.HorizonBucket {
+			return bucketOrder[a.HorizonBucket] < bucketOrder[b.HorizonBucket]
+		}
+		if a.RouteID != b.RouteID {
+			return a.RouteID < b.RouteID
+		}
+		return a.Hour < b.Hour
+	})
+	return output
+}
+
+// Summarize breaks the scored predictions down by horizon bucket and then by
+// breakdown, in order.
+func Summarize(scored []ScoredPrediction, days bus_positions.ServiceDays, breakdown string) ([]Accuracy, error) {
+	s := NewSummarizer(days, breakdown)
+	for _, sp := range scored {
+		if err := s.Add(sp); err != nil {
+			return nil, err
+		}
+	}
+	return s.Accuracy(), nil
+}
+
+// SaveAccuracy replaces whatever we worked out for this service date last
+// time.
+func SaveAccuracy(db *gorm.DB, serviceDate string, rows []Accuracy) error {
+	err := db.Unscoped().Where("service_date = ?", serviceDate).Delete(Accuracy{}).Error
+	if err != nil {
+		return err
+	}
+	for _, a := range rows {
+		if err = db.Create(&a).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A StoredPrediction is a prediction we extracted, whether or not we could
+// score it. The snapshots it came from get purged, so this is the only copy.
+type StoredPrediction struct {
+	gorm.Model
+	ServiceDate  string `gorm:"index"`
+	TripID       string
+	RouteID      string
+	VehicleID    string
+	StopID       string
+	StopSequence int
+	IssuedAt     time.Time
+	PredictedAt  time.Time
+	// nil if we never saw the bus get to the stop
+	ActualAt *time.Time
+}
+
+// ClearPredictions deletes what we stored for the service date last time.
+func ClearPredictions(db *gorm.DB, serviceDate string) error {
+	return db.Unscoped().Where("service_date = ?", serviceDate).Delete(StoredPrediction{}).Error
+}
+
+// SavePredictions stores one snapshot's predictions, with when the bus really
+// got there if we know.
+func SavePredictions(db *gorm.DB, predictions []Prediction, actuals map[TripStop]time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, p := range predictions {
+			sp := StoredPrediction{
+				ServiceDate:  p.ServiceDate,
+				TripID:       p.TripID,
+				RouteID:      p.RouteID,
+				VehicleID:    p.VehicleID,
+				StopID:       p.StopID,
+				StopSequence: p.StopSequence,
+				IssuedAt:     p.IssuedAt,
+				PredictedAt:  p.PredictedAt,
+			}
+			if actualAt, present := actuals[TripStop{p.ServiceDate, p.TripID, p.StopID}]; present {
+				sp.ActualAt = &actualAt
+			}
+			if err := tx.Create(&sp).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
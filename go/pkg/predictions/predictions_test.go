@@ -0,0 +1,170 @@
+package predictions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_realtime"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"gotest.tools/v3/assert"
+)
+
+func getServiceDays() bus_positions.ServiceDays {
+	location, err := time.LoadLocation("US/Eastern")
+	if err != nil {
+		panic(err)
+	}
+	return bus_positions.ServiceDays{Location: location, RolloverHour: 4}
+}
+
+func at(days bus_positions.ServiceDays, hour, minute int) time.Time {
+	return time.Date(2019, 9, 19, hour, minute, 0, 0, days.Location)
+}
+
+func TestExtractPredictions(t *testing.T) {
+	days := getServiceDays()
+	m, err := gtfs_realtime.ParseFile("../gtfs_realtime/test_data/gtfsrt-tu-2019-04-27T03:55:01.pb")
+	assert.NilError(t, err)
+	retrievedAt := time.Date(2019, 4, 27, 3, 55, 1, 0, time.UTC)
+	// The second trip is cancelled.
+	predictions := ExtractPredictions(m, retrievedAt, days, nil)
+	assert.Equal(t, len(predictions), 2)
+	p := predictions[1]
+	assert.Equal(t, p.ServiceDate, "2019-04-26")
+	assert.Equal(t, p.TripID, "914402060")
+	assert.Equal(t, p.VehicleID, "3171")
+	assert.Equal(t, p.StopID, "1002")
+	assert.Equal(t, p.IssuedAt.Unix(), int64(1556337301))
+	// the arrival, not the departure
+	assert.Equal(t, p.PredictedAt.Unix(), int64(1556337500))
+	assert.Equal(t, p.Horizon(), 199*time.Second)
+}
+
+func TestExtractPredictionsFromDelays(t *testing.T) {
+	days := getServiceDays()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	delay := int32(120)
+	sequence := uint32(2)
+	passed := int64(at(days, 7, 50).Unix())
+	m := gtfs_realtime.FeedMessage{
+		Header: gtfs_realtime.FeedHeader{Timestamp: uint64(at(days, 7, 55).Unix())},
+		Entities: []gtfs_realtime.FeedEntity{{ID: "1", TripUpdate: &gtfs_realtime.TripUpdate{
+			Trip: gtfs_realtime.TripDescriptor{TripID: "T1", RouteID: "10A", StartDate: "20190919"},
+			StopTimeUpdates: []gtfs_realtime.StopTimeUpdate{
+				// already in the past, so not a prediction
+				{StopID: "1001", Arrival: &gtfs_realtime.StopTimeEvent{Time: &passed}},
+				{StopID: "1002", StopSequence: &sequence, Arrival: &gtfs_realtime.StopTimeEvent{Delay: &delay}},
+				{StopID: "1003", ScheduleRelationship: gtfs_realtime.StopSkipped, Arrival: &gtfs_realtime.StopTimeEvent{Delay: &delay}},
+			},
+		}}},
+	}
+	predictions := ExtractPredictions(m, at(days, 7, 55), days, &feed)
+	assert.Equal(t, len(predictions), 1)
+	assert.Equal(t, predictions[0].StopSequence, 2)
+	assert.Equal(t, predictions[0].PredictedAt, at(days, 8, 7))
+	assert.Equal(t, predictions[0].Horizon(), 12*time.Minute)
+}
+
+func TestHorizonBucket(t *testing.T) {
+	assert.Equal(t, HorizonBucket(0), "0-2m")
+	assert.Equal(t, HorizonBucket(5*time.Minute), "5-10m")
+	assert.Equal(t, HorizonBucket(29*time.Minute), "20-30m")
+	assert.Equal(t, HorizonBucket(2*time.Hour), "30m+")
+}
+
+func testPredictions(days bus_positions.ServiceDays) ([]Prediction, map[TripStop]time.Time) {
+	predict := func(route string, stop string, issuedHour, issuedMinute int, predictedMinute int) Prediction {
+		return Prediction{
+			ServiceDate: "2019-09-19",
+			TripID:      "T-" + route,
+			RouteID:     route,
+			StopID:      stop,
+			IssuedAt:    at(days, issuedHour, issuedMinute),
+			PredictedAt: at(days, 8, predictedMinute),
+		}
+	}
+	predictions := []Prediction{
+		predict("10A", "1002", 8, 0, 5),
+		predict("10A", "1002", 8, 4, 6),
+		predict("10B", "1002", 7, 58, 5),
+		// we never saw the bus get here
+		predict("10B", "1003", 8, 0, 10),
+	}
+	actuals := map[TripStop]time.Time{
+		{"2019-09-19", "T-10A", "1002"}: at(days, 8, 6),
+		{"2019-09-19", "T-10B", "1002"}: at(days, 8, 8),
+	}
+	return predictions, actuals
+}
+
+func testScored(days bus_positions.ServiceDays) []ScoredPrediction {
+	return Score(testPredictions(days))
+}
+
+func TestSummarize(t *testing.T) {
+	days := getServiceDays()
+	scored := testScored(days)
+	assert.Equal(t, len(scored), 3)
+	assert.Equal(t, scored[0].Error, time.Minute)
+	assert.Equal(t, scored[1].Error, time.Duration(0))
+
+	byHorizon, err := Summarize(scored, days, ByHorizon)
+	assert.NilError(t, err)
+	assert.Equal(t, len(byHorizon), 2)
+	assert.Equal(t, byHorizon[0].HorizonBucket, "2-5m")
+	assert.Equal(t, byHorizon[0].Predictions, 1)
+	assert.Equal(t, byHorizon[1].HorizonBucket, "5-10m")
+	assert.Equal(t, byHorizon[1].Predictions, 2)
+	assert.Equal(t, byHorizon[1].MeanErrorSeconds, 120.0)
+	assert.Equal(t, byHorizon[1].P90AbsoluteErrorSeconds, 180.0)
+	assert.Equal(t, byHorizon[1].WithinOneMinute, 0.5)
+	assert.Equal(t, byHorizon[1].Hour, -1)
+
+	byRoute, err := Summarize(scored, days, ByRoute)
+	assert.NilError(t, err)
+	assert.Equal(t, len(byRoute), 3)
+	assert.Equal(t, byRoute[1].RouteID, "10A")
+	assert.Equal(t, byRoute[2].RouteID, "10B")
+	assert.Equal(t, byRoute[2].MeanAbsoluteErrorSeconds, 180.0)
+
+	byHour, err := Summarize(scored, days, ByHour)
+	assert.NilError(t, err)
+	assert.Equal(t, len(byHour), 3)
+	assert.Equal(t, byHour[1].Hour, 7)
+	assert.Equal(t, byHour[2].Hour, 8)
+
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	defer db.Close()
+	db.AutoMigrate(&Accuracy{})
+	assert.NilError(t, SaveAccuracy(db, "2019-09-19", append(byHorizon, byRoute...)))
+	assert.NilError(t, SaveAccuracy(db, "2019-09-19", byHorizon))
+	var count int
+	db.Model(&Accuracy{}).Count(&count)
+	assert.Equal(t, count, 2)
+}
+
+func TestSavePredictions(t *testing.T) {
+	days := getServiceDays()
+	predictions, actuals := testPredictions(days)
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	defer db.Close()
+	db.AutoMigrate(&StoredPrediction{})
+	assert.NilError(t, SavePredictions(db, predictions, actuals))
+
+	var stored []StoredPrediction
+	assert.NilError(t, db.Order("id").Find(&stored).Error)
+	// even the one we couldn't score
+	assert.Equal(t, len(stored), 4)
+	assert.Equal(t, stored[0].ActualAt.Unix(), at(days, 8, 6).Unix())
+	assert.Assert(t, stored[3].ActualAt == nil)
+
+	assert.NilError(t, ClearPredictions(db, "2019-09-19"))
+	var count int
+	db.Unscoped().Model(&StoredPrediction{}).Count(&count)
+	assert.Equal(t, count, 0)
+}
@@ -0,0 +1,199 @@
+package purge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/archiver"
+)
+
+// DefaultRetentionDays is how many days of short_term each agency keeps after
+// the day is over. purge_old_data used to keep ten for everyone.
+var DefaultRetentionDays = map[string]int{
+	"wmatabus": 10,
+	"mtabus":   10,
+	"clever":   10,
+}
+
+// UploadChecker says whether a day's archive made it off this machine. If
+// it didn't, the string says why.
+type UploadChecker interface {
+	Uploaded(agency string, m archiver.Manifest) (bool, string, error)
+}
+
+// FrozenChecker says whether every Glacier vault has a day's tarball. Once
+// one does, glacier_tier deletes the local copy, so the manifest is all we
+// have to check short_term against.
+type FrozenChecker interface {
+	Frozen(agency string, day string) (bool, error)
+}
+
+// Decision is what we decided to do with one short_term/<day> directory.
+type Decision struct {
+	Day    string
+	Delete bool
+	Reason string
+}
+
+// ParseRetention reads flags like "wmatabus=10,clever=30" on top of the
+// defaults.
+func ParseRetention(s string) (map[string]int, error) {
+	output := make(map[string]int, len(DefaultRetentionDays))
+	for agency, days := range DefaultRetentionDays {
+		output[agency] = days
+	}
+	if s == "" {
+		return output, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected agency=days, not %q", pair)
+		}
+		days, err := strconv.Atoi(parts[1])
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("retention for %s must be a positive number of days", parts[0])
+		}
+		output[parts[0]] = days
+	}
+	return output, nil
+}
+
+// shortTermMatchesManifest makes sure nothing showed up in the directory
+// after we archived it.
+func shortTermMatchesManifest(dayDir string, m archiver.Manifest) (string, error) {
+	sizes := make(map[string]int64, len(m.Files))
+	for _, mf := range m.Files {
+		sizes[filepath.Base(mf.Name)] = mf.Size
+	}
+	infos, err := ioutil.ReadDir(dayDir)
+	if err != nil {
+		return "", err
+	}
+	for _, info := range infos {
+		size, ok := sizes[info.Name()]
+		if !ok {
+			return fmt.Sprintf("%s is not in the archive", info.Name()), nil
+		}
+		if size != info.Size() {
+			return fmt.Sprintf("%s has changed since it was archived", info.Name()), nil
+		}
+	}
+	return "", nil
+}
+
+func decide(dataPath string, agency string, day string, reverify bool, checker UploadChecker, glacier FrozenChecker) (Decision, error) {
+	d := Decision{Day: day}
+	m, err := archiver.ReadManifest(archiver.ManifestPath(dataPath, day))
+	if os.IsNotExist(err) {
+		d.Reason = "there is no manifest"
+		return d, nil
+	}
+	if err != nil {
+		return d, err
+	}
+	if !m.PurgeEligible {
+		d.Reason = "the manifest does not say the archive was verified"
+		return d, nil
+	}
+	archive := archiver.ArchivePath(dataPath, day)
+	info, err := os.Stat(archive)
+	if os.IsNotExist(err) {
+		frozen := false
+		if glacier != nil {
+			if frozen, err = glacier.Frozen(agency, day); err != nil {
+				return d, err
+			}
+		}
+		if !frozen {
+			d.Reason = "there is no archive"
+			return d, nil
+		}
+	} else if err != nil {
+		return d, err
+	} else {
+		if info.Size() != m.ArchiveSize {
+			d.Reason = "the archive is not the size the manifest says"
+			return d, nil
+		}
+		if reverify {
+			if err = archiver.Verify(archive, m); err != nil {
+				d.Reason = fmt.Sprintf("the archive failed verification: %s", err)
+				return d, nil
+			}
+		}
+	}
+	if d.Reason, err = shortTermMatchesManifest(filepath.Join(dataPath, "short_term", day), m); err != nil || d.Reason != "" {
+		return d, err
+	}
+	uploaded, reason, err := checker.Uploaded(agency, m)
+	if err != nil {
+		return d, err
+	}
+	if !uploaded {
+		d.Reason = reason
+		return d, nil
+	}
+	d.Delete = true
+	d.Reason = "archived, verified and uploaded"
+	return d, nil
+}
+
+// Plan decides about every short_term/<day> directory that's older than the
+// retention period. Anything in short_term that isn't named like a day is
+// left alone. reverify reads every archive all the way through again, which
+// is slow. glacier can be nil if nothing has been frozen.
+func Plan(dataPath string, agency string, retentionDays int, now time.Time, reverify bool, checker UploadChecker, glacier FrozenChecker) ([]Decision, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(dataPath, "short_term"))
+	if err != nil {
+		return nil, err
+	}
+	// Days are UTC days, and a day is only over at the end of it.
+	cutoff := now.UTC().AddDate(0, 0, -retentionDays)
+	var decisions []Decision
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", info.Name())
+		if err != nil {
+			continue
+		}
+		if !day.AddDate(0, 0, 1).Before(cutoff) {
+			continue
+		}
+		d, err := decide(dataPath, agency, info.Name(), reverify, checker, glacier)
+		if err != nil {
+			return decisions, fmt.Errorf("%s: %s", info.Name(), err)
+		}
+		decisions = append(decisions, d)
+	}
+	sort.Slice(decisions, func(i, j int) bool { return decisions[i].Day < decisions[j].Day })
+	return decisions, nil
+}
+
+// Execute deletes the directories we decided to delete, unless dryRun.
+func Execute(dataPath string, decisions []Decision, dryRun bool) error {
+	for _, d := range decisions {
+		dir := filepath.Join(dataPath, "short_term", d.Day)
+		if !d.Delete {
+			fmt.Printf("Keeping %s: %s\n", dir, d.Reason)
+			continue
+		}
+		if dryRun {
+			fmt.Printf("Would delete %s: %s\n", dir, d.Reason)
+			continue
+		}
+		fmt.Printf("Deleting %s: %s\n", dir, d.Reason)
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
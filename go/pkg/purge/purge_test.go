@@ -0,0 +1,95 @@
+package purge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/archiver"
+	"gotest.tools/v3/assert"
+)
+
+type fakeChecker map[string]bool
+
+func (f fakeChecker) Uploaded(agency string, m archiver.Manifest) (bool, string, error) {
+	if f[m.Day] {
+		return true, "", nil
+	}
+	return false, "the archive is not in the bucket", nil
+}
+
+func makeDay(t *testing.T, dataPath string, day string) {
+	dir := filepath.Join(dataPath, "short_term", day)
+	assert.NilError(t, os.MkdirAll(dir, 0755))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "buses"+day+"T03:55:01.json"), []byte(`{"BusPositions":[]}`), 0644))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestParseRetention(t *testing.T) {
+	retention, err := ParseRetention("clever=30")
+	assert.NilError(t, err)
+	assert.Equal(t, retention["clever"], 30)
+	assert.Equal(t, retention["wmatabus"], 10)
+	_, err = ParseRetention("clever")
+	assert.Assert(t, err != nil)
+	_, err = ParseRetention("clever=-1")
+	assert.Assert(t, err != nil)
+}
+
+func TestPurge(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "purge")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dataPath)
+	for _, day := range []string{"2019-04-24", "2019-04-25", "2019-04-26", "2019-04-27", "2019-05-07"} {
+		makeDay(t, dataPath, day)
+	}
+	assert.NilError(t, os.MkdirAll(filepath.Join(dataPath, "short_term", "scratch"), 0755))
+	for _, day := range []string{"2019-04-25", "2019-04-26", "2019-04-27", "2019-05-07"} {
+		_, err = archiver.ArchiveDay(dataPath, day, time.UTC)
+		assert.NilError(t, err)
+	}
+	// something showed up after we archived this one
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dataPath, "short_term/2019-04-26/late.json"), []byte("{}"), 0644))
+	checker := fakeChecker{"2019-04-26": true, "2019-04-27": true, "2019-05-07": true}
+
+	now := time.Date(2019, 5, 8, 12, 0, 0, 0, time.UTC)
+	decisions, err := Plan(dataPath, "wmatabus", 10, now, true, checker, nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decisions, []Decision{
+		{Day: "2019-04-24", Reason: "there is no manifest"},
+		{Day: "2019-04-25", Reason: "the archive is not in the bucket"},
+		{Day: "2019-04-26", Reason: "late.json is not in the archive"},
+		{Day: "2019-04-27", Delete: true, Reason: "archived, verified and uploaded"},
+	})
+
+	assert.NilError(t, Execute(dataPath, decisions, true))
+	assert.Assert(t, exists(filepath.Join(dataPath, "short_term/2019-04-27")))
+	assert.NilError(t, Execute(dataPath, decisions, false))
+	assert.Assert(t, !exists(filepath.Join(dataPath, "short_term/2019-04-27")))
+	assert.Assert(t, exists(filepath.Join(dataPath, "short_term/2019-04-26")))
+	assert.Assert(t, exists(filepath.Join(dataPath, "short_term/scratch")))
+	assert.Assert(t, exists(archiver.ArchivePath(dataPath, "2019-04-27")))
+}
+
+func TestPurgeRefusesUnverifiedArchives(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "purge")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dataPath)
+	makeDay(t, dataPath, "2019-04-27")
+	m, err := archiver.ArchiveDay(dataPath, "2019-04-27", time.UTC)
+	assert.NilError(t, err)
+	m.PurgeEligible = false
+	assert.NilError(t, archiver.WriteManifest(archiver.ManifestPath(dataPath, "2019-04-27"), m))
+
+	now := time.Date(2019, 5, 8, 12, 0, 0, 0, time.UTC)
+	decisions, err := Plan(dataPath, "wmatabus", 10, now, false, fakeChecker{"2019-04-27": true}, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, decisions[0].Delete, false)
+	assert.Equal(t, decisions[0].Reason, "the manifest does not say the archive was verified")
+}
@@ -0,0 +1,408 @@
+package replay
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_realtime"
+)
+
+// Feed is one of the things get_bus_positions saves every minute. The values
+// are the filename prefixes.
+type Feed string
+
+const (
+	BusPositions     Feed = "buses"
+	VehiclePositions Feed = "gtfsrt-vp-"
+	TripUpdates      Feed = "gtfsrt-tu-"
+)
+
+var feeds = []Feed{BusPositions, VehiclePositions, TripUpdates}
+
+var busesName = regexp.MustCompile(`^buses....-..-..T..:..:..(?:Z|[+-]..:..)?\.json$`)
+var gtfsrtName = regexp.MustCompile(`^(gtfsrt-(?:vp|tu)-)(....-..-..T..:..:..(?:Z|[+-]..:..)?)\.pb$`)
+
+// Snapshot is one saved file, either on disk under short_term/<day> or inside
+// one of the archive/<day>.tar.gz tarballs.
+type Snapshot struct {
+	Feed Feed
+	// when the poller saved it, in UTC
+	Time time.Time
+	// The file itself, or its name inside Tarball
+	Path    string
+	Tarball string
+	// the second reading of a legacy name from the hour the clocks went
+	// back, until the Index decides between them
+	later time.Time
+}
+
+// ParseName says which feed a snapshot file belongs to and when it was
+// saved, reading legacy names without an offset in location. The bool is
+// false for anything else, like wget logs. A legacy name from the hour the
+// clocks went back gets the first of its two readings; an Index can do
+// better.
+func ParseName(name string, location *time.Location) (Feed, time.Time, bool) {
+	feed, rt, ok := parseName(name, location)
+	return feed, rt.Time, ok
+}
+
+func parseName(name string, location *time.Location) (Feed, bus_positions.RetrievalTime, bool) {
+	base := path.Base(name)
+	if busesName.MatchString(base) {
+		// FileRetrievalTime wants the directory separator before "buses".
+		rt, err := bus_positions.FileRetrievalTime("/"+base, location)
+		return BusPositions, rt, err == nil
+	}
+	result := gtfsrtName.FindStringSubmatch(base)
+	if result == nil {
+		return "", bus_positions.RetrievalTime{}, false
+	}
+	rt, err := bus_positions.ParseRetrievalTime(result[2], location)
+	if err != nil {
+		return "", bus_positions.RetrievalTime{}, false
+	}
+	return Feed(result[1]), rt, true
+}
+
+func newSnapshot(feed Feed, rt bus_positions.RetrievalTime, p string, tarball string) Snapshot {
+	s := Snapshot{Feed: feed, Time: rt.Time, Path: p, Tarball: tarball}
+	if rt.Ambiguous {
+		s.later = rt.Later
+	}
+	return s
+}
+
+// Index knows which snapshots we have for each feed, in order.
+type Index struct {
+	snapshots map[Feed][]Snapshot
+	// what legacy filenames without an offset are in
+	location *time.Location
+}
+
+func NewIndex(location *time.Location) *Index {
+	return &Index{snapshots: make(map[Feed][]Snapshot), location: location}
+}
+
+func (ix *Index) add(s Snapshot) {
+	ix.snapshots[s.Feed] = append(ix.snapshots[s.Feed], s)
+}
+
+func (ix *Index) sort() {
+	for _, snapshots := range ix.snapshots {
+		sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+	}
+}
+
+// AddDirectory indexes every snapshot file and every .tar.gz under dir, so it
+// works on short_term, on archive or on the agency directory above both.
+func (ix *Index) AddDirectory(dir string) error {
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(info.Name(), ".tar.gz") {
+			return ix.addTarball(filePath)
+		}
+		if feed, rt, ok := parseName(info.Name(), ix.location); ok {
+			ix.add(newSnapshot(feed, rt, filePath, ""))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return ix.resolve()
+}
+
+// AddTarball indexes one tarball made by create_archive.
+func (ix *Index) AddTarball(tarball string) error {
+	if err := ix.addTarball(tarball); err != nil {
+		return err
+	}
+	return ix.resolve()
+}
+
+func (ix *Index) addTarball(tarball string) error {
+	return walkTarball(tarball, func(header *tar.Header, r io.Reader) (bool, error) {
+		if feed, rt, ok := parseName(header.Name, ix.location); ok {
+			ix.add(newSnapshot(feed, rt, header.Name, tarball))
+		}
+		return true, nil
+	})
+}
+
+// resolve decides when each legacy snapshot from the repeated hour was
+// really saved, and then sorts. A GTFS-RT feed says when it's from in its
+// header, and a jBusPositions snapshot saved in the same poll has the same
+// name. For anything left, bus_positions.ResolveAmbiguous compares it with
+// its neighbors. A corrupt file doesn't stop the rest from being indexed. We
+// have no legacy names that are ambiguous yet; see
+// bus_positions.AgencyTimezones.
+func (ix *Index) resolve() error {
+	ix.sort()
+	// the earlier reading of a name, in Unix seconds, and what it turned out
+	// to be
+	polls := make(map[int64]time.Time)
+	for _, feed := range []Feed{VehiclePositions, TripUpdates} {
+		for i, s := range ix.snapshots[feed] {
+			if s.later.IsZero() {
+				continue
+			}
+			body, err := Read(s)
+			var msg gtfs_realtime.FeedMessage
+			if err == nil {
+				msg, err = gtfs_realtime.Parse(body)
+			}
+			if err != nil {
+				fmt.Printf("Taking the earlier time for %s because we can't read it: %s\n", s.Path, err)
+				ix.snapshots[feed][i].later = time.Time{}
+				continue
+			}
+			header := time.Unix(int64(msg.Header.Timestamp), 0)
+			if abs(header.Sub(s.later)) < abs(header.Sub(s.Time)) {
+				polls[s.Time.Unix()] = s.later
+			} else {
+				polls[s.Time.Unix()] = s.Time
+			}
+			ix.snapshots[feed][i].Time = polls[s.Time.Unix()]
+			ix.snapshots[feed][i].later = time.Time{}
+		}
+	}
+
+	buses := ix.snapshots[BusPositions]
+	times := make([]bus_positions.RetrievalTime, len(buses))
+	ambiguous := false
+	for i, s := range buses {
+		times[i] = bus_positions.RetrievalTime{Time: s.Time, Ambiguous: !s.later.IsZero(), Later: s.later}
+		ambiguous = ambiguous || times[i].Ambiguous
+	}
+	if ambiguous {
+		resolved, err := bus_positions.ResolveAmbiguous(times, func(i int) (map[string]string, error) {
+			if _, ok := polls[buses[i].Time.Unix()]; ok && times[i].Ambiguous {
+				return nil, nil
+			}
+			// A file we can't read looks like neither neighbor, so it gets
+			// the later reading.
+			body, err := Read(buses[i])
+			var m bus_positions.BusPositionList
+			if err == nil {
+				err = json.Unmarshal(body, &m)
+			}
+			if err != nil {
+				fmt.Printf("Can't compare %s to its neighbors: %s\n", buses[i].Path, err)
+				return nil, nil
+			}
+			return bus_positions.Fingerprint(m), nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := range buses {
+			if t, ok := polls[buses[i].Time.Unix()]; ok && times[i].Ambiguous {
+				resolved[i] = t
+			}
+			buses[i].Time = resolved[i]
+			buses[i].later = time.Time{}
+		}
+	}
+	ix.sort()
+	return nil
+}
+
+// walkTarball calls f on each regular file until f returns false.
+func walkTarball(tarball string, f func(*tar.Header, io.Reader) (bool, error)) error {
+	file, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		keepGoing, err := f(header, tr)
+		if err != nil || !keepGoing {
+			return err
+		}
+	}
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// Len is how many snapshots we have for the feed.
+func (ix *Index) Len(feed Feed) int {
+	return len(ix.snapshots[feed])
+}
+
+// Times lists when each snapshot of the feed was saved, in order.
+func (ix *Index) Times(feed Feed) []time.Time {
+	output := make([]time.Time, 0, len(ix.snapshots[feed]))
+	for _, s := range ix.snapshots[feed] {
+		output = append(output, s.Time)
+	}
+	return output
+}
+
+// First is the time of the earliest snapshot of any feed.
+func (ix *Index) First() (time.Time, bool) {
+	var first time.Time
+	for _, snapshots := range ix.snapshots {
+		if len(snapshots) > 0 && (first.IsZero() || snapshots[0].Time.Before(first)) {
+			first = snapshots[0].Time
+		}
+	}
+	return first, !first.IsZero()
+}
+
+// At returns the snapshot that was live at t, which is the last one saved at
+// or before t.
+func (ix *Index) At(feed Feed, t time.Time) (Snapshot, bool) {
+	snapshots := ix.snapshots[feed]
+	i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i].Time.After(t) })
+	if i == 0 {
+		return Snapshot{}, false
+	}
+	return snapshots[i-1], true
+}
+
+// Next returns the time of the first snapshot of any feed after t.
+func (ix *Index) Next(t time.Time) (time.Time, bool) {
+	var next time.Time
+	for _, snapshots := range ix.snapshots {
+		i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i].Time.After(t) })
+		if i < len(snapshots) && (next.IsZero() || snapshots[i].Time.Before(next)) {
+			next = snapshots[i].Time
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Read returns the contents of the snapshot. Reading out of a tarball means
+// reading through it from the start, so replaying a tarball is a lot slower
+// than replaying short_term.
+func Read(s Snapshot) ([]byte, error) {
+	if s.Tarball == "" {
+		return ioutil.ReadFile(s.Path)
+	}
+	var output []byte
+	err := walkTarball(s.Tarball, func(header *tar.Header, r io.Reader) (bool, error) {
+		if header.Name != s.Path {
+			return true, nil
+		}
+		var err error
+		output, err = ioutil.ReadAll(r)
+		return false, err
+	})
+	if err == nil && output == nil {
+		err = fmt.Errorf("%s is not in %s", s.Path, s.Tarball)
+	}
+	return output, err
+}
+
+// Walk calls f on every snapshot under p, which can be a directory or one
+// tarball, reading each tarball only once. That's much faster than calling
+// Read on each snapshot. Snapshots come in the order they're stored, not in
+// time order, and with ParseName's reading of any ambiguous legacy name.
+func Walk(p string, location *time.Location, f func(Snapshot, []byte) error) error {
+	if strings.HasSuffix(p, ".tar.gz") {
+		return walkTarball(p, func(header *tar.Header, r io.Reader) (bool, error) {
+			feed, t, ok := ParseName(header.Name, location)
+			if !ok {
+				return true, nil
+			}
+			body, err := ioutil.ReadAll(r)
+			if err != nil {
+				return false, err
+			}
+			return true, f(Snapshot{Feed: feed, Time: t, Path: header.Name, Tarball: p}, body)
+		})
+	}
+	return filepath.Walk(p, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(info.Name(), ".tar.gz") {
+			return Walk(filePath, location, f)
+		}
+		feed, t, ok := ParseName(info.Name(), location)
+		if !ok {
+			return nil
+		}
+		body, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		return f(Snapshot{Feed: feed, Time: t, Path: filePath}, body)
+	})
+}
+
+// Clock tells the server what time it is in the replay. With a speed of 1 it
+// keeps pace with the wall clock, with a higher speed it runs that many times
+// faster, and with a speed of 0 it only moves when someone calls Set.
+type Clock struct {
+	mu        sync.Mutex
+	simStart  time.Time
+	wallStart time.Time
+	speed     float64
+	// the wall clock, so tests can replace it
+	wallNow func() time.Time
+}
+
+func NewClock(start time.Time, speed float64) *Clock {
+	return &Clock{simStart: start, wallStart: time.Now(), speed: speed, wallNow: time.Now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elapsed := c.wallNow().Sub(c.wallStart)
+	return c.simStart.Add(time.Duration(float64(elapsed) * c.speed))
+}
+
+// Set jumps to t and carries on playing from there at the same speed.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.simStart = t
+	c.wallStart = c.wallNow()
+}
+
+func (c *Clock) Speed() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.speed
+}
@@ -0,0 +1,224 @@
+package replay
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"gotest.tools/v3/assert"
+)
+
+func copyFile(t *testing.T, from string, to string) {
+	b, err := ioutil.ReadFile(from)
+	assert.NilError(t, err)
+	assert.NilError(t, os.MkdirAll(filepath.Dir(to), 0755))
+	assert.NilError(t, ioutil.WriteFile(to, b, 0644))
+}
+
+// testArchive lays out the 2019-04-27 snapshots the way get_bus_positions
+// and create_archive do: the first one in short_term and the second in a
+// tarball, next to a GTFS-RT file.
+func testArchive(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "replay")
+	assert.NilError(t, err)
+	copyFile(t, "../bus_positions/test_data/buses2019-04-27T03:55:01.json", filepath.Join(dir, "short_term/2019-04-27/buses2019-04-27T03:55:01.json"))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "short_term/2019-04-27/gtfsrt-vp-2019-04-27T03:55:01.pb"), []byte("not really protobuf"), 0644))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "short_term/2019-04-27/wget.log"), []byte("ignore me"), 0644))
+
+	assert.NilError(t, os.MkdirAll(filepath.Join(dir, "archive"), 0755))
+	f, err := os.Create(filepath.Join(dir, "archive/2019-04-27.tar.gz"))
+	assert.NilError(t, err)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Name: "./2019-04-27/", Typeflag: tar.TypeDir, Mode: 0755}))
+	b, err := ioutil.ReadFile("../bus_positions/test_data/buses2019-04-27T04:05:01.json")
+	assert.NilError(t, err)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Name: "./2019-04-27/buses2019-04-27T04:05:01.json", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(b))}))
+	_, err = tw.Write(b)
+	assert.NilError(t, err)
+	assert.NilError(t, tw.Close())
+	assert.NilError(t, gz.Close())
+	return dir
+}
+
+func at(hour int, minute int, second int) time.Time {
+	return time.Date(2019, 4, 27, hour, minute, second, 0, time.UTC)
+}
+
+func TestIndex(t *testing.T) {
+	dir := testArchive(t)
+	defer os.RemoveAll(dir)
+	ix := NewIndex(time.UTC)
+	assert.NilError(t, ix.AddDirectory(dir))
+	assert.Equal(t, ix.Len(BusPositions), 2)
+	assert.Equal(t, ix.Len(VehiclePositions), 1)
+	assert.Equal(t, ix.Len(TripUpdates), 0)
+	first, ok := ix.First()
+	assert.Assert(t, ok)
+	assert.Equal(t, first, at(3, 55, 1))
+
+	_, ok = ix.At(BusPositions, at(3, 55, 0))
+	assert.Assert(t, !ok)
+	s, ok := ix.At(BusPositions, at(4, 0, 0))
+	assert.Assert(t, ok)
+	assert.Equal(t, s.Time, at(3, 55, 1))
+	s, ok = ix.At(BusPositions, at(5, 0, 0))
+	assert.Assert(t, ok)
+	assert.Equal(t, s.Tarball, filepath.Join(dir, "archive/2019-04-27.tar.gz"))
+
+	b, err := Read(s)
+	assert.NilError(t, err)
+	var m bus_positions.BusPositionList
+	assert.NilError(t, json.Unmarshal(b, &m))
+	assert.Equal(t, m.BusPositions[0].VehicleID, "8001")
+
+	next, ok := ix.Next(at(3, 55, 1))
+	assert.Assert(t, ok)
+	assert.Equal(t, next, at(4, 5, 1))
+	_, ok = ix.Next(at(4, 5, 1))
+	assert.Assert(t, !ok)
+}
+
+func TestIndexResolvesTheRepeatedHour(t *testing.T) {
+	location, err := time.LoadLocation("US/Eastern")
+	assert.NilError(t, err)
+	dir, err := ioutil.TempDir("", "replay")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	for name, body := range map[string]string{
+		"buses2019-11-03T00:59:01.json":  `{"BusPositions":[{"VehicleID":"2001","TripID":"A"}]}`,
+		"buses2019-11-03T01:30:01.json":  `{"BusPositions":[{"VehicleID":"2001","TripID":"A"}]}`,
+		"buses2019-11-03T01:30:31.json":  `{"BusPositions":[{"VehicleID":"2001","TripID":"C"}]}`,
+		"buses2019-11-03T01:45:01.json":  `{"BusPositions":[{"VehicleID":"2001","TripID":"C"}]}`,
+		"buses2019-11-03T02:00:01.json":  `{"BusPositions":[{"VehicleID":"2001","TripID":"C"}]}`,
+		"buses2019-11-03T07:01:01Z.json": `{"BusPositions":[{"VehicleID":"2001","TripID":"C"}]}`,
+		// Corrupt files in the repeated hour get a reading instead of
+		// stopping the whole index.
+		"buses2019-11-03T01:50:01.json":    `{"BusPositions":[`,
+		"gtfsrt-tu-2019-11-03T01:40:01.pb": "not a protobuf",
+	} {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644))
+	}
+	// This one's header says it's from April, which is a lot closer to the
+	// first pass through 1:45 than the second, and the jBusPositions
+	// snapshot from the same poll goes along with it.
+	copyFile(t, "../gtfs_realtime/test_data/gtfsrt-vp-2019-04-27T03:55:01.pb", filepath.Join(dir, "gtfsrt-vp-2019-11-03T01:45:01.pb"))
+
+	ix := NewIndex(location)
+	assert.NilError(t, ix.AddDirectory(dir))
+	utc := func(hour int, minute int, second int) time.Time {
+		return time.Date(2019, 11, 3, hour, minute, second, 0, time.UTC)
+	}
+	assert.DeepEqual(t, ix.Times(BusPositions), []time.Time{
+		utc(4, 59, 1), utc(5, 30, 1), utc(5, 45, 1), utc(6, 30, 31), utc(6, 50, 1), utc(7, 0, 1), utc(7, 1, 1),
+	})
+	assert.DeepEqual(t, ix.Times(VehiclePositions), []time.Time{utc(5, 45, 1)})
+	assert.DeepEqual(t, ix.Times(TripUpdates), []time.Time{utc(5, 40, 1)})
+}
+
+func TestWalk(t *testing.T) {
+	dir := testArchive(t)
+	defer os.RemoveAll(dir)
+	sizes := make(map[time.Time]int)
+	err := Walk(dir, time.UTC, func(s Snapshot, body []byte) error {
+		if s.Feed == BusPositions {
+			sizes[s.Time] = len(body)
+		}
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, len(sizes), 2)
+	assert.Assert(t, sizes[at(4, 5, 1)] > 0)
+}
+
+func TestClock(t *testing.T) {
+	wall := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewClock(at(3, 0, 0), 10)
+	c.wallStart = wall
+	c.wallNow = func() time.Time { return wall }
+	assert.Equal(t, c.Now(), at(3, 0, 0))
+	wall = wall.Add(time.Minute)
+	assert.Equal(t, c.Now(), at(3, 10, 0))
+	c.Set(at(4, 0, 0))
+	wall = wall.Add(time.Second)
+	assert.Equal(t, c.Now(), at(4, 0, 10))
+
+	stepped := NewClock(at(3, 0, 0), 0)
+	stepped.wallNow = func() time.Time { return wall.Add(time.Hour) }
+	assert.Equal(t, stepped.Now(), at(3, 0, 0))
+}
+
+func get(s *Server, method string, url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	return w
+}
+
+func decodePositions(t *testing.T, w *httptest.ResponseRecorder) []bus_positions.BusPositionReport {
+	var m bus_positions.BusPositionList
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &m))
+	return m.BusPositions
+}
+
+func TestServer(t *testing.T) {
+	dir := testArchive(t)
+	defer os.RemoveAll(dir)
+	ix := NewIndex(time.UTC)
+	assert.NilError(t, ix.AddDirectory(dir))
+	s := NewServer(ix, NewClock(at(3, 50, 0), 0))
+
+	w := get(s, "GET", "/Bus.svc/json/jBusPositions?api_key=whatever")
+	assert.Equal(t, w.Code, http.StatusNotFound)
+
+	w = get(s, "POST", "/replay/step")
+	assert.Equal(t, w.Code, http.StatusOK)
+	w = get(s, "GET", "/Bus.svc/json/jBusPositions?api_key=whatever")
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("X-Replay-Snapshot-Time"), "2019-04-27T03:55:01Z")
+	assert.Equal(t, len(decodePositions(t, w)), 2)
+
+	w = get(s, "GET", "/Bus.svc/json/jBusPositions?RouteID=28A")
+	positions := decodePositions(t, w)
+	assert.Equal(t, len(positions), 1)
+	assert.Equal(t, positions[0].VehicleID, "2673")
+	w = get(s, "GET", "/Bus.svc/json/jBusPositions?Lat=38.7952&Lon=-77.0754&Radius=500")
+	positions = decodePositions(t, w)
+	assert.Equal(t, len(positions), 1)
+	assert.Equal(t, positions[0].VehicleID, "3171")
+	w = get(s, "GET", "/Bus.svc/json/jBusPositions?Lat=38.7952")
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+
+	w = get(s, "GET", "/gtfs/bus-gtfsrt-vehiclepositions.pb")
+	assert.Equal(t, w.Body.String(), "not really protobuf")
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/x-protobuf")
+
+	get(s, "POST", "/replay/step")
+	w = get(s, "GET", "/Bus.svc/json/jBusPositions")
+	assert.Equal(t, decodePositions(t, w)[0].VehicleID, "8001")
+	// the vehicle positions feed just stays on its last snapshot
+	w = get(s, "GET", "/gtfs/bus-gtfsrt-vehiclepositions.pb")
+	assert.Equal(t, w.Header().Get("X-Replay-Snapshot-Time"), "2019-04-27T03:55:01Z")
+
+	w = get(s, "POST", "/replay/step")
+	assert.Equal(t, w.Code, http.StatusConflict)
+
+	w = get(s, "POST", "/replay/seek?time=2019-04-27T04:00:00")
+	var status Status
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, status.SimulatedTime, at(4, 0, 0))
+	assert.Equal(t, status.Snapshots[BusPositions], 2)
+	w = get(s, "GET", "/Bus.svc/json/jBusPositions")
+	assert.Equal(t, decodePositions(t, w)[0].VehicleID, "3171")
+
+	w = get(s, "GET", "/replay/seek?time=2019-04-27T04:00:00")
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed)
+}
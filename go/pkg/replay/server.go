@@ -0,0 +1,163 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/geo"
+)
+
+// Server answers the same URLs as api.wmata.com with whatever the archive had
+// at the clock's current time. It ignores api_key.
+type Server struct {
+	index *Index
+	clock *Clock
+	mu    sync.Mutex
+	// the last snapshot we read for each feed, since pollers ask for the same
+	// one over and over
+	cache map[Feed]cachedSnapshot
+}
+
+type cachedSnapshot struct {
+	snapshot Snapshot
+	body     []byte
+}
+
+// Status is what /replay/status returns.
+type Status struct {
+	SimulatedTime time.Time    `json:"simulated_time"`
+	Speed         float64      `json:"speed"`
+	Snapshots     map[Feed]int `json:"snapshots"`
+}
+
+func NewServer(index *Index, clock *Clock) *Server {
+	return &Server{index: index, clock: clock, cache: make(map[Feed]cachedSnapshot)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/Bus.svc/json/jBusPositions":
+		s.serveFeed(w, r, BusPositions, "application/json; charset=utf-8")
+	case "/gtfs/bus-gtfsrt-vehiclepositions.pb":
+		s.serveFeed(w, r, VehiclePositions, "application/x-protobuf")
+	case "/gtfs/bus-gtfsrt-tripupdates.pb":
+		s.serveFeed(w, r, TripUpdates, "application/x-protobuf")
+	case "/replay/status":
+		s.writeStatus(w)
+	case "/replay/step":
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		next, ok := s.index.Next(s.clock.Now())
+		if !ok {
+			http.Error(w, "there are no more snapshots", http.StatusConflict)
+			return
+		}
+		s.clock.Set(next)
+		s.writeStatus(w)
+	case "/replay/seek":
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		rt, err := bus_positions.ParseRetrievalTime(r.URL.Query().Get("time"), s.index.location)
+		if err != nil {
+			http.Error(w, "time must look like 2019-09-19T03:00:00Z", http.StatusBadRequest)
+			return
+		}
+		s.clock.Set(rt.Time)
+		s.writeStatus(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) writeStatus(w http.ResponseWriter) {
+	status := Status{SimulatedTime: s.clock.Now(), Speed: s.clock.Speed(), Snapshots: make(map[Feed]int)}
+	for _, feed := range feeds {
+		status.Snapshots[feed] = s.index.Len(feed)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *Server) read(snapshot Snapshot) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cached, ok := s.cache[snapshot.Feed]; ok && cached.snapshot == snapshot {
+		return cached.body, nil
+	}
+	body, err := Read(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	s.cache[snapshot.Feed] = cachedSnapshot{snapshot, body}
+	return body, nil
+}
+
+func (s *Server) serveFeed(w http.ResponseWriter, r *http.Request, feed Feed, contentType string) {
+	snapshot, ok := s.index.At(feed, s.clock.Now())
+	if !ok {
+		http.Error(w, "the archive has nothing this early", http.StatusNotFound)
+		return
+	}
+	body, err := s.read(snapshot)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if feed == BusPositions {
+		body, err = filterPositions(body, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Replay-Snapshot-Time", snapshot.Time.Format(time.RFC3339))
+	w.Write(body)
+}
+
+// filterPositions applies jBusPositions' optional RouteID and Lat/Lon/Radius
+// parameters. Without them the archived file goes out untouched.
+func filterPositions(body []byte, r *http.Request) ([]byte, error) {
+	q := r.URL.Query()
+	routeID := q.Get("RouteID")
+	byDistance := q.Get("Lat") != "" || q.Get("Lon") != "" || q.Get("Radius") != ""
+	if routeID == "" && !byDistance {
+		return body, nil
+	}
+	var lat, lon, radius float64
+	if byDistance {
+		var errs [3]error
+		lat, errs[0] = strconv.ParseFloat(q.Get("Lat"), 64)
+		lon, errs[1] = strconv.ParseFloat(q.Get("Lon"), 64)
+		radius, errs[2] = strconv.ParseFloat(q.Get("Radius"), 64)
+		for _, err := range errs {
+			if err != nil {
+				return nil, fmt.Errorf("Lat, Lon and Radius go together: %s", err)
+			}
+		}
+	}
+	var m bus_positions.BusPositionList
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	filtered := bus_positions.BusPositionList{BusPositions: []bus_positions.BusPositionReport{}}
+	for _, bpr := range m.BusPositions {
+		if routeID != "" && bpr.RouteID != routeID {
+			continue
+		}
+		if byDistance && geo.Haversine(lat, lon, bpr.Lat, bpr.Lon) > radius {
+			continue
+		}
+		filtered.BusPositions = append(filtered.BusPositions, bpr)
+	}
+	return json.Marshal(filtered)
+}
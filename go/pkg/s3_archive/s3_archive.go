@@ -0,0 +1,110 @@
+package s3_archive
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/markongithub/bus_data_archive/pkg/archiver"
+)
+
+// These come from terraform/bus_data_archive.tf. The primary bucket
+// replicates everything to the replica.
+const (
+	PrimaryBucket = "busdata-01-us-west-2"
+	PrimaryRegion = "us-west-2"
+	ReplicaBucket = "busdata-01-eu-west-1"
+	ReplicaRegion = "eu-west-1"
+)
+
+// The archive's sha256 goes in this piece of user metadata, since S3's own
+// ETag isn't a checksum for multipart uploads.
+const SHA256MetadataKey = "Sha256"
+
+// prefix partitions keys by agency and date, like
+// archive/wmatabus/2019/04/27/
+func prefix(agency string, day string) string {
+	return path.Join("archive", agency, strings.Replace(day, "-", "/", -1)) + "/"
+}
+
+func ArchiveKey(agency string, day string) string {
+	return prefix(agency, day) + day + ".tar.gz"
+}
+
+func ManifestKey(agency string, day string) string {
+	return prefix(agency, day) + day + ".manifest.json"
+}
+
+// Checker looks for a day's archive in both buckets.
+type Checker struct {
+	Primary       s3iface.S3API
+	PrimaryBucket string
+	Replica       s3iface.S3API
+	ReplicaBucket string
+}
+
+// NewChecker talks to the buckets in terraform.
+func NewChecker(sess *session.Session) Checker {
+	return Checker{
+		Primary:       s3.New(sess, aws.NewConfig().WithRegion(PrimaryRegion)),
+		PrimaryBucket: PrimaryBucket,
+		Replica:       s3.New(sess, aws.NewConfig().WithRegion(ReplicaRegion)),
+		ReplicaBucket: ReplicaBucket,
+	}
+}
+
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey
+	}
+	return false
+}
+
+// checkBucket returns a reason the day isn't safely in the bucket, or "" if
+// it is.
+func checkBucket(svc s3iface.S3API, bucket string, agency string, m archiver.Manifest) (string, error) {
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(ArchiveKey(agency, m.Day)),
+	})
+	if isNotFound(err) {
+		return fmt.Sprintf("the archive is not in %s", bucket), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if aws.Int64Value(head.ContentLength) != m.ArchiveSize {
+		return fmt.Sprintf("the archive in %s is %d bytes, not %d", bucket, aws.Int64Value(head.ContentLength), m.ArchiveSize), nil
+	}
+	if aws.StringValue(head.Metadata[SHA256MetadataKey]) != m.ArchiveSHA256 {
+		return fmt.Sprintf("the archive in %s doesn't have the manifest's checksum", bucket), nil
+	}
+	_, err = svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(ManifestKey(agency, m.Day)),
+	})
+	if isNotFound(err) {
+		return fmt.Sprintf("the manifest is not in %s", bucket), nil
+	}
+	return "", err
+}
+
+// Uploaded says whether the archive and manifest are in both buckets with
+// the right size and checksum. If not, the string says why.
+func (c Checker) Uploaded(agency string, m archiver.Manifest) (bool, string, error) {
+	for _, target := range []struct {
+		svc    s3iface.S3API
+		bucket string
+	}{{c.Primary, c.PrimaryBucket}, {c.Replica, c.ReplicaBucket}} {
+		reason, err := checkBucket(target.svc, target.bucket, agency, m)
+		if err != nil || reason != "" {
+			return false, reason, err
+		}
+	}
+	return true, "", nil
+}
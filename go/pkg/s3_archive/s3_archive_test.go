@@ -0,0 +1,330 @@
+package s3_archive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/markongithub/bus_data_archive/pkg/archiver"
+	"gotest.tools/v3/assert"
+)
+
+type fakeObject struct {
+	body     []byte
+	metadata http.Header
+}
+
+type fakeUpload struct {
+	key      string
+	metadata http.Header
+	parts    map[int][]byte
+}
+
+// fakeS3 is just enough of S3's REST API, with path-style URLs, for the
+// uploader and the checker.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	uploads map[string]*fakeUpload
+	nextID  int
+	// fail this many UploadPart calls for this part number
+	failPart     int
+	failuresLeft int
+	partUploads  map[int]int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string]fakeObject), uploads: make(map[string]*fakeUpload), partUploads: make(map[int]int)}
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	b, _ := xml.Marshal(v)
+	w.Write(b)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+	key := ""
+	if len(parts) > 1 {
+		key = parts[1]
+	}
+	q := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	path := bucket + "/" + key
+	_, listUploads := q["uploads"]
+
+	switch {
+	case r.Method == "HEAD":
+		obj, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range obj.metadata {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.body)))
+		w.Header().Set("ETag", etag(obj.body))
+	case r.Method == "POST" && listUploads:
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = &fakeUpload{key: path, metadata: metadataHeaders(r.Header), parts: make(map[int][]byte)}
+		f.writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == "GET" && listUploads:
+		type upload struct {
+			Key      string
+			UploadId string
+		}
+		result := struct {
+			XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+			Bucket  string
+			Uploads []upload `xml:"Upload"`
+		}{Bucket: bucket}
+		for id, u := range f.uploads {
+			if strings.HasPrefix(u.key, bucket+"/"+q.Get("prefix")) {
+				result.Uploads = append(result.Uploads, upload{strings.TrimPrefix(u.key, bucket+"/"), id})
+			}
+		}
+		f.writeXML(w, result)
+	case r.Method == "PUT" && q.Get("uploadId") != "":
+		u := f.uploads[q.Get("uploadId")]
+		number, _ := strconv.Atoi(q.Get("partNumber"))
+		f.partUploads[number]++
+		if number == f.failPart && f.failuresLeft > 0 {
+			f.failuresLeft--
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		u.parts[number] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == "GET" && q.Get("uploadId") != "":
+		type part struct {
+			PartNumber int
+			ETag       string
+			Size       int
+		}
+		result := struct {
+			XMLName  xml.Name `xml:"ListPartsResult"`
+			UploadId string
+			Parts    []part `xml:"Part"`
+		}{UploadId: q.Get("uploadId")}
+		u := f.uploads[q.Get("uploadId")]
+		for number, b := range u.parts {
+			result.Parts = append(result.Parts, part{number, etag(b), len(b)})
+		}
+		sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+		f.writeXML(w, result)
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		u := f.uploads[q.Get("uploadId")]
+		var request struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		xml.Unmarshal(body, &request)
+		var assembled []byte
+		for _, p := range request.Parts {
+			b, ok := u.parts[p.PartNumber]
+			if !ok || etag(b) != p.ETag {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			assembled = append(assembled, b...)
+		}
+		f.objects[u.key] = fakeObject{body: assembled, metadata: u.metadata}
+		delete(f.uploads, q.Get("uploadId"))
+		f.writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string
+			ETag    string
+		}{Key: key, ETag: etag(assembled)})
+	case r.Method == "DELETE" && q.Get("uploadId") != "":
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT":
+		f.objects[path] = fakeObject{body: body, metadata: metadataHeaders(r.Header)}
+		w.Header().Set("ETag", etag(body))
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func metadataHeaders(h http.Header) http.Header {
+	output := make(http.Header)
+	for k, v := range h {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			output[k] = v
+		}
+	}
+	return output
+}
+
+func testSession(t *testing.T, url string) *session.Session {
+	sess, err := session.NewSession(aws.NewConfig().
+		WithCredentials(credentials.NewStaticCredentials("key", "secret", "")).
+		WithEndpoint(url).
+		WithS3ForcePathStyle(true).
+		WithMaxRetries(0))
+	assert.NilError(t, err)
+	return sess
+}
+
+func archivedDay(t *testing.T) (string, archiver.Manifest) {
+	dataPath, err := ioutil.TempDir("", "s3_archive")
+	assert.NilError(t, err)
+	day := filepath.Join(dataPath, "short_term/2019-04-27")
+	assert.NilError(t, os.MkdirAll(day, 0755))
+	for _, name := range []string{"buses2019-04-27T03:55:01.json", "buses2019-04-27T04:05:01.json"} {
+		b, err := ioutil.ReadFile("../bus_positions/test_data/" + name)
+		assert.NilError(t, err)
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(day, name), b, 0644))
+	}
+	m, err := archiver.ArchiveDay(dataPath, "2019-04-27", time.UTC)
+	assert.NilError(t, err)
+	return dataPath, m
+}
+
+func TestKeys(t *testing.T) {
+	assert.Equal(t, ArchiveKey("wmatabus", "2019-04-27"), "archive/wmatabus/2019/04/27/2019-04-27.tar.gz")
+	assert.Equal(t, ManifestKey("clever", "2019-09-19"), "archive/clever/2019/09/19/2019-09-19.manifest.json")
+}
+
+func TestUploadDay(t *testing.T) {
+	dataPath, m := archivedDay(t)
+	defer os.RemoveAll(dataPath)
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	uploader := NewUploader(testSession(t, server.URL), PrimaryBucket, server.URL)
+	uploader.PartSize = 200
+	parts := int(m.ArchiveSize/200) + 1
+	assert.Assert(t, parts >= 3)
+
+	// the connection drops in the middle
+	fake.failPart = 2
+	fake.failuresLeft = 1
+	err := uploader.UploadDay(dataPath, "wmatabus", "2019-04-27")
+	assert.ErrorContains(t, err, "uploading part 2")
+	assert.Equal(t, len(fake.uploads), 1)
+
+	assert.NilError(t, uploader.UploadDay(dataPath, "wmatabus", "2019-04-27"))
+	// part 1 made it the first time, so we didn't send it again
+	assert.Equal(t, fake.partUploads[1], 1)
+	assert.Equal(t, fake.partUploads[2], 2)
+	assert.Equal(t, fake.partUploads[parts], 1)
+	assert.Equal(t, len(fake.uploads), 0)
+
+	stored := fake.objects[PrimaryBucket+"/"+ArchiveKey("wmatabus", "2019-04-27")]
+	local, err := ioutil.ReadFile(archiver.ArchivePath(dataPath, "2019-04-27"))
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(stored.body, local))
+	_, ok := fake.objects[PrimaryBucket+"/"+ManifestKey("wmatabus", "2019-04-27")]
+	assert.Assert(t, ok)
+
+	// A second run has nothing to do.
+	assert.NilError(t, uploader.UploadDay(dataPath, "wmatabus", "2019-04-27"))
+	assert.Equal(t, fake.partUploads[1], 1)
+}
+
+func TestUploadDayRestartsAnotherTarballsUpload(t *testing.T) {
+	dataPath, m := archivedDay(t)
+	defer os.RemoveAll(dataPath)
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	uploader := NewUploader(testSession(t, server.URL), PrimaryBucket, server.URL)
+	uploader.PartSize = 200
+
+	fake.failPart = 2
+	fake.failuresLeft = 1
+	assert.ErrorContains(t, uploader.UploadDay(dataPath, "wmatabus", "2019-04-27"), "uploading part 2")
+	// Now pretend we started it for a tarball we've since replaced.
+	archive := archiver.ArchivePath(dataPath, "2019-04-27")
+	record, err := readUploadRecord(archive)
+	assert.NilError(t, err)
+	record.SHA256 = "an older tarball"
+	assert.NilError(t, writeUploadRecord(archive, record))
+
+	assert.NilError(t, uploader.UploadDay(dataPath, "wmatabus", "2019-04-27"))
+	assert.Equal(t, fake.partUploads[1], 2)
+	assert.Equal(t, len(fake.uploads), 0)
+	reason, err := checkBucket(uploader.S3, PrimaryBucket, "wmatabus", m)
+	assert.NilError(t, err)
+	assert.Equal(t, reason, "")
+	_, err = os.Stat(uploadRecordPath(archive))
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestUploadDayChecksTheManifest(t *testing.T) {
+	dataPath, _ := archivedDay(t)
+	defer os.RemoveAll(dataPath)
+	server := httptest.NewServer(newFakeS3())
+	defer server.Close()
+	uploader := NewUploader(testSession(t, server.URL), PrimaryBucket, server.URL)
+	archive := archiver.ArchivePath(dataPath, "2019-04-27")
+	b, err := ioutil.ReadFile(archive)
+	assert.NilError(t, err)
+	b[len(b)/2] ^= 0xff
+	assert.NilError(t, ioutil.WriteFile(archive, b, 0644))
+	assert.ErrorContains(t, uploader.UploadDay(dataPath, "wmatabus", "2019-04-27"), "doesn't match its manifest")
+}
+
+func TestChecker(t *testing.T) {
+	dataPath, m := archivedDay(t)
+	defer os.RemoveAll(dataPath)
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	sess := testSession(t, server.URL)
+	uploader := NewUploader(sess, PrimaryBucket, server.URL)
+	checker := Checker{Primary: uploader.S3, PrimaryBucket: PrimaryBucket, Replica: uploader.S3, ReplicaBucket: ReplicaBucket}
+
+	ok, reason, err := checker.Uploaded("wmatabus", m)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	assert.Equal(t, reason, "the archive is not in busdata-01-us-west-2")
+
+	assert.NilError(t, uploader.UploadDay(dataPath, "wmatabus", "2019-04-27"))
+	ok, reason, err = checker.Uploaded("wmatabus", m)
+	assert.NilError(t, err)
+	assert.Equal(t, reason, "the archive is not in busdata-01-eu-west-1")
+
+	// what replication would do
+	for _, key := range []string{ArchiveKey("wmatabus", "2019-04-27"), ManifestKey("wmatabus", "2019-04-27")} {
+		fake.objects[ReplicaBucket+"/"+key] = fake.objects[PrimaryBucket+"/"+key]
+	}
+	ok, _, err = checker.Uploaded("wmatabus", m)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+}
@@ -0,0 +1,278 @@
+package s3_archive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/markongithub/bus_data_archive/pkg/archiver"
+)
+
+// DefaultPartSize keeps a day's tarball to a few dozen parts. S3 won't take
+// parts under 5MB except for the last one.
+const DefaultPartSize = 64 * 1024 * 1024
+
+// Uploader copies verified daily archives and their manifests to the primary
+// bucket. Replication takes care of the replica.
+type Uploader struct {
+	S3       s3iface.S3API
+	Bucket   string
+	PartSize int64
+}
+
+// NewUploader talks to the primary bucket in terraform. Give it an endpoint
+// to talk to something S3-compatible instead, like a local MinIO.
+func NewUploader(sess *session.Session, bucket string, endpoint string) Uploader {
+	config := aws.NewConfig().WithRegion(PrimaryRegion)
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	return Uploader{S3: s3.New(sess, config), Bucket: bucket, PartSize: DefaultPartSize}
+}
+
+func fileSHA256(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	return hex.EncodeToString(h.Sum(nil)), size, err
+}
+
+// UploadDay uploads one day's archive and then its manifest. It skips
+// anything that's already there and picks up an interrupted multipart upload
+// of the same tarball where it left off.
+func (u Uploader) UploadDay(dataPath string, agency string, day string) error {
+	m, err := archiver.ReadManifest(archiver.ManifestPath(dataPath, day))
+	if err != nil {
+		return err
+	}
+	if !m.PurgeEligible {
+		return fmt.Errorf("the archive for %s hasn't been verified", day)
+	}
+	archive := archiver.ArchivePath(dataPath, day)
+	sum, size, err := fileSHA256(archive)
+	if err != nil {
+		return err
+	}
+	if sum != m.ArchiveSHA256 || size != m.ArchiveSize {
+		return fmt.Errorf("%s doesn't match its manifest", archive)
+	}
+
+	reason, err := checkBucket(u.S3, u.Bucket, agency, m)
+	if err != nil {
+		return err
+	}
+	if reason == "" {
+		fmt.Printf("%s is already in %s.\n", day, u.Bucket)
+		return nil
+	}
+	key := ArchiveKey(agency, day)
+	head, err := u.S3.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(u.Bucket), Key: aws.String(key)})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if err != nil || aws.StringValue(head.Metadata[SHA256MetadataKey]) != m.ArchiveSHA256 {
+		if err = u.uploadArchive(archive, key, m); err != nil {
+			return err
+		}
+	}
+	manifest, err := ioutil.ReadFile(archiver.ManifestPath(dataPath, day))
+	if err != nil {
+		return err
+	}
+	_, err = u.S3.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(u.Bucket),
+		Key:         aws.String(ManifestKey(agency, day)),
+		Body:        bytes.NewReader(manifest),
+		ContentType: aws.String("application/json"),
+		ContentMD5:  aws.String(contentMD5(manifest)),
+	})
+	if err != nil {
+		return err
+	}
+	// Make sure S3 ended up with what the manifest says.
+	if reason, err = checkBucket(u.S3, u.Bucket, agency, m); err != nil {
+		return err
+	}
+	if reason != "" {
+		return fmt.Errorf("after uploading %s, %s", day, reason)
+	}
+	fmt.Printf("Uploaded %s to s3://%s/%s\n", day, u.Bucket, key)
+	return nil
+}
+
+func contentMD5(b []byte) string {
+	sum := md5.Sum(b)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// existingUpload finds a multipart upload we started earlier for this key and
+// the parts it already has, by ETag.
+func (u Uploader) existingUpload(key string) (string, map[int64]string, error) {
+	uploads, err := u.S3.ListMultipartUploads(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(u.Bucket),
+		Prefix: aws.String(key),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	for _, upload := range uploads.Uploads {
+		if aws.StringValue(upload.Key) != key {
+			continue
+		}
+		uploadID := aws.StringValue(upload.UploadId)
+		parts := make(map[int64]string)
+		err = u.S3.ListPartsPages(&s3.ListPartsInput{
+			Bucket:   aws.String(u.Bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+		}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+			for _, part := range page.Parts {
+				parts[aws.Int64Value(part.PartNumber)] = strings.Trim(aws.StringValue(part.ETag), `"`)
+			}
+			return true
+		})
+		return uploadID, parts, err
+	}
+	return "", nil, nil
+}
+
+// S3 won't tell us an unfinished upload's metadata, so we keep which tarball
+// each one is for next to the tarball.
+type uploadRecord struct {
+	UploadID string
+	SHA256   string
+}
+
+func uploadRecordPath(archive string) string {
+	return archive + ".upload"
+}
+
+func readUploadRecord(archive string) (uploadRecord, error) {
+	var r uploadRecord
+	b, err := ioutil.ReadFile(uploadRecordPath(archive))
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return r, err
+	}
+	return r, json.Unmarshal(b, &r)
+}
+
+func writeUploadRecord(archive string, r uploadRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(uploadRecordPath(archive), b, 0644)
+}
+
+func (u Uploader) uploadArchive(archive string, key string, m archiver.Manifest) error {
+	uploadID, existingParts, err := u.existingUpload(key)
+	if err != nil {
+		return err
+	}
+	if uploadID != "" {
+		record, err := readUploadRecord(archive)
+		if err != nil {
+			return err
+		}
+		// If the day was archived again since, resuming would finish the
+		// object with the old tarball's checksum, and it would never match
+		// the manifest.
+		if record.UploadID != uploadID || record.SHA256 != m.ArchiveSHA256 {
+			fmt.Printf("The unfinished upload of %s isn't for this tarball, so we're starting over.\n", key)
+			_, err = u.S3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(u.Bucket),
+				Key:      aws.String(key),
+				UploadId: aws.String(uploadID),
+			})
+			if err != nil {
+				return err
+			}
+			uploadID, existingParts = "", nil
+		}
+	}
+	if uploadID == "" {
+		created, err := u.S3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(u.Bucket),
+			Key:         aws.String(key),
+			ContentType: aws.String("application/gzip"),
+			Metadata:    map[string]*string{SHA256MetadataKey: aws.String(m.ArchiveSHA256)},
+		})
+		if err != nil {
+			return err
+		}
+		uploadID = aws.StringValue(created.UploadId)
+		if err = writeUploadRecord(archive, uploadRecord{UploadID: uploadID, SHA256: m.ArchiveSHA256}); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Resuming the upload of %s, which already has %d parts.\n", key, len(existingParts))
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, u.PartSize)
+	var completed []*s3.CompletedPart
+	for partNumber := int64(1); ; partNumber++ {
+		n, err := io.ReadFull(f, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		part := buf[:n]
+		sum := md5.Sum(part)
+		etag := hex.EncodeToString(sum[:])
+		// S3 makes a part's ETag the MD5 of the part, so a matching one was
+		// uploaded intact.
+		if existingParts[partNumber] != etag {
+			_, err = u.S3.UploadPart(&s3.UploadPartInput{
+				Bucket:     aws.String(u.Bucket),
+				Key:        aws.String(key),
+				UploadId:   aws.String(uploadID),
+				PartNumber: aws.Int64(partNumber),
+				Body:       bytes.NewReader(part),
+				ContentMD5: aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+			})
+			if err != nil {
+				return fmt.Errorf("uploading part %d of %s: %s", partNumber, key, err)
+			}
+		}
+		completed = append(completed, &s3.CompletedPart{ETag: aws.String(`"` + etag + `"`), PartNumber: aws.Int64(partNumber)})
+		if n < len(buf) {
+			break
+		}
+	}
+	_, err = u.S3.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.Bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(uploadRecordPath(archive))
+}
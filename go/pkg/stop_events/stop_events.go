@@ -0,0 +1,175 @@
+package stop_events
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/geo"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+)
+
+// Positions further than this from the shape are probably detours or GPS
+// garbage, and they would drag our interpolation off course.
+const maxProjectionError = 200.0 // meters
+
+// A bus within this many meters (along the shape) of a stop is at the stop.
+const stopRadius = 25.0
+
+// TimedPosition is the least we need to know about a position. WMATA and
+// Clever positions can both be turned into these.
+type TimedPosition struct {
+	Time time.Time
+	Lat  float64
+	Lon  float64
+	// Minutes late according to the agency, if it told us. Clever never does.
+	Deviation float64
+}
+
+type SnappedPosition struct {
+	TimedPosition
+	DistAlong float64
+}
+
+// A Crossing is our best guess at when the bus passed some point on its
+// shape. All we really know is that it happened between Earliest and Latest,
+// which are the two positions on either side.
+type Crossing struct {
+	Time      time.Time
+	Earliest  time.Time
+	Latest    time.Time
+	Deviation float64
+}
+
+// StopEvent says "bus X arrived at stop Y at time T" for one stop on one trip
+// instance. For a bus that went by without stopping, arrival and departure
+// are about the same.
+type StopEvent struct {
+	gorm.Model
+	// "wmata" or "clever", since their trip instances live in different tables
+	Agency            string `gorm:"index:idx_stop_event_trip"`
+	TripInstanceID    uint   `gorm:"index:idx_stop_event_trip"`
+	GTFSTripID        string
+	StopID            string `gorm:"index"`
+	StopSequence      int
+	DistAlong         float64
+	ArrivalTime       time.Time
+	ArrivalEarliest   time.Time
+	ArrivalLatest     time.Time
+	DepartureTime     time.Time
+	DepartureEarliest time.Time
+	DepartureLatest   time.Time
+}
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// SnapToShape needs positions in chronological order. It throws away
+// positions that are nowhere near the shape, and never lets the bus go
+// backwards.
+func SnapToShape(shape geo.Polyline, positions []TimedPosition) []SnappedPosition {
+	var output []SnappedPosition
+	segment := 0
+	for _, p := range positions {
+		proj := shape.ProjectFrom(p.Lat, p.Lon, segment, 50)
+		if proj.Error > maxProjectionError {
+			continue
+		}
+		dist := proj.DistAlong
+		// A bus sitting still will jitter back and forth a little.
+		if len(output) > 0 && dist < output[len(output)-1].DistAlong {
+			dist = output[len(output)-1].DistAlong
+		}
+		output = append(output, SnappedPosition{p, dist})
+		segment = proj.Segment
+	}
+	return output
+}
+
+// FindCrossing finds the first moment the bus got to dist, interpolating
+// between the positions on either side. It returns false if we never saw the
+// bus on both sides of dist.
+func FindCrossing(positions []SnappedPosition, dist float64) (Crossing, bool) {
+	for j, p := range positions {
+		if p.DistAlong < dist {
+			continue
+		}
+		if p.DistAlong == dist {
+			return Crossing{p.Time, p.Time, p.Time, p.Deviation}, true
+		}
+		if j == 0 {
+			return Crossing{}, false
+		}
+		before := positions[j-1]
+		frac := (dist - before.DistAlong) / (p.DistAlong - before.DistAlong)
+		elapsed := p.Time.Sub(before.Time)
+		return Crossing{
+			Time:      before.Time.Add(time.Duration(frac * float64(elapsed))),
+			Earliest:  before.Time,
+			Latest:    p.Time,
+			Deviation: before.Deviation + frac*(p.Deviation-before.Deviation),
+		}, true
+	}
+	return Crossing{}, false
+}
+
+// InferStopEvents treats the bus as arriving when it gets within stopRadius
+// of a stop and departing when it gets more than stopRadius past it. Stops we
+// did not see the bus on both sides of are left out.
+func InferStopEvents(feed gtfs_schedule.Feed, gtfsTripID string, positions []TimedPosition) []StopEvent {
+	shape, ok := feed.TripShape(gtfsTripID)
+	if !ok {
+		fmt.Printf("We have no shape for trip %s.\n", gtfsTripID)
+		return nil
+	}
+	snapped := SnapToShape(shape, positions)
+	stopDistances := feed.StopDistances(gtfsTripID, shape)
+	var output []StopEvent
+	for i, st := range feed.StopTimesByTripID[gtfsTripID] {
+		// The first stop is usually right at the start of the shape.
+		arrivalDist := stopDistances[i] - stopRadius
+		if arrivalDist < 0 {
+			arrivalDist = 0
+		}
+		arrival, ok := FindCrossing(snapped, arrivalDist)
+		if !ok {
+			continue
+		}
+		departureDist := stopDistances[i] + stopRadius
+		if departureDist > shape.Length() {
+			departureDist = shape.Length()
+		}
+		departure, ok := FindCrossing(snapped, departureDist)
+		if !ok {
+			continue
+		}
+		output = append(output, StopEvent{
+			GTFSTripID:        gtfsTripID,
+			StopID:            st.StopID,
+			StopSequence:      st.StopSequence,
+			DistAlong:         stopDistances[i],
+			ArrivalTime:       arrival.Time,
+			ArrivalEarliest:   arrival.Earliest,
+			ArrivalLatest:     arrival.Latest,
+			DepartureTime:     departure.Time,
+			DepartureEarliest: departure.Earliest,
+			DepartureLatest:   departure.Latest,
+		})
+	}
+	return output
+}
+
+// SaveStopEvents replaces whatever we inferred for this trip last time.
+func SaveStopEvents(db *gorm.DB, agency string, tripInstanceID uint, events []StopEvent) {
+	err := db.Unscoped().Where("agency = ? AND trip_instance_id = ?", agency, tripInstanceID).Delete(StopEvent{}).Error
+	check(err)
+	for _, se := range events {
+		se.Agency = agency
+		se.TripInstanceID = tripInstanceID
+		err = db.Create(&se).Error
+		check(err)
+	}
+}
@@ -0,0 +1,91 @@
+package stop_events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"gotest.tools/v3/assert"
+)
+
+func at(hour, minute, second int) time.Time {
+	return time.Date(2019, 9, 19, hour, minute, second, 0, time.UTC)
+}
+
+// The bus dwells at the second stop from about 8:04 to 8:05.
+func samplePositions() []TimedPosition {
+	return []TimedPosition{
+		{Time: at(8, 0, 0), Lat: 38.9, Lon: -77.0},
+		{Time: at(8, 3, 0), Lat: 38.9, Lon: -76.995},
+		{Time: at(8, 4, 0), Lat: 38.9001, Lon: -76.9902},
+		{Time: at(8, 5, 0), Lat: 38.8999, Lon: -76.9899},
+		{Time: at(8, 6, 0), Lat: 38.9, Lon: -76.989},
+		{Time: at(8, 11, 0), Lat: 38.9, Lon: -76.98},
+	}
+}
+
+func TestFindCrossing(t *testing.T) {
+	snapped := []SnappedPosition{
+		{TimedPosition{Time: at(8, 0, 0)}, 0},
+		{TimedPosition{Time: at(8, 1, 0), Deviation: 1}, 100},
+		{TimedPosition{Time: at(8, 2, 0), Deviation: 3}, 300},
+	}
+	crossing, ok := FindCrossing(snapped, 200)
+	assert.Assert(t, ok)
+	assert.Equal(t, crossing.Time, at(8, 1, 30))
+	assert.Equal(t, crossing.Earliest, at(8, 1, 0))
+	assert.Equal(t, crossing.Latest, at(8, 2, 0))
+	assert.Equal(t, crossing.Deviation, 2.0)
+
+	crossing, ok = FindCrossing(snapped, 100)
+	assert.Assert(t, ok)
+	assert.Equal(t, crossing.Earliest, crossing.Latest)
+
+	_, ok = FindCrossing(snapped, 301)
+	assert.Assert(t, !ok)
+	_, ok = FindCrossing(snapped[1:], 50)
+	assert.Assert(t, !ok)
+}
+
+func TestInferStopEvents(t *testing.T) {
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	events := InferStopEvents(feed, "T1", samplePositions())
+	assert.Equal(t, len(events), 3)
+
+	assert.Equal(t, events[0].StopID, "1001")
+	assert.Equal(t, events[0].ArrivalTime, at(8, 0, 0))
+	assert.Assert(t, events[0].DepartureTime.Before(at(8, 3, 0)))
+
+	dwell := events[1]
+	assert.Equal(t, dwell.StopID, "1002")
+	assert.Equal(t, dwell.ArrivalEarliest, at(8, 3, 0))
+	assert.Equal(t, dwell.ArrivalLatest, at(8, 4, 0))
+	assert.Equal(t, dwell.DepartureEarliest, at(8, 5, 0))
+	assert.Equal(t, dwell.DepartureLatest, at(8, 6, 0))
+	assert.Assert(t, dwell.DepartureTime.Sub(dwell.ArrivalTime) > time.Minute)
+
+	// The last stop is the end of the shape, so the bus departs when it gets
+	// there.
+	assert.Equal(t, events[2].DepartureTime, at(8, 11, 0))
+	assert.Assert(t, events[2].ArrivalTime.Before(at(8, 11, 0)))
+}
+
+func TestSaveStopEvents(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	check(err)
+	defer db.Close()
+	db.AutoMigrate(&StopEvent{})
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	events := InferStopEvents(feed, "T1", samplePositions())
+	SaveStopEvents(db, "wmata", 3, events)
+	SaveStopEvents(db, "wmata", 3, events)
+	// The same trip instance ID means a different trip in the Clever database.
+	SaveStopEvents(db, "clever", 3, events[:2])
+	var count int
+	db.Model(&StopEvent{}).Where("agency = ?", "wmata").Count(&count)
+	assert.Equal(t, count, 3)
+	db.Model(&StopEvent{}).Count(&count)
+	assert.Equal(t, count, 5)
+}
@@ -0,0 +1,14 @@
+// Package test_util has what the other packages' tests share. Nothing else
+// should import it.
+package test_util
+
+import "time"
+
+// Eastern is the time zone WMATA's test data is in.
+func Eastern() *time.Location {
+	location, err := time.LoadLocation("US/Eastern")
+	if err != nil {
+		panic(err)
+	}
+	return location
+}
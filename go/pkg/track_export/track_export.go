@@ -0,0 +1,293 @@
+package track_export
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+)
+
+// TrackPoint is one position with everything we might want to show about it.
+// It doesn't care whether it came from Postgres, Dynamo or a snapshot file.
+type TrackPoint struct {
+	VehicleID    string
+	TripID       string
+	RouteID      string
+	TripHeadsign string
+	Time         time.Time
+	Lat          float64
+	Lon          float64
+	Deviation    float64
+}
+
+// A Track is one vehicle on one trip.
+type Track struct {
+	VehicleID    string
+	TripID       string
+	RouteID      string
+	TripHeadsign string
+	Points       []TrackPoint
+}
+
+// Filter fields that are zero match everything.
+type Filter struct {
+	Start     time.Time
+	End       time.Time
+	RouteID   string
+	VehicleID string
+	TripID    string
+}
+
+func (f Filter) Matches(p TrackPoint) bool {
+	if !f.Start.IsZero() && p.Time.Before(f.Start) {
+		return false
+	}
+	if !f.End.IsZero() && !p.Time.Before(f.End) {
+		return false
+	}
+	if f.RouteID != "" && p.RouteID != f.RouteID {
+		return false
+	}
+	if f.VehicleID != "" && p.VehicleID != f.VehicleID {
+		return false
+	}
+	if f.TripID != "" && p.TripID != f.TripID {
+		return false
+	}
+	return true
+}
+
+// FromReport uses the time the bus reported, not the time we retrieved it.
+func FromReport(bpr bus_positions.BusPositionReport, location *time.Location) (TrackPoint, error) {
+	reportedAt, err := bus_positions.ParseReportTime(bpr.DateTime, location)
+	if err != nil {
+		return TrackPoint{}, err
+	}
+	return TrackPoint{
+		VehicleID:    bpr.VehicleID,
+		TripID:       bpr.TripID,
+		RouteID:      bpr.RouteID,
+		TripHeadsign: bpr.TripHeadSign,
+		Time:         reportedAt,
+		Lat:          bpr.Lat,
+		Lon:          bpr.Lon,
+		Deviation:    bpr.Deviation,
+	}, nil
+}
+
+// GroupTracks sorts points into one track per vehicle and trip. The same
+// report can show up in several snapshots, so we only keep one point per
+// vehicle per moment.
+func GroupTracks(points []TrackPoint) []Track {
+	type trackKey struct {
+		VehicleID string
+		TripID    string
+	}
+	type pointKey struct {
+		VehicleID string
+		Time      time.Time
+	}
+	seen := make(map[pointKey]bool)
+	tracks := make(map[trackKey]*Track)
+	var keys []trackKey
+	for _, p := range points {
+		if seen[pointKey{p.VehicleID, p.Time}] {
+			continue
+		}
+		seen[pointKey{p.VehicleID, p.Time}] = true
+		key := trackKey{p.VehicleID, p.TripID}
+		track, present := tracks[key]
+		if !present {
+			track = &Track{VehicleID: p.VehicleID, TripID: p.TripID, RouteID: p.RouteID, TripHeadsign: p.TripHeadsign}
+			tracks[key] = track
+			keys = append(keys, key)
+		}
+		track.Points = append(track.Points, p)
+	}
+	output := make([]Track, 0, len(keys))
+	for _, key := range keys {
+		track := tracks[key]
+		sort.Slice(track.Points, func(i, j int) bool { return track.Points[i].Time.Before(track.Points[j].Time) })
+		output = append(output, *track)
+	}
+	sort.Slice(output, func(i, j int) bool { return output[i].Points[0].Time.Before(output[j].Points[0].Time) })
+	return output
+}
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// WriteGeoJSON writes a LineString for each track followed by a Point for
+// each position. The LineStrings carry their timestamps in coordTimes, which
+// is what most track viewers look for.
+func WriteGeoJSON(w io.Writer, tracks []Track) error {
+	collection := geoJSONFeatureCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, track := range tracks {
+		coordinates := make([][]float64, len(track.Points))
+		times := make([]string, len(track.Points))
+		for i, p := range track.Points {
+			coordinates[i] = []float64{p.Lon, p.Lat}
+			times[i] = p.Time.Format(time.RFC3339)
+		}
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:     "Feature",
+			Geometry: geoJSONGeometry{"LineString", coordinates},
+			Properties: map[string]interface{}{
+				"vehicle_id":    track.VehicleID,
+				"trip_id":       track.TripID,
+				"route_id":      track.RouteID,
+				"trip_headsign": track.TripHeadsign,
+				"start_time":    times[0],
+				"end_time":      times[len(times)-1],
+				"coordTimes":    times,
+			},
+		})
+	}
+	for _, track := range tracks {
+		for _, p := range track.Points {
+			collection.Features = append(collection.Features, geoJSONFeature{
+				Type:     "Feature",
+				Geometry: geoJSONGeometry{"Point", []float64{p.Lon, p.Lat}},
+				Properties: map[string]interface{}{
+					"vehicle_id":    p.VehicleID,
+					"trip_id":       p.TripID,
+					"route_id":      p.RouteID,
+					"trip_headsign": p.TripHeadsign,
+					"time":          p.Time.Format(time.RFC3339),
+					"deviation":     p.Deviation,
+				},
+			})
+		}
+	}
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(collection)
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Time string  `xml:"time"`
+}
+
+type gpxTrack struct {
+	Name    string     `xml:"name"`
+	Desc    string     `xml:"desc"`
+	Segment []gpxPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxFile struct {
+	XMLName xml.Name   `xml:"gpx"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Version string     `xml:"version,attr"`
+	Creator string     `xml:"creator,attr"`
+	Tracks  []gpxTrack `xml:"trk"`
+}
+
+func trackName(track Track) string {
+	return fmt.Sprintf("%s %s vehicle %s", track.RouteID, track.TripHeadsign, track.VehicleID)
+}
+
+func WriteGPX(w io.Writer, tracks []Track) error {
+	gpx := gpxFile{
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		Version: "1.1",
+		Creator: "bus_data_archive",
+	}
+	for _, track := range tracks {
+		gt := gpxTrack{Name: trackName(track), Desc: "trip " + track.TripID}
+		for _, p := range track.Points {
+			gt.Segment = append(gt.Segment, gpxPoint{p.Lat, p.Lon, p.Time.UTC().Format(time.RFC3339)})
+		}
+		gpx.Tracks = append(gpx.Tracks, gt)
+	}
+	return writeXML(w, gpx)
+}
+
+type kmlTimeStamp struct {
+	When string `xml:"when"`
+}
+
+type kmlPlacemark struct {
+	Name        string        `xml:"name"`
+	Description string        `xml:"description,omitempty"`
+	TimeStamp   *kmlTimeStamp `xml:"TimeStamp,omitempty"`
+	LineString  *string       `xml:"LineString>coordinates,omitempty"`
+	Point       *string       `xml:"Point>coordinates,omitempty"`
+}
+
+type kmlFolder struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlFile struct {
+	XMLName xml.Name    `xml:"kml"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Folders []kmlFolder `xml:"Document>Folder"`
+}
+
+func kmlCoordinates(p TrackPoint) string {
+	return fmt.Sprintf("%f,%f,0", p.Lon, p.Lat)
+}
+
+// WriteKML writes a folder per track, with the route as a LineString and each
+// position as a Point with a TimeStamp so Google Earth's time slider works.
+func WriteKML(w io.Writer, tracks []Track) error {
+	kml := kmlFile{Xmlns: "http://www.opengis.net/kml/2.2"}
+	for _, track := range tracks {
+		folder := kmlFolder{Name: trackName(track)}
+		line := ""
+		for i, p := range track.Points {
+			if i > 0 {
+				line += " "
+			}
+			line += kmlCoordinates(p)
+		}
+		folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+			Name:        "trip " + track.TripID,
+			Description: trackName(track),
+			LineString:  &line,
+		})
+		for _, p := range track.Points {
+			coordinates := kmlCoordinates(p)
+			folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+				Name:        p.Time.Format("15:04:05"),
+				Description: fmt.Sprintf("deviation %.1f", p.Deviation),
+				TimeStamp:   &kmlTimeStamp{p.Time.UTC().Format(time.RFC3339)},
+				Point:       &coordinates,
+			})
+		}
+		kml.Folders = append(kml.Folders, folder)
+	}
+	return writeXML(w, kml)
+}
+
+func writeXML(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,93 @@
+package track_export
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/markongithub/bus_data_archive/pkg/bus_positions"
+	"github.com/markongithub/bus_data_archive/pkg/test_util"
+	"gotest.tools/v3/assert"
+)
+
+func samplePoints(location *time.Location) []TrackPoint {
+	at := func(minute int) time.Time { return time.Date(2019, 4, 26, 23, minute, 0, 0, location) }
+	return []TrackPoint{
+		{VehicleID: "3171", TripID: "914402060", RouteID: "10A", Time: at(52), Lat: 38.80, Lon: -77.07},
+		{VehicleID: "2673", TripID: "921172060", RouteID: "28A", Time: at(50), Lat: 38.82, Lon: -77.08, Deviation: 1},
+		{VehicleID: "3171", TripID: "914402060", RouteID: "10A", Time: at(50), Lat: 38.79, Lon: -77.07},
+		// the same report again from the next snapshot
+		{VehicleID: "3171", TripID: "914402060", RouteID: "10A", Time: at(52), Lat: 38.80, Lon: -77.07},
+	}
+}
+
+func TestFromReport(t *testing.T) {
+	location := test_util.Eastern()
+	m := bus_positions.ParseFile("../bus_positions/test_data/buses2019-04-27T03:55:01.json")
+	p, err := FromReport(m.BusPositions[0], location)
+	assert.NilError(t, err)
+	assert.Equal(t, p.VehicleID, "3171")
+	assert.Equal(t, p.TripHeadsign, "HUNTINGTON STATION N")
+	assert.Equal(t, p.Time, time.Date(2019, 4, 26, 23, 54, 46, 0, location))
+	assert.Equal(t, p.Deviation, -1.0)
+}
+
+func TestFilter(t *testing.T) {
+	location := test_util.Eastern()
+	points := samplePoints(location)
+	assert.Assert(t, Filter{}.Matches(points[0]))
+	assert.Assert(t, Filter{RouteID: "10A"}.Matches(points[0]))
+	assert.Assert(t, !Filter{RouteID: "10A"}.Matches(points[1]))
+	assert.Assert(t, !Filter{VehicleID: "3171", TripID: "nope"}.Matches(points[0]))
+	window := Filter{Start: points[2].Time, End: points[0].Time}
+	assert.Assert(t, window.Matches(points[2]))
+	assert.Assert(t, !window.Matches(points[0]))
+}
+
+func TestGroupTracks(t *testing.T) {
+	tracks := GroupTracks(samplePoints(test_util.Eastern()))
+	assert.Equal(t, len(tracks), 2)
+	assert.Equal(t, tracks[0].VehicleID, "3171")
+	assert.Equal(t, len(tracks[0].Points), 2)
+	assert.Assert(t, tracks[0].Points[0].Time.Before(tracks[0].Points[1].Time))
+	assert.Equal(t, len(tracks[1].Points), 1)
+}
+
+func TestWriteGeoJSON(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NilError(t, WriteGeoJSON(&buf, GroupTracks(samplePoints(test_util.Eastern()))))
+	var collection geoJSONFeatureCollection
+	assert.NilError(t, json.Unmarshal(buf.Bytes(), &collection))
+	// two LineStrings and three Points
+	assert.Equal(t, len(collection.Features), 5)
+	assert.Equal(t, collection.Features[0].Geometry.Type, "LineString")
+	assert.Equal(t, collection.Features[0].Properties["route_id"], "10A")
+	assert.Equal(t, collection.Features[2].Geometry.Type, "Point")
+	assert.Equal(t, collection.Features[2].Properties["time"], "2019-04-26T23:50:00-04:00")
+	assert.DeepEqual(t, collection.Features[2].Geometry.Coordinates, []interface{}{-77.07, 38.79})
+}
+
+func TestWriteGPX(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NilError(t, WriteGPX(&buf, GroupTracks(samplePoints(test_util.Eastern()))))
+	var gpx gpxFile
+	assert.NilError(t, xml.Unmarshal(buf.Bytes(), &gpx))
+	assert.Equal(t, len(gpx.Tracks), 2)
+	assert.Equal(t, len(gpx.Tracks[0].Segment), 2)
+	assert.Equal(t, gpx.Tracks[0].Segment[0].Time, "2019-04-27T03:50:00Z")
+}
+
+func TestWriteKML(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NilError(t, WriteKML(&buf, GroupTracks(samplePoints(test_util.Eastern()))))
+	var kml kmlFile
+	assert.NilError(t, xml.Unmarshal(buf.Bytes(), &kml))
+	assert.Equal(t, len(kml.Folders), 2)
+	// the LineString and then one Point per position
+	assert.Equal(t, len(kml.Folders[0].Placemarks), 3)
+	assert.Assert(t, strings.HasPrefix(*kml.Folders[0].Placemarks[0].LineString, "-77.070000,38.790000,0 "))
+	assert.Equal(t, kml.Folders[0].Placemarks[1].TimeStamp.When, "2019-04-27T03:50:00Z")
+}
@@ -0,0 +1,201 @@
+package trip_delivery
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+)
+
+const (
+	StatusOperated = "operated"
+	// we saw it, but not for long enough to say it ran the whole way
+	StatusPartial = "partial"
+	// we never saw it, so it probably didn't run
+	StatusMissing = "missing"
+)
+
+// A trip we saw for less than this fraction of its scheduled running time is
+// only partially observed.
+const DefaultOperatedCoverage = 0.5
+
+// An ObservedTrip is everything we saw of one GTFS trip on a service date,
+// which can be more than one trip instance if WMATA gave it a different start
+// time partway through.
+type ObservedTrip struct {
+	TripID    string
+	VehicleID string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Positions int
+}
+
+// Merge adds another trip instance's worth of observations.
+func (o ObservedTrip) Merge(other ObservedTrip) ObservedTrip {
+	if o.Positions == 0 {
+		return other
+	}
+	if other.FirstSeen.Before(o.FirstSeen) {
+		o.FirstSeen = other.FirstSeen
+	}
+	if other.LastSeen.After(o.LastSeen) {
+		o.LastSeen = other.LastSeen
+	}
+	o.Positions += other.Positions
+	return o
+}
+
+// A TripDelivery is one scheduled trip and whether it ran.
+type TripDelivery struct {
+	gorm.Model
+	ServiceDate    string `gorm:"index"`
+	TripID         string
+	RouteID        string `gorm:"index"`
+	DirectionID    int
+	BlockID        string
+	ScheduledStart time.Time
+	ScheduledEnd   time.Time
+	Status         string
+	// the rest are empty for missing trips
+	VehicleID string
+	FirstSeen *time.Time
+	LastSeen  *time.Time
+	Positions int
+	// how much of the scheduled running time we saw it for, up to 1
+	Coverage float64
+}
+
+// A RouteDelivery is how many of a route's scheduled trips ran on a service
+// date.
+type RouteDelivery struct {
+	gorm.Model
+	ServiceDate string `gorm:"index"`
+	RouteID     string
+	Scheduled   int
+	Operated    int
+	Partial     int
+	Missing     int
+	// operated and partial trips over scheduled ones
+	DeliveredFraction float64
+}
+
+// ScheduledTrips lists every trip scheduled on a service date, with no status
+// yet, in order of route and then start time.
+func ScheduledTrips(feed gtfs_schedule.Feed, dateYYYYMMDD string, location *time.Location) []TripDelivery {
+	dayStart := gtfs_schedule.ServiceDayStart(dateYYYYMMDD, location)
+	serviceDate := dateYYYYMMDD[0:4] + "-" + dateYYYYMMDD[4:6] + "-" + dateYYYYMMDD[6:8]
+	var output []TripDelivery
+	for _, tripID := range feed.TripsByDate(dateYYYYMMDD) {
+		trip := feed.Trips[tripID]
+		stopTimes := feed.StopTimesByTripID[tripID]
+		if len(stopTimes) == 0 {
+			continue
+		}
+		output = append(output, TripDelivery{
+			ServiceDate:    serviceDate,
+			TripID:         tripID,
+			RouteID:        trip.RouteID,
+			DirectionID:    trip.DirectionID,
+			BlockID:        trip.BlockID,
+			ScheduledStart: dayStart.Add(time.Duration(stopTimes[0].Departure) * time.Second),
+			ScheduledEnd:   dayStart.Add(time.Duration(stopTimes[len(stopTimes)-1].Arrival) * time.Second),
+		})
+	}
+	sort.SliceStable(output, func(i, j int) bool {
+		if output[i].RouteID != output[j].RouteID {
+			return output[i].RouteID < output[j].RouteID
+		}
+		return output[i].ScheduledStart.Before(output[j].ScheduledStart)
+	})
+	return output
+}
+
+// Classify matches the schedule against what we saw, by GTFS trip ID. A trip
+// is operated if we saw it for at least operatedCoverage of its scheduled
+// running time.
+func Classify(scheduled []TripDelivery, observed map[string]ObservedTrip, operatedCoverage float64) []TripDelivery {
+	output := make([]TripDelivery, 0, len(scheduled))
+	for _, td := range scheduled {
+		o, present := observed[td.TripID]
+		if !present || o.Positions == 0 {
+			td.Status = StatusMissing
+			output = append(output, td)
+			continue
+		}
+		firstSeen, lastSeen := o.FirstSeen, o.LastSeen
+		td.VehicleID = o.VehicleID
+		td.FirstSeen = &firstSeen
+		td.LastSeen = &lastSeen
+		td.Positions = o.Positions
+		td.Coverage = 1
+		if running := td.ScheduledEnd.Sub(td.ScheduledStart); running > 0 {
+			td.Coverage = lastSeen.Sub(firstSeen).Seconds() / running.Seconds()
+			if td.Coverage > 1 {
+				td.Coverage = 1
+			}
+		}
+		if td.Coverage >= operatedCoverage {
+			td.Status = StatusOperated
+		} else {
+			td.Status = StatusPartial
+		}
+		output = append(output, td)
+	}
+	return output
+}
+
+// Summarize counts trips by route, in order of route.
+func Summarize(trips []TripDelivery) []RouteDelivery {
+	byRoute := make(map[string]*RouteDelivery)
+	var routeIDs []string
+	for _, td := range trips {
+		rd, present := byRoute[td.RouteID]
+		if !present {
+			rd = &RouteDelivery{ServiceDate: td.ServiceDate, RouteID: td.RouteID}
+			byRoute[td.RouteID] = rd
+			routeIDs = append(routeIDs, td.RouteID)
+		}
+		rd.Scheduled++
+		switch td.Status {
+		case StatusOperated:
+			rd.Operated++
+		case StatusPartial:
+			rd.Partial++
+		case StatusMissing:
+			rd.Missing++
+		}
+	}
+	sort.Strings(routeIDs)
+	output := make([]RouteDelivery, 0, len(routeIDs))
+	for _, routeID := range routeIDs {
+		rd := byRoute[routeID]
+		rd.DeliveredFraction = float64(rd.Operated+rd.Partial) / float64(rd.Scheduled)
+		output = append(output, *rd)
+	}
+	return output
+}
+
+// SaveDelivery replaces whatever we worked out for this service date last
+// time.
+func SaveDelivery(db *gorm.DB, serviceDate string, trips []TripDelivery, routes []RouteDelivery) error {
+	err := db.Unscoped().Where("service_date = ?", serviceDate).Delete(TripDelivery{}).Error
+	if err != nil {
+		return err
+	}
+	err = db.Unscoped().Where("service_date = ?", serviceDate).Delete(RouteDelivery{}).Error
+	if err != nil {
+		return err
+	}
+	for _, td := range trips {
+		if err = db.Create(&td).Error; err != nil {
+			return err
+		}
+	}
+	for _, rd := range routes {
+		if err = db.Create(&rd).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
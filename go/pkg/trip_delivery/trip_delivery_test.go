@@ -0,0 +1,101 @@
+package trip_delivery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/markongithub/bus_data_archive/pkg/gtfs_schedule"
+	"github.com/markongithub/bus_data_archive/pkg/test_util"
+	"gotest.tools/v3/assert"
+)
+
+func at(location *time.Location, hour, minute int) time.Time {
+	return time.Date(2019, 9, 19, hour, minute, 0, 0, location)
+}
+
+func classified(location *time.Location) []TripDelivery {
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	scheduled := ScheduledTrips(feed, "20190919", location)
+	observed := map[string]ObservedTrip{
+		"T1": {TripID: "T1", VehicleID: "3171", FirstSeen: at(location, 7, 58), LastSeen: at(location, 8, 9), Positions: 12},
+		// we lost track of this one a few minutes in
+		"T2": {TripID: "T2", VehicleID: "3171", FirstSeen: at(location, 8, 20), LastSeen: at(location, 8, 22), Positions: 3},
+		"T9": {TripID: "T9", VehicleID: "8001", FirstSeen: at(location, 9, 0), LastSeen: at(location, 9, 30), Positions: 30},
+	}
+	return Classify(scheduled, observed, DefaultOperatedCoverage)
+}
+
+func TestScheduledTrips(t *testing.T) {
+	location := test_util.Eastern()
+	feed := gtfs_schedule.Load("../gtfs_schedule/test_data/tiny")
+	scheduled := ScheduledTrips(feed, "20190919", location)
+	assert.Equal(t, len(scheduled), 3)
+	assert.Equal(t, scheduled[0].ServiceDate, "2019-09-19")
+	assert.Equal(t, scheduled[0].TripID, "T1")
+	assert.Equal(t, scheduled[0].BlockID, "B1")
+	assert.Equal(t, scheduled[0].ScheduledStart, at(location, 8, 0))
+	assert.Equal(t, scheduled[0].ScheduledEnd, at(location, 8, 10))
+
+	// T4 only runs on weekends, after midnight
+	scheduled = ScheduledTrips(feed, "20190921", location)
+	assert.Equal(t, len(scheduled), 1)
+	assert.Equal(t, scheduled[0].ScheduledStart, time.Date(2019, 9, 22, 0, 10, 0, 0, location))
+}
+
+func TestClassify(t *testing.T) {
+	location := test_util.Eastern()
+	trips := classified(location)
+	assert.Equal(t, len(trips), 3)
+	assert.Equal(t, trips[0].Status, StatusOperated)
+	assert.Equal(t, trips[0].Coverage, 1.0)
+	assert.Equal(t, trips[0].VehicleID, "3171")
+	assert.Equal(t, *trips[0].FirstSeen, at(location, 7, 58))
+	assert.Equal(t, trips[1].Status, StatusPartial)
+	assert.Equal(t, trips[1].Coverage, 0.2)
+	assert.Equal(t, trips[2].Status, StatusMissing)
+	assert.Assert(t, trips[2].FirstSeen == nil)
+
+	routes := Summarize(trips)
+	assert.DeepEqual(t, routes, []RouteDelivery{{
+		ServiceDate:       "2019-09-19",
+		RouteID:           "10A",
+		Scheduled:         3,
+		Operated:          1,
+		Partial:           1,
+		Missing:           1,
+		DeliveredFraction: 2.0 / 3,
+	}})
+}
+
+func TestMerge(t *testing.T) {
+	location := test_util.Eastern()
+	var o ObservedTrip
+	o = o.Merge(ObservedTrip{TripID: "T1", VehicleID: "3171", FirstSeen: at(location, 8, 5), LastSeen: at(location, 8, 9), Positions: 4})
+	o = o.Merge(ObservedTrip{TripID: "T1", VehicleID: "3171", FirstSeen: at(location, 8, 0), LastSeen: at(location, 8, 4), Positions: 5})
+	assert.Equal(t, o.VehicleID, "3171")
+	assert.Equal(t, o.FirstSeen, at(location, 8, 0))
+	assert.Equal(t, o.LastSeen, at(location, 8, 9))
+	assert.Equal(t, o.Positions, 9)
+}
+
+func TestSaveDelivery(t *testing.T) {
+	location := test_util.Eastern()
+	db, err := gorm.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	defer db.Close()
+	db.AutoMigrate(&TripDelivery{}, &RouteDelivery{})
+
+	trips := classified(location)
+	assert.NilError(t, SaveDelivery(db, "2019-09-19", trips, Summarize(trips)))
+	assert.NilError(t, SaveDelivery(db, "2019-09-19", trips, Summarize(trips)))
+
+	var missing []TripDelivery
+	assert.NilError(t, db.Where("service_date = ? AND status = ?", "2019-09-19", StatusMissing).Find(&missing).Error)
+	assert.Equal(t, len(missing), 1)
+	assert.Equal(t, missing[0].TripID, "T3")
+	var count int
+	db.Model(&RouteDelivery{}).Count(&count)
+	assert.Equal(t, count, 1)
+}
@@ -172,3 +172,27 @@ resource "aws_dynamodb_table" "wmata_bus" {
     enabled        = false
   }
 }
+
+# The same reports as wmata_bus, but keyed by service date and
+# VehicleID#DateTime so each report is only stored once.
+resource "aws_dynamodb_table" "wmata_bus_by_service_date" {
+  name         = "wmata_bus_by_service_date"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "PartitionKey"
+  range_key    = "RangeKey"
+
+  attribute {
+    name = "PartitionKey"
+    type = "S"
+  }
+
+  attribute {
+    name = "RangeKey"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = ""
+    enabled        = false
+  }
+}